@@ -23,4 +23,7 @@ const (
 // WorkspaceReadyMessage describes the content of a workspace-ready file in a workspace
 type WorkspaceReadyMessage struct {
 	Source WorkspaceInitSource `json:"source"`
+
+	// Signature is an optional hex-encoded HMAC-SHA256 of Source, which lets consumers verify the message
+	Signature string `json:"signature,omitempty"`
 }
@@ -45,6 +45,12 @@ func Prepare(req *csapi.WorkspaceInitializer, urls map[string]string) ([]byte, e
 // Execute runs an initializer to place content in destination based on the configuration read
 // from the cfgin stream.
 func Execute(ctx context.Context, destination string, cfgin io.Reader, opts ...initializer.InitializeOpt) (src csapi.WorkspaceInitSource, err error) {
+	return ExecuteWithProgress(ctx, destination, cfgin, nil, opts...)
+}
+
+// ExecuteWithProgress is like Execute, but reports the initialization progress to progress.
+// The download of a backup reports a percentage if the size of the backup is known.
+func ExecuteWithProgress(ctx context.Context, destination string, cfgin io.Reader, progress initializer.ProgressFunc, opts ...initializer.InitializeOpt) (src csapi.WorkspaceInitSource, err error) {
 	var cfg config
 	err = json.NewDecoder(cfgin).Decode(&cfg)
 	if err != nil {
@@ -54,7 +60,21 @@ func Execute(ctx context.Context, destination string, cfgin io.Reader, opts ...i
 	var (
 		rs  storage.DirectDownloader
 		ilr initializer.Initializer
+
+		onDownloadProgress func(read, total int64)
 	)
+	if progress != nil {
+		last := -1
+		onDownloadProgress = func(read, total int64) {
+			// we're called for every read - only report actual changes
+			percent := downloadPercent(read, total)
+			if percent == last {
+				return
+			}
+			last = percent
+			progress(initializer.InitializePhaseDownloading, percent)
+		}
+	}
 	if cfg.FromBackup == "" {
 		var req csapi.WorkspaceInitializer
 		err = protojson.Unmarshal(cfg.Req, &req)
@@ -62,7 +82,7 @@ func Execute(ctx context.Context, destination string, cfgin io.Reader, opts ...i
 			return "", err
 		}
 
-		rs = &storage.NamedURLDownloader{URLs: cfg.URLs}
+		rs = &storage.NamedURLDownloader{URLs: cfg.URLs, OnProgress: onDownloadProgress}
 		ilr, err = initializer.NewFromRequest(ctx, destination, rs, &req)
 		if err != nil {
 			return "", err
@@ -72,10 +92,15 @@ func Execute(ctx context.Context, destination string, cfgin io.Reader, opts ...i
 			URLs: map[string]string{
 				storage.DefaultBackup: cfg.FromBackup,
 			},
+			OnProgress: onDownloadProgress,
 		}
 		ilr = &initializer.EmptyInitializer{}
 	}
 
+	if progress != nil {
+		opts = append(opts, initializer.WithProgress(progress))
+	}
+
 	src, err = initializer.InitializeWorkspace(ctx, destination, rs, append(opts, initializer.WithInitializer(ilr))...)
 	if err != nil {
 		return "", err
@@ -88,3 +113,12 @@ func Execute(ctx context.Context, destination string, cfgin io.Reader, opts ...i
 
 	return src, nil
 }
+
+// downloadPercent returns the share of total which was read, or -1 if that's unknown. Servers can send more
+// than the content length they announced, in which case we cannot tell the progress either.
+func downloadPercent(read, total int64) int {
+	if total <= 0 || read > total {
+		return -1
+	}
+	return int(read * 100 / total)
+}
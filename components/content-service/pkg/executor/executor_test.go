@@ -0,0 +1,30 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package executor
+
+import "testing"
+
+func TestDownloadPercent(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Read        int64
+		Total       int64
+		Expectation int
+	}{
+		{Desc: "started", Read: 0, Total: 200, Expectation: 0},
+		{Desc: "half-way", Read: 100, Total: 200, Expectation: 50},
+		{Desc: "done", Read: 200, Total: 200, Expectation: 100},
+		{Desc: "unknown size", Read: 100, Total: -1, Expectation: -1},
+		{Desc: "size exceeded", Read: 300, Total: 200, Expectation: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := downloadPercent(test.Read, test.Total)
+			if act != test.Expectation {
+				t.Errorf("unexpected percentage: expected %d, got %d", test.Expectation, act)
+			}
+		})
+	}
+}
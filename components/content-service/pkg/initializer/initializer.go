@@ -243,9 +243,35 @@ type initializeOpts struct {
 	InWorkspace bool
 	UID         int
 	GID         int
+	Progress    ProgressFunc
 	mappings    []archive.IDMapping
 }
 
+// InitializePhase is a step of the content initialization
+type InitializePhase string
+
+const (
+	// InitializePhaseCleaning means we're removing prior content from the workspace location
+	InitializePhaseCleaning InitializePhase = "cleaning"
+
+	// InitializePhaseDownloading means we're downloading and extracting a backup
+	InitializePhaseDownloading InitializePhase = "downloading"
+
+	// InitializePhaseInitializing means we're running the initializer, e.g. cloning a Git repository
+	InitializePhaseInitializing InitializePhase = "initializing"
+)
+
+// ProgressFunc receives progress updates during content initialization.
+// percent is in the range of 0-100, or -1 if the progress of the phase is unknown.
+type ProgressFunc func(phase InitializePhase, percent int)
+
+// WithProgress configures a function which receives progress updates during content initialization
+func WithProgress(f ProgressFunc) InitializeOpt {
+	return func(o *initializeOpts) {
+		o.Progress = f
+	}
+}
+
 // WithMappings configures the UID mappings that're used during content initialization
 func WithMappings(mappings []archive.IDMapping) InitializeOpt {
 	return func(o *initializeOpts) {
@@ -295,10 +321,16 @@ func InitializeWorkspace(ctx context.Context, location string, remoteStorage sto
 	for _, o := range opts {
 		o(&cfg)
 	}
+	progress := cfg.Progress
+	if progress == nil {
+		progress = func(InitializePhase, int) {}
+	}
 
 	src = csapi.WorkspaceInitFromOther
 
 	if cfg.CleanSlate {
+		progress(InitializePhaseCleaning, -1)
+
 		// 1. Clean out the workspace directory
 		if _, err := os.Stat(location); os.IsNotExist(err) {
 			// in the very unlikely event that the workspace Pod did not mount (and thus create) the workspace directory, create it
@@ -330,6 +362,7 @@ func InitializeWorkspace(ctx context.Context, location string, remoteStorage sto
 	}
 
 	// Run the initializer
+	progress(InitializePhaseDownloading, -1)
 	hasBackup, err := remoteStorage.Download(ctx, location, storage.DefaultBackup, cfg.mappings)
 	if err != nil {
 		return src, xerrors.Errorf("cannot restore backup: %w", err)
@@ -339,6 +372,7 @@ func InitializeWorkspace(ctx context.Context, location string, remoteStorage sto
 	if hasBackup {
 		src = csapi.WorkspaceInitFromBackup
 	} else {
+		progress(InitializePhaseInitializing, -1)
 		src, err = cfg.Initializer.Run(ctx, cfg.mappings)
 		if err != nil {
 			return src, xerrors.Errorf("cannot initialize workspace: %w", err)
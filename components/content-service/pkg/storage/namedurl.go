@@ -6,6 +6,7 @@ package storage
 
 import (
 	"context"
+	"io"
 	"net/http"
 
 	"golang.org/x/xerrors"
@@ -16,6 +17,10 @@ import (
 // NamedURLDownloader offers downloads from fixed URLs
 type NamedURLDownloader struct {
 	URLs map[string]string
+
+	// OnProgress, if set, is called while downloading with the number of bytes read so far.
+	// total is -1 if the size of the download is unknown.
+	OnProgress func(read, total int64)
 }
 
 // Download takes the latest state from the remote storage and downloads it to a local path
@@ -42,7 +47,12 @@ func (d *NamedURLDownloader) Download(ctx context.Context, destination string, n
 	}
 	defer resp.Body.Close()
 
-	err = extractTarbal(ctx, destination, resp.Body, mappings)
+	var body io.Reader = resp.Body
+	if d.OnProgress != nil {
+		body = &progressReader{R: resp.Body, Total: resp.ContentLength, OnProgress: d.OnProgress}
+	}
+
+	err = extractTarbal(ctx, destination, body, mappings)
 	if err != nil {
 		return true, err
 	}
@@ -54,3 +64,20 @@ func (d *NamedURLDownloader) Download(ctx context.Context, destination string, n
 func (d *NamedURLDownloader) DownloadSnapshot(ctx context.Context, destination string, name string, mappings []archive.IDMapping) (found bool, err error) {
 	return d.Download(ctx, destination, name, mappings)
 }
+
+type progressReader struct {
+	R          io.Reader
+	Total      int64
+	OnProgress func(read, total int64)
+
+	read int64
+}
+
+func (r *progressReader) Read(p []byte) (n int, err error) {
+	n, err = r.R.Read(p)
+	if n > 0 {
+		r.read += int64(n)
+		r.OnProgress(r.read, r.Total)
+	}
+	return
+}
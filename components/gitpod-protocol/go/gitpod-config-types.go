@@ -39,6 +39,9 @@ type GitpodConfig struct {
 	// Controls what ide should be used for a workspace.
 	Ide interface{} `yaml:"ide,omitempty"`
 
+	// List of ports which should not be exposed automatically, e.g. ports of debuggers or sidecars. They can still be exposed manually.
+	IgnorePorts []interface{} `yaml:"ignorePorts,omitempty"`
+
 	// The Docker image to run your workspace in.
 	Image interface{} `yaml:"image,omitempty"`
 
@@ -68,7 +71,10 @@ type Image_object struct {
 // PortsItems
 type PortsItems struct {
 
-	// Port name (deprecated).
+	// A description of what is running on the port.
+	Description string `yaml:"description,omitempty"`
+
+	// Port name, e.g. the name of the service running on the port.
 	Name string `yaml:"name,omitempty"`
 
 	// What to do when a service on this port was detected. 'notify' (default) will show a notification asking the user what to do. 'open-browser' will open a new browser tab. 'open-preview' will open in the preview on the right of the IDE. 'ignore' will do nothing.
@@ -106,6 +112,19 @@ type Prebuilds_object struct {
 	PullRequestsFromForks bool `yaml:"pullRequestsFromForks,omitempty"`
 }
 
+// Restart Restarts the main `command` of the task when it exits. The `before` and `init` commands are never restarted.
+type Restart struct {
+
+	// The time to wait before the first restart, e.g. '1s'. The time doubles with every consecutive restart up to 5 minutes. Default is '1s'.
+	Backoff string `yaml:"backoff,omitempty" json:"backoff,omitempty"`
+
+	// The maximum number of restarts. Default is 0, i.e. restart without limit.
+	MaxRetries int `yaml:"maxRetries,omitempty" json:"maxRetries,omitempty"`
+
+	// When to restart the `command`. Default is 'never'.
+	Policy string `yaml:"policy,omitempty" json:"policy,omitempty"`
+}
+
 // TasksItems
 type TasksItems struct {
 
@@ -115,6 +134,9 @@ type TasksItems struct {
 	// The main shell command to run after `before` and `init`. This command is executed last on every start and doesn't have to terminate.
 	Command string `yaml:"command,omitempty" json:"command,omitempty"`
 
+	// Names of tasks which must be ready before this task starts. A task is ready once its `init` command has finished, or once it has exited.
+	DependsOn []string `yaml:"dependsOn,omitempty" json:"dependsOn,omitempty"`
+
 	// Environment variables to set.
 	Env *Env `yaml:"env,omitempty" json:"env,omitempty"`
 
@@ -132,6 +154,25 @@ type TasksItems struct {
 
 	// A shell command to run after `before`. This command is executed only on during workspace prebuilds. This command is expected to terminate. If it fails, the workspace build fails.
 	Prebuild string `yaml:"prebuild,omitempty" json:"prebuild,omitempty"`
+
+	// Restarts the main `command` of the task when it exits. The `before` and `init` commands are never restarted.
+	Restart *Restart `yaml:"restart,omitempty" json:"restart,omitempty"`
+
+	// Time limits for the phases of the task, e.g. '10m' or '1h30m'. A task which exceeds a limit is terminated and marked as failed. Phases without a limit may take any time.
+	Timeout *Timeout `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// Timeout Time limits for the phases of the task, e.g. '10m' or '1h30m'. A task which exceeds a limit is terminated and marked as failed. Phases without a limit may take any time.
+type Timeout struct {
+
+	// The time the `before` command may take.
+	Before string `yaml:"before,omitempty" json:"before,omitempty"`
+
+	// The time the main `command` may take.
+	Command string `yaml:"command,omitempty" json:"command,omitempty"`
+
+	// The time the `init` command may take. During prebuilds this includes the `prebuild` command.
+	Init string `yaml:"init,omitempty" json:"init,omitempty"`
 }
 
 // Vscode Configure VS Code integration
@@ -229,6 +270,17 @@ func (strct *GitpodConfig) MarshalJSON() ([]byte, error) {
 		buf.Write(tmp)
 	}
 	comma = true
+	// Marshal the "ignorePorts" field
+	if comma {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\"ignorePorts\": ")
+	if tmp, err := json.Marshal(strct.IgnorePorts); err != nil {
+		return nil, err
+	} else {
+		buf.Write(tmp)
+	}
+	comma = true
 	// Marshal the "image" field
 	if comma {
 		buf.WriteString(",")
@@ -314,6 +366,10 @@ func (strct *GitpodConfig) UnmarshalJSON(b []byte) error {
 			if err := json.Unmarshal([]byte(v), &strct.Ide); err != nil {
 				return err
 			}
+		case "ignorePorts":
+			if err := json.Unmarshal([]byte(v), &strct.IgnorePorts); err != nil {
+				return err
+			}
 		case "image":
 			if err := json.Unmarshal([]byte(v), &strct.Image); err != nil {
 				return err
@@ -408,6 +464,17 @@ func (strct *PortsItems) MarshalJSON() ([]byte, error) {
 	buf := bytes.NewBuffer(make([]byte, 0))
 	buf.WriteString("{")
 	comma := false
+	// Marshal the "description" field
+	if comma {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\"description\": ")
+	if tmp, err := json.Marshal(strct.Description); err != nil {
+		return nil, err
+	} else {
+		buf.Write(tmp)
+	}
+	comma = true
 	// Marshal the "name" field
 	if comma {
 		buf.WriteString(",")
@@ -480,6 +547,10 @@ func (strct *PortsItems) UnmarshalJSON(b []byte) error {
 	// parse all the defined properties
 	for k, v := range jsonMap {
 		switch k {
+		case "description":
+			if err := json.Unmarshal([]byte(v), &strct.Description); err != nil {
+				return err
+			}
 		case "name":
 			if err := json.Unmarshal([]byte(v), &strct.Name); err != nil {
 				return err
@@ -512,6 +583,76 @@ func (strct *PortsItems) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+func (strct *Restart) MarshalJSON() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	buf.WriteString("{")
+	comma := false
+	// Marshal the "backoff" field
+	if comma {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\"backoff\": ")
+	if tmp, err := json.Marshal(strct.Backoff); err != nil {
+		return nil, err
+	} else {
+		buf.Write(tmp)
+	}
+	comma = true
+	// Marshal the "maxRetries" field
+	if comma {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\"maxRetries\": ")
+	if tmp, err := json.Marshal(strct.MaxRetries); err != nil {
+		return nil, err
+	} else {
+		buf.Write(tmp)
+	}
+	comma = true
+	// Marshal the "policy" field
+	if comma {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\"policy\": ")
+	if tmp, err := json.Marshal(strct.Policy); err != nil {
+		return nil, err
+	} else {
+		buf.Write(tmp)
+	}
+	comma = true
+
+	buf.WriteString("}")
+	rv := buf.Bytes()
+	return rv, nil
+}
+
+func (strct *Restart) UnmarshalJSON(b []byte) error {
+	var jsonMap map[string]json.RawMessage
+	if err := json.Unmarshal(b, &jsonMap); err != nil {
+		return err
+	}
+	// parse all the defined properties
+	for k, v := range jsonMap {
+		switch k {
+		case "backoff":
+			if err := json.Unmarshal([]byte(v), &strct.Backoff); err != nil {
+				return err
+			}
+		case "maxRetries":
+			if err := json.Unmarshal([]byte(v), &strct.MaxRetries); err != nil {
+				return err
+			}
+		case "policy":
+			if err := json.Unmarshal([]byte(v), &strct.Policy); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("additional property not allowed: \"" + k + "\"")
+		}
+	}
+	return nil
+}
+
 func (strct *TasksItems) MarshalJSON() ([]byte, error) {
 	buf := bytes.NewBuffer(make([]byte, 0))
 	buf.WriteString("{")
@@ -538,6 +679,17 @@ func (strct *TasksItems) MarshalJSON() ([]byte, error) {
 		buf.Write(tmp)
 	}
 	comma = true
+	// Marshal the "dependsOn" field
+	if comma {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\"dependsOn\": ")
+	if tmp, err := json.Marshal(strct.DependsOn); err != nil {
+		return nil, err
+	} else {
+		buf.Write(tmp)
+	}
+	comma = true
 	// Marshal the "env" field
 	if comma {
 		buf.WriteString(",")
@@ -604,6 +756,28 @@ func (strct *TasksItems) MarshalJSON() ([]byte, error) {
 		buf.Write(tmp)
 	}
 	comma = true
+	// Marshal the "restart" field
+	if comma {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\"restart\": ")
+	if tmp, err := json.Marshal(strct.Restart); err != nil {
+		return nil, err
+	} else {
+		buf.Write(tmp)
+	}
+	comma = true
+	// Marshal the "timeout" field
+	if comma {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\"timeout\": ")
+	if tmp, err := json.Marshal(strct.Timeout); err != nil {
+		return nil, err
+	} else {
+		buf.Write(tmp)
+	}
+	comma = true
 
 	buf.WriteString("}")
 	rv := buf.Bytes()
@@ -626,6 +800,10 @@ func (strct *TasksItems) UnmarshalJSON(b []byte) error {
 			if err := json.Unmarshal([]byte(v), &strct.Command); err != nil {
 				return err
 			}
+		case "dependsOn":
+			if err := json.Unmarshal([]byte(v), &strct.DependsOn); err != nil {
+				return err
+			}
 		case "env":
 			if err := json.Unmarshal([]byte(v), &strct.Env); err != nil {
 				return err
@@ -650,6 +828,84 @@ func (strct *TasksItems) UnmarshalJSON(b []byte) error {
 			if err := json.Unmarshal([]byte(v), &strct.Prebuild); err != nil {
 				return err
 			}
+		case "restart":
+			if err := json.Unmarshal([]byte(v), &strct.Restart); err != nil {
+				return err
+			}
+		case "timeout":
+			if err := json.Unmarshal([]byte(v), &strct.Timeout); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("additional property not allowed: \"" + k + "\"")
+		}
+	}
+	return nil
+}
+
+func (strct *Timeout) MarshalJSON() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	buf.WriteString("{")
+	comma := false
+	// Marshal the "before" field
+	if comma {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\"before\": ")
+	if tmp, err := json.Marshal(strct.Before); err != nil {
+		return nil, err
+	} else {
+		buf.Write(tmp)
+	}
+	comma = true
+	// Marshal the "command" field
+	if comma {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\"command\": ")
+	if tmp, err := json.Marshal(strct.Command); err != nil {
+		return nil, err
+	} else {
+		buf.Write(tmp)
+	}
+	comma = true
+	// Marshal the "init" field
+	if comma {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\"init\": ")
+	if tmp, err := json.Marshal(strct.Init); err != nil {
+		return nil, err
+	} else {
+		buf.Write(tmp)
+	}
+	comma = true
+
+	buf.WriteString("}")
+	rv := buf.Bytes()
+	return rv, nil
+}
+
+func (strct *Timeout) UnmarshalJSON(b []byte) error {
+	var jsonMap map[string]json.RawMessage
+	if err := json.Unmarshal(b, &jsonMap); err != nil {
+		return err
+	}
+	// parse all the defined properties
+	for k, v := range jsonMap {
+		switch k {
+		case "before":
+			if err := json.Unmarshal([]byte(v), &strct.Before); err != nil {
+				return err
+			}
+		case "command":
+			if err := json.Unmarshal([]byte(v), &strct.Command); err != nil {
+				return err
+			}
+		case "init":
+			if err := json.Unmarshal([]byte(v), &strct.Init); err != nil {
+				return err
+			}
 		default:
 			return fmt.Errorf("additional property not allowed: \"" + k + "\"")
 		}
@@ -1843,9 +1843,11 @@ type ImageConfigFile struct {
 
 // PortConfig is the PortConfig message type
 type PortConfig struct {
-	OnOpen     string  `json:"onOpen,omitempty"`
-	Port       float64 `json:"port,omitempty"`
-	Visibility string  `json:"visibility,omitempty"`
+	OnOpen      string  `json:"onOpen,omitempty"`
+	Port        float64 `json:"port,omitempty"`
+	Visibility  string  `json:"visibility,omitempty"`
+	Name        string  `json:"name,omitempty"`
+	Description string  `json:"description,omitempty"`
 }
 
 // ResolvedPlugins is the ResolvedPlugins message type
@@ -890,7 +890,7 @@ func (mr *MockAPIInterfaceMockRecorder) UninstallUserPlugin(ctx, params interfac
 // GuessGitTokenScopes mocks base method
 func (m *MockAPIInterface) GuessGitTokenScopes(ctx context.Context, params *GuessGitTokenScopesParams) (*GuessedGitTokenScopes, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetGitTokenScopes", ctx, params)
+	ret := m.ctrl.Call(m, "GuessGitTokenScopes", ctx, params)
 	ret0, _ := ret[0].(*GuessedGitTokenScopes)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
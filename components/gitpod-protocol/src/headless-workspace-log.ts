@@ -29,7 +29,9 @@ export interface HeadlessLogEvent {
 }
 
 export enum TheiaHeadlessLogType {
+    TaskStartedLabel = "workspaceTaskStarted",
     TaskLogLabel = "workspaceTaskOutput",
+    TaskExitedLabel = "workspaceTaskExited",
     TaskFailedLabel = "workspaceTaskFailed",
     TaskSuccessfulLabel = "workspaceTaskDone"
 }
@@ -37,6 +39,8 @@ export enum TheiaHeadlessLogType {
 export interface TheiaHeadlessLogMessage {
     type: TheiaHeadlessLogType;
     data?: string;
+    taskId?: string;
+    exitCode?: number;
     error?: string;
     snapshotURL?: string;
 }
@@ -545,6 +545,7 @@ export interface VSCodeConfig {
 export interface WorkspaceConfig {
     image?: ImageConfig;
     ports?: PortConfig[];
+    ignorePorts?: (number | string)[];
     tasks?: TaskConfig[];
     checkoutLocation?: string;
     workspaceLocation?: string;
@@ -674,6 +675,8 @@ export interface PortConfig {
     port: number;
     onOpen?: PortOnOpen;
     visibility?: PortVisibility;
+    name?: string;
+    description?: string;
 }
 export namespace PortConfig {
     export function is(config: any): config is PortConfig {
@@ -700,6 +703,17 @@ export interface TaskConfig {
     env?: { [env: string]: string };
     openIn?: 'bottom' | 'main' | 'left' | 'right';
     openMode?: 'split-top' | 'split-left' | 'split-right' | 'split-bottom' | 'tab-before' | 'tab-after';
+    dependsOn?: string[];
+    timeout?: {
+        before?: string;
+        init?: string;
+        command?: string;
+    };
+    restart?: {
+        policy?: 'never' | 'on-failure' | 'always';
+        maxRetries?: number;
+        backoff?: string;
+    };
 }
 
 export namespace TaskConfig {
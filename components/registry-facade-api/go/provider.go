@@ -12,4 +12,7 @@ const (
 
 	// ProviderPrefixRemote is the image repository prefix for remotely fetched image specs
 	ProviderPrefixRemote = "remote"
+
+	// ProviderPrefixLocal is the image repository prefix for image specs read from local files
+	ProviderPrefixLocal = "local"
 )
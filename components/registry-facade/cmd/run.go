@@ -5,15 +5,18 @@
 package cmd
 
 import (
+	"context"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/docker/cli/cli/config/configfile"
+	"github.com/fsnotify/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
@@ -25,6 +28,9 @@ import (
 
 var jsonLog bool
 
+// shutdownTimeout is the time in-flight requests have to complete when the registry facade is stopped
+const shutdownTimeout = 10 * time.Second
+
 // runCmd represents the run command
 var runCmd = &cobra.Command{
 	Use:   "run <config.json>",
@@ -108,11 +114,23 @@ var runCmd = &cobra.Command{
 			log.WithField("addr", cfg.PrometheusAddr).Info("started Prometheus metrics server")
 		}
 
+		reloadCtx, cancelReload := context.WithCancel(context.Background())
+		defer cancelReload()
+		go reloadStaticLayers(reloadCtx, reg, args[0])
+
 		log.Info("🏪 registry facade is up and running")
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		select {
 		case <-sigChan:
+			log.Info("received signal - draining in-flight requests")
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			err := reg.Close(ctx)
+			cancel()
+			if err != nil {
+				log.WithError(err).Warn("cannot drain in-flight requests")
+			}
+			<-registryDoneChan
 		case <-registryDoneChan:
 		}
 	},
@@ -122,6 +140,87 @@ func init() {
 	rootCmd.AddCommand(runCmd)
 }
 
+// configReloadDebounce is the time we wait for further changes to the config file before reloading it
+const configReloadDebounce = 1 * time.Second
+
+// reloadStaticLayers reloads the static layers whenever we receive SIGHUP or the config file changes
+func reloadStaticLayers(ctx context.Context, reg *registry.Registry, fn string) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		// We watch the directory rather than the file because Kubernetes updates mounted config maps
+		// by swapping the symlink of the directory.
+		err = watcher.Add(filepath.Dir(fn))
+	}
+	if err != nil {
+		log.WithError(err).Warn("cannot watch config file - send SIGHUP to reload the static layers")
+	} else {
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	// Updating a file or config map produces a burst of events. We reload once the events have settled
+	// rather than reading a config which is only half-way written.
+	debounce := time.NewTimer(configReloadDebounce)
+	stopDebounce := func() {
+		if !debounce.Stop() {
+			select {
+			case <-debounce.C:
+			default:
+			}
+		}
+	}
+	stopDebounce()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hupChan:
+			stopDebounce()
+			log.Info("received SIGHUP - reloading static layers")
+		case <-debounce.C:
+			log.WithField("filename", fn).Info("config file changed - reloading static layers")
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if name := filepath.Base(ev.Name); name != filepath.Base(fn) && name != "..data" {
+				continue
+			}
+			stopDebounce()
+			debounce.Reset(configReloadDebounce)
+			continue
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.WithError(err).Warn("error while watching config file")
+			continue
+		}
+
+		cfg, err := getConfig(fn)
+		if err != nil {
+			log.WithError(err).WithField("filename", fn).Warn("cannot load config - keeping the current static layers")
+			continue
+		}
+		err = reg.ReloadStaticLayers(ctx, cfg.Registry.StaticLayer)
+		if err != nil {
+			log.WithError(err).Warn("cannot reload static layers - keeping the current ones")
+		}
+	}
+}
+
 // FromDockerConfig turns docker client config into docker registry hosts
 func authorizerFromDockerConfig(cfg *configfile.ConfigFile) docker.Authorizer {
 	return docker.NewDockerAuthorizer(docker.WithAuthCreds(func(host string) (user, pass string, err error) {
@@ -5,18 +5,37 @@
 package handover
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
 )
 
+// ProtocolVersion is the version of the handover protocol. Processes only hand over listeners
+// to peers which speak the same version.
+const ProtocolVersion uint16 = 1
+
+// handshakeMagic starts every handshake message and identifies a registry-facade handover peer
+var handshakeMagic = []byte("rfho")
+
+// handshakeTimeout is the time a peer has to complete the handshake
+const handshakeTimeout = 2 * time.Second
+
+// ErrIncompatiblePeer is returned if the handover peer is not a registry-facade speaking
+// the same protocol version
+var ErrIncompatiblePeer = xerrors.Errorf("incompatible handover peer")
+
 // OfferHandover opens a Unix socket on socketFN and waits for another process to ask
 // for the listeners socket file descriptor. Once that happens, it closes the Unix socket and returns.
+// Peers which fail the version handshake are turned away and we keep waiting for a compatible one.
 // If the context is canceled before someone asks for the listener's socket,
 // this function returns context.Canceled.
 func OfferHandover(ctx context.Context, socketFN string, l *net.TCPListener) error {
@@ -24,33 +43,53 @@ func OfferHandover(ctx context.Context, socketFN string, l *net.TCPListener) err
 	if err != nil {
 		return xerrors.Errorf("cannot create handover socket: %w", err)
 	}
-	defer skt.Close()
+	defer func() {
+		skt.Close()
+		// the socket is only useful while we're offering, hence we make sure it's gone
+		// even if the listener did not remove it on close
+		_ = os.Remove(socketFN)
+	}()
 
 	done := make(chan struct{})
 	eg, ctx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
-		recv, err := skt.Accept()
-		if err != nil {
-			return xerrors.Errorf("cannot accept incoming handover connection: %w", err)
-		}
-		defer recv.Close()
-
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
-
-		listenConn := recv.(*net.UnixConn)
-		err = sendListener(listenConn, l)
-		if err != nil {
-			return xerrors.Errorf("cannot send listener: %w", err)
+		for {
+			recv, err := skt.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return xerrors.Errorf("cannot accept incoming handover connection: %w", err)
+			}
+
+			if ctx.Err() != nil {
+				recv.Close()
+				return ctx.Err()
+			}
+
+			listenConn := recv.(*net.UnixConn)
+			err = handshake(listenConn)
+			if err != nil {
+				// the peer is not a compatible registry-facade - wait for the next one
+				recv.Close()
+				continue
+			}
+
+			err = sendListener(listenConn, l)
+			recv.Close()
+			if err != nil {
+				return xerrors.Errorf("cannot send listener: %w", err)
+			}
+
+			close(done)
+			return nil
 		}
-
-		defer close(done)
-		return nil
 	})
 	eg.Go(func() error {
 		select {
 		case <-ctx.Done():
+			// unblock the Accept above
+			skt.Close()
 			return ctx.Err()
 		case <-done:
 			return nil
@@ -60,6 +99,7 @@ func OfferHandover(ctx context.Context, socketFN string, l *net.TCPListener) err
 }
 
 // ReceiveHandover requests a net.Listener handover from a Unix socket on socketFN.
+// If the peer is not a registry-facade speaking the same protocol version, a wrapped ErrIncompatiblePeer is returned.
 // If the context cancels before the transfer is complete, context.Canceled is returned.
 func ReceiveHandover(ctx context.Context, socketFN string) (l net.Listener, err error) {
 	conn, err := net.Dial("unix", socketFN)
@@ -68,7 +108,44 @@ func ReceiveHandover(ctx context.Context, socketFN string) (l net.Listener, err
 	}
 	defer conn.Close()
 
-	return receiveListener(ctx, conn.(*net.UnixConn))
+	uconn := conn.(*net.UnixConn)
+	err = handshake(uconn)
+	if err != nil {
+		return nil, err
+	}
+
+	return receiveListener(ctx, uconn)
+}
+
+// handshake exchanges the protocol version with the peer and fails if the peer is incompatible
+// or does not respond within the handshake timeout. Both sides send their version first and then read the peer's.
+func handshake(conn *net.UnixConn) error {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	msg := make([]byte, len(handshakeMagic)+2)
+	copy(msg, handshakeMagic)
+	binary.BigEndian.PutUint16(msg[len(handshakeMagic):], ProtocolVersion)
+	_, err = conn.Write(msg)
+	if err != nil {
+		return xerrors.Errorf("cannot send handshake: %w", err)
+	}
+
+	peer := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, peer)
+	if err != nil {
+		return xerrors.Errorf("%w: cannot read handshake: %v", ErrIncompatiblePeer, err)
+	}
+	if !bytes.Equal(peer[:len(handshakeMagic)], handshakeMagic) {
+		return xerrors.Errorf("%w: peer is not a registry-facade", ErrIncompatiblePeer)
+	}
+	if v := binary.BigEndian.Uint16(peer[len(handshakeMagic):]); v != ProtocolVersion {
+		return xerrors.Errorf("%w: peer speaks protocol version %d, expected %d", ErrIncompatiblePeer, v, ProtocolVersion)
+	}
+	return nil
 }
 
 // sendListener sends a copy of a TCP listener's file descriptor to a Unix socket.
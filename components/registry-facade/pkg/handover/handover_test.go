@@ -6,7 +6,9 @@ package handover_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
@@ -52,3 +54,91 @@ func TestHandover(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestHandoverIncompatiblePeer(t *testing.T) {
+	tests := []struct {
+		Desc      string
+		Handshake []byte
+	}{
+		{Desc: "no handshake"},
+		{Desc: "not a registry-facade", Handshake: []byte("hello\n\x00\x01")},
+		{Desc: "different version", Handshake: []byte("rfho\xff\xff")},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			socketFN := filepath.Join(t.TempDir(), "handover.sock")
+			skt, err := net.Listen("unix", socketFN)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer skt.Close()
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				conn, err := skt.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.Write(test.Handshake)
+				// keep the connection open so that the handshake can only fail on its content or timeout
+				<-done
+			}()
+
+			_, err = handover.ReceiveHandover(context.Background(), socketFN)
+			if !errors.Is(err, handover.ErrIncompatiblePeer) {
+				t.Errorf("expected ErrIncompatiblePeer, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOfferHandoverSkipsIncompatiblePeer(t *testing.T) {
+	socketFN := filepath.Join(t.TempDir(), "handover.sock")
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("cannot start test listener: %q", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	offerErr := make(chan error, 1)
+	go func() {
+		offerErr <- handover.OfferHandover(ctx, socketFN, l.(*net.TCPListener))
+	}()
+
+	var conn net.Conn
+	for i := 0; ; i++ {
+		conn, err = net.Dial("unix", socketFN)
+		if err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("handover is not offered: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = conn.Write([]byte("rfho\xff\xff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the offering side turns us away without handing over the listener
+	_, err = io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	rl, err := handover.ReceiveHandover(ctx, socketFN)
+	if err != nil {
+		t.Fatalf("cannot receive handover after an incompatible peer: %v", err)
+	}
+	rl.Close()
+
+	err = <-offerErr
+	if err != nil {
+		t.Errorf("unexpected offer error: %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"crypto"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth/token"
+	"github.com/docker/libtrust"
+	"golang.org/x/xerrors"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+)
+
+var errNoCredentials = xerrors.New("no credentials")
+
+// AuthConfig configures how requests are authenticated. Clients present bearer tokens issued by
+// a token server (see https://docs.docker.com/registry/spec/auth/token/).
+type AuthConfig struct {
+	// Realm is the URL of the token server clients obtain bearer tokens from
+	Realm string `json:"realm"`
+	// Service is the name of this registry. Tokens must be issued for this audience.
+	Service string `json:"service"`
+	// Issuer is the expected issuer of tokens
+	Issuer string `json:"issuer"`
+	// RootCertBundle points to a PEM bundle of the certificates or public keys the token server signs tokens with.
+	// Tokens reference their signing key using its libtrust key ID or carry a certificate chain leading up to one
+	// of the certificates.
+	RootCertBundle string `json:"rootCertBundle,omitempty"`
+	// Basic enables HTTP basic auth as a fallback for clients which cannot use bearer tokens
+	Basic *struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"basic,omitempty"`
+}
+
+// ResourceAccess is an access claim of a token, see https://docs.docker.com/registry/spec/auth/jwt/
+type ResourceAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// Identity describes an authenticated client
+type Identity struct {
+	Subject string
+	// Access lists the resources the client was granted access to
+	Access []ResourceAccess
+	// Unrestricted is true for clients which authenticated without a token, e.g. using basic auth
+	Unrestricted bool
+}
+
+type identityContextKey struct{}
+
+// IdentityFromContext returns the identity of the authenticated client or nil if the request was not authenticated
+func IdentityFromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityContextKey{}).(*Identity)
+	return id
+}
+
+// Authorizer decides if a client may perform an action (e.g. "pull") on a repository
+type Authorizer func(ctx context.Context, id *Identity, repository, action string) bool
+
+// ScopeAuthorizer permits actions which are covered by the repository access claims of the client's token.
+// Access claims can use "*" as name to match all repositories, or a path.Match pattern to match some,
+// and "*" as action to permit all actions.
+func ScopeAuthorizer(ctx context.Context, id *Identity, repository, action string) bool {
+	if id == nil {
+		return false
+	}
+	if id.Unrestricted {
+		return true
+	}
+
+	for _, acc := range id.Access {
+		if acc.Type != "repository" {
+			continue
+		}
+		if acc.Name != "*" && acc.Name != repository {
+			if ok, _ := path.Match(acc.Name, repository); !ok {
+				continue
+			}
+		}
+		for _, a := range acc.Actions {
+			if a == action || a == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authenticator authenticates registry requests
+type authenticator struct {
+	Realm   string
+	Service string
+	Tokens  *token.VerifyOptions
+	Basic   *struct {
+		Username string
+		Password string
+	}
+}
+
+func newAuthenticator(cfg *AuthConfig) (*authenticator, error) {
+	if cfg == nil {
+		return nil, xerrors.Errorf("authentication is required but not configured")
+	}
+
+	res := &authenticator{
+		Realm:   cfg.Realm,
+		Service: cfg.Service,
+	}
+	if cfg.RootCertBundle != "" {
+		if cfg.Issuer == "" || cfg.Service == "" {
+			return nil, xerrors.Errorf("token authentication requires an issuer and service")
+		}
+		fc, err := os.ReadFile(cfg.RootCertBundle)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read token root cert bundle: %w", err)
+		}
+		roots, keys, err := parseRootCertBundle(fc)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot parse token root cert bundle: %w", err)
+		}
+		res.Tokens = &token.VerifyOptions{
+			TrustedIssuers:    []string{cfg.Issuer},
+			AcceptedAudiences: []string{cfg.Service},
+			Roots:             roots,
+			TrustedKeys:       keys,
+		}
+	}
+	if cfg.Basic != nil {
+		if cfg.Basic.Username == "" || cfg.Basic.Password == "" {
+			return nil, xerrors.Errorf("basic auth requires a username and password")
+		}
+		res.Basic = &struct {
+			Username string
+			Password string
+		}{cfg.Basic.Username, cfg.Basic.Password}
+	}
+	if res.Tokens == nil && res.Basic == nil {
+		return nil, xerrors.Errorf("no authentication method configured")
+	}
+	if res.Tokens != nil && res.Realm == "" {
+		return nil, xerrors.Errorf("token authentication requires a realm")
+	}
+
+	return res, nil
+}
+
+// Authenticate checks the credentials of a request
+func (a *authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	hdr := r.Header.Get("Authorization")
+	if hdr == "" {
+		return nil, errNoCredentials
+	}
+
+	scheme, credentials := hdr, ""
+	if i := strings.IndexByte(hdr, ' '); i >= 0 {
+		scheme, credentials = hdr[:i], strings.TrimSpace(hdr[i+1:])
+	}
+	switch {
+	case strings.EqualFold(scheme, "Bearer") && a.Tokens != nil:
+		tkn, err := token.NewToken(credentials)
+		if err != nil {
+			return nil, err
+		}
+		err = tkn.Verify(*a.Tokens)
+		if err != nil {
+			return nil, err
+		}
+
+		id := &Identity{Subject: tkn.Claims.Subject}
+		for _, acc := range tkn.Claims.Access {
+			id.Access = append(id.Access, ResourceAccess{Type: acc.Type, Name: acc.Name, Actions: acc.Actions})
+		}
+		return id, nil
+	case strings.EqualFold(scheme, "Basic") && a.Basic != nil:
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			return nil, errNoCredentials
+		}
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.Basic.Username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.Basic.Password)) == 1
+		if !userOK || !passOK {
+			return nil, xerrors.Errorf("invalid username or password")
+		}
+		return &Identity{Subject: user, Unrestricted: true}, nil
+	default:
+		return nil, errNoCredentials
+	}
+}
+
+// Challenge adds the WWW-Authenticate headers which tell a client how to authenticate
+func (a *authenticator) Challenge(w http.ResponseWriter, err error) {
+	if a.Tokens != nil {
+		challenge := fmt.Sprintf("Bearer realm=%q", a.Realm)
+		if a.Service != "" {
+			challenge += fmt.Sprintf(",service=%q", a.Service)
+		}
+		if xerrors.Is(err, token.ErrMalformedToken) || xerrors.Is(err, token.ErrInvalidToken) {
+			// see https://tools.ietf.org/html/rfc6750#section-3.1
+			challenge += `,error="invalid_token"`
+		}
+		w.Header().Add("WWW-Authenticate", challenge)
+	}
+	if a.Basic != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="registry-facade"`)
+	}
+}
+
+func requireAuthentication(auth *authenticator, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := auth.Authenticate(r)
+		if err != nil {
+			if err != errNoCredentials {
+				log.WithError(err).WithField("path", r.URL.Path).Debug("request authentication failed")
+			}
+			auth.Challenge(w, err)
+			respondWithError(w, errcode.ErrorCodeUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, id)))
+	})
+}
+
+// parseRootCertBundle parses a PEM bundle of certificates and public keys. Tokens can be signed by any of the keys,
+// or by a certificate chain leading up to one of the certificates.
+func parseRootCertBundle(data []byte) (roots *x509.CertPool, keys map[string]libtrust.PublicKey, err error) {
+	roots = x509.NewCertPool()
+	keys = make(map[string]libtrust.PublicKey)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key crypto.PublicKey
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			roots.AddCert(cert)
+			key = cert.PublicKey
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, xerrors.Errorf("unsupported PEM block %s", block.Type)
+		}
+
+		pk, err := libtrust.FromCryptoPublicKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[pk.KeyID()] = pk
+	}
+	if len(keys) == 0 {
+		return nil, nil, xerrors.Errorf("no PEM data found")
+	}
+
+	return roots, keys, nil
+}
+
+// authorize wraps a dispatch func such that requests are only dispatched if the authenticated client
+// may perform the requested action on the repository. Without authentication all requests are dispatched.
+func (reg *Registry) authorize(d dispatchFunc) dispatchFunc {
+	return func(ctx context.Context, r *http.Request) http.Handler {
+		if reg.auth == nil {
+			return d(ctx, r)
+		}
+
+		authorizer := reg.Authorizer
+		if authorizer == nil {
+			authorizer = ScopeAuthorizer
+		}
+		action := "pull"
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			action = "push"
+		}
+		name := getName(ctx)
+		id := IdentityFromContext(ctx)
+		if !authorizer(ctx, id, name, action) {
+			log.WithField("name", name).WithField("action", action).Debug("request not authorized")
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				respondWithError(w, errcode.ErrorCodeDenied)
+			})
+		}
+
+		return d(ctx, r)
+	}
+}
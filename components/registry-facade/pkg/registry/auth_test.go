@@ -0,0 +1,495 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth/token"
+	"github.com/docker/libtrust"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRequireAuthentication(t *testing.T) {
+	now := time.Now()
+	ecKey, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := libtrust.GenerateRSA2048PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaCert, err := libtrust.GenerateSelfSignedClientCert(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrustedKey, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrustedCert, err := libtrust.GenerateSelfSignedClientCert(untrustedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the token server signs using the EC key, or the RSA key it has a certificate for
+	ecPEM, err := ecKey.PublicKey().PEMBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "bundle.pem")
+	err = os.WriteFile(bundle, append(pem.EncodeToMemory(ecPEM), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rsaCert.Raw})...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	access := []*token.ResourceActions{{Type: "repository", Name: "remote/foo", Actions: []string{"pull"}}}
+	validClaims := token.ClaimSet{
+		Issuer:     "token-server",
+		Subject:    "foo",
+		Audience:   "registry-facade",
+		Expiration: now.Add(5 * time.Minute).Unix(),
+		IssuedAt:   now.Unix(),
+		Access:     access,
+	}
+	withClaims := func(mod func(c *token.ClaimSet)) token.ClaimSet {
+		c := validClaims
+		mod(&c)
+		return c
+	}
+	signed := signToken(t, ecKey, nil, validClaims)
+	unsigned := signed[:strings.LastIndex(signed, ".")+1]
+	x5c := func(certs ...[]byte) map[string]interface{} {
+		var chain []string
+		for _, c := range certs {
+			chain = append(chain, base64.StdEncoding.EncodeToString(c))
+		}
+		return map[string]interface{}{"x5c": chain}
+	}
+	jwk := func(key libtrust.PublicKey) map[string]interface{} {
+		return map[string]interface{}{"jwk": key}
+	}
+
+	const bearerChallenge = `Bearer realm="https://auth.gitpod.io/token",service="registry-facade"`
+	const invalidTokenChallenge = bearerChallenge + `,error="invalid_token"`
+	const basicChallenge = `Basic realm="registry-facade"`
+
+	type Expectation struct {
+		Status    int
+		Challenge []string
+		Subject   string
+		Access    []ResourceAccess
+	}
+	validToken := Expectation{
+		Status:  http.StatusOK,
+		Subject: "foo",
+		Access:  []ResourceAccess{{Type: "repository", Name: "remote/foo", Actions: []string{"pull"}}},
+	}
+	tests := []struct {
+		Desc          string
+		Basic         bool
+		Authorization string
+		Expectation   Expectation
+	}{
+		{
+			Desc:        "missing",
+			Expectation: Expectation{Status: http.StatusUnauthorized, Challenge: []string{bearerChallenge}},
+		},
+		{
+			Desc:          "unknown scheme",
+			Authorization: "Digest foo",
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{bearerChallenge}},
+		},
+		{
+			Desc:          "malformed",
+			Authorization: "Bearer not-a-token",
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "malformed segments",
+			Authorization: "Bearer a.b.c",
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "expired",
+			Authorization: "Bearer " + signToken(t, ecKey, nil, withClaims(func(c *token.ClaimSet) { c.Expiration = now.Add(-time.Hour).Unix() })),
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "expired within leeway",
+			Authorization: "Bearer " + signToken(t, ecKey, nil, withClaims(func(c *token.ClaimSet) { c.Expiration = now.Add(-10 * time.Second).Unix() })),
+			Expectation:   validToken,
+		},
+		{
+			Desc:          "not yet valid",
+			Authorization: "Bearer " + signToken(t, ecKey, nil, withClaims(func(c *token.ClaimSet) { c.NotBefore = now.Add(time.Hour).Unix() })),
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "no expiry",
+			Authorization: "Bearer " + signToken(t, ecKey, nil, withClaims(func(c *token.ClaimSet) { c.Expiration = 0 })),
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "wrong audience",
+			Authorization: "Bearer " + signToken(t, ecKey, nil, withClaims(func(c *token.ClaimSet) { c.Audience = "someone-else" })),
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "wrong issuer",
+			Authorization: "Bearer " + signToken(t, ecKey, nil, withClaims(func(c *token.ClaimSet) { c.Issuer = "someone-else" })),
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "unsigned",
+			Authorization: "Bearer " + unsigned,
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "untrusted key",
+			Authorization: "Bearer " + signToken(t, untrustedKey, nil, validClaims),
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "key ID of trusted key",
+			Authorization: "Bearer " + signToken(t, untrustedKey, map[string]interface{}{"kid": ecKey.KeyID()}, validClaims),
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "valid ES256 key ID",
+			Authorization: "Bearer " + signToken(t, ecKey, nil, validClaims),
+			Expectation:   validToken,
+		},
+		{
+			Desc:          "valid RS256 key ID of certificate",
+			Authorization: "Bearer " + signToken(t, rsaKey, nil, validClaims),
+			Expectation:   validToken,
+		},
+		{
+			Desc:          "valid certificate chain",
+			Authorization: "Bearer " + signToken(t, rsaKey, x5c(rsaCert.Raw), validClaims),
+			Expectation:   validToken,
+		},
+		{
+			Desc:          "untrusted certificate chain",
+			Authorization: "Bearer " + signToken(t, untrustedKey, x5c(untrustedCert.Raw), validClaims),
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "valid JWK",
+			Authorization: "Bearer " + signToken(t, ecKey, jwk(ecKey.PublicKey()), validClaims),
+			Expectation:   validToken,
+		},
+		{
+			Desc:          "untrusted JWK",
+			Authorization: "Bearer " + signToken(t, untrustedKey, jwk(untrustedKey.PublicKey()), validClaims),
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{invalidTokenChallenge}},
+		},
+		{
+			Desc:          "basic not enabled",
+			Authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")),
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{bearerChallenge}},
+		},
+		{
+			Desc:          "valid basic",
+			Basic:         true,
+			Authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")),
+			Expectation:   Expectation{Status: http.StatusOK, Subject: "user"},
+		},
+		{
+			Desc:          "invalid basic",
+			Basic:         true,
+			Authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("user:wrong")),
+			Expectation:   Expectation{Status: http.StatusUnauthorized, Challenge: []string{bearerChallenge, basicChallenge}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			cfg := &AuthConfig{
+				Realm:          "https://auth.gitpod.io/token",
+				Service:        "registry-facade",
+				Issuer:         "token-server",
+				RootCertBundle: bundle,
+			}
+			if test.Basic {
+				cfg.Basic = &struct {
+					Username string `json:"username"`
+					Password string `json:"password"`
+				}{"user", "pass"}
+			}
+			auth, err := newAuthenticator(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var id *Identity
+			handler := requireAuthentication(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				id = IdentityFromContext(r.Context())
+				w.WriteHeader(http.StatusOK)
+			}))
+			req := httptest.NewRequest("GET", "/v2/", nil)
+			if test.Authorization != "" {
+				req.Header.Set("Authorization", test.Authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			act := Expectation{
+				Status:    rec.Code,
+				Challenge: rec.Header()["Www-Authenticate"],
+			}
+			if id != nil {
+				act.Subject = id.Subject
+				act.Access = id.Access
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected response (-want +got):\n%s", diff)
+			}
+			if rec.Code != http.StatusUnauthorized {
+				return
+			}
+
+			var errs errcode.Errors
+			err = json.Unmarshal(rec.Body.Bytes(), &errs)
+			if err != nil {
+				t.Fatalf("response is not an error: %v", err)
+			}
+			if len(errs) != 1 || errs[0].(errcode.ErrorCoder).ErrorCode() != errcode.ErrorCodeUnauthorized {
+				t.Errorf("expected an unauthorized error, got %v", errs)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := key.PublicKey().PEMBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		tmpdir = t.TempDir()
+		bundle = filepath.Join(tmpdir, "bundle.pem")
+		empty  = filepath.Join(tmpdir, "empty.pem")
+	)
+	err = os.WriteFile(bundle, pem.EncodeToMemory(blk), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(empty, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Desc   string
+		Config *AuthConfig
+		Error  bool
+	}{
+		{Desc: "not configured", Error: true},
+		{Desc: "no method", Config: &AuthConfig{Realm: "r"}, Error: true},
+		{Desc: "valid", Config: &AuthConfig{Realm: "r", Service: "s", Issuer: "i", RootCertBundle: bundle}},
+		{Desc: "no realm", Config: &AuthConfig{Service: "s", Issuer: "i", RootCertBundle: bundle}, Error: true},
+		{Desc: "no issuer", Config: &AuthConfig{Realm: "r", Service: "s", RootCertBundle: bundle}, Error: true},
+		{Desc: "no service", Config: &AuthConfig{Realm: "r", Issuer: "i", RootCertBundle: bundle}, Error: true},
+		{Desc: "missing bundle", Config: &AuthConfig{Realm: "r", Service: "s", Issuer: "i", RootCertBundle: filepath.Join(tmpdir, "missing.pem")}, Error: true},
+		{Desc: "empty bundle", Config: &AuthConfig{Realm: "r", Service: "s", Issuer: "i", RootCertBundle: empty}, Error: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			_, err := newAuthenticator(test.Config)
+			if (err != nil) != test.Error {
+				t.Errorf("unexpected error: expected error %v, got %v", test.Error, err)
+			}
+		})
+	}
+}
+
+func TestScopeAuthorizer(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Identity    *Identity
+		Repository  string
+		Action      string
+		Expectation bool
+	}{
+		{
+			Desc:       "no identity",
+			Repository: "remote/foo",
+			Action:     "pull",
+		},
+		{
+			Desc:        "unrestricted",
+			Identity:    &Identity{Unrestricted: true},
+			Repository:  "remote/foo",
+			Action:      "pull",
+			Expectation: true,
+		},
+		{
+			Desc:        "allow",
+			Identity:    &Identity{Access: []ResourceAccess{{Type: "repository", Name: "remote/foo", Actions: []string{"pull"}}}},
+			Repository:  "remote/foo",
+			Action:      "pull",
+			Expectation: true,
+		},
+		{
+			Desc:       "deny other repository",
+			Identity:   &Identity{Access: []ResourceAccess{{Type: "repository", Name: "remote/foo", Actions: []string{"pull"}}}},
+			Repository: "remote/bar",
+			Action:     "pull",
+		},
+		{
+			Desc:       "deny other action",
+			Identity:   &Identity{Access: []ResourceAccess{{Type: "repository", Name: "remote/foo", Actions: []string{"pull"}}}},
+			Repository: "remote/foo",
+			Action:     "push",
+		},
+		{
+			Desc:       "deny other resource type",
+			Identity:   &Identity{Access: []ResourceAccess{{Type: "registry", Name: "remote/foo", Actions: []string{"*"}}}},
+			Repository: "remote/foo",
+			Action:     "pull",
+		},
+		{
+			Desc:       "no access",
+			Identity:   &Identity{},
+			Repository: "remote/foo",
+			Action:     "pull",
+		},
+		{
+			Desc:        "wildcard name",
+			Identity:    &Identity{Access: []ResourceAccess{{Type: "repository", Name: "*", Actions: []string{"pull"}}}},
+			Repository:  "remote/foo",
+			Action:      "pull",
+			Expectation: true,
+		},
+		{
+			Desc:        "name pattern",
+			Identity:    &Identity{Access: []ResourceAccess{{Type: "repository", Name: "remote/*", Actions: []string{"pull"}}}},
+			Repository:  "remote/foo",
+			Action:      "pull",
+			Expectation: true,
+		},
+		{
+			Desc:       "name pattern mismatch",
+			Identity:   &Identity{Access: []ResourceAccess{{Type: "repository", Name: "remote/*", Actions: []string{"pull"}}}},
+			Repository: "local/foo",
+			Action:     "pull",
+		},
+		{
+			Desc:        "wildcard action",
+			Identity:    &Identity{Access: []ResourceAccess{{Type: "repository", Name: "remote/foo", Actions: []string{"*"}}}},
+			Repository:  "remote/foo",
+			Action:      "push",
+			Expectation: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := ScopeAuthorizer(context.Background(), test.Identity, test.Repository, test.Action)
+			if act != test.Expectation {
+				t.Errorf("unexpected authorization: expected %v, got %v", test.Expectation, act)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	scoped := &Identity{Access: []ResourceAccess{{Type: "repository", Name: "remote/foo", Actions: []string{"pull"}}}}
+
+	tests := []struct {
+		Desc        string
+		Auth        *authenticator
+		Authorizer  Authorizer
+		Identity    *Identity
+		Name        string
+		Method      string
+		Expectation int
+	}{
+		{Desc: "no auth", Name: "remote/bar", Method: "GET", Expectation: http.StatusOK},
+		{Desc: "allowed", Auth: &authenticator{}, Identity: scoped, Name: "remote/foo", Method: "GET", Expectation: http.StatusOK},
+		{Desc: "allowed head", Auth: &authenticator{}, Identity: scoped, Name: "remote/foo", Method: "HEAD", Expectation: http.StatusOK},
+		{Desc: "denied repository", Auth: &authenticator{}, Identity: scoped, Name: "remote/bar", Method: "GET", Expectation: http.StatusForbidden},
+		{Desc: "denied push", Auth: &authenticator{}, Identity: scoped, Name: "remote/foo", Method: "PUT", Expectation: http.StatusForbidden},
+		{
+			Desc: "custom authorizer",
+			Auth: &authenticator{},
+			Authorizer: func(ctx context.Context, id *Identity, repository, action string) bool {
+				return repository == "remote/bar"
+			},
+			Identity:    scoped,
+			Name:        "remote/bar",
+			Method:      "GET",
+			Expectation: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			reg := &Registry{auth: test.Auth, Authorizer: test.Authorizer}
+			d := reg.authorize(func(ctx context.Context, r *http.Request) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				})
+			})
+
+			req := httptest.NewRequest(test.Method, "/v2/"+test.Name+"/manifests/latest", nil)
+			ctx := context.WithValue(req.Context(), identityContextKey{}, test.Identity)
+			ctx = &muxVarsContext{Context: ctx, vars: map[string]string{"name": test.Name}}
+			rec := httptest.NewRecorder()
+			d(ctx, req).ServeHTTP(rec, req)
+
+			if rec.Code != test.Expectation {
+				t.Errorf("unexpected status code: expected %d, got %d", test.Expectation, rec.Code)
+			}
+		})
+	}
+}
+
+// signToken signs a token with the given key. Unless other header fields are given, the token references the key by its ID.
+func signToken(t *testing.T, key libtrust.PrivateKey, hdr map[string]interface{}, claims token.ClaimSet) string {
+	if hdr == nil {
+		hdr = map[string]interface{}{"kid": key.KeyID()}
+	}
+	hdr["typ"] = "JWT"
+	hdr["alg"] = "ES256"
+	if key.KeyType() == "RSA" {
+		hdr["alg"] = "RS256"
+	}
+
+	h, err := json.Marshal(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := joseEncode(h) + "." + joseEncode(c)
+	sig, _, err := key.Sign(strings.NewReader(payload), crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload + "." + joseEncode(sig)
+}
+
+func joseEncode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
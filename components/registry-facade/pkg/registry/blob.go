@@ -47,21 +47,30 @@ func (reg *Registry) handleBlob(ctx context.Context, r *http.Request) http.Handl
 		log.WithError(err).WithField("instanceId", name).Error("cannot get workspace details")
 	}
 
+	layers := reg.currentLayers()
+	superseded := reg.supersededLayers()
 	blobHandler := &blobHandler{
 		Context: ctx,
 		Digest:  dgst,
 		Name:    name,
 
-		Spec:     spec,
-		Resolver: reg.Resolver(),
-		Store:    reg.Store,
-		AdditionalSources: []BlobSource{
-			reg.LayerSource,
-		},
-		ConfigModifier: reg.ConfigModifier,
+		Spec:           spec,
+		Resolver:       reg.Resolver(),
+		Store:          reg.Store,
+		GC:             reg.gc,
+		ConfigModifier: layers.ConfigModifier,
 
 		Metrics: reg.metrics,
 	}
+	// The last source which has a blob serves it, hence the current layers take precedence.
+	for _, s := range superseded {
+		blobHandler.AdditionalSources = append(blobHandler.AdditionalSources, s.LayerSource)
+		blobHandler.SupersededConfigModifiers = append(blobHandler.SupersededConfigModifiers, s.ConfigModifier)
+	}
+	blobHandler.AdditionalSources = append(blobHandler.AdditionalSources, layers.LayerSource)
+	if reg.transcoder != nil {
+		blobHandler.AdditionalSources = append(blobHandler.AdditionalSources, reg.transcoder)
+	}
 
 	mhandler := handlers.MethodHandler{
 		"GET":  http.HandlerFunc(blobHandler.getBlob),
@@ -83,8 +92,12 @@ type blobHandler struct {
 	Spec              *api.ImageSpec
 	Resolver          remotes.Resolver
 	Store             content.Store
+	GC                *storeGC
 	AdditionalSources []BlobSource
 	ConfigModifier    ConfigModifier
+	// SupersededConfigModifiers are the config modifiers of layer sets which a reload replaced recently.
+	// Clients which fetched their manifest before the reload still download the configs they produce.
+	SupersededConfigModifiers []ConfigModifier
 
 	Metrics *metrics
 }
@@ -93,22 +106,31 @@ func (bh *blobHandler) getBlob(w http.ResponseWriter, r *http.Request) {
 	// v2.ErrorCodeBlobUnknown.WithDetail(bh.Digest)
 	span, ctx := opentracing.StartSpanFromContext(r.Context(), "getBlob")
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// We don't cancel when the client goes away, but keep the span so that the blob source calls show up in the trace.
+	ctx, cancel := context.WithCancel(opentracing.ContextWithSpan(context.Background(), span))
 	defer cancel()
 
+	// every blob request counts as use, so that frequently requested blobs are evicted last
+	bh.GC.Touch(bh.Digest)
+
 	err := func() error {
 		// TODO: rather than download the same manifest over and over again,
 		//       we should add it to the store and try and fetch it from there.
 		//		 Only if the store fetch fails should we attetmpt to download it.
-		manifest, fetcher, err := bh.downloadManifest(ctx, bh.Spec.BaseRef)
+		manifests, fetcher, err := bh.downloadManifests(ctx, bh.Spec.BaseRef)
 		if err != nil {
 			return err
 		}
 
 		var srcs []BlobSource
-		srcs = append(srcs, storeBlobSource{Store: bh.Store})
-		srcs = append(srcs, proxyingBlobSource{Fetcher: fetcher, Blobs: manifest.Layers})
-		srcs = append(srcs, &configBlobSource{Fetcher: fetcher, Spec: bh.Spec, Manifest: manifest, ConfigModifier: bh.ConfigModifier})
+		srcs = append(srcs, storeBlobSource{Store: bh.Store, GC: bh.GC})
+		for _, manifest := range manifests {
+			srcs = append(srcs, proxyingBlobSource{Fetcher: fetcher, Blobs: manifest.Layers})
+			for _, modifier := range bh.SupersededConfigModifiers {
+				srcs = append(srcs, &configBlobSource{Fetcher: fetcher, Spec: bh.Spec, Manifest: manifest, ConfigModifier: modifier})
+			}
+			srcs = append(srcs, &configBlobSource{Fetcher: fetcher, Spec: bh.Spec, Manifest: manifest, ConfigModifier: bh.ConfigModifier})
+		}
 		srcs = append(srcs, bh.AdditionalSources...)
 
 		var src BlobSource
@@ -154,7 +176,9 @@ func (bh *blobHandler) getBlob(w http.ResponseWriter, r *http.Request) {
 	tracing.FinishSpan(span, &err)
 }
 
-func (bh *blobHandler) downloadManifest(ctx context.Context, ref string) (res *ociv1.Manifest, fetcher remotes.Fetcher, err error) {
+// downloadManifests downloads the manifest of ref. If ref points to a manifest list, we download the manifests of
+// all platforms because clients can pull any of them.
+func (bh *blobHandler) downloadManifests(ctx context.Context, ref string) (res []*ociv1.Manifest, fetcher remotes.Fetcher, err error) {
 	_, desc, err := bh.Resolver.Resolve(ctx, ref)
 	if err != nil {
 		// ErrInvalidAuthorization
@@ -166,7 +190,23 @@ func (bh *blobHandler) downloadManifest(ctx context.Context, ref string) (res *o
 		log.WithError(err).WithField("ref", ref).WithField("instanceId", bh.Name).Error("cannot get fetcher")
 		return nil, nil, err
 	}
-	res, _, err = DownloadManifest(ctx, fetcher, desc, WithStore(bh.Store))
+	defer bh.GC.Acquire(desc.Digest)()
+
+	mds := []ociv1.Descriptor{desc}
+	if isIndexMediaType(desc.MediaType) {
+		idx, err := downloadIndex(ctx, fetcher, desc, bh.Store)
+		if err != nil {
+			return nil, nil, err
+		}
+		mds = platformManifests(idx)
+	}
+	for _, md := range mds {
+		manifest, _, err := DownloadManifest(ctx, fetcher, md, WithStore(bh.Store))
+		if err != nil {
+			return nil, nil, err
+		}
+		res = append(res, manifest)
+	}
 	return
 }
 
@@ -193,6 +233,7 @@ type BlobSource interface {
 
 type storeBlobSource struct {
 	Store content.Store
+	GC    *storeGC
 }
 
 func (sbs storeBlobSource) HasBlob(ctx context.Context, spec *api.ImageSpec, dgst digest.Digest) bool {
@@ -201,6 +242,14 @@ func (sbs storeBlobSource) HasBlob(ctx context.Context, spec *api.ImageSpec, dgs
 }
 
 func (sbs storeBlobSource) GetBlob(ctx context.Context, spec *api.ImageSpec, dgst digest.Digest) (mediaType string, url string, data io.ReadCloser, err error) {
+	// acquire the blob before we look at it so that the GC cannot remove it while we're serving it
+	release := sbs.GC.Acquire(dgst)
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
 	info, err := sbs.Store.Info(ctx, dgst)
 	if err != nil {
 		return
@@ -211,7 +260,7 @@ func (sbs storeBlobSource) GetBlob(ctx context.Context, spec *api.ImageSpec, dgs
 		return
 	}
 
-	return info.Labels["Content-Type"], "", &reader{ReaderAt: r}, nil
+	return info.Labels["Content-Type"], "", &releasingReadCloser{ReadCloser: &reader{ReaderAt: r}, release: release}, nil
 }
 
 type proxyingBlobSource struct {
@@ -0,0 +1,47 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestGetBlobMultiPlatform(t *testing.T) {
+	for _, platform := range []string{"amd64", "arm64"} {
+		t.Run(platform, func(t *testing.T) {
+			mh := newTestIndexManifestHandler(t)
+			metrics, err := newMetrics(prometheus.NewRegistry(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bh := &blobHandler{
+				Context:        context.Background(),
+				Digest:         digest.FromString(platform),
+				Name:           "foo",
+				Spec:           mh.Spec,
+				Resolver:       mh.Resolver,
+				Store:          mh.Store,
+				ConfigModifier: mh.ConfigModifier,
+				Metrics:        metrics,
+			}
+
+			rec := httptest.NewRecorder()
+			bh.getBlob(rec, httptest.NewRequest(http.MethodGet, "/v2/remote/foo/blobs/"+bh.Digest.String(), nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("unexpected status code %d: %s", rec.Code, rec.Body.String())
+			}
+			if body := rec.Body.String(); body != platform {
+				t.Errorf("unexpected blob content: expected %s, got %s", platform, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+)
+
+const (
+	defaultStoreGCRetention = 24 * time.Hour
+
+	// defaultStoreEvictionInterval is the time between two store size checks if no GC interval is configured
+	defaultStoreEvictionInterval = 1 * time.Minute
+)
+
+// storeGC removes blobs from the content store which were not used within the retention period,
+// and evicts the least recently used blobs once the store grows beyond MaxBytes.
+// Blobs are marked as used whenever a manifest referencing them is served, or when they are
+// read from the store. Blobs which are currently being read are never removed.
+type storeGC struct {
+	Store content.Store
+	// Retention is the time blobs are kept after their last use. Zero disables retention-based collection.
+	Retention time.Duration
+	// MaxBytes is the maximum size of the store. Zero disables eviction.
+	MaxBytes int64
+	Metrics  *metrics
+
+	mu       sync.Mutex
+	lastUsed map[digest.Digest]time.Time
+	inUse    map[digest.Digest]int
+}
+
+func newStoreGC(store content.Store, retention time.Duration, maxBytes int64, metrics *metrics) *storeGC {
+	return &storeGC{
+		Store:     store,
+		Retention: retention,
+		MaxBytes:  maxBytes,
+		Metrics:   metrics,
+		lastUsed:  make(map[digest.Digest]time.Time),
+		inUse:     make(map[digest.Digest]int),
+	}
+}
+
+// Touch marks blobs as used
+func (gc *storeGC) Touch(dgsts ...digest.Digest) {
+	if gc == nil {
+		return
+	}
+
+	now := time.Now()
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	for _, dgst := range dgsts {
+		gc.lastUsed[dgst] = now
+	}
+}
+
+// Acquire marks a blob as in use until the returned release function is called
+func (gc *storeGC) Acquire(dgst digest.Digest) (release func()) {
+	if gc == nil {
+		return func() {}
+	}
+
+	gc.mu.Lock()
+	gc.inUse[dgst]++
+	gc.lastUsed[dgst] = time.Now()
+	gc.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			gc.mu.Lock()
+			defer gc.mu.Unlock()
+
+			gc.inUse[dgst]--
+			if gc.inUse[dgst] <= 0 {
+				delete(gc.inUse, dgst)
+			}
+			gc.lastUsed[dgst] = time.Now()
+		})
+	}
+}
+
+// Run collects garbage and enforces the store size limit every interval until the context is canceled
+func (gc *storeGC) Run(ctx context.Context, interval time.Duration) {
+	log.WithField("interval", interval.String()).WithField("retention", gc.Retention.String()).WithField("maxBytes", gc.MaxBytes).Info("starting content store GC")
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if gc.Retention > 0 {
+			deleted, reclaimed, err := gc.Collect(ctx, time.Now())
+			if err != nil {
+				log.WithError(err).Warn("content store GC failed")
+			}
+			if deleted > 0 {
+				log.WithField("blobs", deleted).WithField("bytes", reclaimed).Info("content store GC removed unused blobs")
+			}
+		}
+
+		deleted, reclaimed, err := gc.Evict(ctx)
+		if err != nil {
+			log.WithError(err).Warn("content store eviction failed")
+		}
+		if deleted > 0 {
+			log.WithField("blobs", deleted).WithField("bytes", reclaimed).Info("content store exceeded its size limit - evicted least recently used blobs")
+		}
+	}
+}
+
+// Collect removes all blobs which were last used before now-Retention
+func (gc *storeGC) Collect(ctx context.Context, now time.Time) (deleted int, reclaimed int64, err error) {
+	cutoff := now.Add(-gc.Retention)
+
+	var candidates []content.Info
+	err = gc.Store.Walk(ctx, func(info content.Info) error {
+		gc.mu.Lock()
+		unused := gc.lastUse(info).Before(cutoff)
+		gc.mu.Unlock()
+
+		if unused {
+			candidates = append(candidates, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, info := range candidates {
+		// the blob might have been used since we walked the store
+		if !gc.remove(ctx, info, func() bool { return gc.lastUse(info).After(cutoff) }) {
+			continue
+		}
+		deleted++
+		reclaimed += info.Size
+	}
+
+	// forget about blobs which were used long ago but aren't in the store
+	gc.mu.Lock()
+	for dgst, t := range gc.lastUsed {
+		if gc.inUse[dgst] == 0 && t.Before(cutoff) {
+			delete(gc.lastUsed, dgst)
+		}
+	}
+	gc.mu.Unlock()
+
+	return
+}
+
+// Evict removes the least recently used blobs until the store is no larger than MaxBytes.
+// Regardless of MaxBytes, Evict updates the store size metric.
+func (gc *storeGC) Evict(ctx context.Context) (deleted int, reclaimed int64, err error) {
+	var (
+		blobs []content.Info
+		size  int64
+	)
+	err = gc.Store.Walk(ctx, func(info content.Info) error {
+		blobs = append(blobs, info)
+		size += info.Size
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	defer func() {
+		if gc.Metrics != nil {
+			gc.Metrics.StoreSize.Set(float64(size - reclaimed))
+		}
+	}()
+	if gc.MaxBytes <= 0 || size <= gc.MaxBytes {
+		return
+	}
+
+	lastUse := make(map[digest.Digest]time.Time, len(blobs))
+	gc.mu.Lock()
+	for _, info := range blobs {
+		lastUse[info.Digest] = gc.lastUse(info)
+	}
+	gc.mu.Unlock()
+	sort.Slice(blobs, func(i, j int) bool { return lastUse[blobs[i].Digest].Before(lastUse[blobs[j].Digest]) })
+
+	for _, info := range blobs {
+		if size-reclaimed <= gc.MaxBytes {
+			break
+		}
+		if !gc.remove(ctx, info, nil) {
+			continue
+		}
+		deleted++
+		reclaimed += info.Size
+	}
+	return
+}
+
+// remove deletes a blob from the store unless it's in use or keep returns true. keep is called with gc.mu held.
+// Returns true if the blob was deleted.
+func (gc *storeGC) remove(ctx context.Context, info content.Info, keep func() bool) bool {
+	// We hold the lock while deleting so that no-one can start using the blob in the meantime.
+	gc.mu.Lock()
+	if gc.inUse[info.Digest] > 0 || (keep != nil && keep()) {
+		gc.mu.Unlock()
+		return false
+	}
+	err := gc.Store.Delete(ctx, info.Digest)
+	if err == nil || errors.Is(err, errdefs.ErrNotFound) {
+		delete(gc.lastUsed, info.Digest)
+	}
+	gc.mu.Unlock()
+
+	if errors.Is(err, errdefs.ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		log.WithError(err).WithField("digest", info.Digest).Warn("cannot delete blob from content store")
+		return false
+	}
+
+	if gc.Metrics != nil {
+		gc.Metrics.StoreGCDeletedBlobs.Inc()
+		gc.Metrics.StoreGCReclaimedBytes.Add(float64(info.Size))
+	}
+	return true
+}
+
+// lastUse returns the time a blob was last used. Callers must hold gc.mu.
+func (gc *storeGC) lastUse(info content.Info) time.Time {
+	res := info.UpdatedAt
+	if info.CreatedAt.After(res) {
+		res = info.CreatedAt
+	}
+	if t, ok := gc.lastUsed[info.Digest]; ok && t.After(res) {
+		res = t
+	}
+	return res
+}
+
+// releasingReadCloser calls release when closed
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releasingReadCloser) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
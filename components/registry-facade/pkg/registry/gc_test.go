@@ -0,0 +1,176 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStoreGCCollect(t *testing.T) {
+	blobs := map[string][]byte{
+		"unused":   []byte("unused"),
+		"acquired": []byte("acquired"),
+		"released": []byte("released"),
+	}
+
+	tests := []struct {
+		Desc      string
+		Now       time.Duration
+		Acquire   []string
+		Release   []string
+		Remaining []string
+	}{
+		{Desc: "within retention", Now: 0, Remaining: []string{"acquired", "released", "unused"}},
+		{Desc: "beyond retention", Now: 2 * time.Hour, Remaining: []string{}},
+		{Desc: "in use", Now: 2 * time.Hour, Acquire: []string{"acquired", "released"}, Release: []string{"released"}, Remaining: []string{"acquired"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			ctx := context.Background()
+			store, err := local.NewStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			dgsts := make(map[string]digest.Digest)
+			for name, b := range blobs {
+				desc := ociv1.Descriptor{Digest: digest.FromBytes(b), Size: int64(len(b))}
+				err := content.WriteBlob(ctx, store, name, bytes.NewReader(b), desc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dgsts[name] = desc.Digest
+			}
+
+			gc := newStoreGC(store, time.Hour, 0, nil)
+			for _, name := range test.Acquire {
+				release := gc.Acquire(dgsts[name])
+				for _, r := range test.Release {
+					if r == name {
+						release()
+					}
+				}
+			}
+
+			_, _, err = gc.Collect(ctx, time.Now().Add(test.Now))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			remaining := []string{}
+			for _, name := range []string{"acquired", "released", "unused"} {
+				if _, err := store.Info(ctx, dgsts[name]); err == nil {
+					remaining = append(remaining, name)
+				}
+			}
+			if diff := cmp.Diff(test.Remaining, remaining); diff != "" {
+				t.Errorf("unexpected remaining blobs (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStoreGCEvict(t *testing.T) {
+	blobs := []string{"blob-0001", "blob-0002", "blob-0003"}
+
+	tests := []struct {
+		Desc      string
+		MaxBytes  int64
+		Acquire   []string
+		Remaining []string
+		Size      float64
+	}{
+		{Desc: "unlimited", MaxBytes: 0, Remaining: []string{"blob-0001", "blob-0002", "blob-0003"}, Size: 27},
+		{Desc: "below limit", MaxBytes: 27, Remaining: []string{"blob-0001", "blob-0002", "blob-0003"}, Size: 27},
+		{Desc: "least recently used", MaxBytes: 20, Remaining: []string{"blob-0002", "blob-0003"}, Size: 18},
+		{Desc: "skip in use", MaxBytes: 20, Acquire: []string{"blob-0001"}, Remaining: []string{"blob-0001", "blob-0003"}, Size: 18},
+		{Desc: "all in use", MaxBytes: 1, Acquire: blobs, Remaining: blobs, Size: 27},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			ctx := context.Background()
+			store, err := local.NewStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			metrics, err := newMetrics(prometheus.NewRegistry(), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gc := newStoreGC(store, 0, test.MaxBytes, metrics)
+			t0 := time.Now()
+			dgsts := make(map[string]digest.Digest)
+			for i, name := range blobs {
+				desc := ociv1.Descriptor{Digest: digest.FromString(name), Size: int64(len(name))}
+				err := content.WriteBlob(ctx, store, name, bytes.NewReader([]byte(name)), desc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dgsts[name] = desc.Digest
+				// blobs are used in order, the first one being the least recently used
+				gc.lastUsed[desc.Digest] = t0.Add(time.Duration(i) * time.Hour)
+			}
+			for _, name := range test.Acquire {
+				gc.inUse[dgsts[name]]++
+			}
+
+			_, _, err = gc.Evict(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			remaining := []string{}
+			for _, name := range blobs {
+				if _, err := store.Info(ctx, dgsts[name]); err == nil {
+					remaining = append(remaining, name)
+				}
+			}
+			if diff := cmp.Diff(test.Remaining, remaining); diff != "" {
+				t.Errorf("unexpected remaining blobs (-want +got):\n%s", diff)
+			}
+			if size := testutil.ToFloat64(metrics.StoreSize); size != test.Size {
+				t.Errorf("unexpected store size: expected %v, got %v", test.Size, size)
+			}
+		})
+	}
+}
+
+func TestStoreGCLastUse(t *testing.T) {
+	var (
+		t0   = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		dgst = digest.FromString("foo")
+	)
+
+	tests := []struct {
+		Desc        string
+		Info        content.Info
+		LastUsed    map[digest.Digest]time.Time
+		Expectation time.Time
+	}{
+		{Desc: "created", Info: content.Info{Digest: dgst, CreatedAt: t0}, Expectation: t0},
+		{Desc: "updated", Info: content.Info{Digest: dgst, CreatedAt: t0, UpdatedAt: t0.Add(time.Minute)}, Expectation: t0.Add(time.Minute)},
+		{Desc: "touched", Info: content.Info{Digest: dgst, CreatedAt: t0}, LastUsed: map[digest.Digest]time.Time{dgst: t0.Add(time.Hour)}, Expectation: t0.Add(time.Hour)},
+		{Desc: "touched before update", Info: content.Info{Digest: dgst, UpdatedAt: t0.Add(time.Hour)}, LastUsed: map[digest.Digest]time.Time{dgst: t0}, Expectation: t0.Add(time.Hour)},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			gc := &storeGC{lastUsed: test.LastUsed}
+			if act := gc.lastUse(test.Info); !act.Equal(test.Expectation) {
+				t.Errorf("unexpected last use: expected %v, got %v", test.Expectation, act)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// serveHealthz reports the registry as alive as soon as the server is up
+func (reg *Registry) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// serveReadyz reports the registry as ready if it can serve images, i.e. the store is open and
+// writable and at least one spec provider is reachable
+func (reg *Registry) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	err := reg.ready(ctx)
+	if err != nil {
+		log.WithError(err).Debug("registry facade is not ready")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// ready returns an error describing why the registry cannot serve images yet
+func (reg *Registry) ready(ctx context.Context) error {
+	if reg.Store == nil {
+		return xerrors.Errorf("store is not open")
+	}
+	if reg.storePath != "" {
+		f, err := os.CreateTemp(reg.storePath, ".readyz-*")
+		if err != nil {
+			return xerrors.Errorf("store is not writable: %w", err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if reg.localSpecs != nil {
+		return nil
+	}
+	// the remote spec providers are checked concurrently so that an unreachable one does not use up the timeout
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	available := make(chan bool, len(reg.remoteSpecs))
+	for _, p := range reg.remoteSpecs {
+		go func(p *RemoteSpecProvider) {
+			available <- p.Available(ctx)
+		}(p)
+	}
+	for range reg.remoteSpecs {
+		if <-available {
+			return nil
+		}
+	}
+	return xerrors.Errorf("no spec provider is reachable")
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content/local"
+	"google.golang.org/grpc"
+)
+
+func TestServeHealthz(t *testing.T) {
+	reg := &Registry{}
+
+	rec := httptest.NewRecorder()
+	reg.serveHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected status code: expected %d, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestServeReadyz(t *testing.T) {
+	srv := grpc.NewServer()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	closed, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	reachable := NewRemoteSpecProvider(l.Addr().String(), []grpc.DialOption{grpc.WithInsecure()})
+	unreachable := NewRemoteSpecProvider(closed.Addr().String(), []grpc.DialOption{grpc.WithInsecure()})
+
+	tests := []struct {
+		Desc         string
+		NoStore      bool
+		MissingStore bool
+		LocalSpecs   bool
+		RemoteSpecs  []*RemoteSpecProvider
+		Expectation  int
+	}{
+		{Desc: "no store", NoStore: true, LocalSpecs: true, Expectation: http.StatusServiceUnavailable},
+		{Desc: "store not writable", MissingStore: true, LocalSpecs: true, Expectation: http.StatusServiceUnavailable},
+		{Desc: "no spec provider", Expectation: http.StatusServiceUnavailable},
+		{Desc: "local spec provider", LocalSpecs: true, Expectation: http.StatusOK},
+		{Desc: "remote spec provider reachable", RemoteSpecs: []*RemoteSpecProvider{reachable}, Expectation: http.StatusOK},
+		{Desc: "remote spec provider unreachable", RemoteSpecs: []*RemoteSpecProvider{unreachable}, Expectation: http.StatusServiceUnavailable},
+		{Desc: "one remote spec provider reachable", RemoteSpecs: []*RemoteSpecProvider{unreachable, reachable}, Expectation: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			storePath := t.TempDir()
+			reg := &Registry{
+				remoteSpecs: test.RemoteSpecs,
+				storePath:   storePath,
+			}
+			if !test.NoStore {
+				reg.Store, err = local.NewStore(storePath)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.MissingStore {
+				reg.storePath = filepath.Join(storePath, "does-not-exist")
+			}
+			if test.LocalSpecs {
+				reg.localSpecs, err = NewFileSpecProvider(t.TempDir())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			rec := httptest.NewRecorder()
+			reg.serveReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil).WithContext(ctx))
+			if rec.Code != test.Expectation {
+				t.Errorf("unexpected status code: expected %d, got %d: %s", test.Expectation, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
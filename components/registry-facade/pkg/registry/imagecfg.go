@@ -8,22 +8,31 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/gitpod-io/gitpod/common-go/log"
 	"github.com/gitpod-io/gitpod/registry-facade/api"
 	lru "github.com/hashicorp/golang-lru"
 	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/xerrors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
 )
 
 // ErrRefInvalid is returned by spec provider who cannot interpret the ref
 var ErrRefInvalid = fmt.Errorf("invalid ref")
 
+// ErrSpecProviderUnavailable is returned by spec providers which cannot reach their backend
+var ErrSpecProviderUnavailable = fmt.Errorf("spec provider unavailable")
+
 // ImageSpecProvider provide the image spec for an image pull
 // based on the ref
 type ImageSpecProvider interface {
-	// GetSpec returns the spec for the image or a wrapped ErrRefInvalid
+	// GetSpec returns the spec for the image or a wrapped ErrRefInvalid.
+	// If the spec provider cannot be reached it may return a wrapped ErrSpecProviderUnavailable instead.
 	GetSpec(ctx context.Context, ref string) (*api.ImageSpec, error)
 }
 
@@ -43,20 +52,101 @@ func NewRemoteSpecProvider(addr string, opts []grpc.DialOption) *RemoteSpecProvi
 	}
 }
 
-// GetSpec returns the spec for the image or a wrapped ErrRefInvalid
+// GetSpec returns the spec for the image, a wrapped ErrRefInvalid or a wrapped ErrSpecProviderUnavailable
+// if the remote spec provider cannot be reached
 func (p *RemoteSpecProvider) GetSpec(ctx context.Context, ref string) (*api.ImageSpec, error) {
 	client, err := p.getClient(ctx)
 	if err != nil {
-		return nil, xerrors.Errorf("%w: %s", ErrRefInvalid, err.Error())
+		return nil, xerrors.Errorf("%w: %s", ErrSpecProviderUnavailable, err.Error())
 	}
 
 	resp, err := client.GetImageSpec(ctx, &api.GetImageSpecRequest{Id: ref})
 	if err != nil {
-		return nil, xerrors.Errorf("%w: %s", ErrRefInvalid, err.Error())
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return nil, xerrors.Errorf("%w: %s", ErrSpecProviderUnavailable, err.Error())
+		default:
+			return nil, xerrors.Errorf("%w: %s", ErrRefInvalid, err.Error())
+		}
 	}
 	return resp.Spec, nil
 }
 
+// Available returns true if the remote spec provider can be reached before ctx is done
+func (p *RemoteSpecProvider) Available(ctx context.Context) bool {
+	_, err := p.getClient(ctx)
+	if err != nil {
+		return false
+	}
+	p.mu.RLock()
+	conn := p.conn
+	p.mu.RUnlock()
+
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			return true
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return false
+		}
+	}
+}
+
+// NewFailoverSpecProvider produces a spec provider which asks the remote spec providers in order.
+// The number of requests to each provider is registered with reg.
+func NewFailoverSpecProvider(providers []*RemoteSpecProvider, reg prometheus.Registerer) (*FailoverSpecProvider, error) {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "remote_spec_provider_requests_total",
+		Help: "number of image spec requests made to remote spec providers",
+	}, []string{"addr", "result"})
+	err := reg.Register(requests)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &FailoverSpecProvider{requests: requests}
+	for _, p := range providers {
+		res.providers = append(res.providers, addressedSpecProvider{Addr: p.addr, ImageSpecProvider: p})
+	}
+	return res, nil
+}
+
+// FailoverSpecProvider asks a list of spec providers in order and fails over to the next one
+// if a provider is unavailable
+type FailoverSpecProvider struct {
+	providers []addressedSpecProvider
+	requests  *prometheus.CounterVec
+}
+
+type addressedSpecProvider struct {
+	Addr string
+	ImageSpecProvider
+}
+
+// GetSpec returns the spec for the image or a wrapped ErrRefInvalid. If all providers are unavailable
+// it returns the error of the last one.
+func (p *FailoverSpecProvider) GetSpec(ctx context.Context, ref string) (spec *api.ImageSpec, err error) {
+	for i, prov := range p.providers {
+		spec, err = prov.GetSpec(ctx, ref)
+		if err != nil {
+			p.requests.WithLabelValues(prov.Addr, "failure").Inc()
+		} else {
+			p.requests.WithLabelValues(prov.Addr, "success").Inc()
+		}
+		if !xerrors.Is(err, ErrSpecProviderUnavailable) {
+			return spec, err
+		}
+		if i < len(p.providers)-1 {
+			log.WithError(err).WithField("addr", prov.Addr).Warn("spec provider unavailable - failing over")
+		}
+	}
+	if err == nil {
+		err = xerrors.Errorf("%w: no spec provider configured", ErrSpecProviderUnavailable)
+	}
+	return nil, err
+}
+
 func (p *RemoteSpecProvider) getClient(ctx context.Context) (client api.SpecProviderClient, err error) {
 	isValidConn := func() bool {
 		return p.conn != nil && p.conn.GetState() != connectivity.TransientFailure
@@ -82,35 +172,81 @@ func (p *RemoteSpecProvider) getClient(ctx context.Context) (client api.SpecProv
 	return api.NewSpecProviderClient(p.conn), nil
 }
 
+const defaultSpecCacheSize = 128
+
 // NewCachingSpecProvider creates a new LRU caching spec provider with a max number of specs it can cache.
-func NewCachingSpecProvider(space int, delegate ImageSpecProvider) (*CachingSpecProvider, error) {
+// The cache metrics are registered with reg.
+func NewCachingSpecProvider(space int, delegate ImageSpecProvider, reg prometheus.Registerer) (*CachingSpecProvider, error) {
 	cache, err := lru.New(space)
 	if err != nil {
 		return nil, err
 	}
+	metrics, err := newSpecCacheMetrics(reg)
+	if err != nil {
+		return nil, err
+	}
 	return &CachingSpecProvider{
 		Cache:    cache,
 		Delegate: delegate,
+		metrics:  metrics,
 	}, nil
 }
 
-// CachingSpecProvider caches an image spec in an LRU cache
+// CachingSpecProvider caches an image spec in an LRU cache.
+//
+// The size of the LRU cache bounds the number of specs we keep in memory, whereas TTL bounds how
+// long we serve a spec without asking the delegate again. Under LRU pressure entries can leave the cache
+// before their TTL is up, in which case they are fetched again on the next request. Without a TTL
+// entries are only ever replaced once they were evicted.
 type CachingSpecProvider struct {
 	Cache    *lru.Cache
 	Delegate ImageSpecProvider
+
+	// TTL is the time after which a cached spec is stale and fetched again. Specs never go stale if this is zero.
+	TTL time.Duration
+	// ServeStale makes the provider serve a stale spec if fetching it again fails. This only helps for as long
+	// as the stale spec has not been evicted from the cache.
+	ServeStale bool
+
+	metrics *specCacheMetrics
+	now     func() time.Time
+}
+
+type cachedSpec struct {
+	Spec    *api.ImageSpec
+	Fetched time.Time
 }
 
 // GetSpec returns the spec for the image or a wrapped ErrRefInvalid
 func (p *CachingSpecProvider) GetSpec(ctx context.Context, ref string) (*api.ImageSpec, error) {
-	res, ok := p.Cache.Get(ref)
-	if ok {
-		return res.(*api.ImageSpec), nil
+	now := time.Now
+	if p.now != nil {
+		now = p.now
 	}
+
+	var stale *cachedSpec
+	if res, ok := p.Cache.Get(ref); ok {
+		entry := res.(*cachedSpec)
+		if p.TTL == 0 || now().Sub(entry.Fetched) < p.TTL {
+			p.metrics.Hits.Inc()
+			return entry.Spec, nil
+		}
+		stale = entry
+	}
+	p.metrics.Misses.Inc()
+
 	spec, err := p.Delegate.GetSpec(ctx, ref)
 	if err != nil {
+		if stale != nil && p.ServeStale {
+			log.WithError(err).WithField("ref", ref).Warn("cannot refresh image spec - serving stale spec")
+			return stale.Spec, nil
+		}
 		return nil, err
 	}
-	p.Cache.Add(ref, spec)
+	if evicted := p.Cache.Add(ref, &cachedSpec{Spec: spec, Fetched: now()}); evicted {
+		p.metrics.Evictions.Inc()
+	}
+	p.metrics.Entries.Set(float64(p.Cache.Len()))
 	return spec, nil
 }
 
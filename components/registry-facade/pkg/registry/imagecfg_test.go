@@ -0,0 +1,387 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
+
+	"github.com/gitpod-io/gitpod/registry-facade/api"
+)
+
+func TestCachingSpecProviderMetrics(t *testing.T) {
+	type Expectation struct {
+		Hits      float64
+		Misses    float64
+		Evictions float64
+		Entries   float64
+	}
+	tests := []struct {
+		Desc        string
+		Refs        []string
+		Expectation Expectation
+	}{
+		{Desc: "no requests"},
+		{Desc: "miss", Refs: []string{"a"}, Expectation: Expectation{Misses: 1, Entries: 1}},
+		{Desc: "hit", Refs: []string{"a", "a", "a"}, Expectation: Expectation{Hits: 2, Misses: 1, Entries: 1}},
+		{Desc: "unknown ref", Refs: []string{"unknown", "unknown"}, Expectation: Expectation{Misses: 2}},
+		{Desc: "eviction", Refs: []string{"a", "b", "c", "a"}, Expectation: Expectation{Misses: 4, Evictions: 2, Entries: 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			delegate := fakeSpecProvider{
+				"a": &api.ImageSpec{BaseRef: "a"},
+				"b": &api.ImageSpec{BaseRef: "b"},
+				"c": &api.ImageSpec{BaseRef: "c"},
+			}
+			p, err := NewCachingSpecProvider(2, delegate, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, ref := range test.Refs {
+				_, _ = p.GetSpec(context.Background(), ref)
+			}
+
+			act := Expectation{
+				Hits:      testutil.ToFloat64(p.metrics.Hits),
+				Misses:    testutil.ToFloat64(p.metrics.Misses),
+				Evictions: testutil.ToFloat64(p.metrics.Evictions),
+				Entries:   testutil.ToFloat64(p.metrics.Entries),
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected metrics (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCachingSpecProviderTTL(t *testing.T) {
+	type Step struct {
+		// After is the time since the first request
+		After time.Duration
+		Ref   string
+		// Upstream is the base ref the delegate returns. The delegate fails if this is empty.
+		Upstream string
+	}
+	type Result struct {
+		BaseRef string
+		Error   bool
+	}
+	tests := []struct {
+		Desc        string
+		TTL         time.Duration
+		ServeStale  bool
+		Steps       []Step
+		Expectation []Result
+	}{
+		{
+			Desc: "no TTL",
+			Steps: []Step{
+				{Ref: "a", Upstream: "v1"},
+				{After: 24 * time.Hour, Ref: "a", Upstream: "v2"},
+			},
+			Expectation: []Result{{BaseRef: "v1"}, {BaseRef: "v1"}},
+		},
+		{
+			Desc: "within TTL",
+			TTL:  time.Minute,
+			Steps: []Step{
+				{Ref: "a", Upstream: "v1"},
+				{After: 30 * time.Second, Ref: "a", Upstream: "v2"},
+			},
+			Expectation: []Result{{BaseRef: "v1"}, {BaseRef: "v1"}},
+		},
+		{
+			Desc: "expired",
+			TTL:  time.Minute,
+			Steps: []Step{
+				{Ref: "a", Upstream: "v1"},
+				{After: 2 * time.Minute, Ref: "a", Upstream: "v2"},
+				{After: 150 * time.Second, Ref: "a", Upstream: "v3"},
+			},
+			Expectation: []Result{{BaseRef: "v1"}, {BaseRef: "v2"}, {BaseRef: "v2"}},
+		},
+		{
+			Desc: "expired refetch fails",
+			TTL:  time.Minute,
+			Steps: []Step{
+				{Ref: "a", Upstream: "v1"},
+				{After: 2 * time.Minute, Ref: "a"},
+			},
+			Expectation: []Result{{BaseRef: "v1"}, {Error: true}},
+		},
+		{
+			Desc:       "expired refetch fails serving stale",
+			TTL:        time.Minute,
+			ServeStale: true,
+			Steps: []Step{
+				{Ref: "a", Upstream: "v1"},
+				{After: 2 * time.Minute, Ref: "a"},
+				{After: 3 * time.Minute, Ref: "a", Upstream: "v2"},
+			},
+			Expectation: []Result{{BaseRef: "v1"}, {BaseRef: "v1"}, {BaseRef: "v2"}},
+		},
+		{
+			Desc:       "evicted before TTL",
+			TTL:        time.Hour,
+			ServeStale: true,
+			Steps: []Step{
+				{Ref: "a", Upstream: "v1"},
+				{Ref: "b", Upstream: "v1"},
+				{Ref: "c", Upstream: "v1"},
+				{After: time.Minute, Ref: "a", Upstream: "v2"},
+				{After: time.Minute, Ref: "c"},
+			},
+			Expectation: []Result{{BaseRef: "v1"}, {BaseRef: "v1"}, {BaseRef: "v1"}, {BaseRef: "v2"}, {BaseRef: "v1"}},
+		},
+		{
+			Desc:       "evicted stale entries cannot be served",
+			TTL:        time.Minute,
+			ServeStale: true,
+			Steps: []Step{
+				{Ref: "a", Upstream: "v1"},
+				{Ref: "b", Upstream: "v1"},
+				{Ref: "c", Upstream: "v1"},
+				{After: 2 * time.Minute, Ref: "a"},
+			},
+			Expectation: []Result{{BaseRef: "v1"}, {BaseRef: "v1"}, {BaseRef: "v1"}, {Error: true}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var (
+				t0       = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+				now      = t0
+				delegate = make(fakeSpecProvider)
+			)
+			p, err := NewCachingSpecProvider(2, delegate, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.TTL = test.TTL
+			p.ServeStale = test.ServeStale
+			p.now = func() time.Time { return now }
+
+			var act []Result
+			for _, step := range test.Steps {
+				now = t0.Add(step.After)
+				if step.Upstream == "" {
+					delete(delegate, step.Ref)
+				} else {
+					delegate[step.Ref] = &api.ImageSpec{BaseRef: step.Upstream}
+				}
+
+				spec, err := p.GetSpec(context.Background(), step.Ref)
+				if err != nil {
+					act = append(act, Result{Error: true})
+					continue
+				}
+				act = append(act, Result{BaseRef: spec.BaseRef})
+			}
+
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected specs (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+type unavailableSpecProvider struct{}
+
+func (unavailableSpecProvider) GetSpec(ctx context.Context, ref string) (*api.ImageSpec, error) {
+	return nil, xerrors.Errorf("%w: connection refused", ErrSpecProviderUnavailable)
+}
+
+func TestFailoverSpecProvider(t *testing.T) {
+	var (
+		specs       = fakeSpecProvider{"a": &api.ImageSpec{BaseRef: "a"}}
+		unreachable = NewRemoteSpecProvider("127.0.0.1:1", []grpc.DialOption{grpc.WithInsecure()})
+	)
+
+	type Request struct {
+		Addr   string
+		Result string
+	}
+	type Expectation struct {
+		BaseRef     string
+		Unavailable bool
+		Invalid     bool
+		Requests    []Request
+	}
+	tests := []struct {
+		Desc        string
+		Providers   []addressedSpecProvider
+		Ref         string
+		Expectation Expectation
+	}{
+		{
+			Desc:      "first available",
+			Providers: []addressedSpecProvider{{"first", specs}, {"second", unavailableSpecProvider{}}},
+			Ref:       "a",
+			Expectation: Expectation{
+				BaseRef:  "a",
+				Requests: []Request{{"first", "success"}},
+			},
+		},
+		{
+			Desc:      "failover",
+			Providers: []addressedSpecProvider{{"first", unavailableSpecProvider{}}, {"second", specs}},
+			Ref:       "a",
+			Expectation: Expectation{
+				BaseRef:  "a",
+				Requests: []Request{{"first", "failure"}, {"second", "success"}},
+			},
+		},
+		{
+			Desc:      "failover from unreachable remote",
+			Providers: []addressedSpecProvider{{"first", unreachable}, {"second", specs}},
+			Ref:       "a",
+			Expectation: Expectation{
+				BaseRef:  "a",
+				Requests: []Request{{"first", "failure"}, {"second", "success"}},
+			},
+		},
+		{
+			Desc:      "invalid ref does not fail over",
+			Providers: []addressedSpecProvider{{"first", specs}, {"second", specs}},
+			Ref:       "unknown",
+			Expectation: Expectation{
+				Invalid:  true,
+				Requests: []Request{{"first", "failure"}},
+			},
+		},
+		{
+			Desc:      "all unavailable",
+			Providers: []addressedSpecProvider{{"first", unavailableSpecProvider{}}, {"second", unavailableSpecProvider{}}},
+			Ref:       "a",
+			Expectation: Expectation{
+				Unavailable: true,
+				Requests:    []Request{{"first", "failure"}, {"second", "failure"}},
+			},
+		},
+		{
+			Desc:        "no providers",
+			Ref:         "a",
+			Expectation: Expectation{Unavailable: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			p, err := NewFailoverSpecProvider(nil, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.providers = test.Providers
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			spec, err := p.GetSpec(ctx, test.Ref)
+
+			var act Expectation
+			if spec != nil {
+				act.BaseRef = spec.BaseRef
+			}
+			act.Unavailable = xerrors.Is(err, ErrSpecProviderUnavailable)
+			act.Invalid = xerrors.Is(err, ErrRefInvalid)
+			for _, prov := range test.Providers {
+				for _, result := range []string{"success", "failure"} {
+					if testutil.ToFloat64(p.requests.WithLabelValues(prov.Addr, result)) > 0 {
+						act.Requests = append(act.Requests, Request{prov.Addr, result})
+					}
+				}
+			}
+
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCachingFailoverSpecProvider(t *testing.T) {
+	specs := fakeSpecProvider{"a": &api.ImageSpec{BaseRef: "a"}}
+	failover, err := NewFailoverSpecProvider(nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failover.providers = []addressedSpecProvider{{"first", specs}}
+	p, err := NewCachingSpecProvider(2, failover, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.GetSpec(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cached specs are served even if none of the spec providers is available
+	failover.providers = []addressedSpecProvider{{"first", unavailableSpecProvider{}}}
+	spec, err := p.GetSpec(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.BaseRef != "a" {
+		t.Errorf("unexpected base ref: expected a, got %s", spec.BaseRef)
+	}
+}
+
+func TestRemoteSpecProviderConfigsUnmarshal(t *testing.T) {
+	tls := func(ca string) *RemoteSpecProviderTLS {
+		return &RemoteSpecProviderTLS{Authority: ca, Certificate: "tls.crt", PrivateKey: "tls.key"}
+	}
+
+	tests := []struct {
+		Desc        string
+		Config      string
+		Expectation RemoteSpecProviderConfigs
+		Error       bool
+	}{
+		{
+			Desc:        "single object",
+			Config:      `{"remoteSpecProvider": {"addr": "a:8080", "tls": {"ca": "a.crt", "crt": "tls.crt", "key": "tls.key"}}}`,
+			Expectation: RemoteSpecProviderConfigs{{Addr: "a:8080", TLS: tls("a.crt")}},
+		},
+		{
+			Desc:   "list",
+			Config: `{"remoteSpecProvider": [{"addr": "a:8080", "tls": {"ca": "a.crt", "crt": "tls.crt", "key": "tls.key"}}, {"addr": "b:8080"}, {"addr": "c:8080", "tls": {"ca": "c.crt", "crt": "tls.crt", "key": "tls.key"}}]}`,
+			Expectation: RemoteSpecProviderConfigs{
+				{Addr: "a:8080", TLS: tls("a.crt")},
+				{Addr: "b:8080"},
+				{Addr: "c:8080", TLS: tls("c.crt")},
+			},
+		},
+		{Desc: "null", Config: `{"remoteSpecProvider": null}`},
+		{Desc: "absent", Config: `{}`},
+		{Desc: "invalid", Config: `{"remoteSpecProvider": "a:8080"}`, Error: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var cfg Config
+			err := json.Unmarshal([]byte(test.Config), &cfg)
+			if test.Error {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Expectation, cfg.RemoteSpecProvider); diff != "" {
+				t.Errorf("unexpected remote spec provider config (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes"
@@ -20,6 +21,7 @@ import (
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/opencontainers/go-digest"
 	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/xerrors"
 )
 
@@ -361,6 +363,62 @@ func (cs CompositeLayerSource) GetBlob(ctx context.Context, spec *api.ImageSpec,
 	return
 }
 
+// Layer source types used to label the layer source metrics
+const (
+	layerSourceIDE         = "ide"
+	layerSourceStaticFile  = "static-file"
+	layerSourceStaticImage = "static-image"
+	layerSourceStaticURL   = "static-url"
+	layerSourceContent     = "content"
+)
+
+// newMeasuringLayerSource produces a layer source which records the latency and errors of the source
+// it delegates to, labeled with the source type
+func newMeasuringLayerSource(source string, delegate LayerSource, metrics *layerSourceMetrics) LayerSource {
+	return &measuringLayerSource{
+		LayerSource: delegate,
+		source:      source,
+		metrics:     metrics,
+	}
+}
+
+type measuringLayerSource struct {
+	LayerSource
+	source  string
+	metrics *layerSourceMetrics
+}
+
+func (s *measuringLayerSource) observe(hist *prometheus.HistogramVec, operation string, t0 time.Time, err error) {
+	hist.WithLabelValues(s.source).Observe(time.Since(t0).Seconds())
+	if err != nil {
+		s.metrics.Errors.WithLabelValues(s.source, operation).Inc()
+	}
+}
+
+// Envs returns the list of env modifiers
+func (s *measuringLayerSource) Envs(ctx context.Context, spec *api.ImageSpec) (res []EnvModifier, err error) {
+	defer func(t0 time.Time) {
+		s.observe(s.metrics.ResolveHist, "envs", t0, err)
+	}(time.Now())
+	return s.LayerSource.Envs(ctx, spec)
+}
+
+// GetLayer returns the list of all layers from this source
+func (s *measuringLayerSource) GetLayer(ctx context.Context, spec *api.ImageSpec) (res []AddonLayer, err error) {
+	defer func(t0 time.Time) {
+		s.observe(s.metrics.ResolveHist, "layer", t0, err)
+	}(time.Now())
+	return s.LayerSource.GetLayer(ctx, spec)
+}
+
+// GetBlob provides access to a blob. The latency covers the time until the blob can be read, not the time it takes to read it.
+func (s *measuringLayerSource) GetBlob(ctx context.Context, spec *api.ImageSpec, dgst digest.Digest) (mediaType string, url string, data io.ReadCloser, err error) {
+	defer func(t0 time.Time) {
+		s.observe(s.metrics.ServeHist, "blob", t0, err)
+	}(time.Now())
+	return s.LayerSource.GetBlob(ctx, spec, dgst)
+}
+
 // RefSource extracts an image reference from an image spec
 type RefSource func(*api.ImageSpec) (ref string, err error)
 
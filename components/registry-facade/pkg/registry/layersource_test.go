@@ -12,14 +12,19 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	ctesting "github.com/gitpod-io/gitpod/common-go/testing"
+	"github.com/gitpod-io/gitpod/registry-facade/api"
 
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type testStaticLayerSourceFixture struct {
@@ -161,3 +166,67 @@ func (f *fakeFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.Re
 	}
 	return io.NopCloser(bytes.NewReader(c)), nil
 }
+
+func TestMeasuringLayerSource(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "layer.tar.gz")
+	err := os.WriteFile(fn, []byte("layer"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromString("layer")
+	src := FileLayerSource{{AddonLayer: AddonLayer{Descriptor: ocispec.Descriptor{Digest: dgst}}, Filename: fn}}
+
+	tests := []struct {
+		Desc          string
+		Digest        digest.Digest
+		ExpectedError bool
+	}{
+		{Desc: "found", Digest: dgst},
+		{Desc: "not found", Digest: digest.FromString("other"), ExpectedError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			metrics, err := newLayerSourceMetrics(reg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msrc := newMeasuringLayerSource(layerSourceStaticFile, src, metrics)
+			_, _, rc, err := msrc.GetBlob(context.Background(), &api.ImageSpec{}, test.Digest)
+			if rc != nil {
+				rc.Close()
+			}
+			if (err != nil) != test.ExpectedError {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var observations uint64
+			for _, mf := range mfs {
+				if mf.GetName() != "layer_source_serve_seconds" {
+					continue
+				}
+				for _, m := range mf.GetMetric() {
+					if len(m.GetLabel()) == 1 && m.GetLabel()[0].GetValue() == layerSourceStaticFile {
+						observations += m.GetHistogram().GetSampleCount()
+					}
+				}
+			}
+			if observations != 1 {
+				t.Errorf("unexpected number of serve latency observations: expected 1, got %d", observations)
+			}
+
+			var expectedErrors float64
+			if test.ExpectedError {
+				expectedErrors = 1
+			}
+			if errs := testutil.ToFloat64(metrics.Errors.WithLabelValues(layerSourceStaticFile, "blob")); errs != expectedErrors {
+				t.Errorf("unexpected number of errors: expected %v, got %v", expectedErrors, errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/docker/distribution/registry/api/errcode"
+)
+
+const (
+	defaultMaxHeaderBytes   = 64 << 10
+	defaultMaxURLLength     = 8 << 10
+	defaultMaxManifestBytes = 4 << 20
+)
+
+// RequestLimits limits the size of the requests the registry facade accepts. Without them, clients could
+// make the facade buffer arbitrarily large requests. The defaults are generous for any registry client.
+type RequestLimits struct {
+	// MaxHeaderBytes is the maximum size of the request headers. Larger requests fail with 431. Defaults to 64 KiB.
+	MaxHeaderBytes int `json:"maxHeaderBytes,omitempty"`
+	// MaxURLLength is the maximum length of the request URL. Longer URLs fail with 414. Defaults to 8 KiB.
+	MaxURLLength int `json:"maxURLLength,omitempty"`
+	// MaxManifestBytes is the maximum size of request bodies, i.e. of manifests pushed once we support that.
+	// Larger requests fail with 413. Defaults to 4 MiB.
+	MaxManifestBytes int64 `json:"maxManifestBytes,omitempty"`
+}
+
+func intOrDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// apply sets the header limit of srv. The net/http server reads somewhat more than that before it
+// fails with 431, hence limit enforces the exact limit.
+func (l RequestLimits) apply(srv *http.Server) {
+	srv.MaxHeaderBytes = intOrDefault(l.MaxHeaderBytes, defaultMaxHeaderBytes)
+}
+
+// limit rejects requests which exceed the limits before they're dispatched to h
+func (l RequestLimits) limit(h http.Handler) http.Handler {
+	var (
+		maxHeaderBytes   = intOrDefault(l.MaxHeaderBytes, defaultMaxHeaderBytes)
+		maxURLLength     = intOrDefault(l.MaxURLLength, defaultMaxURLLength)
+		maxManifestBytes = l.MaxManifestBytes
+	)
+	if maxManifestBytes == 0 {
+		maxManifestBytes = defaultMaxManifestBytes
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > maxURLLength || len(r.URL.String()) > maxURLLength {
+			serveLimitExceeded(w, http.StatusRequestURITooLong, "request URL too long")
+			return
+		}
+		if headerBytes(r.Header) > maxHeaderBytes {
+			serveLimitExceeded(w, http.StatusRequestHeaderFieldsTooLarge, "request header fields too large")
+			return
+		}
+		if r.ContentLength > maxManifestBytes {
+			serveLimitExceeded(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			// the content length might be unknown or wrong
+			r.Body = http.MaxBytesReader(w, r.Body, maxManifestBytes)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// headerBytes returns the size of the header fields as sent over the wire
+func headerBytes(hdr http.Header) int {
+	var n int
+	for k, vs := range hdr {
+		for _, v := range vs {
+			// "<key>: <value>\r\n"
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
+
+func serveLimitExceeded(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(errcode.Errors{errcode.ErrorCodeDenied.WithMessage(msg)})
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRequestLimitsApply(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Config      string
+		Expectation int
+	}{
+		{Desc: "default", Config: `{}`, Expectation: defaultMaxHeaderBytes},
+		{Desc: "configured", Config: `{"limits": {"maxHeaderBytes": 1024}}`, Expectation: 1024},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var cfg Config
+			err := json.Unmarshal([]byte(test.Config), &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var srv http.Server
+			cfg.Limits.apply(&srv)
+			if srv.MaxHeaderBytes != test.Expectation {
+				t.Errorf("unexpected max header bytes: want %d, got %d", test.Expectation, srv.MaxHeaderBytes)
+			}
+		})
+	}
+}
+
+func TestRequestLimitsLimit(t *testing.T) {
+	limits := RequestLimits{
+		MaxHeaderBytes:   256,
+		MaxURLLength:     64,
+		MaxManifestBytes: 128,
+	}
+
+	type expectation struct {
+		Status int
+		Body   string
+	}
+	tests := []struct {
+		Desc        string
+		Method      string
+		Path        string
+		Header      http.Header
+		Body        io.Reader
+		Chunked     bool
+		Expectation expectation
+	}{
+		{
+			Desc:        "within limits",
+			Method:      http.MethodPut,
+			Path:        "/v2/foo/manifests/latest",
+			Header:      http.Header{"Accept": []string{"application/json"}},
+			Body:        strings.NewReader(strings.Repeat("a", 128)),
+			Expectation: expectation{Status: http.StatusOK, Body: strings.Repeat("a", 128)},
+		},
+		{
+			Desc:        "URL too long",
+			Method:      http.MethodGet,
+			Path:        "/v2/" + strings.Repeat("a", 64) + "/manifests/latest",
+			Expectation: expectation{Status: http.StatusRequestURITooLong},
+		},
+		{
+			Desc:        "headers too large",
+			Method:      http.MethodGet,
+			Path:        "/v2/foo/manifests/latest",
+			Header:      http.Header{"Authorization": []string{"Bearer " + strings.Repeat("a", 256)}},
+			Expectation: expectation{Status: http.StatusRequestHeaderFieldsTooLarge},
+		},
+		{
+			Desc:        "body too large",
+			Method:      http.MethodPut,
+			Path:        "/v2/foo/manifests/latest",
+			Body:        strings.NewReader(strings.Repeat("a", 129)),
+			Expectation: expectation{Status: http.StatusRequestEntityTooLarge},
+		},
+		{
+			Desc:        "chunked body too large",
+			Method:      http.MethodPut,
+			Path:        "/v2/foo/manifests/latest",
+			Body:        strings.NewReader(strings.Repeat("a", 129)),
+			Chunked:     true,
+			Expectation: expectation{Status: http.StatusBadRequest, Body: "http: request body too large"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var handlerCalled bool
+			handler := limits.limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handlerCalled = true
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				_, _ = w.Write(body)
+			}))
+
+			req := httptest.NewRequest(test.Method, test.Path, test.Body)
+			for k, v := range test.Header {
+				req.Header[k] = v
+			}
+			if test.Chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			act := expectation{Status: rec.Code, Body: strings.TrimSpace(rec.Body.String())}
+			if act.Status == http.StatusOK || handlerCalled {
+				if diff := cmp.Diff(test.Expectation, act); diff != "" {
+					t.Errorf("unexpected response (-want +got):\n%s", diff)
+				}
+				return
+			}
+
+			if act.Status != test.Expectation.Status {
+				t.Errorf("unexpected status: want %d, got %d", test.Expectation.Status, act.Status)
+			}
+			var errs errcode.Errors
+			err := json.Unmarshal(rec.Body.Bytes(), &errs)
+			if err != nil {
+				t.Fatalf("response is not an error: %v", err)
+			}
+			if len(errs) != 1 {
+				t.Errorf("expected exactly one error, got %v", errs)
+			}
+		})
+	}
+}
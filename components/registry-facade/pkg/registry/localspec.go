@@ -0,0 +1,146 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/xerrors"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/registry-facade/api"
+)
+
+const specFileExt = ".json"
+
+// FileSpecProvider provides image specs from files in a directory, which makes it possible to run
+// registry-facade without ws-manager. The spec for a name is read from <dir>/<name>.json which contains
+// the JSON representation of an api.ImageSpec, e.g. {"baseRef": "alpine:latest", "ideRef": "..."}.
+type FileSpecProvider struct {
+	Dir string
+
+	mu    sync.RWMutex
+	specs map[string]*api.ImageSpec
+}
+
+// NewFileSpecProvider produces a new file spec provider reading the specs in dir
+func NewFileSpecProvider(dir string) (*FileSpecProvider, error) {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot use spec directory: %w", err)
+	}
+	if !stat.IsDir() {
+		return nil, xerrors.Errorf("spec directory %s is not a directory", dir)
+	}
+
+	p := &FileSpecProvider{Dir: dir}
+	p.reload()
+	return p, nil
+}
+
+// GetSpec returns the spec for the image or a wrapped ErrRefInvalid
+func (p *FileSpecProvider) GetSpec(ctx context.Context, ref string) (*api.ImageSpec, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	spec, ok := p.specs[ref]
+	if !ok {
+		return nil, xerrors.Errorf("%w: no spec file for %s", ErrRefInvalid, ref)
+	}
+	return spec, nil
+}
+
+// Watch reloads the specs whenever a spec file changes until the context is canceled
+func (p *FileSpecProvider) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	err = watcher.Add(p.Dir)
+	if err != nil {
+		return err
+	}
+
+	// spec files might have changed before we started watching
+	p.reload()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Ext(ev.Name) != specFileExt {
+				continue
+			}
+			p.reload()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.WithError(err).Warn("error while watching spec files")
+		}
+	}
+}
+
+// reload reads all spec files. If a spec file cannot be read we keep serving the spec we read last from that file,
+// so that a half-written file does not fail pulls.
+func (p *FileSpecProvider) reload() {
+	files, err := os.ReadDir(p.Dir)
+	if err != nil {
+		log.WithError(err).WithField("dir", p.Dir).Warn("cannot list spec files")
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	specs := make(map[string]*api.ImageSpec, len(files))
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != specFileExt {
+			continue
+		}
+
+		name := strings.TrimSuffix(f.Name(), specFileExt)
+		fn := filepath.Join(p.Dir, f.Name())
+		spec, err := readSpecFile(fn)
+		if err != nil {
+			log.WithError(err).WithField("file", fn).Warn("cannot read spec file")
+			if prev, ok := p.specs[name]; ok {
+				specs[name] = prev
+			}
+			continue
+		}
+		specs[name] = spec
+	}
+	p.specs = specs
+}
+
+func readSpecFile(fn string) (*api.ImageSpec, error) {
+	fc, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec api.ImageSpec
+	err = protojson.Unmarshal(fc, &spec)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal spec: %w", err)
+	}
+	if spec.BaseRef == "" {
+		return nil, xerrors.Errorf("spec has no baseRef")
+	}
+	return &spec, nil
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/xerrors"
+)
+
+func TestFileSpecProvider(t *testing.T) {
+	type Expectation struct {
+		BaseRef string
+		Invalid bool
+	}
+	tests := []struct {
+		Desc        string
+		Files       map[string]string
+		Ref         string
+		Expectation Expectation
+	}{
+		{
+			Desc:        "valid spec",
+			Files:       map[string]string{"foo.json": `{"baseRef": "alpine:latest", "ideRef": "ide:latest"}`},
+			Ref:         "foo",
+			Expectation: Expectation{BaseRef: "alpine:latest"},
+		},
+		{
+			Desc: "content layer",
+			Files: map[string]string{"foo.json": `{
+				"baseRef": "alpine:latest",
+				"contentLayer": [{"direct": {"content": "aGVsbG8="}}]
+			}`},
+			Ref:         "foo",
+			Expectation: Expectation{BaseRef: "alpine:latest"},
+		},
+		{
+			Desc:        "unknown ref",
+			Files:       map[string]string{"foo.json": `{"baseRef": "alpine:latest"}`},
+			Ref:         "bar",
+			Expectation: Expectation{Invalid: true},
+		},
+		{
+			Desc:        "malformed JSON",
+			Files:       map[string]string{"foo.json": `{"baseRef": "alpine:latest"`},
+			Ref:         "foo",
+			Expectation: Expectation{Invalid: true},
+		},
+		{
+			Desc:        "unknown field",
+			Files:       map[string]string{"foo.json": `{"baseRef": "alpine:latest", "foo": "bar"}`},
+			Ref:         "foo",
+			Expectation: Expectation{Invalid: true},
+		},
+		{
+			Desc:        "wrong field type",
+			Files:       map[string]string{"foo.json": `{"baseRef": 42}`},
+			Ref:         "foo",
+			Expectation: Expectation{Invalid: true},
+		},
+		{
+			Desc:        "missing base ref",
+			Files:       map[string]string{"foo.json": `{"ideRef": "ide:latest"}`},
+			Ref:         "foo",
+			Expectation: Expectation{Invalid: true},
+		},
+		{
+			Desc:        "malformed spec does not affect others",
+			Files:       map[string]string{"foo.json": `{"baseRef": "alpine:latest"}`, "bar.json": `not JSON`},
+			Ref:         "foo",
+			Expectation: Expectation{BaseRef: "alpine:latest"},
+		},
+		{
+			Desc:        "non-JSON file",
+			Files:       map[string]string{"foo.yaml": `baseRef: alpine:latest`},
+			Ref:         "foo",
+			Expectation: Expectation{Invalid: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			dir := t.TempDir()
+			for fn, c := range test.Files {
+				err := os.WriteFile(filepath.Join(dir, fn), []byte(c), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p, err := NewFileSpecProvider(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			spec, err := p.GetSpec(context.Background(), test.Ref)
+			if err != nil && !xerrors.Is(err, ErrRefInvalid) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var act Expectation
+			if err != nil {
+				act.Invalid = true
+			} else {
+				act.BaseRef = spec.BaseRef
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected spec (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFileSpecProviderKeepsLastValidSpec(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "foo.json")
+	err := os.WriteFile(fn, []byte(`{"baseRef": "alpine:latest"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewFileSpecProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(fn, []byte(`{"baseRef": "alp`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.reload()
+
+	spec, err := p.GetSpec(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.BaseRef != "alpine:latest" {
+		t.Errorf("unexpected base ref: expected alpine:latest, got %s", spec.BaseRef)
+	}
+}
+
+func TestFileSpecProviderWatch(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewFileSpecProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- p.Watch(ctx)
+	}()
+
+	waitForBaseRef := func(expected string) {
+		t.Helper()
+		var act string
+		for i := 0; i < 100; i++ {
+			spec, err := p.GetSpec(ctx, "foo")
+			if err == nil {
+				act = spec.BaseRef
+			} else {
+				act = ""
+			}
+			if act == expected {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("spec was not reloaded: expected base ref %q, got %q", expected, act)
+	}
+
+	fn := filepath.Join(dir, "foo.json")
+	for _, baseRef := range []string{"alpine:latest", "ubuntu:latest"} {
+		err = os.WriteFile(fn, []byte(`{"baseRef": "`+baseRef+`"}`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForBaseRef(baseRef)
+	}
+
+	err = os.Remove(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForBaseRef("")
+
+	cancel()
+	if err := <-watchErr; err != nil {
+		t.Errorf("watch failed: %v", err)
+	}
+}
@@ -12,12 +12,14 @@ import (
 	"io"
 	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/remotes"
 	distv2 "github.com/docker/distribution/registry/api/v2"
 	"github.com/gitpod-io/gitpod/common-go/log"
@@ -25,6 +27,7 @@ import (
 	"github.com/gitpod-io/gitpod/registry-facade/api"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
 	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
@@ -47,13 +50,21 @@ func (reg *Registry) handleManifest(ctx context.Context, r *http.Request) http.H
 		})
 	}
 
+	layers := reg.currentLayers()
 	manifestHandler := &manifestHandler{
 		Context:        ctx,
 		Name:           name,
+		Repository:     getName(ctx),
+		Tags:           reg.tags,
 		Spec:           spec,
 		Resolver:       reg.Resolver(),
 		Store:          reg.Store,
-		ConfigModifier: reg.ConfigModifier,
+		GC:             reg.gc,
+		Cache:          layers.Manifests,
+		ConfigModifier: layers.ConfigModifier,
+	}
+	if reg.transcoder != nil {
+		manifestHandler.LayerCompression = negotiateLayerCompression(r.Header["Accept"])
 	}
 	reference := getReference(ctx)
 	dgst, err := digest.Parse(reference)
@@ -85,46 +96,34 @@ type manifestHandler struct {
 	Spec           *api.ImageSpec
 	Resolver       remotes.Resolver
 	Store          content.Store
+	GC             *storeGC
+	Cache          *manifestCache
 	ConfigModifier ConfigModifier
-
-	Name   string
-	Tag    string
-	Digest digest.Digest
+	// LayerCompression is the compression the layers added by ConfigModifier should have
+	LayerCompression layerCompression
+
+	// Name is the name without the spec provider prefix, Repository the full name including it
+	Name       string
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+	// Tags records the tags of successfully served manifests
+	Tags *tagCache
 }
 
 func (mh *manifestHandler) getManifest(w http.ResponseWriter, r *http.Request) {
 	span, ctx := opentracing.StartSpanFromContext(r.Context(), "getManifest")
+	w.Header().Set(versionHeader, version())
 	err := func() error {
 		log.WithField("spec", mh.Spec).Debug("get manifest")
 		tracing.LogMessageSafe(span, "spec", mh.Spec)
 
-		var (
-			acceptType string
-			err        error
-		)
-		for _, acceptHeader := range r.Header["Accept"] {
-			for _, mediaType := range strings.Split(acceptHeader, ",") {
-				if mediaType, _, err = mime.ParseMediaType(strings.TrimSpace(mediaType)); err != nil {
-					continue
-				}
-
-				if mediaType == ociv1.MediaTypeImageManifest ||
-					mediaType == images.MediaTypeDockerSchema2Manifest ||
-					mediaType == "*" {
-
-					acceptType = ociv1.MediaTypeImageManifest
-					break
-				}
-			}
-			if acceptType != "" {
-				break
-			}
-		}
-		if acceptType == "" {
+		accepted := acceptedManifestMediaTypes(r.Header["Accept"])
+		acceptedIndex := acceptedIndexMediaTypes(r.Header["Accept"])
+		if len(accepted) == 0 && len(acceptedIndex) == 0 {
 			return distv2.ErrorCodeManifestUnknown.WithMessage("Accept header does not include OCIv1 or v2 manifests")
 		}
 
-		// Note: we ignore the mh.Digest for now because we always return a manifest, never a manifest index.
 		ref := mh.Spec.BaseRef
 
 		_, desc, err := mh.Resolver.Resolve(ctx, ref)
@@ -133,105 +132,423 @@ func (mh *manifestHandler) getManifest(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		fetcher, err := mh.Resolver.Fetcher(ctx, ref)
+		platform := requestPlatform(r)
+		key, err := mh.Cache.Key(mh.Spec, desc.Digest, accepted, acceptedIndex, platform, mh.Digest, mh.LayerCompression)
+		if err != nil {
+			log.WithError(err).WithField("spec", mh.Spec).Warn("cannot compute manifest cache key - not caching the manifest")
+		}
+
+		var (
+			mediaType string
+			p         []byte
+			dgst      digest.Digest
+		)
+		if cached, ok := mh.Cache.Get(key); ok {
+			mediaType, p, dgst = cached.MediaType, cached.Content, cached.Digest
+		} else {
+			mediaType, p, err = mh.assemble(ctx, desc, accepted, acceptedIndex, platform)
+			if err != nil {
+				return err
+			}
+			dgst = digest.FromBytes(p)
+			mh.Cache.Add(key, &cachedManifest{MediaType: mediaType, Content: p, Digest: dgst})
+		}
+		span.LogKV("manifest", string(p))
+
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(p)))
+		w.Header().Set("Etag", fmt.Sprintf(`"%s"`, dgst))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		if r.Method == http.MethodHead {
+			// HEAD requests get the same headers as GET requests - including the digest of the
+			// assembled manifest - so that clients can tell if they need to pull at all.
+			return nil
+		}
+		_, _ = w.Write(p)
+
+		log.WithField("name", mh.Name).WithField("tag", mh.Tag).Debug("get manifest")
+		return nil
+	}()
+
+	if err != nil {
+		log.WithError(err).WithField("spec", mh.Spec).Error("cannot get manifest")
+		respondWithError(w, err)
+	} else {
+		// only tags which actually resolved to a manifest show up in the tag list
+		mh.Tags.Add(mh.Repository, mh.Tag)
+	}
+	tracing.FinishSpan(span, &err)
+}
+
+// assemble produces the manifest or index served for the upstream manifest desc
+func (mh *manifestHandler) assemble(ctx context.Context, desc ociv1.Descriptor, accepted, acceptedIndex []string, platform ociv1.Platform) (mediaType string, p []byte, err error) {
+	ref := mh.Spec.BaseRef
+
+	fetcher, err := mh.Resolver.Fetcher(ctx, ref)
+	if err != nil {
+		log.WithError(err).WithField("ref", ref).WithField("instanceId", mh.Name).Error("cannot get fetcher")
+		return "", nil, distv2.ErrorCodeManifestUnknown.WithDetail(err)
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		log.WithError(err).WithField("ref", ref).WithField("instanceId", mh.Name).Error("cannot fetch manifest")
+		return "", nil, distv2.ErrorCodeManifestUnknown.WithDetail(err)
+	}
+	defer rc.Close()
+
+	defer mh.GC.Acquire(desc.Digest)()
+
+	if isIndexMediaType(desc.MediaType) && len(acceptedIndex) > 0 {
+		// the client can handle an index, hence we serve one referencing the assembled manifests of all platforms
+		mediaType = negotiateMediaType(acceptedIndex, desc.MediaType)
+		p, err = mh.assembleIndex(ctx, fetcher, desc, mediaType)
+		if err != nil {
+			return "", nil, err
+		}
+	} else {
+		if len(accepted) == 0 {
+			return "", nil, distv2.ErrorCodeManifestUnknown.WithMessage("Accept header does not include OCIv1 or v2 manifests")
+		}
+
+		manifest, ndesc, err := DownloadManifest(ctx, fetcher, desc, WithStore(mh.Store), WithPlatform(platforms.Only(platform)))
 		if err != nil {
-			log.WithError(err).WithField("ref", ref).WithField("instanceId", mh.Name).Error("cannot get fetcher")
-			return distv2.ErrorCodeManifestUnknown.WithDetail(err)
+			return "", nil, distv2.ErrorCodeManifestUnknown.WithDetail(err)
 		}
-		rc, err := fetcher.Fetch(ctx, desc)
+
+		// we serve the manifest with the media type of the upstream manifest if the client accepts it, and convert it otherwise
+		mediaType = negotiateMediaType(accepted, ndesc.MediaType)
+		p, err = mh.assembleManifest(ctx, fetcher, *ndesc, manifest, mediaType)
 		if err != nil {
-			log.WithError(err).WithField("ref", ref).WithField("instanceId", mh.Name).Error("cannot fetch manifest")
-			return distv2.ErrorCodeManifestUnknown.WithDetail(err)
+			return "", nil, err
 		}
-		defer rc.Close()
+	}
 
-		manifest, ndesc, err := DownloadManifest(ctx, fetcher, desc, WithStore(mh.Store))
+	if mh.Digest != "" && digest.FromBytes(p) != mh.Digest && isIndexMediaType(desc.MediaType) {
+		// Clients which received an index request the manifest for their platform by digest.
+		// If the digest matches none of the platform manifests we serve what we'd serve for a tag.
+		mt, pp, err := mh.findPlatformManifest(ctx, fetcher, desc, accepted, mh.Digest)
 		if err != nil {
-			return distv2.ErrorCodeManifestUnknown.WithDetail(err)
+			return "", nil, err
+		}
+		if pp != nil {
+			mediaType, p = mt, pp
 		}
-		desc = *ndesc
+	}
 
-		var p []byte
-		switch desc.MediaType {
-		case images.MediaTypeDockerSchema2Manifest, ociv1.MediaTypeImageManifest:
-			// download config
-			cfg, err := DownloadConfig(ctx, fetcher, manifest.Config)
-			if err != nil {
-				return err
-			}
+	return mediaType, p, nil
+}
+
+// assembleManifest adds the addon layers to a platform manifest and serializes it using mediaType
+func (mh *manifestHandler) assembleManifest(ctx context.Context, fetcher remotes.Fetcher, desc ociv1.Descriptor, upstream *ociv1.Manifest, mediaType string) (p []byte, err error) {
+	mh.GC.Touch(desc.Digest)
+
+	// we must not modify the upstream manifest as callers might assemble it more than once
+	manifest := *upstream
+	manifest.Layers = append([]ociv1.Descriptor(nil), upstream.Layers...)
+
+	// download config
+	cfg, err := DownloadConfig(ctx, fetcher, manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	// modify config
+	compression := mh.LayerCompression
+	if compression == layerCompressionZstd && mediaType == images.MediaTypeDockerSchema2Manifest {
+		// Docker manifests have no media type for zstd compressed layers
+		compression = layerCompressionGzip
+	}
+	addonLayer, err := mh.ConfigModifier(withLayerCompression(ctx, compression), mh.Spec, cfg)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Layers = append(manifest.Layers, addonLayer...)
+	if mediaType != desc.MediaType {
+		convertManifest(&manifest, mediaType)
+	}
+
+	// place config in store
+	rawCfg, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfgDgst := digest.FromBytes(rawCfg)
+	mh.GC.Touch(cfgDgst)
+	for _, l := range manifest.Layers {
+		mh.GC.Touch(l.Digest)
+	}
+
+	// optimization: we store the config in the store just in case the client attempts to download the config blob
+	// 				 from us. If they download it from a registry facade from which the manifest hasn't been downloaded
+	//               we'll re-create the config on the fly.
+	if w, err := mh.Store.Writer(ctx, content.WithRef(mh.Spec.BaseRef), content.WithDescriptor(desc)); err == nil {
+		defer w.Close()
+
+		_, err = w.Write(rawCfg)
+		if err != nil {
+			log.WithError(err).Warn("cannot write config to store - we'll regenerate it on demand")
+		}
+		err = w.Commit(ctx, 0, cfgDgst)
+		if err != nil {
+			log.WithError(err).Warn("cannot commit config to store - we'll regenerate it on demand")
+		}
+	}
+
+	// update config digest in manifest
+	manifest.Config.Digest = cfgDgst
+	manifest.Config.URLs = nil
+	manifest.Config.Size = int64(len(rawCfg))
+
+	// When serving images.MediaTypeDockerSchema2Manifest we have to set the mediaType in the manifest itself.
+	// Although somewhat compatible with the OCI manifest spec (see https://github.com/opencontainers/image-spec/blob/master/manifest.md),
+	// this field is not part of the OCI Go structs. In this particular case, we'll go ahead and add it ourselves.
+	//
+	// fixes https://github.com/gitpod-io/gitpod/pull/3397
+	if mediaType == images.MediaTypeDockerSchema2Manifest {
+		type ManifestWithMediaType struct {
+			ociv1.Manifest
+			MediaType string `json:"mediaType"`
+		}
+		p, _ = json.Marshal(ManifestWithMediaType{
+			Manifest:  manifest,
+			MediaType: images.MediaTypeDockerSchema2Manifest,
+		})
+	} else {
+		p, _ = json.Marshal(manifest)
+	}
+
+	return p, nil
+}
+
+// assembleIndex assembles the manifests of all platforms of an upstream index, and serializes an index
+// referencing them using mediaType
+func (mh *manifestHandler) assembleIndex(ctx context.Context, fetcher remotes.Fetcher, desc ociv1.Descriptor, mediaType string) ([]byte, error) {
+	idx, err := downloadIndex(ctx, fetcher, desc, mh.Store)
+	if err != nil {
+		return nil, distv2.ErrorCodeManifestUnknown.WithDetail(err)
+	}
+
+	manifestMediaType := ociv1.MediaTypeImageManifest
+	if mediaType == images.MediaTypeDockerSchema2ManifestList {
+		manifestMediaType = images.MediaTypeDockerSchema2Manifest
+	}
+
+	var manifests []ociv1.Descriptor
+	for _, md := range platformManifests(idx) {
+		manifest, _, err := DownloadManifest(ctx, fetcher, md, WithStore(mh.Store))
+		if err != nil {
+			return nil, distv2.ErrorCodeManifestUnknown.WithDetail(err)
+		}
+		p, err := mh.assembleManifest(ctx, fetcher, md, manifest, manifestMediaType)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, ociv1.Descriptor{
+			MediaType:   manifestMediaType,
+			Digest:      digest.FromBytes(p),
+			Size:        int64(len(p)),
+			Platform:    md.Platform,
+			Annotations: md.Annotations,
+		})
+	}
+	if len(manifests) == 0 {
+		return nil, distv2.ErrorCodeManifestUnknown.WithMessage("index contains no image manifests")
+	}
 
-			// modify config
-			addonLayer, err := mh.ConfigModifier(ctx, mh.Spec, cfg)
+	// Same as with manifests, Docker manifest lists must carry their media type.
+	type IndexWithMediaType struct {
+		ociv1.Index
+		MediaType string `json:"mediaType,omitempty"`
+	}
+	res := IndexWithMediaType{
+		Index: ociv1.Index{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			Manifests:   manifests,
+			Annotations: idx.Annotations,
+		},
+	}
+	if mediaType == images.MediaTypeDockerSchema2ManifestList {
+		res.MediaType = mediaType
+	}
+	return json.Marshal(res)
+}
+
+// findPlatformManifest searches the platforms of an upstream index for the assembled manifest with the given digest.
+// Returns nil if no manifest matches.
+func (mh *manifestHandler) findPlatformManifest(ctx context.Context, fetcher remotes.Fetcher, desc ociv1.Descriptor, accepted []string, dgst digest.Digest) (mediaType string, p []byte, err error) {
+	idx, err := downloadIndex(ctx, fetcher, desc, mh.Store)
+	if err != nil {
+		return "", nil, distv2.ErrorCodeManifestUnknown.WithDetail(err)
+	}
+
+	for _, md := range platformManifests(idx) {
+		manifest, _, err := DownloadManifest(ctx, fetcher, md, WithStore(mh.Store))
+		if err != nil {
+			return "", nil, distv2.ErrorCodeManifestUnknown.WithDetail(err)
+		}
+		for _, mt := range accepted {
+			p, err := mh.assembleManifest(ctx, fetcher, md, manifest, mt)
 			if err != nil {
-				return err
+				return "", nil, err
+			}
+			if digest.FromBytes(p) == dgst {
+				return mt, p, nil
 			}
-			manifest.Layers = append(manifest.Layers, addonLayer...)
+		}
+	}
+	return "", nil, nil
+}
+
+var (
+	// manifestMediaTypes are the media types of the manifests we can serve, in order of preference
+	manifestMediaTypes = []string{ociv1.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest}
+	// indexMediaTypes are the media types of the indices we can serve, in order of preference
+	indexMediaTypes = []string{ociv1.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList}
+)
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == ociv1.MediaTypeImageIndex || mediaType == images.MediaTypeDockerSchema2ManifestList
+}
+
+// acceptedManifestMediaTypes returns the manifest media types we can serve and the client accepts,
+// in order of preference. Media types with q=0 are not considered accepted.
+func acceptedManifestMediaTypes(acceptHeaders []string) []string {
+	return acceptedMediaTypes(acceptHeaders, manifestMediaTypes, true)
+}
+
+// acceptedIndexMediaTypes returns the index media types we can serve and the client accepts, in order of preference.
+// Unlike manifests, clients have to explicitly accept indices - wildcards don't count.
+func acceptedIndexMediaTypes(acceptHeaders []string) []string {
+	return acceptedMediaTypes(acceptHeaders, indexMediaTypes, false)
+}
 
-			// place config in store
-			rawCfg, err := json.Marshal(cfg)
+func acceptedMediaTypes(acceptHeaders []string, supported []string, matchWildcard bool) []string {
+	accepted := make(map[string]struct{})
+	for _, acceptHeader := range acceptHeaders {
+		for _, mediaType := range strings.Split(acceptHeader, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaType))
 			if err != nil {
-				return err
+				continue
+			}
+			if q, ok := params["q"]; ok {
+				if qv, err := strconv.ParseFloat(q, 64); err == nil && qv == 0 {
+					continue
+				}
 			}
-			cfgDgst := digest.FromBytes(rawCfg)
-
-			// optimization: we store the config in the store just in case the client attempts to download the config blob
-			// 				 from us. If they download it from a registry facade from which the manifest hasn't been downloaded
-			//               we'll re-create the config on the fly.
-			if w, err := mh.Store.Writer(ctx, content.WithRef(ref), content.WithDescriptor(desc)); err == nil {
-				defer w.Close()
 
-				_, err = w.Write(rawCfg)
-				if err != nil {
-					log.WithError(err).Warn("cannot write config to store - we'll regenerate it on demand")
+			switch mediaType {
+			case "*", "*/*", "application/*":
+				if !matchWildcard {
+					continue
 				}
-				err = w.Commit(ctx, 0, cfgDgst)
-				if err != nil {
-					log.WithError(err).Warn("cannot commit config to store - we'll regenerate it on demand")
+				for _, mt := range supported {
+					accepted[mt] = struct{}{}
 				}
+			default:
+				accepted[mediaType] = struct{}{}
 			}
+		}
+	}
 
-			// update config digest in manifest
-			manifest.Config.Digest = cfgDgst
-			manifest.Config.URLs = nil
-			manifest.Config.Size = int64(len(rawCfg))
-
-			// When serving images.MediaTypeDockerSchema2Manifest we have to set the mediaType in the manifest itself.
-			// Although somewhat compatible with the OCI manifest spec (see https://github.com/opencontainers/image-spec/blob/master/manifest.md),
-			// this field is not part of the OCI Go structs. In this particular case, we'll go ahead and add it ourselves.
-			//
-			// fixes https://github.com/gitpod-io/gitpod/pull/3397
-			if desc.MediaType == images.MediaTypeDockerSchema2Manifest {
-				type ManifestWithMediaType struct {
-					ociv1.Manifest
-					MediaType string `json:"mediaType"`
-				}
-				p, _ = json.Marshal(ManifestWithMediaType{
-					Manifest:  *manifest,
-					MediaType: images.MediaTypeDockerSchema2Manifest,
-				})
-			} else {
-				p, _ = json.Marshal(manifest)
+	var res []string
+	for _, mt := range supported {
+		if _, ok := accepted[mt]; ok {
+			res = append(res, mt)
+		}
+	}
+	return res
+}
+
+// negotiateMediaType returns the upstream media type if the client accepts it, and the media type
+// the client accepts that we prefer otherwise.
+func negotiateMediaType(accepted []string, upstream string) string {
+	for _, mt := range accepted {
+		if mt == upstream {
+			return mt
+		}
+	}
+	return accepted[0]
+}
+
+// requestPlatform determines the platform a client pulls an image for. Clients can state the platform
+// using a platform parameter in the Accept header, e.g. `application/vnd.oci.image.manifest.v1+json; platform="linux/arm64"`.
+// Otherwise we use the os/ and arch/ tokens of the User-Agent sent by Docker, and fall back to the default platform.
+func requestPlatform(r *http.Request) ociv1.Platform {
+	for _, acceptHeader := range r.Header["Accept"] {
+		for _, mediaType := range strings.Split(acceptHeader, ",") {
+			_, params, err := mime.ParseMediaType(strings.TrimSpace(mediaType))
+			if err != nil {
+				continue
+			}
+			p, ok := params["platform"]
+			if !ok {
+				continue
+			}
+			platform, err := platforms.Parse(p)
+			if err != nil {
+				log.WithError(err).WithField("platform", p).Debug("cannot parse requested platform")
+				continue
 			}
+			return platform
 		}
+	}
 
-		dgst := digest.FromBytes(p).String()
-		span.LogKV("manifest", string(p))
+	var goos, goarch string
+	for _, token := range strings.Fields(r.UserAgent()) {
+		if strings.HasPrefix(token, "os/") {
+			goos = strings.TrimPrefix(token, "os/")
+		} else if strings.HasPrefix(token, "arch/") {
+			goarch = strings.TrimPrefix(token, "arch/")
+		}
+	}
+	if goos != "" && goarch != "" {
+		platform, err := platforms.Parse(goos + "/" + goarch)
+		if err == nil {
+			return platform
+		}
+	}
 
-		w.Header().Set("Content-Type", desc.MediaType)
-		w.Header().Set("Content-Length", fmt.Sprint(len(p)))
-		w.Header().Set("Etag", fmt.Sprintf(`"%s"`, dgst))
-		w.Header().Set("Docker-Content-Digest", dgst)
-		_, _ = w.Write(p)
+	return platforms.DefaultSpec()
+}
 
-		log.WithField("name", mh.Name).WithField("tag", mh.Tag).Debug("get manifest")
-		return nil
+var (
+	ociToDockerMediaTypes = map[string]string{
+		ociv1.MediaTypeImageConfig:                    images.MediaTypeDockerSchema2Config,
+		ociv1.MediaTypeImageLayer:                     images.MediaTypeDockerSchema2Layer,
+		ociv1.MediaTypeImageLayerGzip:                 images.MediaTypeDockerSchema2LayerGzip,
+		ociv1.MediaTypeImageLayerNonDistributable:     images.MediaTypeDockerSchema2LayerForeign,
+		ociv1.MediaTypeImageLayerNonDistributableGzip: images.MediaTypeDockerSchema2LayerForeignGzip,
+	}
+	dockerToOCIMediaTypes = func() map[string]string {
+		res := make(map[string]string, len(ociToDockerMediaTypes))
+		for oci, docker := range ociToDockerMediaTypes {
+			res[docker] = oci
+		}
+		return res
 	}()
+)
 
-	if err != nil {
-		log.WithError(err).WithField("spec", mh.Spec).Error("cannot get manifest")
-		respondWithError(w, err)
+// convertManifest converts the media types of the config and layers of a manifest to those matching
+// the manifest media type. Media types without equivalent, e.g. zstd compressed OCI layers, are left untouched.
+func convertManifest(manifest *ociv1.Manifest, mediaType string) {
+	var mapping map[string]string
+	switch mediaType {
+	case images.MediaTypeDockerSchema2Manifest:
+		mapping = ociToDockerMediaTypes
+	case ociv1.MediaTypeImageManifest:
+		mapping = dockerToOCIMediaTypes
+	default:
+		return
+	}
+
+	if mt, ok := mapping[manifest.Config.MediaType]; ok {
+		manifest.Config.MediaType = mt
+	}
+	for i, l := range manifest.Layers {
+		if mt, ok := mapping[l.MediaType]; ok {
+			manifest.Layers[i].MediaType = mt
+		}
 	}
-	tracing.FinishSpan(span, &err)
 }
 
 // DownloadConfig downloads and unmarshales OCIv2 image config, refered to by an OCI descriptor.
@@ -258,7 +575,8 @@ func DownloadConfig(ctx context.Context, fetcher remotes.Fetcher, desc ociv1.Des
 }
 
 type manifestDownloadOptions struct {
-	Store content.Store
+	Store    content.Store
+	Platform platforms.MatchComparer
 }
 
 // ManifestDownloadOption alters the default manifest download behaviour
@@ -271,75 +589,36 @@ func WithStore(store content.Store) ManifestDownloadOption {
 	}
 }
 
+// WithPlatform chooses the manifest for a platform if the desc points to a manifest list
+func WithPlatform(platform platforms.MatchComparer) ManifestDownloadOption {
+	return func(o *manifestDownloadOptions) {
+		o.Platform = platform
+	}
+}
+
 // DownloadManifest downloads and unmarshals the manifest of the given desc. If the desc points to manifest list
-// we choose the first manifest in that list.
+// we choose the manifest of the platform configured using WithPlatform, or the first manifest in that list.
 func DownloadManifest(ctx context.Context, fetcher remotes.Fetcher, desc ociv1.Descriptor, options ...ManifestDownloadOption) (cfg *ociv1.Manifest, rdesc *ociv1.Descriptor, err error) {
 	var opts manifestDownloadOptions
 	for _, o := range options {
 		o(&opts)
 	}
 
-	var (
-		rc           io.ReadCloser
-		placeInStore bool
-	)
-	if opts.Store != nil {
-		r, err := opts.Store.ReaderAt(ctx, desc)
-		if errors.Cause(err) == errdefs.ErrNotFound {
-			// not in store yet
-		} else if err != nil {
-			log.WithError(err).WithField("desc", desc).Warn("cannot get manifest from store")
-		} else {
-			rc = &reader{ReaderAt: r}
-		}
-	}
-	if rc == nil {
-		placeInStore = true
-		rc, err = fetcher.Fetch(ctx, desc)
-		if err != nil {
-			err = fmt.Errorf("cannot download manifest: %w", err)
-			return
-		}
-	}
-
-	inpt, err := io.ReadAll(rc)
-	rc.Close()
-	if err != nil {
-		err = fmt.Errorf("cannot download manifest: %w", err)
-		return
-	}
-
 	rdesc = &desc
-
-	switch rdesc.MediaType {
-	case images.MediaTypeDockerSchema2ManifestList, ociv1.MediaTypeImageIndex:
-		// we received a manifest list which means we'll pick the default platform
-		// and fetch that manifest
-		var list ociv1.Index
-		err = json.Unmarshal(inpt, &list)
+	if isIndexMediaType(desc.MediaType) {
+		// we received a manifest list which means we'll pick the manifest of our platform
+		var list *ociv1.Index
+		list, err = downloadIndex(ctx, fetcher, desc, opts.Store)
 		if err != nil {
-			err = fmt.Errorf("cannot unmarshal index: %w", err)
-			return
-		}
-		if len(list.Manifests) == 0 {
-			err = fmt.Errorf("empty manifest")
 			return
 		}
 
-		// TODO: choose by platform, not just the first manifest
-		md := list.Manifests[0]
-		rc, err = fetcher.Fetch(ctx, md)
+		var md ociv1.Descriptor
+		md, err = selectManifest(list.Manifests, opts.Platform)
 		if err != nil {
-			err = fmt.Errorf("cannot download config: %w", err)
 			return
 		}
 		rdesc = &md
-		inpt, err = io.ReadAll(rc)
-		rc.Close()
-		if err != nil {
-			err = fmt.Errorf("cannot download manifest: %w", err)
-			return
-		}
 	}
 
 	switch rdesc.MediaType {
@@ -349,36 +628,142 @@ func DownloadManifest(ctx context.Context, fetcher remotes.Fetcher, desc ociv1.D
 		return
 	}
 
+	inpt, err := fetchManifest(ctx, fetcher, *rdesc, opts.Store)
+	if err != nil {
+		return
+	}
+
 	var res ociv1.Manifest
 	err = json.Unmarshal(inpt, &res)
 	if err != nil {
-		err = fmt.Errorf("cannot decode config: %w", err)
+		err = fmt.Errorf("cannot decode manifest: %w", err)
 		return
 	}
 
-	if opts.Store != nil && placeInStore {
-		// We're cheating here and store the actual image manifest under the desc of what's
-		// possibly an image index. This way we don't have to resolve the image index the next
-		// time one wishes to resolve desc.
-		w, err := opts.Store.Writer(ctx, content.WithDescriptor(desc), content.WithRef(desc.Digest.String()))
+	cfg = &res
+	return
+}
+
+// downloadIndex downloads and unmarshals the image index or manifest list of the given desc
+func downloadIndex(ctx context.Context, fetcher remotes.Fetcher, desc ociv1.Descriptor, store content.Store) (*ociv1.Index, error) {
+	if !isIndexMediaType(desc.MediaType) {
+		return nil, fmt.Errorf("unsupported media type")
+	}
+
+	inpt, err := fetchManifest(ctx, fetcher, desc, store)
+	if err != nil {
+		return nil, err
+	}
+
+	var res ociv1.Index
+	err = json.Unmarshal(inpt, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal index: %w", err)
+	}
+	return &res, nil
+}
+
+// selectManifest chooses the manifest that best matches the platform. If platform is nil or
+// none of the manifests states its platform, the first manifest is chosen.
+func selectManifest(manifests []ociv1.Descriptor, platform platforms.MatchComparer) (res ociv1.Descriptor, err error) {
+	if len(manifests) == 0 {
+		return res, fmt.Errorf("empty manifest")
+	}
+	if platform == nil {
+		return manifests[0], nil
+	}
+
+	var (
+		found       bool
+		hasPlatform bool
+	)
+	for _, m := range manifests {
+		if m.Platform == nil {
+			continue
+		}
+		hasPlatform = true
+		if !platform.Match(*m.Platform) {
+			continue
+		}
+		if !found || platform.Less(*m.Platform, *res.Platform) {
+			res = m
+			found = true
+		}
+	}
+	if found {
+		return res, nil
+	}
+	if !hasPlatform {
+		return manifests[0], nil
+	}
+	return res, fmt.Errorf("image has no manifest for the requested platform")
+}
+
+// platformManifests returns the image manifests of an index, skipping entries which aren't images
+// that can run on a platform, e.g. attestations.
+func platformManifests(idx *ociv1.Index) []ociv1.Descriptor {
+	var res []ociv1.Descriptor
+	for _, md := range idx.Manifests {
+		if md.MediaType != images.MediaTypeDockerSchema2Manifest && md.MediaType != ociv1.MediaTypeImageManifest {
+			continue
+		}
+		if md.Platform != nil && md.Platform.OS == "unknown" {
+			continue
+		}
+		res = append(res, md)
+	}
+	return res
+}
+
+// fetchManifest reads a manifest or index from the store, or downloads it if the store doesn't have it yet.
+// Downloaded content is placed in the store.
+func fetchManifest(ctx context.Context, fetcher remotes.Fetcher, desc ociv1.Descriptor, store content.Store) ([]byte, error) {
+	if store != nil {
+		r, err := store.ReaderAt(ctx, desc)
+		if errors.Cause(err) == errdefs.ErrNotFound {
+			// not in store yet
+		} else if err != nil {
+			log.WithError(err).WithField("desc", desc).Warn("cannot get manifest from store")
+		} else {
+			rc := &reader{ReaderAt: r}
+			inpt, err := io.ReadAll(rc)
+			rc.Close()
+			if err == nil {
+				return inpt, nil
+			}
+			log.WithError(err).WithField("desc", desc).Warn("cannot read manifest from store")
+		}
+	}
+
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot download manifest: %w", err)
+	}
+	inpt, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cannot download manifest: %w", err)
+	}
+
+	if store != nil {
+		w, err := store.Writer(ctx, content.WithDescriptor(desc), content.WithRef(desc.Digest.String()))
 		if err != nil {
-			log.WithError(err).WithField("desc", *rdesc).Warn("cannot store manifest")
+			log.WithError(err).WithField("desc", desc).Warn("cannot store manifest")
 		} else {
 			_, err = io.Copy(w, bytes.NewReader(inpt))
 			if err != nil {
-				log.WithError(err).WithField("desc", *rdesc).Warn("cannot store manifest")
+				log.WithError(err).WithField("desc", desc).Warn("cannot store manifest")
 			}
 
 			err = w.Commit(ctx, 0, digest.FromBytes(inpt))
 			if err != nil {
-				log.WithError(err).WithField("desc", *rdesc).Warn("cannot store manifest")
+				log.WithError(err).WithField("desc", desc).Warn("cannot store manifest")
 			}
 			w.Close()
 		}
 	}
 
-	cfg = &res
-	return
+	return inpt, nil
 }
 
 func (mh *manifestHandler) putManifest(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,513 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/gitpod-io/gitpod/registry-facade/api"
+)
+
+// newTestManifestHandler produces a manifest handler serving an upstream manifest of the given media type
+// with one layer, to which the config modifier adds an uncompressed OCI layer.
+func newTestManifestHandler(t *testing.T, mediaType string) *manifestHandler {
+	content := make(map[string][]byte)
+	desc := addTestManifest(t, content, mediaType, "base")
+	return newTestManifestHandlerForDesc(t, content, desc)
+}
+
+// newTestIndexManifestHandler produces a manifest handler serving an upstream OCI index
+// with a linux/amd64 and linux/arm64 manifest, and an attestation manifest.
+func newTestIndexManifestHandler(t *testing.T) *manifestHandler {
+	content := make(map[string][]byte)
+	amd64 := addTestManifest(t, content, ociv1.MediaTypeImageManifest, "amd64")
+	amd64.Platform = &ociv1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := addTestManifest(t, content, ociv1.MediaTypeImageManifest, "arm64")
+	arm64.Platform = &ociv1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	attestation := addTestManifest(t, content, ociv1.MediaTypeImageManifest, "attestation")
+	attestation.Platform = &ociv1.Platform{OS: "unknown", Architecture: "unknown"}
+
+	idx, err := json.Marshal(ociv1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ociv1.Descriptor{amd64, arm64, attestation},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[digest.FromBytes(idx).Encoded()] = idx
+
+	return newTestManifestHandlerForDesc(t, content, ociv1.Descriptor{
+		MediaType: ociv1.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(idx),
+		Size:      int64(len(idx)),
+	})
+}
+
+// addTestManifest adds a manifest with a single layer and its config to content. The layer's content is name.
+func addTestManifest(t *testing.T, content map[string][]byte, mediaType, name string) ociv1.Descriptor {
+	cfgMediaType, layerMediaType := ociv1.MediaTypeImageConfig, ociv1.MediaTypeImageLayerGzip
+	if mediaType == images.MediaTypeDockerSchema2Manifest {
+		cfgMediaType, layerMediaType = images.MediaTypeDockerSchema2Config, images.MediaTypeDockerSchema2LayerGzip
+	}
+
+	cfg, err := json.Marshal(ociv1.Image{
+		Author: name,
+		RootFS: ociv1.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf, err := json.Marshal(ociv1.Manifest{
+		Config: ociv1.Descriptor{
+			MediaType: cfgMediaType,
+			Digest:    digest.FromBytes(cfg),
+			Size:      int64(len(cfg)),
+		},
+		Layers: []ociv1.Descriptor{
+			{
+				MediaType: layerMediaType,
+				Digest:    digest.FromString(name),
+				Size:      int64(len(name)),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[digest.FromBytes(mf).Encoded()] = mf
+	content[digest.FromBytes(cfg).Encoded()] = cfg
+	content[digest.FromString(name).Encoded()] = []byte(name)
+
+	return ociv1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(mf),
+		Size:      int64(len(mf)),
+	}
+}
+
+func newTestManifestHandlerForDesc(t *testing.T, content map[string][]byte, desc ociv1.Descriptor) *manifestHandler {
+	const ref = "docker.io/library/alpine:latest"
+
+	rawDesc, err := json.Marshal(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[ref] = rawDesc
+
+	store, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addonLayer := ociv1.Descriptor{
+		MediaType: ociv1.MediaTypeImageLayer,
+		Digest:    digest.FromString("addon"),
+		Size:      5,
+	}
+
+	return &manifestHandler{
+		Context:  context.Background(),
+		Name:     "foo",
+		Tag:      "latest",
+		Spec:     &api.ImageSpec{BaseRef: ref},
+		Resolver: &fakeFetcher{Content: content},
+		Store:    store,
+		ConfigModifier: func(ctx context.Context, spec *api.ImageSpec, cfg *ociv1.Image) ([]ociv1.Descriptor, error) {
+			return []ociv1.Descriptor{addonLayer}, nil
+		},
+	}
+}
+
+func TestGetManifestHeadParity(t *testing.T) {
+	serve := func(method string) *httptest.ResponseRecorder {
+		mh := newTestManifestHandler(t, ociv1.MediaTypeImageManifest)
+		req := httptest.NewRequest(method, "/v2/remote/foo/manifests/latest", nil)
+		req.Header.Set("Accept", ociv1.MediaTypeImageManifest)
+		rec := httptest.NewRecorder()
+		mh.getManifest(rec, req)
+		return rec
+	}
+
+	get := serve(http.MethodGet)
+	head := serve(http.MethodHead)
+
+	if get.Code != http.StatusOK {
+		t.Fatalf("GET failed with status %d: %s", get.Code, get.Body.String())
+	}
+	if head.Code != get.Code {
+		t.Errorf("unexpected HEAD status code: expected %d, got %d", get.Code, head.Code)
+	}
+	for _, hdr := range []string{"Docker-Content-Digest", "Content-Type", "Content-Length", "Etag", versionHeader} {
+		if g, h := get.Header().Get(hdr), head.Header().Get(hdr); g != h || g == "" {
+			t.Errorf("header %s differs between GET and HEAD: GET %q, HEAD %q", hdr, g, h)
+		}
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("HEAD response has a body of %d bytes", head.Body.Len())
+	}
+	if dgst := digest.FromBytes(get.Body.Bytes()).String(); dgst != get.Header().Get("Docker-Content-Digest") {
+		t.Errorf("Docker-Content-Digest does not match the manifest: expected %s, got %s", dgst, get.Header().Get("Docker-Content-Digest"))
+	}
+}
+
+func TestGetManifestMediaTypes(t *testing.T) {
+	type Expectation struct {
+		Status      int
+		ContentType string
+		MediaType   string
+		Config      string
+		Layers      []string
+	}
+	ociExpectation := Expectation{
+		Status:      http.StatusOK,
+		ContentType: ociv1.MediaTypeImageManifest,
+		Config:      ociv1.MediaTypeImageConfig,
+		Layers:      []string{ociv1.MediaTypeImageLayerGzip, ociv1.MediaTypeImageLayer},
+	}
+	dockerExpectation := Expectation{
+		Status:      http.StatusOK,
+		ContentType: images.MediaTypeDockerSchema2Manifest,
+		MediaType:   images.MediaTypeDockerSchema2Manifest,
+		Config:      images.MediaTypeDockerSchema2Config,
+		Layers:      []string{images.MediaTypeDockerSchema2LayerGzip, images.MediaTypeDockerSchema2Layer},
+	}
+
+	tests := []struct {
+		Desc        string
+		Upstream    string
+		Accept      []string
+		Expectation Expectation
+	}{
+		{
+			Desc:        "OCI upstream, OCI client",
+			Upstream:    ociv1.MediaTypeImageManifest,
+			Accept:      []string{ociv1.MediaTypeImageManifest},
+			Expectation: ociExpectation,
+		},
+		{
+			Desc:        "OCI upstream, Docker client",
+			Upstream:    ociv1.MediaTypeImageManifest,
+			Accept:      []string{images.MediaTypeDockerSchema2Manifest},
+			Expectation: dockerExpectation,
+		},
+		{
+			Desc:        "OCI upstream, client accepting both",
+			Upstream:    ociv1.MediaTypeImageManifest,
+			Accept:      []string{images.MediaTypeDockerSchema2Manifest, ociv1.MediaTypeImageManifest},
+			Expectation: ociExpectation,
+		},
+		{
+			Desc:     "Docker upstream, Docker client",
+			Upstream: images.MediaTypeDockerSchema2Manifest,
+			Accept:   []string{images.MediaTypeDockerSchema2Manifest},
+			Expectation: Expectation{
+				Status:      http.StatusOK,
+				ContentType: images.MediaTypeDockerSchema2Manifest,
+				MediaType:   images.MediaTypeDockerSchema2Manifest,
+				Config:      images.MediaTypeDockerSchema2Config,
+				// we don't convert the addon layers if the upstream manifest is served as is
+				Layers: []string{images.MediaTypeDockerSchema2LayerGzip, ociv1.MediaTypeImageLayer},
+			},
+		},
+		{
+			Desc:        "Docker upstream, OCI client",
+			Upstream:    images.MediaTypeDockerSchema2Manifest,
+			Accept:      []string{ociv1.MediaTypeImageManifest},
+			Expectation: ociExpectation,
+		},
+		{
+			Desc:     "Docker upstream, client accepting both in a single header",
+			Upstream: images.MediaTypeDockerSchema2Manifest,
+			Accept:   []string{ociv1.MediaTypeImageManifest + ", " + images.MediaTypeDockerSchema2Manifest},
+			Expectation: Expectation{
+				Status:      http.StatusOK,
+				ContentType: images.MediaTypeDockerSchema2Manifest,
+				MediaType:   images.MediaTypeDockerSchema2Manifest,
+				Config:      images.MediaTypeDockerSchema2Config,
+				Layers:      []string{images.MediaTypeDockerSchema2LayerGzip, ociv1.MediaTypeImageLayer},
+			},
+		},
+		{
+			Desc:        "wildcard",
+			Upstream:    ociv1.MediaTypeImageManifest,
+			Accept:      []string{"*/*"},
+			Expectation: ociExpectation,
+		},
+		{
+			Desc:        "no accept header",
+			Upstream:    ociv1.MediaTypeImageManifest,
+			Expectation: Expectation{Status: http.StatusNotFound},
+		},
+		{
+			Desc:        "index only",
+			Upstream:    ociv1.MediaTypeImageManifest,
+			Accept:      []string{ociv1.MediaTypeImageIndex},
+			Expectation: Expectation{Status: http.StatusNotFound},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			mh := newTestManifestHandler(t, test.Upstream)
+			req := httptest.NewRequest(http.MethodGet, "/v2/remote/foo/manifests/latest", nil)
+			for _, a := range test.Accept {
+				req.Header.Add("Accept", a)
+			}
+			rec := httptest.NewRecorder()
+			mh.getManifest(rec, req)
+
+			act := Expectation{Status: rec.Code}
+			if rec.Code == http.StatusOK {
+				var mf struct {
+					ociv1.Manifest
+					MediaType string `json:"mediaType"`
+				}
+				err := json.Unmarshal(rec.Body.Bytes(), &mf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				act.ContentType = rec.Header().Get("Content-Type")
+				act.MediaType = mf.MediaType
+				act.Config = mf.Config.MediaType
+				for _, l := range mf.Layers {
+					act.Layers = append(act.Layers, l.MediaType)
+				}
+			}
+
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected response (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAcceptedManifestMediaTypes(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Accept      []string
+		Expectation []string
+	}{
+		{Desc: "none"},
+		{Desc: "OCI", Accept: []string{ociv1.MediaTypeImageManifest}, Expectation: []string{ociv1.MediaTypeImageManifest}},
+		{Desc: "Docker", Accept: []string{images.MediaTypeDockerSchema2Manifest}, Expectation: []string{images.MediaTypeDockerSchema2Manifest}},
+		{
+			Desc:        "multiple headers",
+			Accept:      []string{images.MediaTypeDockerSchema2Manifest, ociv1.MediaTypeImageManifest},
+			Expectation: []string{ociv1.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest},
+		},
+		{
+			Desc:        "comma separated",
+			Accept:      []string{images.MediaTypeDockerSchema2Manifest + ", " + images.MediaTypeDockerSchema1Manifest},
+			Expectation: []string{images.MediaTypeDockerSchema2Manifest},
+		},
+		{Desc: "wildcard", Accept: []string{"*/*"}, Expectation: manifestMediaTypes},
+		{Desc: "bare wildcard", Accept: []string{"*"}, Expectation: manifestMediaTypes},
+		{
+			Desc:        "q=0 excludes",
+			Accept:      []string{ociv1.MediaTypeImageManifest + ";q=0", images.MediaTypeDockerSchema2Manifest + ";q=0.5"},
+			Expectation: []string{images.MediaTypeDockerSchema2Manifest},
+		},
+		{Desc: "manifest lists only", Accept: []string{ociv1.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList}},
+		{Desc: "invalid", Accept: []string{";;"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := acceptedManifestMediaTypes(test.Accept)
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected media types (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetManifestPlatform(t *testing.T) {
+	const dockerUserAgent = "docker/20.10.7 go/go1.13.15 git-commit/b0f5bc3 kernel/5.10.25-linuxkit os/linux arch/%s UpstreamClient(Docker-Client/20.10.7 \\(darwin\\))"
+
+	type Expectation struct {
+		Status int
+		Layers []digest.Digest
+	}
+	tests := []struct {
+		Desc        string
+		Accept      string
+		UserAgent   string
+		Expectation Expectation
+	}{
+		{
+			Desc:        "arm64 user agent",
+			Accept:      ociv1.MediaTypeImageManifest,
+			UserAgent:   fmt.Sprintf(dockerUserAgent, "arm64"),
+			Expectation: Expectation{Status: http.StatusOK, Layers: []digest.Digest{digest.FromString("arm64"), digest.FromString("addon")}},
+		},
+		{
+			Desc:        "amd64 user agent",
+			Accept:      ociv1.MediaTypeImageManifest,
+			UserAgent:   fmt.Sprintf(dockerUserAgent, "amd64"),
+			Expectation: Expectation{Status: http.StatusOK, Layers: []digest.Digest{digest.FromString("amd64"), digest.FromString("addon")}},
+		},
+		{
+			Desc:        "accept platform",
+			Accept:      ociv1.MediaTypeImageManifest + `; platform="linux/arm64"`,
+			UserAgent:   fmt.Sprintf(dockerUserAgent, "amd64"),
+			Expectation: Expectation{Status: http.StatusOK, Layers: []digest.Digest{digest.FromString("arm64"), digest.FromString("addon")}},
+		},
+		{
+			Desc:        "unavailable platform",
+			Accept:      ociv1.MediaTypeImageManifest + `; platform="linux/s390x"`,
+			Expectation: Expectation{Status: http.StatusNotFound},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			mh := newTestIndexManifestHandler(t)
+			req := httptest.NewRequest(http.MethodGet, "/v2/remote/foo/manifests/latest", nil)
+			req.Header.Set("Accept", test.Accept)
+			req.Header.Set("User-Agent", test.UserAgent)
+			rec := httptest.NewRecorder()
+			mh.getManifest(rec, req)
+
+			act := Expectation{Status: rec.Code}
+			if rec.Code == http.StatusOK {
+				var mf ociv1.Manifest
+				err := json.Unmarshal(rec.Body.Bytes(), &mf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, l := range mf.Layers {
+					act.Layers = append(act.Layers, l.Digest)
+				}
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected response (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetManifestIndex(t *testing.T) {
+	tests := []struct {
+		Desc              string
+		Accept            []string
+		IndexMediaType    string
+		ManifestMediaType string
+	}{
+		{
+			Desc:              "OCI",
+			Accept:            []string{ociv1.MediaTypeImageIndex, ociv1.MediaTypeImageManifest},
+			IndexMediaType:    ociv1.MediaTypeImageIndex,
+			ManifestMediaType: ociv1.MediaTypeImageManifest,
+		},
+		{
+			Desc:              "Docker",
+			Accept:            []string{images.MediaTypeDockerSchema2ManifestList, images.MediaTypeDockerSchema2Manifest},
+			IndexMediaType:    images.MediaTypeDockerSchema2ManifestList,
+			ManifestMediaType: images.MediaTypeDockerSchema2Manifest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			serve := func(dgst digest.Digest) *httptest.ResponseRecorder {
+				mh := newTestIndexManifestHandler(t)
+				mh.Digest = dgst
+				req := httptest.NewRequest(http.MethodGet, "/v2/remote/foo/manifests/latest", nil)
+				for _, a := range test.Accept {
+					req.Header.Add("Accept", a)
+				}
+				rec := httptest.NewRecorder()
+				mh.getManifest(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("unexpected status code %d: %s", rec.Code, rec.Body.String())
+				}
+				return rec
+			}
+
+			rec := serve("")
+			if ct := rec.Header().Get("Content-Type"); ct != test.IndexMediaType {
+				t.Errorf("unexpected content type: expected %s, got %s", test.IndexMediaType, ct)
+			}
+			var idx ociv1.Index
+			err := json.Unmarshal(rec.Body.Bytes(), &idx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var platforms []string
+			for _, md := range idx.Manifests {
+				if md.MediaType != test.ManifestMediaType {
+					t.Errorf("unexpected manifest media type: expected %s, got %s", test.ManifestMediaType, md.MediaType)
+				}
+				platforms = append(platforms, md.Platform.Architecture)
+
+				// clients pull the manifest for their platform by digest
+				rec := serve(md.Digest)
+				if dgst := rec.Header().Get("Docker-Content-Digest"); dgst != md.Digest.String() {
+					t.Errorf("unexpected digest for %s: expected %s, got %s", md.Platform.Architecture, md.Digest, dgst)
+				}
+				if ct := rec.Header().Get("Content-Type"); ct != test.ManifestMediaType {
+					t.Errorf("unexpected content type for %s: expected %s, got %s", md.Platform.Architecture, test.ManifestMediaType, ct)
+				}
+				var mf ociv1.Manifest
+				err := json.Unmarshal(rec.Body.Bytes(), &mf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(mf.Layers) != 2 || mf.Layers[0].Digest != digest.FromString(md.Platform.Architecture) {
+					t.Errorf("manifest for %s does not contain the platform layer: %v", md.Platform.Architecture, mf.Layers)
+				}
+			}
+			if diff := cmp.Diff([]string{"amd64", "arm64"}, platforms); diff != "" {
+				t.Errorf("unexpected platforms (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSelectManifest(t *testing.T) {
+	var (
+		amd64 = ociv1.Descriptor{Digest: digest.FromString("amd64"), Platform: &ociv1.Platform{OS: "linux", Architecture: "amd64"}}
+		arm64 = ociv1.Descriptor{Digest: digest.FromString("arm64"), Platform: &ociv1.Platform{OS: "linux", Architecture: "arm64"}}
+		armv7 = ociv1.Descriptor{Digest: digest.FromString("armv7"), Platform: &ociv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}}
+		armv6 = ociv1.Descriptor{Digest: digest.FromString("armv6"), Platform: &ociv1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}}
+		noPlf = ociv1.Descriptor{Digest: digest.FromString("none")}
+	)
+
+	tests := []struct {
+		Desc        string
+		Manifests   []ociv1.Descriptor
+		Platform    platforms.MatchComparer
+		Expectation digest.Digest
+		Error       bool
+	}{
+		{Desc: "no platform", Manifests: []ociv1.Descriptor{amd64, arm64}, Expectation: amd64.Digest},
+		{Desc: "exact match", Manifests: []ociv1.Descriptor{amd64, arm64}, Platform: platforms.Only(*arm64.Platform), Expectation: arm64.Digest},
+		{Desc: "best variant", Manifests: []ociv1.Descriptor{armv6, armv7}, Platform: platforms.Only(*armv7.Platform), Expectation: armv7.Digest},
+		{Desc: "compatible variant", Manifests: []ociv1.Descriptor{amd64, armv6}, Platform: platforms.Only(*armv7.Platform), Expectation: armv6.Digest},
+		{Desc: "no platforms in index", Manifests: []ociv1.Descriptor{noPlf}, Platform: platforms.Only(*arm64.Platform), Expectation: noPlf.Digest},
+		{Desc: "no match", Manifests: []ociv1.Descriptor{amd64}, Platform: platforms.Only(*arm64.Platform), Error: true},
+		{Desc: "empty", Error: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act, err := selectManifest(test.Manifests, test.Platform)
+			if (err != nil) != test.Error {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if act.Digest != test.Expectation {
+				t.Errorf("unexpected manifest: expected %s, got %s", test.Expectation, act.Digest)
+			}
+		})
+	}
+}
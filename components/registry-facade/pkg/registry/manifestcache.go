@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/gitpod-io/gitpod/registry-facade/api"
+)
+
+const defaultManifestCacheSize = 128
+
+// manifestCache caches assembled manifests so that pulls of the same image spec don't re-run
+// layer assembly and config modification
+type manifestCache struct {
+	// StaticLayers are the refs of the static layers added to every image. They are part of the cache key.
+	StaticLayers []string
+
+	cache   *lru.Cache
+	metrics *metrics
+}
+
+// cachedManifest is an assembled manifest as it was served to a client
+type cachedManifest struct {
+	MediaType string
+	Content   []byte
+	Digest    digest.Digest
+}
+
+func newManifestCache(space int, staticLayers []string, metrics *metrics) (*manifestCache, error) {
+	cache, err := lru.New(space)
+	if err != nil {
+		return nil, err
+	}
+	return &manifestCache{
+		StaticLayers: staticLayers,
+		cache:        cache,
+		metrics:      metrics,
+	}, nil
+}
+
+// Key computes the cache key of the manifest served for a spec. Besides the spec and what the client accepts,
+// the key includes the digest of the upstream manifest, the static layer refs and the layer compression.
+// The content layers and the IDE ref are part of the spec, hence entries are never served once the base image
+// or any addon layer changes.
+// We key on these inputs rather than the addon layers themselves to avoid producing the layers for cache hits.
+func (c *manifestCache) Key(spec *api.ImageSpec, upstream digest.Digest, accepted, acceptedIndex []string, platform ociv1.Platform, requested digest.Digest, compression layerCompression) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+
+	rspec, err := spec.ToBase64()
+	if err != nil {
+		return "", err
+	}
+
+	d := digest.Canonical.Digester()
+	fmt.Fprintf(d.Hash(), "%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n",
+		rspec,
+		upstream,
+		strings.Join(accepted, ","),
+		strings.Join(acceptedIndex, ","),
+		platforms.Format(platform),
+		requested,
+		strings.Join(c.StaticLayers, ","),
+		compression,
+	)
+	return d.Digest().String(), nil
+}
+
+// Get returns the cached manifest for a key
+func (c *manifestCache) Get(key string) (*cachedManifest, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+
+	v, ok := c.cache.Get(key)
+	if !ok {
+		c.metrics.ManifestCacheMisses.Inc()
+		return nil, false
+	}
+	c.metrics.ManifestCacheHits.Inc()
+	return v.(*cachedManifest), true
+}
+
+// Add caches a manifest for a key
+func (c *manifestCache) Add(key string, m *cachedManifest) {
+	if c == nil || key == "" {
+		return
+	}
+	c.cache.Add(key, m)
+}
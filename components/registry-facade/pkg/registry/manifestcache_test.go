@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/gitpod-io/gitpod/registry-facade/api"
+)
+
+func TestManifestCacheKey(t *testing.T) {
+	type Input struct {
+		Spec          *api.ImageSpec
+		Upstream      digest.Digest
+		Accepted      []string
+		AcceptedIndex []string
+		Platform      ociv1.Platform
+		Requested     digest.Digest
+		StaticLayer   string
+		Compression   layerCompression
+	}
+	base := Input{
+		Spec:        &api.ImageSpec{BaseRef: "alpine:latest", IdeRef: "ide:latest"},
+		Upstream:    digest.FromString("upstream"),
+		Accepted:    []string{ociv1.MediaTypeImageManifest},
+		Platform:    ociv1.Platform{OS: "linux", Architecture: "amd64"},
+		StaticLayer: "image:supervisor:latest",
+	}
+
+	tests := []struct {
+		Desc   string
+		Modify func(*Input)
+		Equal  bool
+	}{
+		{Desc: "same input", Modify: func(in *Input) {}, Equal: true},
+		{Desc: "different base ref", Modify: func(in *Input) { in.Spec = &api.ImageSpec{BaseRef: "ubuntu:latest", IdeRef: "ide:latest"} }},
+		{Desc: "different IDE ref", Modify: func(in *Input) { in.Spec = &api.ImageSpec{BaseRef: "alpine:latest", IdeRef: "ide:commit-1234"} }},
+		{Desc: "different content layer", Modify: func(in *Input) {
+			in.Spec = &api.ImageSpec{BaseRef: "alpine:latest", IdeRef: "ide:latest", ContentLayer: []*api.ContentLayer{
+				{Spec: &api.ContentLayer_Direct{Direct: &api.DirectContentLayer{Content: []byte("content")}}},
+			}}
+		}},
+		{Desc: "different upstream manifest", Modify: func(in *Input) { in.Upstream = digest.FromString("updated") }},
+		{Desc: "different accepted media types", Modify: func(in *Input) { in.Accepted = []string{images.MediaTypeDockerSchema2Manifest} }},
+		{Desc: "accepting an index", Modify: func(in *Input) { in.AcceptedIndex = []string{ociv1.MediaTypeImageIndex} }},
+		{Desc: "different platform", Modify: func(in *Input) { in.Platform = ociv1.Platform{OS: "linux", Architecture: "arm64"} }},
+		{Desc: "requested by digest", Modify: func(in *Input) { in.Requested = digest.FromString("manifest") }},
+		{Desc: "different static layer", Modify: func(in *Input) { in.StaticLayer = "image:supervisor:commit-1234" }},
+		{Desc: "different layer compression", Modify: func(in *Input) { in.Compression = layerCompressionZstd }},
+	}
+	key := func(t *testing.T, in Input) string {
+		cache, err := newManifestCache(1, []string{in.StaticLayer}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := cache.Key(in.Spec, in.Upstream, in.Accepted, in.AcceptedIndex, in.Platform, in.Requested, in.Compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			in := base
+			test.Modify(&in)
+
+			if equal := key(t, base) == key(t, in); equal != test.Equal {
+				t.Errorf("unexpected key equality: expected %v, got %v", test.Equal, equal)
+			}
+		})
+	}
+}
+
+func TestGetManifestCached(t *testing.T) {
+	metrics, err := newMetrics(prometheus.NewRegistry(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := newManifestCache(8, nil, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var modifications int
+	serve := func(accept string) *httptest.ResponseRecorder {
+		mh := newTestManifestHandler(t, ociv1.MediaTypeImageManifest)
+		mh.Cache = cache
+		modifier := mh.ConfigModifier
+		mh.ConfigModifier = func(ctx context.Context, spec *api.ImageSpec, cfg *ociv1.Image) ([]ociv1.Descriptor, error) {
+			modifications++
+			return modifier(ctx, spec, cfg)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/v2/remote/foo/manifests/latest", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		mh.getManifest(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status code %d: %s", rec.Code, rec.Body.String())
+		}
+		return rec
+	}
+
+	first := serve(ociv1.MediaTypeImageManifest)
+	second := serve(ociv1.MediaTypeImageManifest)
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("cached manifest differs from the assembled one")
+	}
+	if dgst := second.Header().Get("Docker-Content-Digest"); dgst != digest.FromBytes(second.Body.Bytes()).String() {
+		t.Errorf("cached manifest has wrong digest %s", dgst)
+	}
+	if modifications != 1 {
+		t.Errorf("expected the config to be modified once, got %d", modifications)
+	}
+
+	docker := serve(images.MediaTypeDockerSchema2Manifest)
+	if ct := docker.Header().Get("Content-Type"); ct != images.MediaTypeDockerSchema2Manifest {
+		t.Errorf("served cached manifest with wrong content type %s", ct)
+	}
+	if modifications != 2 {
+		t.Errorf("expected the config to be modified twice, got %d", modifications)
+	}
+
+	if hits := testutil.ToFloat64(metrics.ManifestCacheHits); hits != 1 {
+		t.Errorf("unexpected cache hits: expected 1, got %v", hits)
+	}
+	if misses := testutil.ToFloat64(metrics.ManifestCacheMisses); misses != 2 {
+		t.Errorf("unexpected cache misses: expected 2, got %v", misses)
+	}
+}
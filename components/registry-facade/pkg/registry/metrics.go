@@ -6,6 +6,8 @@ package registry
 
 import (
 	"net/http"
+	"net/http/httptrace"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,6 +32,12 @@ type measuringRegistryRoundTripper struct {
 }
 
 func (m *measuringRegistryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			m.metrics.DownstreamConnections.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+		},
+	}))
+
 	t0 := time.Now()
 	resp, err := m.delegate.RoundTrip(req)
 	dt := time.Since(t0)
@@ -48,6 +56,14 @@ type metrics struct {
 	ManifestHist          prometheus.Histogram
 	BlobCounter           prometheus.Counter
 	BlobDownloadSpeedHist prometheus.Histogram
+	StoreGCDeletedBlobs   prometheus.Counter
+	StoreGCReclaimedBytes prometheus.Counter
+	StoreSize             prometheus.Gauge
+	ManifestCacheHits     prometheus.Counter
+	ManifestCacheMisses   prometheus.Counter
+	ResolverPoolHits      prometheus.Counter
+	ResolverPoolMisses    prometheus.Counter
+	DownstreamConnections *prometheus.CounterVec
 }
 
 func newMetrics(reg prometheus.Registerer, upstream bool) (*metrics, error) {
@@ -75,16 +91,158 @@ func newMetrics(reg prometheus.Registerer, upstream bool) (*metrics, error) {
 		Help:    "blob download speed in bytes per second",
 		Buckets: prometheus.ExponentialBuckets(1024*1024, 2, 10),
 	})
+	storeGCDeletedBlobs := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "store_gc_deleted_blobs_total",
+		Help: "number of blobs the content store GC removed",
+	})
+	storeGCReclaimedBytes := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "store_gc_reclaimed_bytes_total",
+		Help: "number of bytes the content store GC reclaimed",
+	})
+	storeSize := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "store_size_bytes",
+		Help: "size of the blobs in the content store",
+	})
+	manifestCacheHits := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "manifest_cache_hits_total",
+		Help: "number of manifest requests served from the assembled manifest cache",
+	})
+	manifestCacheMisses := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "manifest_cache_misses_total",
+		Help: "number of manifest requests for which the manifest had to be assembled",
+	})
+	resolverPoolHits := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "resolver_pool_hits_total",
+		Help: "number of times a pooled resolver was reused",
+	})
+	resolverPoolMisses := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "resolver_pool_misses_total",
+		Help: "number of times a new resolver had to be created because there was none for the registry or it was idle for too long",
+	})
+	downstreamConnections := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "connections_total",
+		Help: "number of connections used for requests to the downstream registry",
+	}, []string{"reused"})
 	if upstream {
 		err = reg.Register(blobDownloadSpeedHist)
 		if err != nil {
 			return nil, err
 		}
+		err = reg.Register(storeGCDeletedBlobs)
+		if err != nil {
+			return nil, err
+		}
+		err = reg.Register(storeGCReclaimedBytes)
+		if err != nil {
+			return nil, err
+		}
+		err = reg.Register(storeSize)
+		if err != nil {
+			return nil, err
+		}
+		err = reg.Register(manifestCacheHits)
+		if err != nil {
+			return nil, err
+		}
+		err = reg.Register(manifestCacheMisses)
+		if err != nil {
+			return nil, err
+		}
+		err = reg.Register(resolverPoolHits)
+		if err != nil {
+			return nil, err
+		}
+		err = reg.Register(resolverPoolMisses)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = reg.Register(downstreamConnections)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &metrics{
 		ManifestHist:          manifestHist,
 		BlobCounter:           blobCounter,
 		BlobDownloadSpeedHist: blobDownloadSpeedHist,
+		StoreGCDeletedBlobs:   storeGCDeletedBlobs,
+		StoreGCReclaimedBytes: storeGCReclaimedBytes,
+		StoreSize:             storeSize,
+		ManifestCacheHits:     manifestCacheHits,
+		ManifestCacheMisses:   manifestCacheMisses,
+		ResolverPoolHits:      resolverPoolHits,
+		ResolverPoolMisses:    resolverPoolMisses,
+		DownstreamConnections: downstreamConnections,
 	}, nil
 }
+
+// specCacheMetrics expose the effectiveness of the caching spec provider
+type specCacheMetrics struct {
+	Hits      prometheus.Counter
+	Misses    prometheus.Counter
+	Evictions prometheus.Counter
+	Entries   prometheus.Gauge
+}
+
+func newSpecCacheMetrics(reg prometheus.Registerer) (*specCacheMetrics, error) {
+	res := &specCacheMetrics{
+		Hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "spec_cache_hits_total",
+			Help: "number of image spec requests served from the cache",
+		}),
+		Misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "spec_cache_misses_total",
+			Help: "number of image spec requests forwarded to the spec provider",
+		}),
+		Evictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "spec_cache_evictions_total",
+			Help: "number of image specs evicted from the cache",
+		}),
+		Entries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "spec_cache_entries",
+			Help: "number of image specs in the cache",
+		}),
+	}
+	for _, c := range []prometheus.Collector{res.Hits, res.Misses, res.Evictions, res.Entries} {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// layerSourceMetrics expose the latency and errors of the individual layer sources
+type layerSourceMetrics struct {
+	ResolveHist *prometheus.HistogramVec
+	ServeHist   *prometheus.HistogramVec
+	Errors      *prometheus.CounterVec
+}
+
+func newLayerSourceMetrics(reg prometheus.Registerer) (*layerSourceMetrics, error) {
+	res := &layerSourceMetrics{
+		ResolveHist: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "layer_source_resolve_seconds",
+			Help:    "time it takes a layer source to provide the layers and env modifiers of an image spec",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10},
+		}, []string{"source"}),
+		ServeHist: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "layer_source_serve_seconds",
+			Help:    "time it takes a layer source to start serving a blob",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10},
+		}, []string{"source"}),
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "layer_source_errors_total",
+			Help: "number of failed layer source operations",
+		}, []string{"source", "operation"}),
+	}
+	for _, c := range []prometheus.Collector{res.ResolveHist, res.ServeHist, res.Errors} {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
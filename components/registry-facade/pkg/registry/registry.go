@@ -5,19 +5,24 @@
 package registry
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/common-go/util"
 	"github.com/gitpod-io/gitpod/registry-facade/api"
 	"github.com/gitpod-io/gitpod/registry-facade/pkg/handover"
 
@@ -31,6 +36,7 @@ import (
 	"github.com/gorilla/mux"
 	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
 	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/xerrors"
 	"google.golang.org/grpc"
@@ -39,30 +45,107 @@ import (
 
 // Config configures the registry
 type Config struct {
-	Port        int    `json:"port"`
-	Prefix      string `json:"prefix"`
-	StaticLayer []struct {
-		Ref  string `json:"ref"`
-		Type string `json:"type"`
-	} `json:"staticLayer"`
-	RemoteSpecProvider *struct {
-		Addr string `json:"addr"`
-		TLS  *struct {
-			Authority   string `json:"ca"`
-			Certificate string `json:"crt"`
-			PrivateKey  string `json:"key"`
-		} `json:"tls,omitempty"`
-	} `json:"remoteSpecProvider,omitempty"`
-	Store       string `json:"store"`
-	RequireAuth bool   `json:"requireAuth"`
-	TLS         *struct {
+	Port   int    `json:"port"`
+	Prefix string `json:"prefix"`
+	// StaticLayer are the layers added to every image. The file and url layers can be reloaded without a restart.
+	StaticLayer        []StaticLayerConfig       `json:"staticLayer"`
+	RemoteSpecProvider RemoteSpecProviderConfigs `json:"remoteSpecProvider,omitempty"`
+	// SpecCache configures the cache in front of the remote spec providers
+	SpecCache struct {
+		// Size is the number of image specs cached. Defaults to 128.
+		Size int `json:"size,omitempty"`
+		// TTL is the time after which cached image specs are fetched again. Specs are cached until evicted if this is zero.
+		TTL util.Duration `json:"ttl,omitempty"`
+		// ServeStale serves a cached image spec after its TTL if fetching it again fails
+		ServeStale bool `json:"serveStale,omitempty"`
+	} `json:"specCache"`
+	// LocalSpecProvider serves image specs from JSON files in a directory. Edits take effect without a restart.
+	LocalSpecProvider *struct {
+		Dir string `json:"dir"`
+	} `json:"localSpecProvider,omitempty"`
+	Store string `json:"store"`
+	// StoreMaxBytes is the maximum size of the content store. Once exceeded, the least recently used blobs are evicted.
+	// The store size is unlimited if this is zero.
+	StoreMaxBytes int64 `json:"storeMaxBytes,omitempty"`
+	// ResolverIdleTimeout is the time after which an unused resolver for a registry is discarded. Resolvers
+	// are shared per registry to reuse connections and auth tokens. Defaults to five minutes.
+	ResolverIdleTimeout util.Duration `json:"resolverIdleTimeout,omitempty"`
+	// ResolverRetry configures how resolving and fetching images from remote registries is retried on transient errors
+	ResolverRetry RetryConfig `json:"resolverRetry"`
+	// TranscodeLayers recompresses the layers we add to images using the compression clients ask for
+	// in their Accept header, e.g. zstd. Transcoded layers are kept in the store. If this is false,
+	// layers are served the way their layer source provides them.
+	TranscodeLayers bool `json:"transcodeLayers,omitempty"`
+	// ManifestCacheSize is the number of assembled manifests kept in memory. Defaults to 128.
+	ManifestCacheSize int  `json:"manifestCacheSize,omitempty"`
+	RequireAuth       bool `json:"requireAuth"`
+	// LogRequests logs the method, path and relevant headers of all registry requests at debug level
+	LogRequests bool `json:"logRequests,omitempty"`
+	// AdvertiseFeatures lists the features the registry facade supports in the X-RegistryFacade-Features
+	// header of the /v2/ base response
+	AdvertiseFeatures bool `json:"advertiseFeatures,omitempty"`
+	// Timeouts configures the timeouts of the registry server
+	Timeouts ServerTimeouts `json:"timeouts"`
+	// Limits limits the size of requests
+	Limits RequestLimits `json:"limits"`
+	// Auth configures how requests are authenticated if RequireAuth is set
+	Auth *AuthConfig `json:"auth,omitempty"`
+	TLS  *struct {
 		Certificate string `json:"crt"`
 		PrivateKey  string `json:"key"`
+		// ClientCA is the CA certificate clients must present a certificate of. Client certificates are not required if this is empty.
+		ClientCA string `json:"clientCA,omitempty"`
 	} `json:"tls"`
 	Handover struct {
 		Enabled bool   `json:"enabled"`
 		Sockets string `json:"sockets"`
 	} `json:"handover"`
+	StoreGC struct {
+		// Interval is the time between two content store GC runs. GC is disabled if this is zero.
+		// If StoreMaxBytes is set, the store size is checked at this interval as well.
+		Interval util.Duration `json:"interval,omitempty"`
+		// Retention is the time blobs are kept in the store after they were last used. Defaults to 24 hours.
+		Retention util.Duration `json:"retention,omitempty"`
+	} `json:"storeGC"`
+}
+
+// RemoteSpecProviderConfig configures a remote spec provider
+type RemoteSpecProviderConfig struct {
+	Addr string                 `json:"addr"`
+	TLS  *RemoteSpecProviderTLS `json:"tls,omitempty"`
+}
+
+// RemoteSpecProviderTLS configures the TLS client certificate used to connect to a remote spec provider
+type RemoteSpecProviderTLS struct {
+	Authority   string `json:"ca"`
+	Certificate string `json:"crt"`
+	PrivateKey  string `json:"key"`
+}
+
+// RemoteSpecProviderConfigs configures a list of remote spec providers. We fail over to the next provider
+// if the ones before are unavailable. For backwards compatibility a single provider can be configured
+// using an object instead of a list.
+type RemoteSpecProviderConfigs []RemoteSpecProviderConfig
+
+// UnmarshalJSON unmarshals a list of remote spec provider configs or a single one
+func (c *RemoteSpecProviderConfigs) UnmarshalJSON(data []byte) error {
+	if d := bytes.TrimSpace(data); len(d) > 0 && d[0] == '{' {
+		var single RemoteSpecProviderConfig
+		err := json.Unmarshal(d, &single)
+		if err != nil {
+			return err
+		}
+		*c = RemoteSpecProviderConfigs{single}
+		return nil
+	}
+
+	var list []RemoteSpecProviderConfig
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+	*c = list
+	return nil
 }
 
 // ResolverProvider provides new resolver
@@ -70,19 +153,60 @@ type ResolverProvider func() remotes.Resolver
 
 // Registry acts as registry facade
 type Registry struct {
-	Config         Config
-	Resolver       ResolverProvider
-	Store          content.Store
-	LayerSource    LayerSource
-	ConfigModifier ConfigModifier
-	SpecProvider   map[string]ImageSpecProvider
+	Config       Config
+	Resolver     ResolverProvider
+	Store        content.Store
+	SpecProvider map[string]ImageSpecProvider
+	// Authorizer decides which repositories authenticated clients may access if authentication is required.
+	// Defaults to ScopeAuthorizer.
+	Authorizer Authorizer
+
+	metrics     *metrics
+	tags        *tagCache
+	transcoder  *layerTranscoder
+	localSpecs  *FileSpecProvider
+	remoteSpecs []*RemoteSpecProvider
+	storePath   string
+	gc          *storeGC
+	auth        *authenticator
+
+	layerBuilder *layerSetBuilder
+	// reloadMu serializes reloads of the static layers
+	reloadMu   sync.Mutex
+	layersMu   sync.RWMutex
+	layers     *layerSet
+	superseded []supersededLayerSet
+
+	mu     sync.Mutex
+	srv    *http.Server
+	closed bool
+}
 
-	metrics *metrics
-	srv     *http.Server
+const (
+	// EnvStore overrides the store path of the config if set
+	EnvStore = "REGFAC_STORE"
+	// EnvPrefix overrides the route prefix of the config if set, even if it's set to an empty string
+	EnvPrefix = "REGFAC_PREFIX"
+)
+
+// applyEnvOverrides returns cfg with the store path and prefix replaced by the values of the
+// EnvStore and EnvPrefix environment variables, so that container deployments can adjust them
+// without editing the config file. Set env vars take precedence over the config; the Telepresence
+// root is applied on top of the resulting store path.
+func applyEnvOverrides(cfg Config) Config {
+	if store := os.Getenv(EnvStore); store != "" {
+		cfg.Store = store
+	}
+	if prefix, ok := os.LookupEnv(EnvPrefix); ok {
+		cfg.Prefix = prefix
+	}
+	return cfg
 }
 
 // NewRegistry creates a new registry
 func NewRegistry(cfg Config, newResolver ResolverProvider, reg prometheus.Registerer) (*Registry, error) {
+	cfg = applyEnvOverrides(cfg)
+
 	storePath := cfg.Store
 	if tproot := os.Getenv("TELEPRESENCE_ROOT"); tproot != "" {
 		storePath = filepath.Join(tproot, storePath)
@@ -91,7 +215,6 @@ func NewRegistry(cfg Config, newResolver ResolverProvider, reg prometheus.Regist
 	if err != nil {
 		return nil, err
 	}
-	// TODO: GC the store
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -101,7 +224,14 @@ func NewRegistry(cfg Config, newResolver ResolverProvider, reg prometheus.Regist
 		return nil, err
 	}
 
-	var layerSources []LayerSource
+	pool := newResolverPool(newResolver, time.Duration(cfg.ResolverIdleTimeout), metrics)
+	// a transient registry hiccup should not fail the whole manifest assembly
+	newResolver = NewRetryingResolverProvider(pool.Provider(), cfg.ResolverRetry)
+
+	layerSourceMetrics, err := newLayerSourceMetrics(reg)
+	if err != nil {
+		return nil, err
+	}
 
 	ideRefSource := func(s *api.ImageSpec) (ref string, err error) {
 		return s.IdeRef, nil
@@ -110,98 +240,171 @@ func NewRegistry(cfg Config, newResolver ResolverProvider, reg prometheus.Regist
 	if err != nil {
 		return nil, err
 	}
-	layerSources = append(layerSources, ideLayerSource)
+	clsrc, err := NewContentLayerSource()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create content layer source: %w", err)
+	}
 
-	log.Info("preparing static layer")
-	for _, sl := range cfg.StaticLayer {
-		switch sl.Type {
-		case "file":
-			src, err := NewFileLayerSource(ctx, sl.Ref)
-			if err != nil {
-				return nil, fmt.Errorf("cannot source layer from %s: %w", sl.Ref, err)
-			}
-			layerSources = append(layerSources, src)
-		case "image":
-			src, err := NewStaticSourceFromImage(ctx, newResolver(), sl.Ref)
+	specProvider := map[string]ImageSpecProvider{}
+	var remotes []*RemoteSpecProvider
+	if len(cfg.RemoteSpecProvider) > 0 {
+		for _, rsp := range cfg.RemoteSpecProvider {
+			opts, err := remoteSpecProviderDialOptions(rsp)
 			if err != nil {
-				return nil, fmt.Errorf("cannot source layer from %s: %w", sl.Ref, err)
+				return nil, err
 			}
-			layerSources = append(layerSources, src)
-		default:
-			return nil, fmt.Errorf("unknown static layer type: %s", sl.Type)
+			remotes = append(remotes, NewRemoteSpecProvider(rsp.Addr, opts))
 		}
+		failover, err := NewFailoverSpecProvider(remotes, reg)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create failover spec provider: %w", err)
+		}
+
+		// the cache sits in front of the failover provider so that cached specs can be served
+		// while none of the remote spec providers is reachable
+		cacheSize := cfg.SpecCache.Size
+		if cacheSize == 0 {
+			cacheSize = defaultSpecCacheSize
+		}
+		specprov, err := NewCachingSpecProvider(cacheSize, failover, reg)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create caching spec provider: %w", err)
+		}
+		specprov.TTL = time.Duration(cfg.SpecCache.TTL)
+		specprov.ServeStale = cfg.SpecCache.ServeStale
+		specProvider[api.ProviderPrefixRemote] = specprov
 	}
-	clsrc, err := NewContentLayerSource()
+
+	var localSpecs *FileSpecProvider
+	if cfg.LocalSpecProvider != nil {
+		localSpecs, err = NewFileSpecProvider(cfg.LocalSpecProvider.Dir)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create local spec provider: %w", err)
+		}
+		specProvider[api.ProviderPrefixLocal] = localSpecs
+	}
+
+	tags, err := newTagCache(1024)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot create content layer source: %w", err)
+		return nil, xerrors.Errorf("cannot create tag cache: %w", err)
 	}
-	layerSources = append(layerSources, clsrc)
 
-	specProvider := map[string]ImageSpecProvider{}
-	if cfg.RemoteSpecProvider != nil {
-		opts := []grpc.DialOption{
-			grpc.WithUnaryInterceptor(grpc_opentracing.UnaryClientInterceptor(grpc_opentracing.WithTracer(opentracing.GlobalTracer()))),
-			grpc.WithStreamInterceptor(grpc_opentracing.StreamClientInterceptor(grpc_opentracing.WithTracer(opentracing.GlobalTracer()))),
-		}
-
-		if cfg.RemoteSpecProvider.TLS != nil {
-			ca := cfg.RemoteSpecProvider.TLS.Authority
-			crt := cfg.RemoteSpecProvider.TLS.Certificate
-			key := cfg.RemoteSpecProvider.TLS.PrivateKey
-
-			// Telepresence (used for debugging only) requires special paths to load files from
-			if root := os.Getenv("TELEPRESENCE_ROOT"); root != "" {
-				ca = filepath.Join(root, ca)
-				crt = filepath.Join(root, crt)
-				key = filepath.Join(root, key)
+	var gc *storeGC
+	if cfg.StoreGC.Interval > 0 || cfg.StoreMaxBytes > 0 {
+		var retention time.Duration
+		if cfg.StoreGC.Interval > 0 {
+			retention = time.Duration(cfg.StoreGC.Retention)
+			if retention == 0 {
+				retention = defaultStoreGCRetention
 			}
+		}
+		gc = newStoreGC(store, retention, cfg.StoreMaxBytes, metrics)
+	}
 
-			rootCA, err := os.ReadFile(ca)
-			if err != nil {
-				return nil, xerrors.Errorf("could not read ca certificate: %s", err)
-			}
-			certPool := x509.NewCertPool()
-			if ok := certPool.AppendCertsFromPEM(rootCA); !ok {
-				return nil, xerrors.Errorf("failed to append ca certs")
-			}
+	var auth *authenticator
+	if cfg.RequireAuth {
+		auth, err = newAuthenticator(cfg.Auth)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot configure authentication: %w", err)
+		}
+	}
 
-			certificate, err := tls.LoadX509KeyPair(crt, key)
-			if err != nil {
-				log.WithField("config", cfg.TLS).Error("Cannot load ws-manager certs - this is a configuration issue.")
-				return nil, xerrors.Errorf("cannot load ws-manager certs: %w", err)
-			}
+	manifestCacheSize := cfg.ManifestCacheSize
+	if manifestCacheSize == 0 {
+		manifestCacheSize = defaultManifestCacheSize
+	}
+	builder := &layerSetBuilder{
+		Store:              store,
+		Resolver:           newResolver,
+		IDE:                newMeasuringLayerSource(layerSourceIDE, ideLayerSource, layerSourceMetrics),
+		Content:            newMeasuringLayerSource(layerSourceContent, clsrc, layerSourceMetrics),
+		ManifestCacheSize:  manifestCacheSize,
+		Metrics:            metrics,
+		LayerSourceMetrics: layerSourceMetrics,
+	}
 
-			creds := credentials.NewTLS(&tls.Config{
-				Certificates: []tls.Certificate{certificate},
-				RootCAs:      certPool,
-			})
-			opts = append(opts, grpc.WithTransportCredentials(creds))
-			log.
-				WithField("ca", ca).
-				WithField("cert", crt).
-				WithField("key", key).
-				Debug("using TLS config to connect ws-manager")
-		} else {
-			opts = append(opts, grpc.WithInsecure())
-		}
-
-		specprov, err := NewCachingSpecProvider(128, NewRemoteSpecProvider(cfg.RemoteSpecProvider.Addr, opts))
+	res := &Registry{
+		Config:       cfg,
+		Resolver:     newResolver,
+		Store:        store,
+		SpecProvider: specProvider,
+		Authorizer:   ScopeAuthorizer,
+		metrics:      metrics,
+		tags:         tags,
+		localSpecs:   localSpecs,
+		remoteSpecs:  remotes,
+		storePath:    storePath,
+		gc:           gc,
+		auth:         auth,
+		layerBuilder: builder,
+	}
+	if cfg.TranscodeLayers {
+		// the transcoder serves the layers of whichever layer set is in use
+		res.transcoder, err = newLayerTranscoder(currentLayerSource{reg: res}, store, gc)
 		if err != nil {
-			return nil, xerrors.Errorf("cannot create caching spec provider: %w", err)
+			return nil, xerrors.Errorf("cannot create layer transcoder: %w", err)
 		}
-		specProvider[api.ProviderPrefixRemote] = specprov
+		builder.Transcoder = res.transcoder
 	}
 
-	layerSource := CompositeLayerSource(layerSources)
-	return &Registry{
-		Config:         cfg,
-		Resolver:       newResolver,
-		Store:          store,
-		SpecProvider:   specProvider,
-		LayerSource:    layerSource,
-		ConfigModifier: NewConfigModifierFromLayerSource(layerSource),
-		metrics:        metrics,
-	}, nil
+	log.Info("preparing static layer")
+	res.layers, err = builder.Build(ctx, cfg.StaticLayer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// remoteSpecProviderDialOptions produces the gRPC dial options for a remote spec provider
+func remoteSpecProviderDialOptions(c RemoteSpecProviderConfig) ([]grpc.DialOption, error) {
+	opts := []grpc.DialOption{
+		grpc.WithUnaryInterceptor(grpc_opentracing.UnaryClientInterceptor(grpc_opentracing.WithTracer(opentracing.GlobalTracer()))),
+		grpc.WithStreamInterceptor(grpc_opentracing.StreamClientInterceptor(grpc_opentracing.WithTracer(opentracing.GlobalTracer()))),
+	}
+
+	if c.TLS != nil {
+		ca := c.TLS.Authority
+		crt := c.TLS.Certificate
+		key := c.TLS.PrivateKey
+
+		// Telepresence (used for debugging only) requires special paths to load files from
+		if root := os.Getenv("TELEPRESENCE_ROOT"); root != "" {
+			ca = filepath.Join(root, ca)
+			crt = filepath.Join(root, crt)
+			key = filepath.Join(root, key)
+		}
+
+		rootCA, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, xerrors.Errorf("could not read ca certificate: %s", err)
+		}
+		certPool := x509.NewCertPool()
+		if ok := certPool.AppendCertsFromPEM(rootCA); !ok {
+			return nil, xerrors.Errorf("failed to append ca certs")
+		}
+
+		certificate, err := tls.LoadX509KeyPair(crt, key)
+		if err != nil {
+			log.WithField("config", c.TLS).Error("Cannot load ws-manager certs - this is a configuration issue.")
+			return nil, xerrors.Errorf("cannot load ws-manager certs: %w", err)
+		}
+
+		creds := credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			RootCAs:      certPool,
+		})
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+		log.
+			WithField("ca", ca).
+			WithField("cert", crt).
+			WithField("key", key).
+			Debug("using TLS config to connect ws-manager")
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	return opts, nil
 }
 
 // Serve serves the registry on the given port
@@ -209,12 +412,37 @@ func (reg *Registry) Serve() error {
 	routes := distv2.RouterWithPrefix(reg.Config.Prefix)
 	reg.registerHandler(routes)
 
+	if reg.gc != nil {
+		gcCtx, cancelGC := context.WithCancel(context.Background())
+		defer cancelGC()
+		interval := time.Duration(reg.Config.StoreGC.Interval)
+		if interval == 0 {
+			interval = defaultStoreEvictionInterval
+		}
+		go reg.gc.Run(gcCtx, interval)
+	}
+
+	if reg.localSpecs != nil {
+		watchCtx, cancelWatch := context.WithCancel(context.Background())
+		defer cancelWatch()
+		go func() {
+			err := reg.localSpecs.Watch(watchCtx)
+			if err != nil {
+				log.WithError(err).Warn("cannot watch local spec files - changes require a restart")
+			}
+		}()
+	}
+
 	var handler http.Handler = routes
 	if reg.Config.RequireAuth {
-		handler = reg.requireAuthentication(routes)
+		handler = requireAuthentication(reg.auth, routes)
 	}
 	mux := http.NewServeMux()
 	mux.Handle("/", handler)
+	// the probe and version endpoints are served without authentication so that Kubernetes and operators can reach them
+	mux.HandleFunc("/healthz", reg.serveHealthz)
+	mux.HandleFunc("/readyz", reg.serveReadyz)
+	mux.HandleFunc("/version", reg.serveVersion)
 
 	if addr := os.Getenv("REGFAC_NO_TLS_DEBUG"); addr != "" {
 		// Gitpod port-forwarding also does SSL termination. If we only served the HTTPS service
@@ -223,7 +451,7 @@ func (reg *Registry) Serve() error {
 		// HTTP service.
 		//
 		// Note: this is is just meant for a telepresence setup
-		go http.ListenAndServe(addr, mux)
+		go http.ListenAndServe(addr, reg.Config.Limits.limit(mux))
 	}
 
 	addr := fmt.Sprintf(":%d", reg.Config.Port)
@@ -232,6 +460,11 @@ func (reg *Registry) Serve() error {
 		err error
 	)
 	if fn := reg.Config.Handover.Sockets; reg.Config.Handover.Enabled && fn != "" {
+		err = SweepHandoverSockets(fn)
+		if err != nil {
+			log.WithError(err).Warn("cannot remove stale handover sockets")
+		}
+
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		l, err = ReceiveHandover(ctx, reg.Config.Handover.Sockets)
 		cancel()
@@ -247,16 +480,26 @@ func (reg *Registry) Serve() error {
 		}
 	}
 
-	reg.srv = &http.Server{
+	srv := &http.Server{
 		Addr:    addr,
-		Handler: mux,
+		Handler: reg.Config.Limits.limit(mux),
+	}
+	reg.Config.Timeouts.apply(srv)
+	reg.Config.Limits.apply(srv)
+	reg.mu.Lock()
+	if reg.closed {
+		reg.mu.Unlock()
+		l.Close()
+		return nil
 	}
+	reg.srv = srv
+	reg.mu.Unlock()
 
 	var hoc <-chan bool
 	if reg.Config.Handover.Enabled {
 		hoctx, cancelHO := context.WithCancel(context.Background())
 		defer cancelHO()
-		hoc, err = OfferHandover(hoctx, reg.Config.Handover.Sockets, l, reg.srv)
+		hoc, err = OfferHandover(hoctx, reg.Config.Handover.Sockets, l, srv)
 		if err != nil {
 			return err
 		}
@@ -265,23 +508,42 @@ func (reg *Registry) Serve() error {
 	if reg.Config.TLS != nil {
 		log.WithField("addr", addr).Info("HTTPS registry server listening")
 
-		cert, key := reg.Config.TLS.Certificate, reg.Config.TLS.PrivateKey
+		cert, key, clientCA := reg.Config.TLS.Certificate, reg.Config.TLS.PrivateKey, reg.Config.TLS.ClientCA
 		if tproot := os.Getenv("TELEPRESENCE_ROOT"); tproot != "" {
 			cert = filepath.Join(tproot, cert)
 			key = filepath.Join(tproot, key)
+			if clientCA != "" {
+				clientCA = filepath.Join(tproot, clientCA)
+			}
+		}
+		if clientCA != "" {
+			srv.TLSConfig, err = clientAuthTLSConfig(clientCA)
+			if err != nil {
+				return err
+			}
+			log.WithField("clientCA", clientCA).Info("requiring client certificates")
 		}
 
-		return reg.srv.ServeTLS(l, cert, key)
+		err = srv.ServeTLS(l, cert, key)
+		if err == http.ErrServerClosed {
+			// the server was shut down using Close
+			return nil
+		}
+		return err
 	}
 
 	srvErrChan := make(chan error, 1)
 	go func() {
 		log.WithField("addr", addr).Info("HTTP registry server listening")
-		srvErrChan <- reg.srv.Serve(l)
+		srvErrChan <- srv.Serve(l)
 	}()
 
 	select {
 	case err := <-srvErrChan:
+		if err == http.ErrServerClosed {
+			// the server was shut down using Close
+			return nil
+		}
 		return err
 	case handingOver := <-hoc:
 		if !handingOver {
@@ -293,6 +555,36 @@ func (reg *Registry) Serve() error {
 	}
 }
 
+// clientAuthTLSConfig produces a server TLS config which requires clients to present a certificate signed by the CA in caFN
+func clientAuthTLSConfig(caFN string) (*tls.Config, error) {
+	ca, err := os.ReadFile(caFN)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read client CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, xerrors.Errorf("cannot read client CA certificate: %s contains no certificate", caFN)
+	}
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}, nil
+}
+
+// Close stops the registry server from accepting new connections and waits for in-flight requests
+// to complete. It returns once all requests are done or ctx is done, whichever happens first.
+func (reg *Registry) Close(ctx context.Context) error {
+	reg.mu.Lock()
+	srv := reg.srv
+	reg.closed = true
+	reg.mu.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
+}
+
 // MustServe calls serve and logs any error as Fatal
 func (reg *Registry) MustServe() {
 	err := reg.Serve()
@@ -301,8 +593,9 @@ func (reg *Registry) MustServe() {
 	}
 }
 
-// ReceiveHandover lists all Unix sockets in loc, finds the latest and attempts a Listener
-// handover from that socket. If loc == "", this function returns nil, nil.
+// ReceiveHandover lists all Unix sockets in loc and attempts a Listener handover from the latest one.
+// Sockets whose peer is gone or incompatible are skipped in favour of the next latest.
+// If loc == "" or there is no socket to hand over from, this function returns nil, nil.
 func ReceiveHandover(ctx context.Context, loc string) (l net.Listener, err error) {
 	if loc == "" {
 		return nil, nil
@@ -311,22 +604,70 @@ func ReceiveHandover(ctx context.Context, loc string) (l net.Listener, err error
 	if err != nil {
 		return nil, err
 	}
-	var fn string
+	var fns []string
 	for _, f := range fs {
-		if f.Type()*os.ModeSocket == 0 {
+		if f.Type()&os.ModeSocket == 0 {
 			continue
 		}
-		if f.Name() > fn {
-			fn = f.Name()
+		fns = append(fns, f.Name())
+	}
+	// socket names contain the time they were created at, hence the latest sorts last
+	sort.Sort(sort.Reverse(sort.StringSlice(fns)))
+
+	for _, fn := range fns {
+		fn = filepath.Join(loc, fn)
+
+		log.WithField("fn", fn).Debug("found handover socket - attempting listener handover")
+		l, err = handover.ReceiveHandover(ctx, fn)
+		if err == nil {
+			log.WithField("fn", fn).Info("received listener handover")
+			return l, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
+		log.WithError(err).WithField("fn", fn).Warn("cannot receive listener handover - trying the next socket")
 	}
-	if fn == "" {
-		return nil, nil
+	return nil, nil
+}
+
+// SweepHandoverSockets removes the Unix sockets in loc which no process listens on anymore,
+// e.g. because their registry-facade crashed. Sockets of live processes are left alone.
+// If loc == "", this function does nothing.
+func SweepHandoverSockets(loc string) error {
+	if loc == "" {
+		return nil
+	}
+	fs, err := os.ReadDir(loc)
+	if err != nil {
+		return err
 	}
-	fn = filepath.Join(loc, fn)
+	for _, f := range fs {
+		if f.Type()&os.ModeSocket == 0 {
+			continue
+		}
+		fn := filepath.Join(loc, f.Name())
+
+		conn, err := net.Dial("unix", fn)
+		if err == nil {
+			// someone is still offering a handover on this socket. Closing the connection right away
+			// makes the handshake fail, which the offering process shrugs off.
+			conn.Close()
+			continue
+		}
+		if !xerrors.Is(err, syscall.ECONNREFUSED) {
+			log.WithError(err).WithField("fn", fn).Debug("cannot check handover socket - leaving it in place")
+			continue
+		}
 
-	log.WithField("fn", fn).Debug("found handover socket - attempting listener handover")
-	return handover.ReceiveHandover(ctx, fn)
+		err = os.Remove(fn)
+		if err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("fn", fn).Warn("cannot remove stale handover socket")
+			continue
+		}
+		log.WithField("fn", fn).Info("removed stale handover socket")
+	}
+	return nil
 }
 
 // Shutdowner is a process that can be shut down
@@ -372,42 +713,50 @@ func OfferHandover(ctx context.Context, loc string, l net.Listener, s Shutdowner
 	return handingOverC, nil
 }
 
-func (reg *Registry) requireAuthentication(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fail := func() {
-			w.Header().Add("WWW-Authenticate", "Basic")
-			w.WriteHeader(http.StatusUnauthorized)
-		}
-
-		_, _, ok := r.BasicAuth()
-		if !ok {
-			fail()
-			return
-		}
-
-		// todo: implement auth
-
-		h.ServeHTTP(w, r)
-	})
-}
-
 // registerHandler registers the handle* functions with the corresponding routes
 func (reg *Registry) registerHandler(routes *mux.Router) {
 	routes.Get(distv2.RouteNameBase).HandlerFunc(reg.handleAPIBase)
-	routes.Get(distv2.RouteNameManifest).Handler(dispatcher(reg.handleManifest))
-	// routes.Get(v2.RouteNameCatalog).Handler(dispatcher(reg.handleCatalog))
-	// routes.Get(v2.RouteNameTags).Handler(dispatcher(reg.handleTags))
-	routes.Get(distv2.RouteNameBlob).Handler(dispatcher(reg.handleBlob))
-	// routes.Get(v2.RouteNameBlobUpload).Handler(dispatcher(reg.handleBlobUpload))
-	// routes.Get(v2.RouteNameBlobUploadChunk).Handler(dispatcher(reg.handleBlobUploadChunk))
+	// blobs can take long to transfer and are limited by the server's write timeout only - see ServerTimeouts
+	timeouts := reg.Config.Timeouts
+	routes.Get(distv2.RouteNameManifest).Handler(timeouts.limitWrite(dispatcher(reg.authorize(reg.handleManifest), reg.Config.LogRequests)))
+	// routes.Get(v2.RouteNameCatalog).Handler(dispatcher(reg.handleCatalog, reg.Config.LogRequests))
+	routes.Get(distv2.RouteNameTags).Handler(timeouts.limitWrite(dispatcher(reg.authorize(reg.handleTags), reg.Config.LogRequests)))
+	routes.Get(distv2.RouteNameBlob).Handler(dispatcher(reg.authorize(reg.handleBlob), reg.Config.LogRequests))
+	// routes.Get(v2.RouteNameBlobUpload).Handler(dispatcher(reg.handleBlobUpload, reg.Config.LogRequests))
+	// routes.Get(v2.RouteNameBlobUploadChunk).Handler(dispatcher(reg.handleBlobUploadChunk, reg.Config.LogRequests))
 	routes.NotFoundHandler = http.HandlerFunc(reg.handleAPIBase)
 }
 
+const (
+	// distributionAPIVersionHeader announces the registry API version, which some clients check on the base endpoint
+	distributionAPIVersionHeader = "Docker-Distribution-API-Version"
+	distributionAPIVersion       = "registry/2.0"
+
+	// featuresHeader lists the features the registry facade supports if Config.AdvertiseFeatures is set
+	featuresHeader = "X-RegistryFacade-Features"
+)
+
+// features returns the features this registry facade supports as configured
+func (reg *Registry) features() []string {
+	res := []string{"manifests", "blobs", "tags"}
+	if reg.Config.TranscodeLayers {
+		res = append(res, "transcode")
+	}
+	if reg.Config.RequireAuth {
+		res = append(res, "auth")
+	}
+	return res
+}
+
 // handleApiBase implements a simple yes-man for doing overall checks against the
 // api. This can support auth roundtrips to support docker login.
 func (reg *Registry) handleAPIBase(w http.ResponseWriter, r *http.Request) {
 	const emptyJSON = "{}"
 	// Provide a simple /v2/ 200 OK response with empty json response.
+	w.Header().Set(distributionAPIVersionHeader, distributionAPIVersion)
+	if reg.Config.AdvertiseFeatures {
+		w.Header().Set(featuresHeader, strings.Join(reg.features(), ","))
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Length", fmt.Sprint(len(emptyJSON)))
 
@@ -416,14 +765,30 @@ func (reg *Registry) handleAPIBase(w http.ResponseWriter, r *http.Request) {
 
 type dispatchFunc func(ctx context.Context, r *http.Request) http.Handler
 
-// dispatcher wraps a dispatchFunc and provides context
-func dispatcher(d dispatchFunc) http.Handler {
+// dispatcher wraps a dispatchFunc and provides context. If logRequests is set, requests are logged at debug level.
+// Every request is traced in a span which continues the trace of the client if there is one.
+func dispatcher(d dispatchFunc, logRequests bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fc, _ := httputil.DumpRequest(r, false)
-		fmt.Fprint(os.Stderr, string(fc))
+		if logRequests {
+			log.WithFields(requestLogFields(r)).Debug("registry request")
+		}
+
+		span := startRequestSpan(r)
+		sw := &statusRecordingResponseWriter{ResponseWriter: w}
+		w = sw
+		defer func() {
+			if sw.Status == 0 {
+				sw.Status = http.StatusOK
+			}
+			ext.HTTPStatusCode.Set(span, uint16(sw.Status))
+			if sw.Status >= http.StatusBadRequest {
+				ext.Error.Set(span, true)
+			}
+			span.Finish()
+		}()
 
 		// Get context from request, add vars and other info and sync back
-		ctx := r.Context()
+		ctx := opentracing.ContextWithSpan(r.Context(), span)
 		ctx = &muxVarsContext{
 			Context: ctx,
 			vars:    mux.Vars(r),
@@ -446,6 +811,68 @@ func dispatcher(d dispatchFunc) http.Handler {
 	})
 }
 
+// startRequestSpan starts the span of a registry request, tagged with the route, repository name and reference
+// or digest. The span is a child of the client's span if the request carries its trace context.
+func startRequestSpan(r *http.Request) opentracing.Span {
+	route := "unknown"
+	if cr := mux.CurrentRoute(r); cr != nil && cr.GetName() != "" {
+		route = cr.GetName()
+	}
+
+	tracer := opentracing.GlobalTracer()
+	var opts []opentracing.StartSpanOption
+	if clientCtx, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header)); err == nil {
+		opts = append(opts, ext.RPCServerOption(clientCtx))
+	} else {
+		opts = append(opts, ext.SpanKindRPCServer)
+	}
+	span := tracer.StartSpan("registry."+route, opts...)
+	ext.HTTPMethod.Set(span, r.Method)
+	ext.HTTPUrl.Set(span, r.URL.Path)
+	span.SetTag("route", route)
+
+	vars := mux.Vars(r)
+	for _, k := range []string{"name", "reference", "digest"} {
+		if v, ok := vars[k]; ok {
+			span.SetTag(k, v)
+		}
+	}
+	return span
+}
+
+// statusRecordingResponseWriter records the status code of a response
+type statusRecordingResponseWriter struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (w *statusRecordingResponseWriter) WriteHeader(status int) {
+	if w.Status == 0 {
+		w.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecordingResponseWriter) Write(p []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// requestLogFields produces the log fields of a request. We never log the value of the Authorization header,
+// only whether a request carries one.
+func requestLogFields(r *http.Request) map[string]interface{} {
+	return map[string]interface{}{
+		"method":        r.Method,
+		"path":          r.URL.Path,
+		"accept":        strings.Join(r.Header.Values("Accept"), ", "),
+		"userAgent":     r.UserAgent(),
+		"range":         r.Header.Get("Range"),
+		"authorization": r.Header.Get("Authorization") != "",
+	}
+}
+
 func respondWithError(w http.ResponseWriter, terr error) {
 	err := errcode.ServeJSON(w, terr)
 	if err != nil {
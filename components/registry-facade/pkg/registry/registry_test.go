@@ -0,0 +1,585 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content/local"
+	distv2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/registry-facade/pkg/handover"
+)
+
+func TestDispatcherLogging(t *testing.T) {
+	const token = "secret-token"
+
+	tests := []struct {
+		Desc        string
+		Config      string
+		Expectation bool
+	}{
+		{Desc: "default", Config: `{}`},
+		{Desc: "disabled", Config: `{"logRequests": false}`},
+		{Desc: "enabled", Config: `{"logRequests": true}`, Expectation: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var cfg Config
+			err := json.Unmarshal([]byte(test.Config), &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			logger := log.Log.Logger
+			prevOut, prevLevel, prevFormatter := logger.Out, logger.GetLevel(), logger.Formatter
+			logger.SetOutput(&out)
+			logger.SetLevel(logrus.DebugLevel)
+			logger.SetFormatter(&logrus.JSONFormatter{})
+			defer func() {
+				logger.SetOutput(prevOut)
+				logger.SetLevel(prevLevel)
+				logger.SetFormatter(prevFormatter)
+			}()
+
+			routes := mux.NewRouter()
+			routes.Handle("/v2/{name:.+}/manifests/{reference}", dispatcher(func(ctx context.Context, r *http.Request) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			}, cfg.LogRequests))
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/remote/foo/manifests/latest", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Accept", "application/vnd.oci.image.manifest.v1+json")
+			routes.ServeHTTP(httptest.NewRecorder(), req)
+
+			logged := strings.Contains(out.String(), "registry request")
+			if logged != test.Expectation {
+				t.Errorf("unexpected request logging: expected %v, got %v: %s", test.Expectation, logged, out.String())
+			}
+			if strings.Contains(out.String(), token) {
+				t.Errorf("Authorization header value was logged: %s", out.String())
+			}
+			if test.Expectation && !strings.Contains(out.String(), "/v2/remote/foo/manifests/latest") {
+				t.Errorf("request path was not logged: %s", out.String())
+			}
+		})
+	}
+}
+
+func TestDispatcherTracing(t *testing.T) {
+	tests := []struct {
+		Desc          string
+		Path          string
+		ClientSpan    bool
+		Status        int
+		ExpectedTags  map[string]interface{}
+		ExpectedError bool
+	}{
+		{
+			Desc:   "manifest",
+			Path:   "/v2/remote/foo/manifests/latest",
+			Status: http.StatusOK,
+			ExpectedTags: map[string]interface{}{
+				"route":     "manifest",
+				"name":      "remote/foo",
+				"reference": "latest",
+			},
+		},
+		{
+			Desc:       "blob with client trace",
+			Path:       "/v2/remote/foo/blobs/sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			ClientSpan: true,
+			Status:     http.StatusOK,
+			ExpectedTags: map[string]interface{}{
+				"route":  "blob",
+				"name":   "remote/foo",
+				"digest": "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			},
+		},
+		{
+			Desc:   "error",
+			Path:   "/v2/remote/foo/manifests/latest",
+			Status: http.StatusNotFound,
+			ExpectedTags: map[string]interface{}{
+				"route":     "manifest",
+				"name":      "remote/foo",
+				"reference": "latest",
+			},
+			ExpectedError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			tracer := mocktracer.New()
+			prevTracer := opentracing.GlobalTracer()
+			opentracing.SetGlobalTracer(tracer)
+			defer opentracing.SetGlobalTracer(prevTracer)
+
+			routes := distv2.RouterWithPrefix("")
+			handler := dispatcher(func(ctx context.Context, r *http.Request) http.Handler {
+				// spans started by the handlers must be part of the request's trace
+				span, _ := opentracing.StartSpanFromContext(ctx, "handler")
+				span.Finish()
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if test.Status != http.StatusOK {
+						w.WriteHeader(test.Status)
+					}
+				})
+			}, false)
+			routes.Get(distv2.RouteNameManifest).Handler(handler)
+			routes.Get(distv2.RouteNameBlob).Handler(handler)
+
+			req := httptest.NewRequest(http.MethodGet, test.Path, nil)
+			var clientSpan *mocktracer.MockSpan
+			if test.ClientSpan {
+				clientSpan = tracer.StartSpan("client").(*mocktracer.MockSpan)
+				err := tracer.Inject(clientSpan.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			routes.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := tracer.FinishedSpans()
+			if len(spans) != 2 {
+				t.Fatalf("expected two finished spans, got %d", len(spans))
+			}
+			handlerSpan, requestSpan := spans[0], spans[1]
+			if handlerSpan.ParentID != requestSpan.SpanContext.SpanID {
+				t.Errorf("handler span is not a child of the request span")
+			}
+			if clientSpan != nil && requestSpan.ParentID != clientSpan.SpanContext.SpanID {
+				t.Errorf("request span is not a child of the client span")
+			}
+			if clientSpan == nil && requestSpan.ParentID != 0 {
+				t.Errorf("request span has unexpected parent %d", requestSpan.ParentID)
+			}
+
+			tags := requestSpan.Tags()
+			for k, v := range test.ExpectedTags {
+				if tags[k] != v {
+					t.Errorf("unexpected span tag %s: expected %v, got %v", k, v, tags[k])
+				}
+			}
+			if status := tags[string(ext.HTTPStatusCode)]; status != uint16(test.Status) {
+				t.Errorf("unexpected status code tag: expected %d, got %v", test.Status, status)
+			}
+			if isErr, _ := tags[string(ext.Error)].(bool); isErr != test.ExpectedError {
+				t.Errorf("unexpected error tag: expected %v, got %v", test.ExpectedError, isErr)
+			}
+		})
+	}
+}
+
+func TestRegistryClose(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	// readiness checks against an unreachable spec provider take until the readiness timeout,
+	// which gives us an in-flight request
+	unreachable := NewRemoteSpecProvider(l.Addr().String(), []grpc.DialOption{grpc.WithInsecure()})
+	store, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &Registry{
+		Config:      Config{Port: port},
+		Store:       store,
+		remoteSpecs: []*RemoteSpecProvider{unreachable},
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- reg.Serve()
+	}()
+
+	url := fmt.Sprintf("http://localhost:%d", port)
+	for i := 0; ; i++ {
+		resp, err := http.Get(url + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if i > 100 {
+			t.Fatalf("registry did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	inflight := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url + "/readyz")
+		if err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+			inflight <- 0
+			return
+		}
+		resp.Body.Close()
+		inflight <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*readinessTimeout)
+	defer cancel()
+	err = reg.Close(ctx)
+	if err != nil {
+		t.Fatalf("cannot close registry: %v", err)
+	}
+
+	select {
+	case code := <-inflight:
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("unexpected status code of the in-flight request: %d", code)
+		}
+	default:
+		t.Errorf("Close returned before the in-flight request was done")
+	}
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			t.Errorf("unexpected serve error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Serve did not return after Close")
+	}
+	if _, err := http.Get(url + "/healthz"); err == nil {
+		t.Errorf("registry still accepts requests after Close")
+	}
+}
+
+func TestReceiveHandoverSkipsStaleSocket(t *testing.T) {
+	loc := t.TempDir()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	offerErr := make(chan error, 1)
+	go func() {
+		offerErr <- handover.OfferHandover(ctx, filepath.Join(loc, "rf-handover-1.sock"), l.(*net.TCPListener))
+	}()
+
+	// a crashed predecessor leaves its socket behind without anyone listening on it
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(loc, "rf-handover-2.sock"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	var rl net.Listener
+	for i := 0; rl == nil; i++ {
+		rl, err = ReceiveHandover(ctx, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 100 {
+			t.Fatal("did not receive a listener handover")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rl.Addr().String() != l.Addr().String() {
+		t.Errorf("received wrong listener: expected %s, got %s", l.Addr(), rl.Addr())
+	}
+	rl.Close()
+
+	err = <-offerErr
+	if err != nil {
+		t.Errorf("unexpected offer error: %v", err)
+	}
+}
+
+func TestSweepHandoverSockets(t *testing.T) {
+	loc := t.TempDir()
+
+	live, err := net.Listen("unix", filepath.Join(loc, "rf-handover-1.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(loc, "rf-handover-2.sock"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	err = os.WriteFile(filepath.Join(loc, "not-a-socket"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SweepHandoverSockets(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := os.ReadDir(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var act []string
+	for _, f := range fs {
+		act = append(act, f.Name())
+	}
+	if diff := cmp.Diff([]string{"not-a-socket", "rf-handover-1.sock"}, act); diff != "" {
+		t.Errorf("unexpected files after sweep (-want +got):\n%s", diff)
+	}
+}
+
+func TestServeClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCertificate(t, "ca", nil, nil)
+	srvCert, srvKey := newTestCertificate(t, "localhost", ca, caKey)
+	clientCert, clientKey := newTestCertificate(t, "client", ca, caKey)
+	untrustedCert, untrustedKey := newTestCertificate(t, "untrusted", nil, nil)
+
+	writePEM := func(fn, tpe string, der []byte) string {
+		fn = filepath.Join(dir, fn)
+		err := os.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: tpe, Bytes: der}), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	keyPEM := func(fn string, key *ecdsa.PrivateKey) string {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writePEM(fn, "EC PRIVATE KEY", der)
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	var cfg Config
+	err = json.Unmarshal([]byte(fmt.Sprintf(`{"port": %d, "tls": {"crt": %q, "key": %q, "clientCA": %q}}`,
+		port,
+		writePEM("tls.crt", "CERTIFICATE", srvCert.Raw),
+		keyPEM("tls.key", srvKey),
+		writePEM("ca.crt", "CERTIFICATE", ca.Raw),
+	)), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &Registry{Config: cfg}
+	go reg.Serve()
+	defer reg.Close(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientFor := func(cert *x509.Certificate, key *ecdsa.PrivateKey) *http.Client {
+		tlsCfg := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			tlsCfg.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	}
+	url := fmt.Sprintf("https://localhost:%d/healthz", port)
+
+	for i := 0; ; i++ {
+		resp, err := clientFor(clientCert, clientKey).Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status code with a trusted client certificate: %d", resp.StatusCode)
+			}
+			break
+		}
+		if i > 100 {
+			t.Fatalf("request with a trusted client certificate failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		Desc string
+		Cert *x509.Certificate
+		Key  *ecdsa.PrivateKey
+	}{
+		{Desc: "no client certificate"},
+		{Desc: "untrusted client certificate", Cert: untrustedCert, Key: untrustedKey},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			resp, err := clientFor(test.Cert, test.Key).Get(url)
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("expected the request to be rejected, got status code %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// newTestCertificate produces a certificate for name signed by parent. If parent is nil, the certificate is a self-signed CA.
+func newTestCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestHandleAPIBase(t *testing.T) {
+	tests := []struct {
+		Desc             string
+		Config           Config
+		ExpectedFeatures string
+	}{
+		{Desc: "default"},
+		{Desc: "advertise features", Config: Config{AdvertiseFeatures: true}, ExpectedFeatures: "manifests,blobs,tags"},
+		{Desc: "advertise optional features", Config: Config{AdvertiseFeatures: true, TranscodeLayers: true, RequireAuth: true}, ExpectedFeatures: "manifests,blobs,tags,transcode,auth"},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			reg := &Registry{Config: test.Config}
+			routes := distv2.RouterWithPrefix("")
+			reg.registerHandler(routes)
+
+			rec := httptest.NewRecorder()
+			routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("unexpected status code: expected %d, got %d", http.StatusOK, rec.Code)
+			}
+			if v := rec.Header().Get("Docker-Distribution-API-Version"); v != "registry/2.0" {
+				t.Errorf("unexpected API version header: %q", v)
+			}
+			if v := rec.Header().Get(featuresHeader); v != test.ExpectedFeatures {
+				t.Errorf("unexpected features header: expected %q, got %q", test.ExpectedFeatures, v)
+			}
+			if body := rec.Body.String(); body != "{}" {
+				t.Errorf("unexpected body: %q", body)
+			}
+		})
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	type expectation struct {
+		Store  string
+		Prefix string
+	}
+	tests := []struct {
+		Desc        string
+		Env         map[string]string
+		Expectation expectation
+	}{
+		{
+			Desc:        "no overrides",
+			Expectation: expectation{Store: "/mnt/cache/registry", Prefix: "registry.gitpod.io"},
+		},
+		{
+			Desc:        "store override",
+			Env:         map[string]string{EnvStore: "/var/lib/registry-facade"},
+			Expectation: expectation{Store: "/var/lib/registry-facade", Prefix: "registry.gitpod.io"},
+		},
+		{
+			Desc:        "prefix override",
+			Env:         map[string]string{EnvPrefix: "reg.example.com"},
+			Expectation: expectation{Store: "/mnt/cache/registry", Prefix: "reg.example.com"},
+		},
+		{
+			Desc:        "both overrides",
+			Env:         map[string]string{EnvStore: "/var/lib/registry-facade", EnvPrefix: "reg.example.com"},
+			Expectation: expectation{Store: "/var/lib/registry-facade", Prefix: "reg.example.com"},
+		},
+		{
+			Desc:        "empty store is ignored",
+			Env:         map[string]string{EnvStore: ""},
+			Expectation: expectation{Store: "/mnt/cache/registry", Prefix: "registry.gitpod.io"},
+		},
+		{
+			Desc:        "empty prefix clears the prefix",
+			Env:         map[string]string{EnvPrefix: ""},
+			Expectation: expectation{Store: "/mnt/cache/registry"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			for _, k := range []string{EnvStore, EnvPrefix} {
+				if v, ok := os.LookupEnv(k); ok {
+					defer os.Setenv(k, v)
+				} else {
+					defer os.Unsetenv(k)
+				}
+				os.Unsetenv(k)
+			}
+			for k, v := range test.Env {
+				os.Setenv(k, v)
+			}
+
+			cfg := applyEnvOverrides(Config{Store: "/mnt/cache/registry", Prefix: "registry.gitpod.io"})
+
+			act := expectation{Store: cfg.Store, Prefix: cfg.Prefix}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected config (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const defaultResolverIdleTimeout = 5 * time.Minute
+
+// newResolverPool produces a pool which shares resolvers per registry host so that repeated pulls
+// from the same registry reuse connections and cached auth tokens. Resolvers which were not used
+// for idleTimeout are discarded.
+func newResolverPool(newResolver ResolverProvider, idleTimeout time.Duration, metrics *metrics) *resolverPool {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultResolverIdleTimeout
+	}
+	return &resolverPool{
+		newResolver: newResolver,
+		idleTimeout: idleTimeout,
+		metrics:     metrics,
+		resolvers:   make(map[string]*pooledResolver),
+		now:         time.Now,
+	}
+}
+
+type resolverPool struct {
+	newResolver ResolverProvider
+	idleTimeout time.Duration
+	metrics     *metrics
+
+	mu        sync.Mutex
+	resolvers map[string]*pooledResolver
+	now       func() time.Time
+}
+
+type pooledResolver struct {
+	remotes.Resolver
+	lastUsed time.Time
+}
+
+// Provider produces resolvers which use the pooled resolver of the registry each ref points to
+func (p *resolverPool) Provider() ResolverProvider {
+	return func() remotes.Resolver {
+		return poolingResolver{pool: p}
+	}
+}
+
+// get returns the pooled resolver for the registry host of ref
+func (p *resolverPool) get(ref string) remotes.Resolver {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		// the resolver will tell the caller what's wrong with the ref
+		return p.newResolver()
+	}
+	host := reference.Domain(named)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	for h, r := range p.resolvers {
+		if now.Sub(r.lastUsed) > p.idleTimeout {
+			delete(p.resolvers, h)
+		}
+	}
+
+	r, ok := p.resolvers[host]
+	if ok {
+		p.metrics.ResolverPoolHits.Inc()
+	} else {
+		p.metrics.ResolverPoolMisses.Inc()
+		r = &pooledResolver{Resolver: p.newResolver()}
+		p.resolvers[host] = r
+	}
+	r.lastUsed = now
+	return r.Resolver
+}
+
+type poolingResolver struct {
+	pool *resolverPool
+}
+
+// Resolve resolves ref using the pooled resolver of its registry
+func (r poolingResolver) Resolve(ctx context.Context, ref string) (name string, desc ociv1.Descriptor, err error) {
+	return r.pool.get(ref).Resolve(ctx, ref)
+}
+
+// Fetcher returns a fetcher for ref using the pooled resolver of its registry
+func (r poolingResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return r.pool.get(ref).Fetcher(ctx, ref)
+}
+
+// Pusher returns a pusher for ref using the pooled resolver of its registry
+func (r poolingResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return r.pool.get(ref).Pusher(ctx, ref)
+}
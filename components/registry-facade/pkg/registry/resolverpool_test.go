@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResolverPool(t *testing.T) {
+	type use struct {
+		Ref string
+		// After is the time since the previous use
+		After time.Duration
+	}
+	tests := []struct {
+		Desc              string
+		Uses              []use
+		ExpectedResolvers int
+	}{
+		{
+			Desc:              "same registry",
+			Uses:              []use{{Ref: "docker.io/library/alpine:latest"}, {Ref: "alpine:3.14"}, {Ref: "gitpod/workspace-full"}},
+			ExpectedResolvers: 1,
+		},
+		{
+			Desc:              "different registries",
+			Uses:              []use{{Ref: "alpine:latest"}, {Ref: "eu.gcr.io/gitpod/ide:latest"}, {Ref: "eu.gcr.io/gitpod/other:latest"}},
+			ExpectedResolvers: 2,
+		},
+		{
+			Desc:              "used before idle timeout",
+			Uses:              []use{{Ref: "alpine:latest"}, {Ref: "alpine:latest", After: 4 * time.Minute}, {Ref: "alpine:latest", After: 4 * time.Minute}},
+			ExpectedResolvers: 1,
+		},
+		{
+			Desc:              "idle timeout",
+			Uses:              []use{{Ref: "alpine:latest"}, {Ref: "alpine:latest", After: 6 * time.Minute}},
+			ExpectedResolvers: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			metrics, err := newMetrics(prometheus.NewRegistry(), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var created int
+			pool := newResolverPool(func() remotes.Resolver {
+				created++
+				return &flakyResolver{}
+			}, defaultResolverIdleTimeout, metrics)
+			now := time.Now()
+			pool.now = func() time.Time { return now }
+
+			resolver := pool.Provider()()
+			for _, u := range test.Uses {
+				now = now.Add(u.After)
+				_, _, err := resolver.Resolve(context.Background(), u.Ref)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if created != test.ExpectedResolvers {
+				t.Errorf("unexpected number of resolvers: expected %d, got %d", test.ExpectedResolvers, created)
+			}
+			if misses := testutil.ToFloat64(metrics.ResolverPoolMisses); int(misses) != test.ExpectedResolvers {
+				t.Errorf("unexpected resolver pool misses: expected %d, got %v", test.ExpectedResolvers, misses)
+			}
+			if hits := testutil.ToFloat64(metrics.ResolverPoolHits); int(hits) != len(test.Uses)-test.ExpectedResolvers {
+				t.Errorf("unexpected resolver pool hits: expected %d, got %v", len(test.Uses)-test.ExpectedResolvers, hits)
+			}
+		})
+	}
+}
+
+func TestMeasuringRegistryRoundTripperConnectionReuse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	rt, err := NewMeasuringRegistryRoundTripper(&http.Transport{}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rt}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL + "/v2/foo/manifests/latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	metrics := rt.(*measuringRegistryRoundTripper).metrics
+	if n := testutil.ToFloat64(metrics.DownstreamConnections.WithLabelValues("false")); n != 1 {
+		t.Errorf("unexpected number of new connections: expected 1, got %v", n)
+	}
+	if n := testutil.ToFloat64(metrics.DownstreamConnections.WithLabelValues("true")); n != 2 {
+		t.Errorf("unexpected number of reused connections: expected 2, got %v", n)
+	}
+}
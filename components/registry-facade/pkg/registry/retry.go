@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/xerrors"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/common-go/util"
+)
+
+const (
+	defaultResolverRetryAttempts = 3
+	defaultResolverRetryBackoff  = 500 * time.Millisecond
+)
+
+// RetryConfig configures how often and how quickly failed operations are retried
+type RetryConfig struct {
+	// Attempts is the maximum number of attempts. Defaults to 3. Set this to 1 to disable retries.
+	Attempts int `json:"attempts,omitempty"`
+	// Backoff is the time waited before the first retry. It doubles with every retry. Defaults to 500ms.
+	Backoff util.Duration `json:"backoff,omitempty"`
+}
+
+// retry calls op until it succeeds, fails with an error that's not worth retrying or runs out of attempts.
+// If ctx is done while waiting for the next attempt, ctx.Err() is returned.
+func (c RetryConfig) retry(ctx context.Context, op func() error) error {
+	attempts := c.Attempts
+	if attempts <= 0 {
+		attempts = defaultResolverRetryAttempts
+	}
+	backoff := time.Duration(c.Backoff)
+	if backoff <= 0 {
+		backoff = defaultResolverRetryBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= attempts || !isRetryableError(err) {
+			return err
+		}
+		log.WithError(err).WithField("attempt", attempt).WithField("backoff", backoff.String()).Debug("retrying failed registry operation")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// statusCodeRegexp extracts the HTTP status code from the unexpected status errors of containerd's docker resolver
+var statusCodeRegexp = regexp.MustCompile(`unexpected status.*?: (\d{3}) `)
+
+// isRetryableError returns true if err is likely transient, e.g. a timeout, a reset connection or a server error.
+// Errors like "not found" or "unauthorized" are not retryable.
+func isRetryableError(err error) bool {
+	if xerrors.Is(err, context.Canceled) || xerrors.Is(err, context.DeadlineExceeded) {
+		// the caller gave up
+		return false
+	}
+	if errdefs.IsNotFound(err) {
+		return false
+	}
+	if xerrors.Is(err, syscall.ECONNRESET) || xerrors.Is(err, syscall.ECONNREFUSED) || xerrors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if xerrors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if m := statusCodeRegexp.FindStringSubmatch(err.Error()); len(m) == 2 {
+		code, _ := strconv.Atoi(m[1])
+		return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// NewRetryingResolverProvider produces resolvers which retry resolving and fetching on transient errors
+func NewRetryingResolverProvider(provider ResolverProvider, cfg RetryConfig) ResolverProvider {
+	return func() remotes.Resolver {
+		return &retryingResolver{Resolver: provider(), cfg: cfg}
+	}
+}
+
+type retryingResolver struct {
+	remotes.Resolver
+	cfg RetryConfig
+}
+
+// Resolve resolves ref and retries on transient errors
+func (r *retryingResolver) Resolve(ctx context.Context, ref string) (name string, desc ociv1.Descriptor, err error) {
+	err = r.cfg.retry(ctx, func() error {
+		name, desc, err = r.Resolver.Resolve(ctx, ref)
+		return err
+	})
+	return
+}
+
+// Fetcher produces a fetcher for ref which retries on transient errors
+func (r *retryingResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	var f remotes.Fetcher
+	err := r.cfg.retry(ctx, func() (err error) {
+		f, err = r.Resolver.Fetcher(ctx, ref)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &retryingFetcher{Fetcher: f, cfg: r.cfg}, nil
+}
+
+type retryingFetcher struct {
+	remotes.Fetcher
+	cfg RetryConfig
+}
+
+// Fetch starts fetching desc and retries on transient errors. Errors while reading the content are not retried.
+func (f *retryingFetcher) Fetch(ctx context.Context, desc ociv1.Descriptor) (rc io.ReadCloser, err error) {
+	err = f.cfg.retry(ctx, func() error {
+		rc, err = f.Fetcher.Fetch(ctx, desc)
+		return err
+	})
+	return
+}
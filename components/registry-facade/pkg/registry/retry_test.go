@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/xerrors"
+
+	"github.com/gitpod-io/gitpod/common-go/util"
+)
+
+// flakyResolver fails the first len(errs) calls of each operation with the respective error
+type flakyResolver struct {
+	errs []error
+
+	resolveCalls int
+	fetchCalls   int
+}
+
+func (r *flakyResolver) err(call int) error {
+	if call < len(r.errs) {
+		return r.errs[call]
+	}
+	return nil
+}
+
+func (r *flakyResolver) Resolve(ctx context.Context, ref string) (string, ociv1.Descriptor, error) {
+	defer func() { r.resolveCalls++ }()
+	if err := r.err(r.resolveCalls); err != nil {
+		return "", ociv1.Descriptor{}, err
+	}
+	return ref, ociv1.Descriptor{MediaType: ociv1.MediaTypeImageManifest}, nil
+}
+
+func (r *flakyResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return r, nil
+}
+
+func (r *flakyResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return nil, xerrors.Errorf("not supported")
+}
+
+func (r *flakyResolver) Fetch(ctx context.Context, desc ociv1.Descriptor) (io.ReadCloser, error) {
+	defer func() { r.fetchCalls++ }()
+	if err := r.err(r.fetchCalls); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader("content")), nil
+}
+
+func TestRetryingResolver(t *testing.T) {
+	var (
+		errUnavailable  = fmt.Errorf("unexpected status code https://registry:5000/v2/foo/manifests/latest: 503 Service Unavailable")
+		errUnauthorized = fmt.Errorf("unexpected status code https://registry:5000/v2/foo/manifests/latest: 401 Unauthorized")
+		errNotFound     = xerrors.Errorf("registry:5000/foo:latest: %w", errdefs.ErrNotFound)
+		errReset        = xerrors.Errorf("read tcp: %w", syscall.ECONNRESET)
+	)
+
+	tests := []struct {
+		Desc          string
+		Errs          []error
+		Attempts      int
+		ExpectedErr   error
+		ExpectedCalls int
+	}{
+		{Desc: "no error", ExpectedCalls: 1},
+		{Desc: "server error", Errs: []error{errUnavailable, errUnavailable}, ExpectedCalls: 3},
+		{Desc: "connection reset", Errs: []error{errReset}, ExpectedCalls: 2},
+		{Desc: "out of attempts", Errs: []error{errUnavailable, errUnavailable, errUnavailable}, ExpectedErr: errUnavailable, ExpectedCalls: 3},
+		{Desc: "configured attempts", Errs: []error{errUnavailable, errUnavailable}, Attempts: 2, ExpectedErr: errUnavailable, ExpectedCalls: 2},
+		{Desc: "not found", Errs: []error{errNotFound}, ExpectedErr: errNotFound, ExpectedCalls: 1},
+		{Desc: "unauthorized", Errs: []error{errUnauthorized}, ExpectedErr: errUnauthorized, ExpectedCalls: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			cfg := RetryConfig{Attempts: test.Attempts, Backoff: util.Duration(time.Millisecond)}
+			ctx := context.Background()
+
+			res := &flakyResolver{errs: test.Errs}
+			resolver := NewRetryingResolverProvider(func() remotes.Resolver { return res }, cfg)()
+			_, _, err := resolver.Resolve(ctx, "registry:5000/foo:latest")
+			if err != test.ExpectedErr {
+				t.Errorf("unexpected resolve error: expected %v, got %v", test.ExpectedErr, err)
+			}
+			if res.resolveCalls != test.ExpectedCalls {
+				t.Errorf("unexpected number of resolve calls: expected %d, got %d", test.ExpectedCalls, res.resolveCalls)
+			}
+
+			fetcher, err := resolver.Fetcher(ctx, "registry:5000/foo:latest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, err := fetcher.Fetch(ctx, ociv1.Descriptor{})
+			if err != test.ExpectedErr {
+				t.Errorf("unexpected fetch error: expected %v, got %v", test.ExpectedErr, err)
+			}
+			if rc != nil {
+				rc.Close()
+			}
+			if res.fetchCalls != test.ExpectedCalls {
+				t.Errorf("unexpected number of fetch calls: expected %d, got %d", test.ExpectedCalls, res.fetchCalls)
+			}
+		})
+	}
+}
+
+func TestRetryingResolverCancel(t *testing.T) {
+	errUnavailable := fmt.Errorf("unexpected status code https://registry/v2/foo/manifests/latest: 503 Service Unavailable")
+	res := &flakyResolver{errs: []error{errUnavailable, errUnavailable}}
+	resolver := NewRetryingResolverProvider(func() remotes.Resolver { return res }, RetryConfig{Backoff: util.Duration(time.Hour)})()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := resolver.Resolve(ctx, "registry/foo:latest")
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the retry to stop when the context is done, got %v", err)
+	}
+	if res.resolveCalls != 1 {
+		t.Errorf("unexpected number of resolve calls: expected 1, got %d", res.resolveCalls)
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/xerrors"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/registry-facade/api"
+)
+
+// StaticLayerConfig configures a layer which is added to every image
+type StaticLayerConfig struct {
+	Ref  string `json:"ref"`
+	Type string `json:"type"`
+	// Checksum is the expected digest of a layer of type url, e.g. sha256:<hex>. Startup fails if the downloaded
+	// layer does not match. If set, a layer which is in the store already is not downloaded again.
+	Checksum string `json:"checksum,omitempty"`
+	// Retry configures how often downloading a layer of type url is attempted
+	Retry RetryConfig `json:"retry,omitempty"`
+}
+
+// staticLayer is a static layer as it was loaded
+type staticLayer struct {
+	Config StaticLayerConfig
+	Source LayerSource
+}
+
+// layerSet are the layers added to images. The registry replaces the layer set as a whole when the static layers
+// are reloaded, so that each request uses a layer source, config modifier and manifest cache which belong together.
+type layerSet struct {
+	LayerSource    LayerSource
+	ConfigModifier ConfigModifier
+	// Manifests caches the manifests assembled using this layer set. Reloading starts with an empty cache.
+	Manifests *manifestCache
+
+	static []staticLayer
+}
+
+// supersededLayerSetRetention is the time a layer set keeps serving blobs after a reload replaced it
+const supersededLayerSetRetention = 10 * time.Minute
+
+// supersededLayerSet is a layer set which was replaced by a reload
+type supersededLayerSet struct {
+	Layers *layerSet
+	Until  time.Time
+}
+
+// layerSetBuilder loads the static layers and builds layer sets around them
+type layerSetBuilder struct {
+	Store      content.Store
+	Resolver   ResolverProvider
+	IDE        LayerSource
+	Content    LayerSource
+	Transcoder *layerTranscoder
+
+	ManifestCacheSize  int
+	Metrics            *metrics
+	LayerSourceMetrics *layerSourceMetrics
+}
+
+// Build loads the static layers and produces a new layer set. If prev is not nil, its image layers are reused
+// rather than fetched again. Image layers which are not part of prev cannot be added that way.
+func (b *layerSetBuilder) Build(ctx context.Context, cfgs []StaticLayerConfig, prev *layerSet) (*layerSet, error) {
+	static := make([]staticLayer, 0, len(cfgs))
+	for _, sl := range cfgs {
+		src, err := b.loadStaticLayer(ctx, sl, prev)
+		if err != nil {
+			return nil, fmt.Errorf("cannot source layer from %s: %w", sl.Ref, err)
+		}
+		static = append(static, staticLayer{Config: sl, Source: src})
+	}
+
+	sources := make([]LayerSource, 0, len(static)+2)
+	sources = append(sources, b.IDE)
+	for _, sl := range static {
+		sources = append(sources, sl.Source)
+	}
+	sources = append(sources, b.Content)
+	layerSource := CompositeLayerSource(sources)
+
+	configModifier := NewConfigModifierFromLayerSource(layerSource)
+	if b.Transcoder != nil {
+		configModifier = b.Transcoder.ConfigModifier(configModifier)
+	}
+
+	staticLayers := make([]string, 0, len(cfgs))
+	for _, sl := range cfgs {
+		staticLayers = append(staticLayers, sl.Type+":"+sl.Ref)
+	}
+	manifests, err := newManifestCache(b.ManifestCacheSize, staticLayers, b.Metrics)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create manifest cache: %w", err)
+	}
+
+	return &layerSet{
+		LayerSource:    layerSource,
+		ConfigModifier: configModifier,
+		Manifests:      manifests,
+		static:         static,
+	}, nil
+}
+
+func (b *layerSetBuilder) loadStaticLayer(ctx context.Context, sl StaticLayerConfig, prev *layerSet) (LayerSource, error) {
+	switch sl.Type {
+	case "file":
+		src, err := newStoredFileLayerSource(ctx, b.Store, sl.Ref)
+		if err != nil {
+			return nil, err
+		}
+		return newMeasuringLayerSource(layerSourceStaticFile, src, b.LayerSourceMetrics), nil
+	case "image":
+		if prev != nil {
+			// Image layers are served from the upstream registry using the descriptors we resolved at startup.
+			// Resolving them again could change the layers of manifests which are in the middle of being pulled.
+			for _, p := range prev.static {
+				if p.Config.Type == sl.Type && p.Config.Ref == sl.Ref {
+					return p.Source, nil
+				}
+			}
+			return nil, fmt.Errorf("image layers cannot be added without a restart")
+		}
+		src, err := NewStaticSourceFromImage(ctx, b.Resolver(), sl.Ref)
+		if err != nil {
+			return nil, err
+		}
+		return newMeasuringLayerSource(layerSourceStaticImage, src, b.LayerSourceMetrics), nil
+	case "url":
+		src, err := NewURLLayerSource(ctx, b.Store, sl.Ref, digest.Digest(sl.Checksum), sl.Retry)
+		if err != nil {
+			return nil, err
+		}
+		return newMeasuringLayerSource(layerSourceStaticURL, src, b.LayerSourceMetrics), nil
+	default:
+		return nil, fmt.Errorf("unknown static layer type: %s", sl.Type)
+	}
+}
+
+// currentLayers returns the layer set in use
+func (reg *Registry) currentLayers() *layerSet {
+	reg.layersMu.RLock()
+	defer reg.layersMu.RUnlock()
+	return reg.layers
+}
+
+// supersededLayers returns the layer sets which were replaced by a reload within the last
+// supersededLayerSetRetention, oldest first
+func (reg *Registry) supersededLayers() []*layerSet {
+	now := time.Now()
+
+	reg.layersMu.Lock()
+	defer reg.layersMu.Unlock()
+
+	var (
+		res  []*layerSet
+		keep = reg.superseded[:0]
+	)
+	for _, s := range reg.superseded {
+		if !now.Before(s.Until) {
+			continue
+		}
+		keep = append(keep, s)
+		res = append(res, s.Layers)
+	}
+	reg.superseded = keep
+	return res
+}
+
+// ReloadStaticLayers loads the file and url static layers again and replaces the layers added to images.
+// Image layers are kept as they were loaded at startup. Manifests are assembled using the new layers right away,
+// while the previous layers keep serving blobs for supersededLayerSetRetention so that pulls which fetched their
+// manifest before the reload can complete. If loading fails, the registry keeps serving the previous layers.
+func (reg *Registry) ReloadStaticLayers(ctx context.Context, cfgs []StaticLayerConfig) error {
+	reg.reloadMu.Lock()
+	defer reg.reloadMu.Unlock()
+
+	layers, err := reg.layerBuilder.Build(ctx, cfgs, reg.currentLayers())
+	if err != nil {
+		return err
+	}
+
+	reg.layersMu.Lock()
+	if prev := reg.layers; prev != nil {
+		// we only keep what's needed to serve blobs
+		reg.superseded = append(reg.superseded, supersededLayerSet{
+			Layers: &layerSet{LayerSource: prev.LayerSource, ConfigModifier: prev.ConfigModifier},
+			Until:  time.Now().Add(supersededLayerSetRetention),
+		})
+	}
+	reg.layers = layers
+	reg.layersMu.Unlock()
+
+	log.WithField("staticLayers", len(cfgs)).Info("reloaded static layers")
+	return nil
+}
+
+// currentLayerSource delegates to the layer source the registry uses at the time of the call.
+// Blobs of superseded layer sets are served as well.
+type currentLayerSource struct {
+	reg *Registry
+}
+
+func (s currentLayerSource) blobSources() []LayerSource {
+	superseded := s.reg.supersededLayers()
+	res := make([]LayerSource, 0, len(superseded)+1)
+	res = append(res, s.reg.currentLayers().LayerSource)
+	for i := len(superseded) - 1; i >= 0; i-- {
+		res = append(res, superseded[i].LayerSource)
+	}
+	return res
+}
+
+// Envs returns the list of env modifiers
+func (s currentLayerSource) Envs(ctx context.Context, spec *api.ImageSpec) ([]EnvModifier, error) {
+	return s.reg.currentLayers().LayerSource.Envs(ctx, spec)
+}
+
+// GetLayer return all layers of this source
+func (s currentLayerSource) GetLayer(ctx context.Context, spec *api.ImageSpec) ([]AddonLayer, error) {
+	return s.reg.currentLayers().LayerSource.GetLayer(ctx, spec)
+}
+
+// HasBlob checks if a digest can be served by this blob source
+func (s currentLayerSource) HasBlob(ctx context.Context, spec *api.ImageSpec, dgst digest.Digest) bool {
+	for _, src := range s.blobSources() {
+		if src.HasBlob(ctx, spec, dgst) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBlob provides access to a blob. If a ReadCloser is returned the receiver is expected to
+// call close on it eventually.
+func (s currentLayerSource) GetBlob(ctx context.Context, spec *api.ImageSpec, dgst digest.Digest) (mediaType string, url string, data io.ReadCloser, err error) {
+	for _, src := range s.blobSources() {
+		if src.HasBlob(ctx, spec, dgst) {
+			return src.GetBlob(ctx, spec, dgst)
+		}
+	}
+	err = errdefs.ErrNotFound
+	return
+}
+
+// storedFileLayerSource serves a file layer from a copy in the content store. That way clients which fetched
+// a manifest before the file changed can still download the layer as it was, and a changed file is never
+// served under the digest of its previous content.
+type storedFileLayerSource struct {
+	AddonLayer
+	Filename string
+	Store    content.Store
+
+	mu sync.Mutex
+}
+
+func newStoredFileLayerSource(ctx context.Context, store content.Store, fn string) (*storedFileLayerSource, error) {
+	src, err := NewFileLayerSource(ctx, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &storedFileLayerSource{
+		AddonLayer: src[0].AddonLayer,
+		Filename:   fn,
+		Store:      store,
+	}
+	err = res.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// store copies the file into the content store unless the layer is there already.
+// This fails if the file no longer has the digest we loaded.
+func (s *storedFileLayerSource) store(ctx context.Context) error {
+	f, err := os.Open(s.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = content.WriteBlob(ctx, s.Store, "static-layer-"+s.Descriptor.Digest.String(), f, s.Descriptor)
+	if err != nil {
+		return xerrors.Errorf("cannot store layer %s: %w", s.Filename, err)
+	}
+	return nil
+}
+
+// Envs returns the list of env modifiers
+func (s *storedFileLayerSource) Envs(ctx context.Context, spec *api.ImageSpec) ([]EnvModifier, error) {
+	return nil, nil
+}
+
+// GetLayer return all layers of this source
+func (s *storedFileLayerSource) GetLayer(ctx context.Context, spec *api.ImageSpec) ([]AddonLayer, error) {
+	return []AddonLayer{s.AddonLayer}, nil
+}
+
+// HasBlob checks if a digest can be served by this blob source
+func (s *storedFileLayerSource) HasBlob(ctx context.Context, spec *api.ImageSpec, dgst digest.Digest) bool {
+	return s.Descriptor.Digest == dgst
+}
+
+// GetBlob provides access to a blob. If a ReadCloser is returned the receiver is expected to
+// call close on it eventually.
+func (s *storedFileLayerSource) GetBlob(ctx context.Context, spec *api.ImageSpec, dgst digest.Digest) (mediaType string, url string, data io.ReadCloser, err error) {
+	if s.Descriptor.Digest != dgst {
+		err = errdefs.ErrNotFound
+		return
+	}
+
+	r, err := s.Store.ReaderAt(ctx, s.Descriptor)
+	if errdefs.IsNotFound(err) {
+		// the store GC might have removed the layer - copy it again if the file did not change
+		s.mu.Lock()
+		err = s.store(ctx)
+		s.mu.Unlock()
+		if err == nil {
+			r, err = s.Store.ReaderAt(ctx, s.Descriptor)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	return s.Descriptor.MediaType, "", &reader{ReaderAt: r}, nil
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/gitpod-io/gitpod/registry-facade/api"
+)
+
+func newTestLayerSetBuilder(t *testing.T) *layerSetBuilder {
+	store, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := newMetrics(prometheus.NewRegistry(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerSourceMetrics, err := newLayerSourceMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &layerSetBuilder{
+		Store:              store,
+		IDE:                CompositeLayerSource{},
+		Content:            CompositeLayerSource{},
+		ManifestCacheSize:  8,
+		Metrics:            metrics,
+		LayerSourceMetrics: layerSourceMetrics,
+	}
+}
+
+func TestReloadStaticLayersUnderLoad(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	// both the file and the URL layer change with every generation
+	const reloads = 5
+	type generation struct {
+		File, URL []byte
+	}
+	generations := make([]generation, reloads+1)
+	for i := range generations {
+		generations[i].File, _ = testLayerTarball(t, fmt.Sprintf("echo file generation %d\n", i))
+		generations[i].URL, _ = testLayerTarball(t, fmt.Sprintf("echo url generation %d\n", i))
+	}
+	var current int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(generations[atomic.LoadInt64(&current)].URL)
+	}))
+	defer srv.Close()
+
+	fn := filepath.Join(t.TempDir(), "layer.tar.gz")
+	err := os.WriteFile(fn, generations[0].File, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgs := []StaticLayerConfig{
+		{Type: "file", Ref: fn},
+		{Type: "url", Ref: srv.URL},
+	}
+
+	mh := newTestManifestHandler(t, ociv1.MediaTypeImageManifest)
+	builder := newTestLayerSetBuilder(t)
+	builder.Store = mh.Store
+	tags, err := newTagCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &Registry{
+		Resolver:     func() remotes.Resolver { return mh.Resolver },
+		Store:        mh.Store,
+		SpecProvider: map[string]ImageSpecProvider{api.ProviderPrefixRemote: fakeSpecProvider{"foo": mh.Spec}},
+		metrics:      builder.Metrics,
+		tags:         tags,
+		layerBuilder: builder,
+	}
+	reg.layers, err = builder.Build(ctx, cfgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := api.ProviderPrefixRemote + "/foo"
+	getManifest := func() (*ociv1.Manifest, error) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/"+name+"/manifests/latest", nil)
+		req.Header.Set("Accept", ociv1.MediaTypeImageManifest)
+		ctx := &muxVarsContext{Context: req.Context(), vars: map[string]string{"name": name, "reference": "latest"}}
+		rec := httptest.NewRecorder()
+		reg.handleManifest(ctx, req).ServeHTTP(rec, req.WithContext(ctx))
+		if rec.Code != http.StatusOK {
+			return nil, fmt.Errorf("manifest request failed with status %d: %s", rec.Code, rec.Body.String())
+		}
+
+		var mf ociv1.Manifest
+		err := json.Unmarshal(rec.Body.Bytes(), &mf)
+		if err != nil {
+			return nil, err
+		}
+		if len(mf.Layers) != 1+len(cfgs) {
+			return nil, fmt.Errorf("expected %d layers, got %d", 1+len(cfgs), len(mf.Layers))
+		}
+		return &mf, nil
+	}
+	getBlobs := func(mf *ociv1.Manifest) error {
+		for _, desc := range append([]ociv1.Descriptor{mf.Config}, mf.Layers...) {
+			req := httptest.NewRequest(http.MethodGet, "/v2/"+name+"/blobs/"+desc.Digest.String(), nil)
+			ctx := &muxVarsContext{Context: req.Context(), vars: map[string]string{"name": name, "digest": desc.Digest.String()}}
+			rec := httptest.NewRecorder()
+			reg.handleBlob(ctx, req).ServeHTTP(rec, req.WithContext(ctx))
+			if rec.Code != http.StatusOK {
+				return fmt.Errorf("blob %s request failed with status %d: %s", desc.Digest, rec.Code, rec.Body.String())
+			}
+			if act := digest.FromBytes(rec.Body.Bytes()); act != desc.Digest {
+				return fmt.Errorf("blob %s has digest %s", desc.Digest, act)
+			}
+		}
+		return nil
+	}
+
+	// this client fetches its manifest before all reloads and downloads the blobs afterwards
+	early, err := getManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		stop  = make(chan struct{})
+		wg    sync.WaitGroup
+		pulls int64
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				mf, err := getManifest()
+				if err == nil {
+					err = getBlobs(mf)
+				}
+				if err != nil {
+					t.Errorf("pull failed: %v", err)
+					return
+				}
+				atomic.AddInt64(&pulls, 1)
+			}
+		}()
+	}
+
+	configs := map[digest.Digest]struct{}{early.Config.Digest: {}}
+	for i := 1; i <= reloads; i++ {
+		// the file is changed in place, i.e. the layer we loaded before is gone from the file system
+		atomic.StoreInt64(&current, int64(i))
+		err := os.WriteFile(fn, generations[i].File, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prev := reg.currentLayers()
+		err = reg.ReloadStaticLayers(ctx, cfgs)
+		if err != nil {
+			t.Errorf("cannot reload static layers: %v", err)
+			break
+		}
+		if reg.currentLayers().Manifests == prev.Manifests {
+			t.Errorf("reload %d did not invalidate the manifest cache", i)
+		}
+
+		mf, err := getManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs[mf.Config.Digest] = struct{}{}
+	}
+	close(stop)
+	wg.Wait()
+
+	if len(configs) != reloads+1 {
+		t.Errorf("expected every reload to produce a new image config, got %d distinct configs", len(configs))
+	}
+	if atomic.LoadInt64(&pulls) == 0 {
+		t.Error("no pull completed while reloading")
+	}
+	err = getBlobs(early)
+	if err != nil {
+		t.Errorf("pull which fetched its manifest before the reloads failed: %v", err)
+	}
+
+	// once the retention is over, the superseded layers are no longer served
+	reg.layersMu.Lock()
+	for i := range reg.superseded {
+		reg.superseded[i].Until = time.Now()
+	}
+	reg.layersMu.Unlock()
+	err = getBlobs(early)
+	if err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Errorf("expected superseded blobs to be unknown after the retention, got %v", err)
+	}
+	if len(reg.supersededLayers()) != 0 {
+		t.Error("expired layer sets were not removed")
+	}
+}
+
+func TestLayerSetBuilderImageLayers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	imageSource := &FileLayerSource{}
+	prev := &layerSet{static: []staticLayer{
+		{Config: StaticLayerConfig{Type: "image", Ref: "gitpod/supervisor:latest"}, Source: imageSource},
+	}}
+
+	tests := []struct {
+		Desc  string
+		Cfgs  []StaticLayerConfig
+		Error string
+	}{
+		{Desc: "unchanged", Cfgs: []StaticLayerConfig{{Type: "image", Ref: "gitpod/supervisor:latest"}}},
+		{Desc: "removed"},
+		{Desc: "added", Cfgs: []StaticLayerConfig{{Type: "image", Ref: "gitpod/supervisor:commit-1234"}}, Error: "without a restart"},
+		{Desc: "unknown type", Cfgs: []StaticLayerConfig{{Type: "foo", Ref: "bar"}}, Error: "unknown static layer type"},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			layers, err := newTestLayerSetBuilder(t).Build(ctx, test.Cfgs, prev)
+			if test.Error != "" {
+				if err == nil || !strings.Contains(err.Error(), test.Error) {
+					t.Errorf("expected error containing %q, got %v", test.Error, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(layers.static) != len(test.Cfgs) {
+				t.Fatalf("expected %d static layers, got %d", len(test.Cfgs), len(layers.static))
+			}
+			for _, sl := range layers.static {
+				if sl.Source != LayerSource(imageSource) {
+					t.Errorf("image layer %s was not reused", sl.Config.Ref)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	distv2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/gorilla/handlers"
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+)
+
+// errorCodePaginationNumberInvalid is returned when the n parameter of a paginated request is invalid.
+// The version of docker/distribution we use does not define this error code yet.
+var errorCodePaginationNumberInvalid = errcode.Register("registry-facade", errcode.ErrorDescriptor{
+	Value:          "PAGINATION_NUMBER_INVALID",
+	Message:        "invalid number of results requested",
+	Description:    "Returned when the `n` parameter (number of results to return) is not an integer, or `n` is negative.",
+	HTTPStatusCode: http.StatusBadRequest,
+})
+
+// TagListingSpecProvider is an ImageSpecProvider which can enumerate the tags it can resolve for a ref
+type TagListingSpecProvider interface {
+	ImageSpecProvider
+
+	// ListTags returns all tags the spec provider can resolve for the ref
+	ListTags(ctx context.Context, ref string) ([]string, error)
+}
+
+// tagCache remembers the tags which were requested for a name
+type tagCache struct {
+	mu    sync.Mutex
+	cache *lru.Cache
+}
+
+func newTagCache(space int) (*tagCache, error) {
+	cache, err := lru.New(space)
+	if err != nil {
+		return nil, err
+	}
+	return &tagCache{cache: cache}, nil
+}
+
+// Add records a tag for a name
+func (c *tagCache) Add(name, tag string) {
+	if c == nil || tag == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var tags map[string]struct{}
+	if v, ok := c.cache.Get(name); ok {
+		tags = v.(map[string]struct{})
+	} else {
+		tags = make(map[string]struct{})
+	}
+	tags[tag] = struct{}{}
+	c.cache.Add(name, tags)
+}
+
+// List returns all tags recorded for a name
+func (c *tagCache) List(name string) []string {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.cache.Get(name)
+	if !ok {
+		return nil
+	}
+	tags := v.(map[string]struct{})
+	res := make([]string, 0, len(tags))
+	for t := range tags {
+		res = append(res, t)
+	}
+	return res
+}
+
+type tagsAPIResponse struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+func (reg *Registry) handleTags(ctx context.Context, r *http.Request) http.Handler {
+	spname, name := getSpecProviderName(ctx)
+	sp, ok := reg.SpecProvider[spname]
+	if !ok {
+		log.WithField("specProvName", spname).Error("unknown spec provider")
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			respondWithError(w, distv2.ErrorCodeNameUnknown)
+		})
+	}
+
+	th := &tagsHandler{
+		Context:      ctx,
+		Name:         getName(ctx),
+		Ref:          name,
+		SpecProvider: sp,
+		Cache:        reg.tags,
+	}
+	return handlers.MethodHandler{
+		"GET": http.HandlerFunc(th.getTags),
+	}
+}
+
+type tagsHandler struct {
+	Context context.Context
+
+	// Name is the full name including the spec provider prefix, Ref the name without it
+	Name         string
+	Ref          string
+	SpecProvider ImageSpecProvider
+	Cache        *tagCache
+}
+
+func (th *tagsHandler) getTags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	q := r.URL.Query()
+	n := -1
+	if nq := q.Get("n"); nq != "" {
+		var err error
+		n, err = strconv.Atoi(nq)
+		if err != nil || n < 0 {
+			respondWithError(w, errorCodePaginationNumberInvalid.WithDetail(map[string]string{"n": nq}))
+			return
+		}
+	}
+	last := q.Get("last")
+
+	var tags []string
+	if lister, ok := th.SpecProvider.(TagListingSpecProvider); ok {
+		var err error
+		tags, err = lister.ListTags(ctx, th.Ref)
+		if err != nil {
+			log.WithError(err).WithField("name", th.Name).Error("cannot list tags")
+			respondWithError(w, distv2.ErrorCodeNameUnknown)
+			return
+		}
+	} else {
+		// The spec provider cannot tell us which tags exist. We make sure the name is known and
+		// fall back to the tags which were requested for it before.
+		_, err := th.SpecProvider.GetSpec(ctx, th.Ref)
+		if err != nil {
+			log.WithError(err).WithField("name", th.Name).Debug("cannot get spec")
+			respondWithError(w, distv2.ErrorCodeNameUnknown)
+			return
+		}
+		tags = th.Cache.List(th.Name)
+	}
+
+	tags, more := paginateTags(tags, n, last)
+	if more {
+		next := url.Values{}
+		next.Set("n", strconv.Itoa(n))
+		next.Set("last", tags[len(tags)-1])
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, next.Encode()))
+	}
+
+	p, err := json.Marshal(tagsAPIResponse{
+		Name: th.Name,
+		Tags: tags,
+	})
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprint(len(p)))
+	_, _ = w.Write(p)
+}
+
+// paginateTags sorts the tags and returns at most n tags that come after last in lexical order.
+// If n is negative all remaining tags are returned. more is true if there are tags beyond the returned ones.
+func paginateTags(tags []string, n int, last string) (res []string, more bool) {
+	sorted := make([]string, len(tags))
+	copy(sorted, tags)
+	sort.Strings(sorted)
+
+	res = make([]string, 0, len(sorted))
+	for _, t := range sorted {
+		if last != "" && t <= last {
+			continue
+		}
+		res = append(res, t)
+	}
+
+	if n >= 0 && len(res) > n {
+		return res[:n], n > 0
+	}
+	return res, false
+}
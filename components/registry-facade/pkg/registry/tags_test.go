@@ -0,0 +1,211 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/xerrors"
+
+	"github.com/gitpod-io/gitpod/registry-facade/api"
+)
+
+type fakeSpecProvider map[string]*api.ImageSpec
+
+func (p fakeSpecProvider) GetSpec(ctx context.Context, ref string) (*api.ImageSpec, error) {
+	spec, ok := p[ref]
+	if !ok {
+		return nil, xerrors.Errorf("%w: %s", ErrRefInvalid, ref)
+	}
+	return spec, nil
+}
+
+type fakeTagListingSpecProvider struct {
+	fakeSpecProvider
+	Tags []string
+}
+
+func (p fakeTagListingSpecProvider) ListTags(ctx context.Context, ref string) ([]string, error) {
+	return p.Tags, nil
+}
+
+func TestPaginateTags(t *testing.T) {
+	tags := []string{"c", "a", "d", "b"}
+	tests := []struct {
+		Desc string
+		N    int
+		Last string
+		Tags []string
+		More bool
+	}{
+		{Desc: "all", N: -1, Tags: []string{"a", "b", "c", "d"}},
+		{Desc: "first page", N: 2, Tags: []string{"a", "b"}, More: true},
+		{Desc: "second page", N: 2, Last: "b", Tags: []string{"c", "d"}},
+		{Desc: "beyond last", N: 2, Last: "d", Tags: []string{}},
+		{Desc: "empty page", N: 0, Tags: []string{}},
+		{Desc: "last only", N: -1, Last: "a", Tags: []string{"b", "c", "d"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			res, more := paginateTags(tags, test.N, test.Last)
+			if diff := cmp.Diff(test.Tags, res); diff != "" {
+				t.Errorf("unexpected tags (-want +got):\n%s", diff)
+			}
+			if more != test.More {
+				t.Errorf("unexpected more: expected %v, got %v", test.More, more)
+			}
+		})
+	}
+}
+
+func TestGetTags(t *testing.T) {
+	specs := fakeSpecProvider{"foo": &api.ImageSpec{BaseRef: "docker.io/library/alpine:latest"}}
+	cache, err := newTagCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Add("remote/foo", "latest")
+	cache.Add("remote/foo", "1.0")
+	cache.Add("remote/foo", "latest")
+
+	tests := []struct {
+		Desc         string
+		Ref          string
+		SpecProvider ImageSpecProvider
+		Query        string
+		StatusCode   int
+		Response     *tagsAPIResponse
+		Link         string
+	}{
+		{
+			Desc:         "cached tags",
+			Ref:          "foo",
+			SpecProvider: specs,
+			StatusCode:   http.StatusOK,
+			Response:     &tagsAPIResponse{Name: "remote/foo", Tags: []string{"1.0", "latest"}},
+		},
+		{
+			Desc:         "paginated",
+			Ref:          "foo",
+			SpecProvider: specs,
+			Query:        "?n=1",
+			StatusCode:   http.StatusOK,
+			Response:     &tagsAPIResponse{Name: "remote/foo", Tags: []string{"1.0"}},
+			Link:         `</v2/remote/foo/tags/list?last=1.0&n=1>; rel="next"`,
+		},
+		{
+			Desc:         "listing spec provider",
+			Ref:          "foo",
+			SpecProvider: fakeTagListingSpecProvider{fakeSpecProvider: specs, Tags: []string{"b", "a"}},
+			StatusCode:   http.StatusOK,
+			Response:     &tagsAPIResponse{Name: "remote/foo", Tags: []string{"a", "b"}},
+		},
+		{
+			Desc:         "unknown name",
+			Ref:          "bar",
+			SpecProvider: specs,
+			StatusCode:   http.StatusNotFound,
+		},
+		{
+			Desc:         "invalid n",
+			Ref:          "foo",
+			SpecProvider: specs,
+			Query:        "?n=-1",
+			StatusCode:   http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			th := &tagsHandler{
+				Context:      context.Background(),
+				Name:         "remote/" + test.Ref,
+				Ref:          test.Ref,
+				SpecProvider: test.SpecProvider,
+				Cache:        cache,
+			}
+			rec := httptest.NewRecorder()
+			th.getTags(rec, httptest.NewRequest("GET", "/v2/remote/"+test.Ref+"/tags/list"+test.Query, nil))
+
+			if rec.Code != test.StatusCode {
+				t.Fatalf("unexpected status code: expected %d, got %d", test.StatusCode, rec.Code)
+			}
+			if link := rec.Header().Get("Link"); link != test.Link {
+				t.Errorf("unexpected link header: expected %s, got %s", test.Link, link)
+			}
+			if test.Response == nil {
+				return
+			}
+
+			var res tagsAPIResponse
+			err := json.Unmarshal(rec.Body.Bytes(), &res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(*test.Response, res); diff != "" {
+				t.Errorf("unexpected response (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestManifestRecordsTags(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Name        string
+		BaseRef     string
+		Accept      string
+		Reference   string
+		Expectation []string
+	}{
+		{Desc: "served", Name: "foo", Accept: ociv1.MediaTypeImageManifest, Reference: "latest", Expectation: []string{"latest"}},
+		{Desc: "unknown name", Name: "bar", Accept: ociv1.MediaTypeImageManifest, Reference: "latest"},
+		{Desc: "unknown base ref", Name: "foo", BaseRef: "docker.io/library/unknown:latest", Accept: ociv1.MediaTypeImageManifest, Reference: "latest"},
+		{Desc: "unacceptable media type", Name: "foo", Accept: "application/json", Reference: "latest"},
+		{Desc: "digest", Name: "foo", Accept: ociv1.MediaTypeImageManifest, Reference: digest.FromString("manifest").String()},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			mh := newTestManifestHandler(t, ociv1.MediaTypeImageManifest)
+			if test.BaseRef != "" {
+				mh.Spec.BaseRef = test.BaseRef
+			}
+			tags, err := newTagCache(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			metrics, err := newMetrics(prometheus.NewRegistry(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reg := &Registry{
+				Resolver:     func() remotes.Resolver { return mh.Resolver },
+				Store:        mh.Store,
+				SpecProvider: map[string]ImageSpecProvider{api.ProviderPrefixRemote: fakeSpecProvider{"foo": mh.Spec}},
+				metrics:      metrics,
+				tags:         tags,
+				layers:       &layerSet{ConfigModifier: mh.ConfigModifier},
+			}
+
+			name := api.ProviderPrefixRemote + "/" + test.Name
+			req := httptest.NewRequest(http.MethodGet, "/v2/"+name+"/manifests/"+test.Reference, nil)
+			req.Header.Set("Accept", test.Accept)
+			ctx := &muxVarsContext{Context: req.Context(), vars: map[string]string{"name": name, "reference": test.Reference}}
+			reg.handleManifest(ctx, req).ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+			if diff := cmp.Diff(test.Expectation, tags.List(name)); diff != "" {
+				t.Errorf("unexpected tags (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
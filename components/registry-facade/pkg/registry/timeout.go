@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+
+	"github.com/gitpod-io/gitpod/common-go/util"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 1 * time.Minute
+	defaultBlobWriteTimeout  = 30 * time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+// ServerTimeouts configures the timeouts of the registry server. Without them, clients which open connections
+// and never finish their requests (slowloris) can exhaust the connections and memory of the facade.
+//
+// Blobs are a problem here: pulling a layer of a few gigabytes over a slow link legitimately takes minutes,
+// while everything else we serve is small. The net/http server only supports a single write timeout for all
+// requests, which therefore has to be the blob write timeout. All other routes get the shorter write timeout
+// as handler timeout instead, i.e. they fail with 503 if the response is not written in time.
+type ServerTimeouts struct {
+	// ReadHeader is the time clients have to send the request headers. Defaults to 10 seconds.
+	ReadHeader util.Duration `json:"readHeader,omitempty"`
+	// Read is the time clients have to send the whole request. As we only serve GET and HEAD requests this is
+	// hardly longer than ReadHeader. Defaults to 30 seconds.
+	Read util.Duration `json:"read,omitempty"`
+	// Write is the time we have to produce and write responses other than blobs, e.g. manifests. This includes
+	// resolving the image and assembling the manifest. Defaults to one minute.
+	Write util.Duration `json:"write,omitempty"`
+	// BlobWrite is the time we have to write a blob. Clients with slow connections cannot pull blobs
+	// which take longer than this to transfer. Defaults to 30 minutes.
+	BlobWrite util.Duration `json:"blobWrite,omitempty"`
+	// Idle is the time keep-alive connections are kept open waiting for the next request. Defaults to two minutes.
+	Idle util.Duration `json:"idle,omitempty"`
+}
+
+func durationOrDefault(d util.Duration, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// apply sets the connection timeouts of srv
+func (t ServerTimeouts) apply(srv *http.Server) {
+	srv.ReadHeaderTimeout = durationOrDefault(t.ReadHeader, defaultReadHeaderTimeout)
+	srv.ReadTimeout = durationOrDefault(t.Read, defaultReadTimeout)
+	srv.IdleTimeout = durationOrDefault(t.Idle, defaultIdleTimeout)
+
+	srv.WriteTimeout = durationOrDefault(t.BlobWrite, defaultBlobWriteTimeout)
+	if write := durationOrDefault(t.Write, defaultWriteTimeout); write > srv.WriteTimeout {
+		srv.WriteTimeout = write
+	}
+}
+
+// limitWrite makes h fail with 503 if it does not complete within the write timeout. h's response is buffered
+// until it completes, hence this must not be used for routes which serve blobs.
+func (t ServerTimeouts) limitWrite(h http.Handler) http.Handler {
+	msg, _ := json.Marshal(errcode.Errors{errcode.ErrorCodeUnavailable.WithMessage("request timed out")})
+	return http.TimeoutHandler(h, durationOrDefault(t.Write, defaultWriteTimeout), string(msg))
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestServerTimeoutsApply(t *testing.T) {
+	type timeouts struct {
+		ReadHeader time.Duration
+		Read       time.Duration
+		Write      time.Duration
+		Idle       time.Duration
+	}
+	tests := []struct {
+		Desc        string
+		Config      string
+		Expectation timeouts
+	}{
+		{
+			Desc:        "defaults",
+			Config:      `{}`,
+			Expectation: timeouts{ReadHeader: defaultReadHeaderTimeout, Read: defaultReadTimeout, Write: defaultBlobWriteTimeout, Idle: defaultIdleTimeout},
+		},
+		{
+			Desc:        "configured",
+			Config:      `{"timeouts": {"readHeader": "5s", "read": "10s", "write": "20s", "blobWrite": "1h", "idle": "1m"}}`,
+			Expectation: timeouts{ReadHeader: 5 * time.Second, Read: 10 * time.Second, Write: 1 * time.Hour, Idle: 1 * time.Minute},
+		},
+		{
+			Desc:        "write timeout larger than blob write timeout",
+			Config:      `{"timeouts": {"write": "2h", "blobWrite": "1h"}}`,
+			Expectation: timeouts{ReadHeader: defaultReadHeaderTimeout, Read: defaultReadTimeout, Write: 2 * time.Hour, Idle: defaultIdleTimeout},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var cfg Config
+			err := json.Unmarshal([]byte(test.Config), &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var srv http.Server
+			cfg.Timeouts.apply(&srv)
+			act := timeouts{ReadHeader: srv.ReadHeaderTimeout, Read: srv.ReadTimeout, Write: srv.WriteTimeout, Idle: srv.IdleTimeout}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected server timeouts (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServerTimeoutsLimitWrite(t *testing.T) {
+	var cfg Config
+	err := json.Unmarshal([]byte(`{"timeouts": {"write": "50ms"}}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Desc           string
+		Delay          time.Duration
+		ExpectedStatus int
+	}{
+		{Desc: "in time", ExpectedStatus: http.StatusOK},
+		{Desc: "too slow", Delay: 1 * time.Second, ExpectedStatus: http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			handler := cfg.Timeouts.limitWrite(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(test.Delay):
+				case <-r.Context().Done():
+					return
+				}
+				_, _ = w.Write([]byte("{}"))
+			}))
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/remote/foo/manifests/latest", nil))
+			if rec.Code != test.ExpectedStatus {
+				t.Errorf("unexpected status code: expected %d, got %d", test.ExpectedStatus, rec.Code)
+			}
+			if test.ExpectedStatus == http.StatusServiceUnavailable && !strings.Contains(rec.Body.String(), "UNAVAILABLE") {
+				t.Errorf("timeout response is not a registry error: %s", rec.Body.String())
+			}
+		})
+	}
+}
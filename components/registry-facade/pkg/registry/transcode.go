@@ -0,0 +1,325 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/xerrors"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/registry-facade/api"
+)
+
+// layerCompression is the compression of a layer blob
+type layerCompression string
+
+const (
+	// layerCompressionPassthrough serves layers the way their layer source provides them
+	layerCompressionPassthrough layerCompression = ""
+	layerCompressionNone        layerCompression = "none"
+	layerCompressionGzip        layerCompression = "gzip"
+	layerCompressionZstd        layerCompression = "zstd"
+)
+
+// mediaTypeImageLayerZstd is the media type of zstd compressed OCI layers
+const mediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+// layerMediaTypes are the compressed layer media types a client can ask for in its Accept header, in order of preference
+var layerMediaTypes = []string{mediaTypeImageLayerZstd, ociv1.MediaTypeImageLayerGzip, images.MediaTypeDockerSchema2LayerGzip}
+
+// negotiateLayerCompression returns the layer compression the client prefers according to its Accept header.
+// Clients which don't list any layer media types get the layers as they are.
+func negotiateLayerCompression(acceptHeaders []string) layerCompression {
+	accepted := acceptedMediaTypes(acceptHeaders, layerMediaTypes, false)
+	if len(accepted) == 0 {
+		return layerCompressionPassthrough
+	}
+	if accepted[0] == mediaTypeImageLayerZstd {
+		return layerCompressionZstd
+	}
+	return layerCompressionGzip
+}
+
+// layerMediaType returns the media type of a layer with the given compression, staying with the Docker
+// media types if the layer had one of those before
+func layerMediaType(mediaType string, compression layerCompression) string {
+	docker := strings.HasPrefix(mediaType, "application/vnd.docker.")
+	switch {
+	case compression == layerCompressionGzip && docker:
+		return images.MediaTypeDockerSchema2LayerGzip
+	case compression == layerCompressionGzip:
+		return ociv1.MediaTypeImageLayerGzip
+	case compression == layerCompressionZstd:
+		return mediaTypeImageLayerZstd
+	case compression == layerCompressionNone && docker:
+		return images.MediaTypeDockerSchema2Layer
+	case compression == layerCompressionNone:
+		return ociv1.MediaTypeImageLayer
+	default:
+		return mediaType
+	}
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detectLayerCompression determines the compression of a layer from its first bytes. We don't trust
+// the media types here because layer sources don't always get them right.
+func detectLayerCompression(head []byte) layerCompression {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return layerCompressionGzip
+	case bytes.HasPrefix(head, zstdMagic):
+		return layerCompressionZstd
+	default:
+		return layerCompressionNone
+	}
+}
+
+type layerCompressionContextKey struct{}
+
+// withLayerCompression sets the compression the layers added by a transcoding config modifier should have
+func withLayerCompression(ctx context.Context, compression layerCompression) context.Context {
+	return context.WithValue(ctx, layerCompressionContextKey{}, compression)
+}
+
+func layerCompressionFromContext(ctx context.Context) layerCompression {
+	c, _ := ctx.Value(layerCompressionContextKey{}).(layerCompression)
+	return c
+}
+
+// transcodedLayer identifies a layer blob transcoded to a particular compression
+type transcodedLayer struct {
+	Source      digest.Digest
+	Compression layerCompression
+}
+
+// newLayerTranscoder produces a transcoder which recompresses the layers of src and places them in the store
+func newLayerTranscoder(src LayerSource, store content.Store, gc *storeGC) (*layerTranscoder, error) {
+	transcoded, err := lru.New(1024)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := lru.New(1024)
+	if err != nil {
+		return nil, err
+	}
+	return &layerTranscoder{
+		Source:     src,
+		Store:      store,
+		GC:         gc,
+		transcoded: transcoded,
+		sources:    sources,
+	}, nil
+}
+
+// layerTranscoder recompresses the layers of a layer source. Transcoded layers are kept in the store,
+// and serves them as blob source in case they were evicted from the store.
+type layerTranscoder struct {
+	Source LayerSource
+	Store  content.Store
+	GC     *storeGC
+
+	// transcoded maps transcodedLayer to the descriptor of the transcoded blob
+	transcoded *lru.Cache
+	// sources maps the digest of a transcoded blob to its transcodedLayer
+	sources *lru.Cache
+	group   singleflight.Group
+}
+
+// ConfigModifier wraps a config modifier so that the layers it adds are transcoded to the compression
+// set using withLayerCompression. Without a compression in the context, the layers are passed through.
+func (t *layerTranscoder) ConfigModifier(modifier ConfigModifier) ConfigModifier {
+	return func(ctx context.Context, spec *api.ImageSpec, cfg *ociv1.Image) ([]ociv1.Descriptor, error) {
+		layer, err := modifier(ctx, spec, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		compression := layerCompressionFromContext(ctx)
+		if compression == layerCompressionPassthrough {
+			return layer, nil
+		}
+		for i, l := range layer {
+			layer[i], err = t.transcode(ctx, spec, l, compression)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot transcode layer %s: %w", l.Digest, err)
+			}
+		}
+		return layer, nil
+	}
+}
+
+// transcode recompresses the layer desc using compression, places it in the store and returns its descriptor.
+// Layers which are served from a URL are passed through.
+func (t *layerTranscoder) transcode(ctx context.Context, spec *api.ImageSpec, desc ociv1.Descriptor, compression layerCompression) (ociv1.Descriptor, error) {
+	if len(desc.URLs) > 0 {
+		return desc, nil
+	}
+
+	key := transcodedLayer{Source: desc.Digest, Compression: compression}
+	if v, ok := t.transcoded.Get(key); ok {
+		res := v.(ociv1.Descriptor)
+		if res.Digest == desc.Digest {
+			// the layer already had the compression
+			return res, nil
+		}
+		if _, err := t.Store.Info(ctx, res.Digest); err == nil {
+			return res, nil
+		}
+	}
+
+	res, err, _ := t.group.Do(string(desc.Digest)+"+"+string(compression), func() (interface{}, error) {
+		return t.doTranscode(ctx, spec, desc, compression)
+	})
+	if err != nil {
+		return ociv1.Descriptor{}, err
+	}
+	return res.(ociv1.Descriptor), nil
+}
+
+func (t *layerTranscoder) doTranscode(ctx context.Context, spec *api.ImageSpec, desc ociv1.Descriptor, compression layerCompression) (res ociv1.Descriptor, err error) {
+	_, _, rc, err := t.Source.GetBlob(ctx, spec, desc.Digest)
+	if err != nil {
+		return
+	}
+	if rc == nil {
+		// the layer is served from a URL - there's nothing for us to transcode
+		return desc, nil
+	}
+	defer rc.Close()
+
+	br := bufio.NewReader(rc)
+	head, _ := br.Peek(len(zstdMagic))
+	current := detectLayerCompression(head)
+
+	key := transcodedLayer{Source: desc.Digest, Compression: compression}
+	if current == compression {
+		res = desc
+		res.MediaType = layerMediaType(desc.MediaType, compression)
+		t.transcoded.Add(key, res)
+		return res, nil
+	}
+
+	var uncompressed io.Reader
+	switch current {
+	case layerCompressionGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return res, err
+		}
+		defer zr.Close()
+		uncompressed = zr
+	case layerCompressionZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return res, err
+		}
+		defer zr.Close()
+		uncompressed = zr
+	default:
+		uncompressed = br
+	}
+
+	w, err := t.Store.Writer(ctx, content.WithRef("transcode-"+string(desc.Digest)+"-"+string(compression)))
+	if err != nil {
+		return res, err
+	}
+	defer w.Close()
+
+	// The compressed output must be the same every time, as we might have to transcode again
+	// after the store evicted the layer and clients expect the digest from the manifest.
+	var compressed io.WriteCloser
+	switch compression {
+	case layerCompressionGzip:
+		compressed = gzip.NewWriter(w)
+	case layerCompressionZstd:
+		compressed, err = zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return res, err
+		}
+	default:
+		compressed = nopWriteCloser{w}
+	}
+	_, err = io.Copy(compressed, uncompressed)
+	if err != nil {
+		return res, err
+	}
+	err = compressed.Close()
+	if err != nil {
+		return res, err
+	}
+
+	status, err := w.Status()
+	if err != nil {
+		return res, err
+	}
+	dgst := w.Digest()
+	err = w.Commit(ctx, status.Offset, dgst)
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return res, err
+	}
+	t.GC.Touch(dgst)
+
+	res = ociv1.Descriptor{
+		MediaType:   layerMediaType(desc.MediaType, compression),
+		Digest:      dgst,
+		Size:        status.Offset,
+		Annotations: desc.Annotations,
+	}
+	t.transcoded.Add(key, res)
+	t.sources.Add(dgst, key)
+	log.WithField("source", desc.Digest).WithField("digest", dgst).WithField("compression", compression).Debug("transcoded layer")
+	return res, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// HasBlob checks if a digest is a transcoded layer
+func (t *layerTranscoder) HasBlob(ctx context.Context, spec *api.ImageSpec, dgst digest.Digest) bool {
+	return t.sources.Contains(dgst)
+}
+
+// GetBlob serves a transcoded layer from the store and transcodes it again if the store no longer has it
+func (t *layerTranscoder) GetBlob(ctx context.Context, spec *api.ImageSpec, dgst digest.Digest) (mediaType string, url string, data io.ReadCloser, err error) {
+	src, ok := t.sources.Get(dgst)
+	if !ok {
+		err = errdefs.ErrNotFound
+		return
+	}
+	key := src.(transcodedLayer)
+
+	desc, err := t.transcode(ctx, spec, ociv1.Descriptor{Digest: key.Source}, key.Compression)
+	if err != nil {
+		return
+	}
+	if desc.Digest != dgst {
+		err = xerrors.Errorf("transcoding %s again produced %s instead of %s", key.Source, desc.Digest, dgst)
+		return
+	}
+
+	_, url, data, err = storeBlobSource{Store: t.Store, GC: t.GC}.GetBlob(ctx, spec, dgst)
+	return desc.MediaType, url, data, err
+}
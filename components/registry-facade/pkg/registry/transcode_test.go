@@ -0,0 +1,218 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/gitpod-io/gitpod/registry-facade/api"
+)
+
+func TestNegotiateLayerCompression(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Accept      []string
+		Expectation layerCompression
+	}{
+		{Desc: "no accept header", Expectation: layerCompressionPassthrough},
+		{Desc: "manifests only", Accept: []string{ociv1.MediaTypeImageManifest + ", " + images.MediaTypeDockerSchema2Manifest}, Expectation: layerCompressionPassthrough},
+		{Desc: "wildcard", Accept: []string{"*/*"}, Expectation: layerCompressionPassthrough},
+		{Desc: "OCI gzip", Accept: []string{ociv1.MediaTypeImageManifest, ociv1.MediaTypeImageLayerGzip}, Expectation: layerCompressionGzip},
+		{Desc: "Docker gzip", Accept: []string{images.MediaTypeDockerSchema2LayerGzip}, Expectation: layerCompressionGzip},
+		{Desc: "zstd", Accept: []string{mediaTypeImageLayerZstd}, Expectation: layerCompressionZstd},
+		{Desc: "zstd preferred over gzip", Accept: []string{ociv1.MediaTypeImageLayerGzip + ", " + mediaTypeImageLayerZstd}, Expectation: layerCompressionZstd},
+		{Desc: "zstd refused", Accept: []string{ociv1.MediaTypeImageLayerGzip + ", " + mediaTypeImageLayerZstd + ";q=0"}, Expectation: layerCompressionGzip},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := negotiateLayerCompression(test.Accept)
+			if act != test.Expectation {
+				t.Errorf("unexpected layer compression: expected %q, got %q", test.Expectation, act)
+			}
+		})
+	}
+}
+
+func TestLayerTranscoder(t *testing.T) {
+	uncompressed := []byte(strings.Repeat("this would be a tar file containing the layer content\n", 100))
+	diffID := digest.FromBytes(uncompressed)
+
+	compress := func(t *testing.T, compression layerCompression) []byte {
+		var buf bytes.Buffer
+		switch compression {
+		case layerCompressionGzip:
+			w := gzip.NewWriter(&buf)
+			_, _ = w.Write(uncompressed)
+			w.Close()
+		case layerCompressionZstd:
+			w, err := zstd.NewWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = w.Write(uncompressed)
+			w.Close()
+		default:
+			buf.Write(uncompressed)
+		}
+		return buf.Bytes()
+	}
+	decompress := func(t *testing.T, compression layerCompression, p []byte) []byte {
+		var r io.Reader
+		switch compression {
+		case layerCompressionGzip:
+			zr, err := gzip.NewReader(bytes.NewReader(p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = zr
+		case layerCompressionZstd:
+			zr, err := zstd.NewReader(bytes.NewReader(p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			r = zr
+		default:
+			r = bytes.NewReader(p)
+		}
+		res, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	tests := []struct {
+		Desc              string
+		Source            layerCompression
+		SourceMediaType   string
+		Target            layerCompression
+		ExpectedMediaType string
+		ExpectUnchanged   bool
+	}{
+		{Desc: "passthrough", Source: layerCompressionGzip, SourceMediaType: ociv1.MediaTypeImageLayerGzip, Target: layerCompressionPassthrough, ExpectedMediaType: ociv1.MediaTypeImageLayerGzip, ExpectUnchanged: true},
+		{Desc: "gzip to gzip", Source: layerCompressionGzip, SourceMediaType: ociv1.MediaTypeImageLayerGzip, Target: layerCompressionGzip, ExpectedMediaType: ociv1.MediaTypeImageLayerGzip, ExpectUnchanged: true},
+		{Desc: "gzip to zstd", Source: layerCompressionGzip, SourceMediaType: ociv1.MediaTypeImageLayerGzip, Target: layerCompressionZstd, ExpectedMediaType: mediaTypeImageLayerZstd},
+		{Desc: "zstd to gzip", Source: layerCompressionZstd, SourceMediaType: mediaTypeImageLayerZstd, Target: layerCompressionGzip, ExpectedMediaType: ociv1.MediaTypeImageLayerGzip},
+		{Desc: "uncompressed to gzip", Source: layerCompressionNone, SourceMediaType: ociv1.MediaTypeImageLayer, Target: layerCompressionGzip, ExpectedMediaType: ociv1.MediaTypeImageLayerGzip},
+		{Desc: "uncompressed to zstd", Source: layerCompressionNone, SourceMediaType: ociv1.MediaTypeImageLayer, Target: layerCompressionZstd, ExpectedMediaType: mediaTypeImageLayerZstd},
+		{Desc: "mislabeled Docker zstd to gzip", Source: layerCompressionZstd, SourceMediaType: images.MediaTypeDockerSchema2LayerGzip, Target: layerCompressionGzip, ExpectedMediaType: images.MediaTypeDockerSchema2LayerGzip},
+		{Desc: "mislabeled gzip", Source: layerCompressionGzip, SourceMediaType: ociv1.MediaTypeImageLayer, Target: layerCompressionGzip, ExpectedMediaType: ociv1.MediaTypeImageLayerGzip, ExpectUnchanged: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			ctx := context.Background()
+			spec := &api.ImageSpec{}
+
+			blob := compress(t, test.Source)
+			fn := filepath.Join(t.TempDir(), "layer")
+			err := os.WriteFile(fn, blob, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := FileLayerSource{{
+				AddonLayer: AddonLayer{
+					Descriptor: ociv1.Descriptor{MediaType: test.SourceMediaType, Digest: digest.FromBytes(blob), Size: int64(len(blob))},
+					DiffID:     diffID,
+				},
+				Filename: fn,
+			}}
+
+			store, err := local.NewStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			transcoder, err := newLayerTranscoder(src, store, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			modifier := transcoder.ConfigModifier(NewConfigModifierFromLayerSource(src))
+
+			var cfg ociv1.Image
+			layer, err := modifier(withLayerCompression(ctx, test.Target), spec, &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(layer) != 1 || len(cfg.RootFS.DiffIDs) != 1 {
+				t.Fatalf("expected exactly one layer, got %v with diffIDs %v", layer, cfg.RootFS.DiffIDs)
+			}
+			desc := layer[0]
+
+			if desc.MediaType != test.ExpectedMediaType {
+				t.Errorf("unexpected media type: expected %s, got %s", test.ExpectedMediaType, desc.MediaType)
+			}
+			if unchanged := desc.Digest == src[0].Descriptor.Digest; unchanged != test.ExpectUnchanged {
+				t.Errorf("unexpected layer digest %s: source digest is %s", desc.Digest, src[0].Descriptor.Digest)
+			}
+			if cfg.RootFS.DiffIDs[0] != diffID {
+				t.Errorf("unexpected diffID: expected %s, got %s", diffID, cfg.RootFS.DiffIDs[0])
+			}
+
+			// the blob served for the layer must match its descriptor and its diffID
+			var serve BlobSource = transcoder
+			if test.ExpectUnchanged {
+				serve = src
+			}
+			if !serve.HasBlob(ctx, spec, desc.Digest) {
+				t.Fatalf("layer blob %s is not available", desc.Digest)
+			}
+			_, _, rc, err := serve.GetBlob(ctx, spec, desc.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			served, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dgst := digest.FromBytes(served); dgst != desc.Digest {
+				t.Errorf("served blob digest %s does not match layer digest %s", dgst, desc.Digest)
+			}
+			if int64(len(served)) != desc.Size {
+				t.Errorf("served blob size %d does not match layer size %d", len(served), desc.Size)
+			}
+			if detected := detectLayerCompression(served); test.Target != layerCompressionPassthrough && detected != test.Target {
+				t.Errorf("unexpected blob compression: expected %s, got %s", test.Target, detected)
+			}
+			if dgst := digest.FromBytes(decompress(t, detectLayerCompression(served), served)); dgst != diffID {
+				t.Errorf("uncompressed blob digest %s does not match diffID %s", dgst, diffID)
+			}
+			if test.ExpectUnchanged {
+				return
+			}
+
+			// once the store evicted the layer, we must produce the same blob again
+			err = store.Delete(ctx, desc.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, rc, err = transcoder.GetBlob(ctx, spec, desc.Digest)
+			if err != nil {
+				t.Fatalf("cannot serve evicted layer: %v", err)
+			}
+			again, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(served, again) {
+				t.Errorf("transcoding the layer again produced a different blob")
+			}
+		})
+	}
+}
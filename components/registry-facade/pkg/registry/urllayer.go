@@ -0,0 +1,247 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/xerrors"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/registry-facade/api"
+)
+
+// urlLayerDownloadTimeout is the time a single attempt at downloading a static layer may take
+const urlLayerDownloadTimeout = 5 * time.Minute
+
+// URLLayerSource provides a static layer which is downloaded from a URL and cached in the content store
+type URLLayerSource struct {
+	AddonLayer
+	URL string
+
+	Store  content.Store
+	Retry  RetryConfig
+	Client *http.Client
+
+	mu sync.Mutex
+}
+
+// NewURLLayerSource downloads a gzipped layer from an HTTP(S) URL into the store. If checksum is set, the layer must
+// have that digest, and a layer which is in the store already is not downloaded again.
+func NewURLLayerSource(ctx context.Context, store content.Store, layerURL string, checksum digest.Digest, retry RetryConfig) (*URLLayerSource, error) {
+	u, err := url.Parse(layerURL)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid layer URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, xerrors.Errorf("layer URL %s must use http or https", layerURL)
+	}
+	if checksum != "" {
+		err = checksum.Validate()
+		if err != nil {
+			return nil, xerrors.Errorf("invalid checksum for layer %s: %w", layerURL, err)
+		}
+	}
+
+	src := &URLLayerSource{
+		URL:    layerURL,
+		Store:  store,
+		Retry:  retry,
+		Client: http.DefaultClient,
+	}
+
+	var desc ociv1.Descriptor
+	if checksum != "" {
+		info, err := store.Info(ctx, checksum)
+		if err == nil {
+			desc = ociv1.Descriptor{MediaType: ociv1.MediaTypeImageLayer, Digest: checksum, Size: info.Size}
+			log.WithField("url", layerURL).WithField("digest", checksum).Debug("static layer is in the store already")
+		} else if !errdefs.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	if desc.Digest == "" {
+		desc, err = src.download(ctx, checksum)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	diffID, err := src.diffID(ctx, desc)
+	if err != nil {
+		return nil, xerrors.Errorf("layer from %s is not a gzipped tarball: %w", layerURL, err)
+	}
+	src.AddonLayer = AddonLayer{
+		Descriptor: desc,
+		DiffID:     diffID,
+	}
+
+	log.WithField("diffID", diffID).WithField("url", layerURL).Debug("loaded static layer")
+	return src, nil
+}
+
+// download downloads the layer into the store. If expected is set, the layer must have that digest.
+func (s *URLLayerSource) download(ctx context.Context, expected digest.Digest) (desc ociv1.Descriptor, err error) {
+	alg := digest.Canonical
+	if expected != "" {
+		alg = expected.Algorithm()
+	}
+
+	// We download to a temporary file first so that we never add anything but the expected layer to the store.
+	tmp, err := os.CreateTemp("", "registry-facade-layer-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var (
+		dgst digest.Digest
+		size int64
+	)
+	err = s.Retry.retry(ctx, func() (err error) {
+		dgst, size, err = s.fetch(ctx, tmp, alg)
+		return err
+	})
+	if err != nil {
+		return desc, xerrors.Errorf("cannot download layer from %s: %w", s.URL, err)
+	}
+	if expected != "" && dgst != expected {
+		return desc, xerrors.Errorf("checksum mismatch for layer from %s: expected %s, got %s", s.URL, expected, dgst)
+	}
+
+	desc = ociv1.Descriptor{
+		MediaType: ociv1.MediaTypeImageLayer,
+		Digest:    dgst,
+		Size:      size,
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	err = content.WriteBlob(ctx, s.Store, "static-layer-"+dgst.String(), tmp, desc)
+	if err != nil {
+		return desc, xerrors.Errorf("cannot store layer from %s: %w", s.URL, err)
+	}
+	return desc, nil
+}
+
+// fetch makes a single attempt at downloading the layer to f and returns its digest and size
+func (s *URLLayerSource) fetch(ctx context.Context, f *os.File, alg digest.Algorithm) (dgst digest.Digest, size int64, err error) {
+	ctx, cancel := context.WithTimeout(ctx, urlLayerDownloadTimeout)
+	defer cancel()
+
+	// start over if a previous attempt failed half-way through
+	err = f.Truncate(0)
+	if err != nil {
+		return
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// the message format matches the one isRetryableError expects
+		err = xerrors.Errorf("unexpected status downloading layer: %s", resp.Status)
+		return
+	}
+
+	digester := alg.Digester()
+	size, err = io.Copy(io.MultiWriter(f, digester.Hash()), resp.Body)
+	if err != nil {
+		return
+	}
+	return digester.Digest(), size, nil
+}
+
+// diffID computes the diffID of the layer in the store
+func (s *URLLayerSource) diffID(ctx context.Context, desc ociv1.Descriptor) (digest.Digest, error) {
+	r, err := s.Store.ReaderAt(ctx, desc)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	diffr, err := gzip.NewReader(&reader{ReaderAt: r})
+	if err != nil {
+		return "", err
+	}
+	defer diffr.Close()
+	return digest.FromReader(diffr)
+}
+
+// Envs returns the list of env modifiers
+func (s *URLLayerSource) Envs(ctx context.Context, spec *api.ImageSpec) ([]EnvModifier, error) {
+	return nil, nil
+}
+
+// GetLayer return all layers of this source
+func (s *URLLayerSource) GetLayer(ctx context.Context, spec *api.ImageSpec) ([]AddonLayer, error) {
+	return []AddonLayer{s.AddonLayer}, nil
+}
+
+// HasBlob checks if a digest can be served by this blob source
+func (s *URLLayerSource) HasBlob(ctx context.Context, spec *api.ImageSpec, dgst digest.Digest) bool {
+	return s.Descriptor.Digest == dgst
+}
+
+// GetBlob provides access to a blob. If a ReadCloser is returned the receiver is expected to
+// call close on it eventually.
+func (s *URLLayerSource) GetBlob(ctx context.Context, spec *api.ImageSpec, dgst digest.Digest) (mediaType string, url string, data io.ReadCloser, err error) {
+	if s.Descriptor.Digest != dgst {
+		err = errdefs.ErrNotFound
+		return
+	}
+
+	r, err := s.Store.ReaderAt(ctx, s.Descriptor)
+	if errdefs.IsNotFound(err) {
+		// the store GC might have removed the layer - download it again
+		r, err = s.redownload(ctx)
+	}
+	if err != nil {
+		return
+	}
+
+	return s.Descriptor.MediaType, "", &reader{ReaderAt: r}, nil
+}
+
+func (s *URLLayerSource) redownload(ctx context.Context) (content.ReaderAt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// someone else might have downloaded the layer while we were waiting
+	r, err := s.Store.ReaderAt(ctx, s.Descriptor)
+	if !errdefs.IsNotFound(err) {
+		return r, err
+	}
+
+	log.WithField("url", s.URL).WithField("digest", s.Descriptor.Digest).Info("static layer is no longer in the store - downloading it again")
+	_, err = s.download(ctx, s.Descriptor.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return s.Store.ReaderAt(ctx, s.Descriptor)
+}
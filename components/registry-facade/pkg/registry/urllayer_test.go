@@ -0,0 +1,209 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/gitpod-io/gitpod/common-go/util"
+)
+
+func testLayerTarball(t *testing.T, script string) (layer []byte, diffID digest.Digest) {
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	data := []byte(script)
+	err := tw.WriteHeader(&tar.Header{Name: "usr/bin/hello", Mode: 0755, Size: int64(len(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tw.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res bytes.Buffer
+	gw := gzip.NewWriter(&res)
+	_, err = gw.Write(tarball.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Bytes(), digest.FromBytes(tarball.Bytes())
+}
+
+func TestURLLayerSource(t *testing.T) {
+	layer, diffID := testLayerTarball(t, "echo hello world\n")
+	layerDigest := digest.FromBytes(layer)
+
+	type expectation struct {
+		Error    string
+		Requests int64
+	}
+	tests := []struct {
+		Desc     string
+		Checksum digest.Digest
+		// Failures is the number of requests which fail with Status before the layer is served
+		Failures    int
+		Status      int
+		Body        []byte
+		Cached      bool
+		Expectation expectation
+	}{
+		{Desc: "no checksum", Expectation: expectation{Requests: 1}},
+		{Desc: "matching checksum", Checksum: layerDigest, Expectation: expectation{Requests: 1}},
+		{
+			Desc:        "checksum mismatch",
+			Checksum:    digest.FromString("something else"),
+			Expectation: expectation{Requests: 1, Error: "checksum mismatch"},
+		},
+		{Desc: "invalid checksum", Checksum: "sha256:foo", Expectation: expectation{Error: "invalid checksum"}},
+		{Desc: "cached", Checksum: layerDigest, Cached: true},
+		{Desc: "transient failure", Failures: 1, Status: http.StatusServiceUnavailable, Expectation: expectation{Requests: 2}},
+		{
+			Desc:        "permanent failure",
+			Failures:    5,
+			Status:      http.StatusServiceUnavailable,
+			Expectation: expectation{Requests: 3, Error: "503 Service Unavailable"},
+		},
+		{
+			Desc:        "not found",
+			Failures:    1,
+			Status:      http.StatusNotFound,
+			Expectation: expectation{Requests: 1, Error: "404 Not Found"},
+		},
+		{Desc: "not gzipped", Body: []byte("not a layer"), Expectation: expectation{Requests: 1, Error: "not a gzipped tarball"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			body := layer
+			if test.Body != nil {
+				body = test.Body
+			}
+			var requests int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if n := atomic.AddInt64(&requests, 1); n <= int64(test.Failures) {
+					w.WriteHeader(test.Status)
+					return
+				}
+				_, _ = w.Write(body)
+			}))
+			defer srv.Close()
+
+			store, err := local.NewStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.Cached {
+				err = content.WriteBlob(ctx, store, "cached", bytes.NewReader(layer), ociv1.Descriptor{Digest: layerDigest, Size: int64(len(layer))})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			src, err := NewURLLayerSource(ctx, store, srv.URL+"/layer.tar.gz", test.Checksum, RetryConfig{Backoff: util.Duration(time.Millisecond)})
+
+			act := expectation{Requests: atomic.LoadInt64(&requests)}
+			if err != nil {
+				act.Error = test.Expectation.Error
+				if !strings.Contains(err.Error(), test.Expectation.Error) || test.Expectation.Error == "" {
+					act.Error = err.Error()
+				}
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected result (-want +got):\n%s", diff)
+			}
+			if err != nil {
+				return
+			}
+
+			if src.Descriptor.Digest != layerDigest {
+				t.Errorf("unexpected digest: want %s, got %s", layerDigest, src.Descriptor.Digest)
+			}
+			if src.DiffID != diffID {
+				t.Errorf("unexpected diffID: want %s, got %s", diffID, src.DiffID)
+			}
+			if _, err := store.Info(ctx, layerDigest); err != nil {
+				t.Errorf("layer is not in the store: %v", err)
+			}
+		})
+	}
+}
+
+func TestURLLayerSourceGetBlob(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	layer, _ := testLayerTarball(t, "echo hello world\n")
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		_, _ = w.Write(layer)
+	}))
+	defer srv.Close()
+
+	store, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := NewURLLayerSource(ctx, store, srv.URL, "", RetryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getBlob := func() []byte {
+		_, _, rc, err := src.GetBlob(ctx, nil, src.Descriptor.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		res, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if !bytes.Equal(getBlob(), layer) {
+		t.Error("served blob does not match the layer")
+	}
+
+	// the store GC removed the layer
+	err = store.Delete(ctx, src.Descriptor.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(getBlob(), layer) {
+		t.Error("served blob does not match the layer after downloading it again")
+	}
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Errorf("expected the layer to be downloaded twice, got %d downloads", n)
+	}
+}
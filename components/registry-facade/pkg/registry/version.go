@@ -0,0 +1,50 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Build information - set during build using -ldflags "-X github.com/gitpod-io/gitpod/registry-facade/pkg/registry.Version=<version>"
+// and likewise for Commit
+var (
+	// Version is the version of the registry facade
+	Version = ""
+	// Commit is the git commit the registry facade was built from
+	Commit = ""
+)
+
+// versionHeader carries the version of the registry facade which served a manifest
+const versionHeader = "X-RegistryFacade-Version"
+
+var startTime = time.Now()
+
+// versionInfo is the build information served on /version
+type versionInfo struct {
+	Version string    `json:"version"`
+	Commit  string    `json:"commit"`
+	Started time.Time `json:"started"`
+}
+
+// version returns the version of the registry facade, or "unknown" if it was not set during build
+func version() string {
+	if Version == "" {
+		return "unknown"
+	}
+	return Version
+}
+
+// serveVersion serves the build information of the registry facade
+func (reg *Registry) serveVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(versionInfo{
+		Version: version(),
+		Commit:  Commit,
+		Started: startTime,
+	})
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestServeVersion(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Version     string
+		Commit      string
+		Expectation versionInfo
+	}{
+		{Desc: "not set during build", Expectation: versionInfo{Version: "unknown"}},
+		{Desc: "set during build", Version: "v0.1.0", Commit: "37b2dcf", Expectation: versionInfo{Version: "v0.1.0", Commit: "37b2dcf"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			prevVersion, prevCommit := Version, Commit
+			Version, Commit = test.Version, test.Commit
+			defer func() {
+				Version, Commit = prevVersion, prevCommit
+			}()
+
+			rec := httptest.NewRecorder()
+			(&Registry{}).serveVersion(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("unexpected status code: expected %d, got %d", http.StatusOK, rec.Code)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("unexpected content type: %s", ct)
+			}
+
+			var act versionInfo
+			err := json.Unmarshal(rec.Body.Bytes(), &act)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !act.Started.Equal(startTime) {
+				t.Errorf("unexpected start time: expected %v, got %v", startTime, act.Started)
+			}
+			act.Started = test.Expectation.Started
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected version info (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
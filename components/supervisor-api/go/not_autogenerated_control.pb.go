@@ -24,8 +24,24 @@ const _ = grpc.SupportPackageIsVersion7
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
 type ControlServiceClient interface {
-	// ExposePort exposes a port
+	// ExposePort exposes a port. Ports which are neither served nor configured cannot be exposed.
 	ExposePort(ctx context.Context, in *ExposePortRequest, opts ...grpc.CallOption) (*ExposePortResponse, error)
+	// UnexposePort stops exposing a port, no matter if it was exposed manually or auto-exposed.
+	// Auto-exposed ports are not exposed again automatically until supervisor restarts.
+	UnexposePort(ctx context.Context, in *UnexposePortRequest, opts ...grpc.CallOption) (*UnexposePortResponse, error)
+	// ChangePortVisibility makes a port public or private. Ports which are not exposed yet are exposed
+	// with the requested visibility.
+	ChangePortVisibility(ctx context.Context, in *ChangePortVisibilityRequest, opts ...grpc.CallOption) (*ChangePortVisibilityResponse, error)
+	// ListExposedPorts lists the ports which are currently exposed
+	ListExposedPorts(ctx context.Context, in *ListExposedPortsRequest, opts ...grpc.CallOption) (*ListExposedPortsResponse, error)
+	// RestartIDE stops the IDE and launches it again without restarting the workspace.
+	// Terminals, ports and content are left untouched. Returns once the IDE is ready again.
+	RestartIDE(ctx context.Context, in *RestartIDERequest, opts ...grpc.CallOption) (*RestartIDEResponse, error)
+	// SuspendIDE stops the IDE and all of its child processes to free resources while the workspace is idle.
+	// The IDE is resumed automatically as soon as a client uses the supervisor API again.
+	SuspendIDE(ctx context.Context, in *SuspendIDERequest, opts ...grpc.CallOption) (*SuspendIDEResponse, error)
+	// ResumeIDE continues a suspended IDE. Resuming an IDE which is not suspended has no effect.
+	ResumeIDE(ctx context.Context, in *ResumeIDERequest, opts ...grpc.CallOption) (*ResumeIDEResponse, error)
 }
 
 type controlServiceClient struct {
@@ -45,10 +61,80 @@ func (c *controlServiceClient) ExposePort(ctx context.Context, in *ExposePortReq
 	return out, nil
 }
 
+func (c *controlServiceClient) UnexposePort(ctx context.Context, in *UnexposePortRequest, opts ...grpc.CallOption) (*UnexposePortResponse, error) {
+	out := new(UnexposePortResponse)
+	err := c.cc.Invoke(ctx, "/supervisor.ControlService/UnexposePort", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlServiceClient) ChangePortVisibility(ctx context.Context, in *ChangePortVisibilityRequest, opts ...grpc.CallOption) (*ChangePortVisibilityResponse, error) {
+	out := new(ChangePortVisibilityResponse)
+	err := c.cc.Invoke(ctx, "/supervisor.ControlService/ChangePortVisibility", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlServiceClient) ListExposedPorts(ctx context.Context, in *ListExposedPortsRequest, opts ...grpc.CallOption) (*ListExposedPortsResponse, error) {
+	out := new(ListExposedPortsResponse)
+	err := c.cc.Invoke(ctx, "/supervisor.ControlService/ListExposedPorts", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlServiceClient) RestartIDE(ctx context.Context, in *RestartIDERequest, opts ...grpc.CallOption) (*RestartIDEResponse, error) {
+	out := new(RestartIDEResponse)
+	err := c.cc.Invoke(ctx, "/supervisor.ControlService/RestartIDE", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlServiceClient) SuspendIDE(ctx context.Context, in *SuspendIDERequest, opts ...grpc.CallOption) (*SuspendIDEResponse, error) {
+	out := new(SuspendIDEResponse)
+	err := c.cc.Invoke(ctx, "/supervisor.ControlService/SuspendIDE", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlServiceClient) ResumeIDE(ctx context.Context, in *ResumeIDERequest, opts ...grpc.CallOption) (*ResumeIDEResponse, error) {
+	out := new(ResumeIDEResponse)
+	err := c.cc.Invoke(ctx, "/supervisor.ControlService/ResumeIDE", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // ControlServiceServer is the server API for ControlService service.
 type ControlServiceServer interface {
-	// ExposePort exposes a port
+	// ExposePort exposes a port. Ports which are neither served nor configured cannot be exposed.
 	ExposePort(context.Context, *ExposePortRequest) (*ExposePortResponse, error)
+	// UnexposePort stops exposing a port, no matter if it was exposed manually or auto-exposed.
+	// Auto-exposed ports are not exposed again automatically until supervisor restarts.
+	UnexposePort(context.Context, *UnexposePortRequest) (*UnexposePortResponse, error)
+	// ChangePortVisibility makes a port public or private. Ports which are not exposed yet are exposed
+	// with the requested visibility.
+	ChangePortVisibility(context.Context, *ChangePortVisibilityRequest) (*ChangePortVisibilityResponse, error)
+	// ListExposedPorts lists the ports which are currently exposed
+	ListExposedPorts(context.Context, *ListExposedPortsRequest) (*ListExposedPortsResponse, error)
+	// RestartIDE stops the IDE and launches it again without restarting the workspace.
+	// Terminals, ports and content are left untouched. Returns once the IDE is ready again.
+	RestartIDE(context.Context, *RestartIDERequest) (*RestartIDEResponse, error)
+	// SuspendIDE stops the IDE and all of its child processes to free resources while the workspace is idle.
+	// The IDE is resumed automatically as soon as a client uses the supervisor API again.
+	SuspendIDE(context.Context, *SuspendIDERequest) (*SuspendIDEResponse, error)
+	// ResumeIDE continues a suspended IDE. Resuming an IDE which is not suspended has no effect.
+	ResumeIDE(context.Context, *ResumeIDERequest) (*ResumeIDEResponse, error)
 }
 
 // UnimplementedControlServiceServer can be embedded to have forward compatible implementations.
@@ -58,6 +144,24 @@ type UnimplementedControlServiceServer struct {
 func (*UnimplementedControlServiceServer) ExposePort(context.Context, *ExposePortRequest) (*ExposePortResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ExposePort not implemented")
 }
+func (*UnimplementedControlServiceServer) UnexposePort(context.Context, *UnexposePortRequest) (*UnexposePortResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UnexposePort not implemented")
+}
+func (*UnimplementedControlServiceServer) ChangePortVisibility(context.Context, *ChangePortVisibilityRequest) (*ChangePortVisibilityResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ChangePortVisibility not implemented")
+}
+func (*UnimplementedControlServiceServer) ListExposedPorts(context.Context, *ListExposedPortsRequest) (*ListExposedPortsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListExposedPorts not implemented")
+}
+func (*UnimplementedControlServiceServer) RestartIDE(context.Context, *RestartIDERequest) (*RestartIDEResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RestartIDE not implemented")
+}
+func (*UnimplementedControlServiceServer) SuspendIDE(context.Context, *SuspendIDERequest) (*SuspendIDEResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SuspendIDE not implemented")
+}
+func (*UnimplementedControlServiceServer) ResumeIDE(context.Context, *ResumeIDERequest) (*ResumeIDEResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResumeIDE not implemented")
+}
 
 func RegisterControlServiceServer(s *grpc.Server, srv ControlServiceServer) {
 	s.RegisterService(&_ControlService_serviceDesc, srv)
@@ -81,6 +185,114 @@ func _ControlService_ExposePort_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ControlService_UnexposePort_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnexposePortRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServiceServer).UnexposePort(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/supervisor.ControlService/UnexposePort",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServiceServer).UnexposePort(ctx, req.(*UnexposePortRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlService_ChangePortVisibility_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChangePortVisibilityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServiceServer).ChangePortVisibility(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/supervisor.ControlService/ChangePortVisibility",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServiceServer).ChangePortVisibility(ctx, req.(*ChangePortVisibilityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlService_ListExposedPorts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListExposedPortsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServiceServer).ListExposedPorts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/supervisor.ControlService/ListExposedPorts",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServiceServer).ListExposedPorts(ctx, req.(*ListExposedPortsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlService_RestartIDE_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestartIDERequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServiceServer).RestartIDE(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/supervisor.ControlService/RestartIDE",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServiceServer).RestartIDE(ctx, req.(*RestartIDERequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlService_SuspendIDE_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SuspendIDERequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServiceServer).SuspendIDE(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/supervisor.ControlService/SuspendIDE",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServiceServer).SuspendIDE(ctx, req.(*SuspendIDERequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlService_ResumeIDE_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResumeIDERequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServiceServer).ResumeIDE(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/supervisor.ControlService/ResumeIDE",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServiceServer).ResumeIDE(ctx, req.(*ResumeIDERequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _ControlService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "supervisor.ControlService",
 	HandlerType: (*ControlServiceServer)(nil),
@@ -89,6 +301,30 @@ var _ControlService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "ExposePort",
 			Handler:    _ControlService_ExposePort_Handler,
 		},
+		{
+			MethodName: "UnexposePort",
+			Handler:    _ControlService_UnexposePort_Handler,
+		},
+		{
+			MethodName: "ChangePortVisibility",
+			Handler:    _ControlService_ChangePortVisibility_Handler,
+		},
+		{
+			MethodName: "ListExposedPorts",
+			Handler:    _ControlService_ListExposedPorts_Handler,
+		},
+		{
+			MethodName: "RestartIDE",
+			Handler:    _ControlService_RestartIDE_Handler,
+		},
+		{
+			MethodName: "SuspendIDE",
+			Handler:    _ControlService_SuspendIDE_Handler,
+		},
+		{
+			MethodName: "ResumeIDE",
+			Handler:    _ControlService_ResumeIDE_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "control.proto",
@@ -24,6 +24,9 @@ type StatusServiceClient interface {
 	// ContentStatus returns the status of the workspace content. When used with `wait`, the call
 	// returns when the content has become available.
 	ContentStatus(ctx context.Context, in *ContentStatusRequest, opts ...grpc.CallOption) (*ContentStatusResponse, error)
+	// ContentProgress streams the progress of the workspace content initialization. The stream ends
+	// once the workspace content has become available.
+	ContentProgress(ctx context.Context, in *ContentProgressRequest, opts ...grpc.CallOption) (StatusService_ContentProgressClient, error)
 	// BackupStatus offers feedback on the workspace backup status. This status information can
 	// be relayed to the user to provide transparency as to how "safe" their files/content
 	// data are w.r.t. to being lost.
@@ -32,6 +35,15 @@ type StatusServiceClient interface {
 	PortsStatus(ctx context.Context, in *PortsStatusRequest, opts ...grpc.CallOption) (StatusService_PortsStatusClient, error)
 	// TasksStatus provides tasks status information.
 	TasksStatus(ctx context.Context, in *TasksStatusRequest, opts ...grpc.CallOption) (StatusService_TasksStatusClient, error)
+	// ReaperStatus lists the most recent processes reaped by supervisor. This is meant
+	// for debugging orphaned-process issues.
+	ReaperStatus(ctx context.Context, in *ReaperStatusRequest, opts ...grpc.CallOption) (*ReaperStatusResponse, error)
+	// IDEResourceUsage returns the most recently sampled CPU and memory usage of the IDE,
+	// aggregated over the processes in its process group.
+	IDEResourceUsage(ctx context.Context, in *IDEResourceUsageRequest, opts ...grpc.CallOption) (*IDEResourceUsageResponse, error)
+	// PhaseEvents streams the startup phases supervisor went through, in the order they happened.
+	// Phases which happened before the call are sent first. The stream ends once all phases happened.
+	PhaseEvents(ctx context.Context, in *PhaseEventsRequest, opts ...grpc.CallOption) (StatusService_PhaseEventsClient, error)
 }
 
 type statusServiceClient struct {
@@ -69,6 +81,38 @@ func (c *statusServiceClient) ContentStatus(ctx context.Context, in *ContentStat
 	return out, nil
 }
 
+func (c *statusServiceClient) ContentProgress(ctx context.Context, in *ContentProgressRequest, opts ...grpc.CallOption) (StatusService_ContentProgressClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_StatusService_serviceDesc.Streams[0], "/supervisor.StatusService/ContentProgress", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &statusServiceContentProgressClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type StatusService_ContentProgressClient interface {
+	Recv() (*ContentProgressResponse, error)
+	grpc.ClientStream
+}
+
+type statusServiceContentProgressClient struct {
+	grpc.ClientStream
+}
+
+func (x *statusServiceContentProgressClient) Recv() (*ContentProgressResponse, error) {
+	m := new(ContentProgressResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *statusServiceClient) BackupStatus(ctx context.Context, in *BackupStatusRequest, opts ...grpc.CallOption) (*BackupStatusResponse, error) {
 	out := new(BackupStatusResponse)
 	err := c.cc.Invoke(ctx, "/supervisor.StatusService/BackupStatus", in, out, opts...)
@@ -79,7 +123,7 @@ func (c *statusServiceClient) BackupStatus(ctx context.Context, in *BackupStatus
 }
 
 func (c *statusServiceClient) PortsStatus(ctx context.Context, in *PortsStatusRequest, opts ...grpc.CallOption) (StatusService_PortsStatusClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_StatusService_serviceDesc.Streams[0], "/supervisor.StatusService/PortsStatus", opts...)
+	stream, err := c.cc.NewStream(ctx, &_StatusService_serviceDesc.Streams[1], "/supervisor.StatusService/PortsStatus", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +155,7 @@ func (x *statusServicePortsStatusClient) Recv() (*PortsStatusResponse, error) {
 }
 
 func (c *statusServiceClient) TasksStatus(ctx context.Context, in *TasksStatusRequest, opts ...grpc.CallOption) (StatusService_TasksStatusClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_StatusService_serviceDesc.Streams[1], "/supervisor.StatusService/TasksStatus", opts...)
+	stream, err := c.cc.NewStream(ctx, &_StatusService_serviceDesc.Streams[2], "/supervisor.StatusService/TasksStatus", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -142,6 +186,56 @@ func (x *statusServiceTasksStatusClient) Recv() (*TasksStatusResponse, error) {
 	return m, nil
 }
 
+func (c *statusServiceClient) ReaperStatus(ctx context.Context, in *ReaperStatusRequest, opts ...grpc.CallOption) (*ReaperStatusResponse, error) {
+	out := new(ReaperStatusResponse)
+	err := c.cc.Invoke(ctx, "/supervisor.StatusService/ReaperStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *statusServiceClient) IDEResourceUsage(ctx context.Context, in *IDEResourceUsageRequest, opts ...grpc.CallOption) (*IDEResourceUsageResponse, error) {
+	out := new(IDEResourceUsageResponse)
+	err := c.cc.Invoke(ctx, "/supervisor.StatusService/IDEResourceUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *statusServiceClient) PhaseEvents(ctx context.Context, in *PhaseEventsRequest, opts ...grpc.CallOption) (StatusService_PhaseEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_StatusService_serviceDesc.Streams[3], "/supervisor.StatusService/PhaseEvents", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &statusServicePhaseEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type StatusService_PhaseEventsClient interface {
+	Recv() (*PhaseEventsResponse, error)
+	grpc.ClientStream
+}
+
+type statusServicePhaseEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *statusServicePhaseEventsClient) Recv() (*PhaseEventsResponse, error) {
+	m := new(PhaseEventsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // StatusServiceServer is the server API for StatusService service.
 type StatusServiceServer interface {
 	// SupervisorStatus returns once supervisor is running.
@@ -151,6 +245,9 @@ type StatusServiceServer interface {
 	// ContentStatus returns the status of the workspace content. When used with `wait`, the call
 	// returns when the content has become available.
 	ContentStatus(context.Context, *ContentStatusRequest) (*ContentStatusResponse, error)
+	// ContentProgress streams the progress of the workspace content initialization. The stream ends
+	// once the workspace content has become available.
+	ContentProgress(*ContentProgressRequest, StatusService_ContentProgressServer) error
 	// BackupStatus offers feedback on the workspace backup status. This status information can
 	// be relayed to the user to provide transparency as to how "safe" their files/content
 	// data are w.r.t. to being lost.
@@ -159,6 +256,15 @@ type StatusServiceServer interface {
 	PortsStatus(*PortsStatusRequest, StatusService_PortsStatusServer) error
 	// TasksStatus provides tasks status information.
 	TasksStatus(*TasksStatusRequest, StatusService_TasksStatusServer) error
+	// ReaperStatus lists the most recent processes reaped by supervisor. This is meant
+	// for debugging orphaned-process issues.
+	ReaperStatus(context.Context, *ReaperStatusRequest) (*ReaperStatusResponse, error)
+	// IDEResourceUsage returns the most recently sampled CPU and memory usage of the IDE,
+	// aggregated over the processes in its process group.
+	IDEResourceUsage(context.Context, *IDEResourceUsageRequest) (*IDEResourceUsageResponse, error)
+	// PhaseEvents streams the startup phases supervisor went through, in the order they happened.
+	// Phases which happened before the call are sent first. The stream ends once all phases happened.
+	PhaseEvents(*PhaseEventsRequest, StatusService_PhaseEventsServer) error
 }
 
 // UnimplementedStatusServiceServer can be embedded to have forward compatible implementations.
@@ -174,6 +280,9 @@ func (*UnimplementedStatusServiceServer) IDEStatus(context.Context, *IDEStatusRe
 func (*UnimplementedStatusServiceServer) ContentStatus(context.Context, *ContentStatusRequest) (*ContentStatusResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ContentStatus not implemented")
 }
+func (*UnimplementedStatusServiceServer) ContentProgress(*ContentProgressRequest, StatusService_ContentProgressServer) error {
+	return status.Errorf(codes.Unimplemented, "method ContentProgress not implemented")
+}
 func (*UnimplementedStatusServiceServer) BackupStatus(context.Context, *BackupStatusRequest) (*BackupStatusResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method BackupStatus not implemented")
 }
@@ -183,6 +292,15 @@ func (*UnimplementedStatusServiceServer) PortsStatus(*PortsStatusRequest, Status
 func (*UnimplementedStatusServiceServer) TasksStatus(*TasksStatusRequest, StatusService_TasksStatusServer) error {
 	return status.Errorf(codes.Unimplemented, "method TasksStatus not implemented")
 }
+func (*UnimplementedStatusServiceServer) ReaperStatus(context.Context, *ReaperStatusRequest) (*ReaperStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReaperStatus not implemented")
+}
+func (*UnimplementedStatusServiceServer) IDEResourceUsage(context.Context, *IDEResourceUsageRequest) (*IDEResourceUsageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method IDEResourceUsage not implemented")
+}
+func (*UnimplementedStatusServiceServer) PhaseEvents(*PhaseEventsRequest, StatusService_PhaseEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method PhaseEvents not implemented")
+}
 
 func RegisterStatusServiceServer(s *grpc.Server, srv StatusServiceServer) {
 	s.RegisterService(&_StatusService_serviceDesc, srv)
@@ -242,6 +360,27 @@ func _StatusService_ContentStatus_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _StatusService_ContentProgress_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ContentProgressRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StatusServiceServer).ContentProgress(m, &statusServiceContentProgressServer{stream})
+}
+
+type StatusService_ContentProgressServer interface {
+	Send(*ContentProgressResponse) error
+	grpc.ServerStream
+}
+
+type statusServiceContentProgressServer struct {
+	grpc.ServerStream
+}
+
+func (x *statusServiceContentProgressServer) Send(m *ContentProgressResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 func _StatusService_BackupStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(BackupStatusRequest)
 	if err := dec(in); err != nil {
@@ -302,6 +441,63 @@ func (x *statusServiceTasksStatusServer) Send(m *TasksStatusResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _StatusService_ReaperStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReaperStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatusServiceServer).ReaperStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/supervisor.StatusService/ReaperStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatusServiceServer).ReaperStatus(ctx, req.(*ReaperStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StatusService_IDEResourceUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IDEResourceUsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatusServiceServer).IDEResourceUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/supervisor.StatusService/IDEResourceUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatusServiceServer).IDEResourceUsage(ctx, req.(*IDEResourceUsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StatusService_PhaseEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PhaseEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StatusServiceServer).PhaseEvents(m, &statusServicePhaseEventsServer{stream})
+}
+
+type StatusService_PhaseEventsServer interface {
+	Send(*PhaseEventsResponse) error
+	grpc.ServerStream
+}
+
+type statusServicePhaseEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *statusServicePhaseEventsServer) Send(m *PhaseEventsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _StatusService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "supervisor.StatusService",
 	HandlerType: (*StatusServiceServer)(nil),
@@ -322,8 +518,21 @@ var _StatusService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "BackupStatus",
 			Handler:    _StatusService_BackupStatus_Handler,
 		},
+		{
+			MethodName: "ReaperStatus",
+			Handler:    _StatusService_ReaperStatus_Handler,
+		},
+		{
+			MethodName: "IDEResourceUsage",
+			Handler:    _StatusService_IDEResourceUsage_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ContentProgress",
+			Handler:       _StatusService_ContentProgress_Handler,
+			ServerStreams: true,
+		},
 		{
 			StreamName:    "PortsStatus",
 			Handler:       _StatusService_PortsStatus_Handler,
@@ -334,6 +543,11 @@ var _StatusService_serviceDesc = grpc.ServiceDesc{
 			Handler:       _StatusService_TasksStatus_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "PhaseEvents",
+			Handler:       _StatusService_PhaseEvents_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "status.proto",
 }
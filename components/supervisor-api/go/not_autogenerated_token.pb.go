@@ -21,6 +21,9 @@ type TokenServiceClient interface {
 	GetToken(ctx context.Context, in *GetTokenRequest, opts ...grpc.CallOption) (*GetTokenResponse, error)
 	SetToken(ctx context.Context, in *SetTokenRequest, opts ...grpc.CallOption) (*SetTokenResponse, error)
 	ClearToken(ctx context.Context, in *ClearTokenRequest, opts ...grpc.CallOption) (*ClearTokenResponse, error)
+	// RevokeToken removes cached tokens for a host. Revoking is idempotent, i.e. it succeeds
+	// even if no token matched.
+	RevokeToken(ctx context.Context, in *RevokeTokenRequest, opts ...grpc.CallOption) (*RevokeTokenResponse, error)
 	ProvideToken(ctx context.Context, opts ...grpc.CallOption) (TokenService_ProvideTokenClient, error)
 }
 
@@ -59,6 +62,15 @@ func (c *tokenServiceClient) ClearToken(ctx context.Context, in *ClearTokenReque
 	return out, nil
 }
 
+func (c *tokenServiceClient) RevokeToken(ctx context.Context, in *RevokeTokenRequest, opts ...grpc.CallOption) (*RevokeTokenResponse, error) {
+	out := new(RevokeTokenResponse)
+	err := c.cc.Invoke(ctx, "/supervisor.TokenService/RevokeToken", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *tokenServiceClient) ProvideToken(ctx context.Context, opts ...grpc.CallOption) (TokenService_ProvideTokenClient, error) {
 	stream, err := c.cc.NewStream(ctx, &_TokenService_serviceDesc.Streams[0], "/supervisor.TokenService/ProvideToken", opts...)
 	if err != nil {
@@ -95,6 +107,9 @@ type TokenServiceServer interface {
 	GetToken(context.Context, *GetTokenRequest) (*GetTokenResponse, error)
 	SetToken(context.Context, *SetTokenRequest) (*SetTokenResponse, error)
 	ClearToken(context.Context, *ClearTokenRequest) (*ClearTokenResponse, error)
+	// RevokeToken removes cached tokens for a host. Revoking is idempotent, i.e. it succeeds
+	// even if no token matched.
+	RevokeToken(context.Context, *RevokeTokenRequest) (*RevokeTokenResponse, error)
 	ProvideToken(TokenService_ProvideTokenServer) error
 }
 
@@ -111,6 +126,9 @@ func (*UnimplementedTokenServiceServer) SetToken(context.Context, *SetTokenReque
 func (*UnimplementedTokenServiceServer) ClearToken(context.Context, *ClearTokenRequest) (*ClearTokenResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ClearToken not implemented")
 }
+func (*UnimplementedTokenServiceServer) RevokeToken(context.Context, *RevokeTokenRequest) (*RevokeTokenResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeToken not implemented")
+}
 func (*UnimplementedTokenServiceServer) ProvideToken(TokenService_ProvideTokenServer) error {
 	return status.Errorf(codes.Unimplemented, "method ProvideToken not implemented")
 }
@@ -173,6 +191,24 @@ func _TokenService_ClearToken_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _TokenService_RevokeToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TokenServiceServer).RevokeToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/supervisor.TokenService/RevokeToken",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TokenServiceServer).RevokeToken(ctx, req.(*RevokeTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _TokenService_ProvideToken_Handler(srv interface{}, stream grpc.ServerStream) error {
 	return srv.(TokenServiceServer).ProvideToken(&tokenServiceProvideTokenServer{stream})
 }
@@ -215,6 +251,10 @@ var _TokenService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "ClearToken",
 			Handler:    _TokenService_ClearToken_Handler,
 		},
+		{
+			MethodName: "RevokeToken",
+			Handler:    _TokenService_RevokeToken_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -0,0 +1,48 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/gitpod-io/gitpod/supervisor/pkg/supervisor"
+)
+
+var validateCmdOpts struct {
+	Workspace bool
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "validates the supervisor config without starting the workspace",
+	Long: `Validates the supervisor config without starting the workspace.
+
+Prints a JSON report of all checks and exits with a non-zero code if any check failed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := supervisor.GetConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot load config: %v\n", err)
+			os.Exit(2)
+		}
+
+		report := supervisor.ValidateConfig(cfg, validateCmdOpts.Workspace)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+		if !report.OK {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+
+	validateCmd.Flags().BoolVar(&validateCmdOpts.Workspace, "workspace", false, "also validate the workspace config drawn from the environment")
+}
@@ -8,6 +8,8 @@ import (
 	"io"
 	"sync"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // Clock abstracts time for the bucket limiter
@@ -109,3 +111,33 @@ func (w *writer) Write(buf []byte) (n int, err error) {
 func Writer(dst io.Writer, b *Bucket) io.Writer {
 	return &writer{w: dst, bucket: b}
 }
+
+type formatter struct {
+	f      logrus.Formatter
+	bucket *Bucket
+}
+
+func (f *formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	buf, err := f.f.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// We never drop the last words before supervisor goes down.
+	if entry.Level <= logrus.FatalLevel {
+		return buf, nil
+	}
+
+	// Unlike the writer we drop entire log entries rather than truncating them,
+	// so that the log output remains parseable.
+	if grant := f.bucket.TakeAvailable(int64(len(buf))); grant < int64(len(buf)) {
+		return nil, nil
+	}
+	return buf, nil
+}
+
+// Formatter produces a new rate limited logrus formatter which drops log entries exceeding
+// the bucket limit. Fatal and panic entries are never dropped.
+func Formatter(f logrus.Formatter, b *Bucket) logrus.Formatter {
+	return &formatter{f: f, bucket: b}
+}
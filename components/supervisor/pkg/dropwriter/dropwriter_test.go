@@ -8,6 +8,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	"github.com/gitpod-io/gitpod/supervisor/pkg/dropwriter"
 )
 
@@ -80,3 +82,49 @@ func TestBucket(t *testing.T) {
 		})
 	}
 }
+
+type constFormatter string
+
+func (f constFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return []byte(f), nil
+}
+
+func TestFormatter(t *testing.T) {
+	tests := []struct {
+		Name         string
+		Levels       []logrus.Level
+		Expectations []string
+	}{
+		{
+			Name:         "below limit",
+			Levels:       []logrus.Level{logrus.InfoLevel},
+			Expectations: []string{"entry\n"},
+		},
+		{
+			Name:         "above limit",
+			Levels:       []logrus.Level{logrus.InfoLevel, logrus.ErrorLevel, logrus.InfoLevel},
+			Expectations: []string{"entry\n", "", ""},
+		},
+		{
+			Name:         "fatal bypasses limit",
+			Levels:       []logrus.Level{logrus.InfoLevel, logrus.ErrorLevel, logrus.FatalLevel, logrus.PanicLevel},
+			Expectations: []string{"entry\n", "", "entry\n", "entry\n"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			clock := func() time.Time { return time.Time{}.Add(1 * time.Second) }
+			f := dropwriter.Formatter(constFormatter("entry\n"), dropwriter.NewBucketClock(10, 0, clock))
+			for step, lvl := range test.Levels {
+				buf, err := f.Format(&logrus.Entry{Level: lvl})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(buf) != test.Expectations[step] {
+					t.Errorf("step %d: unexpected output: expected %q, got %q", step, test.Expectations[step], string(buf))
+				}
+			}
+		})
+	}
+}
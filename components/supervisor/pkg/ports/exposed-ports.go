@@ -34,6 +34,9 @@ type ExposedPortsInterface interface {
 
 	// Expose exposes a port to the internet. Upon successful execution any Observer will be updated.
 	Expose(ctx context.Context, local, global uint32, public bool) <-chan error
+
+	// Unexpose stops exposing a port to the internet. Upon successful execution any Observer will be updated.
+	Unexpose(ctx context.Context, local uint32) <-chan error
 }
 
 // NoopExposedPorts implements ExposedPortsInterface but does nothing
@@ -54,6 +57,13 @@ func (*NoopExposedPorts) Expose(ctx context.Context, local, global uint32, publi
 	return done
 }
 
+// Unexpose stops exposing a port to the internet. Upon successful execution any Observer will be updated.
+func (*NoopExposedPorts) Unexpose(ctx context.Context, local uint32) <-chan error {
+	done := make(chan error)
+	close(done)
+	return done
+}
+
 // GitpodExposedPorts uses a connection to the Gitpod server to implement
 // the ExposedPortsInterface.
 type GitpodExposedPorts struct {
@@ -201,3 +211,16 @@ func (g *GitpodExposedPorts) Expose(ctx context.Context, local, global uint32, p
 	g.requests <- req
 	return req.done
 }
+
+// Unexpose stops exposing a port to the internet. Upon successful execution any Observer will be updated.
+func (g *GitpodExposedPorts) Unexpose(ctx context.Context, local uint32) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		defer close(done)
+		err := g.C.ClosePort(ctx, g.WorkspaceID, float32(local))
+		if err != nil {
+			done <- err
+		}
+	}()
+	return done
+}
@@ -11,6 +11,7 @@ import (
 	"reflect"
 	"regexp"
 	"strconv"
+	"sync"
 
 	gitpod "github.com/gitpod-io/gitpod/gitpod-protocol"
 )
@@ -22,11 +23,19 @@ type RangeConfig struct {
 	End   uint32
 }
 
+// IgnoredRange is a range of ports which must not be exposed automatically
+type IgnoredRange struct {
+	Start uint32
+	End   uint32
+}
+
 // Configs provides access to port configurations
 type Configs struct {
 	workspaceConfigs     map[uint32]*gitpod.PortConfig
 	instancePortConfigs  map[uint32]*gitpod.PortConfig
 	instanceRangeConfigs []*RangeConfig
+	ignoredPorts         map[uint32]struct{}
+	ignoredRanges        []*IgnoredRange
 }
 
 // ForEach iterates over all configured ports
@@ -73,15 +82,33 @@ func (configs *Configs) Get(port uint32) (*gitpod.PortConfig, ConfigKind, bool)
 	for _, rangeConfig := range configs.instanceRangeConfigs {
 		if rangeConfig.Start <= port && port <= rangeConfig.End {
 			return &gitpod.PortConfig{
-				Port:       float64(port),
-				OnOpen:     rangeConfig.OnOpen,
-				Visibility: rangeConfig.Visibility,
+				Port:        float64(port),
+				OnOpen:      rangeConfig.OnOpen,
+				Visibility:  rangeConfig.Visibility,
+				Name:        rangeConfig.Name,
+				Description: rangeConfig.Description,
 			}, RangeConfigKind, true
 		}
 	}
 	return nil, PortConfigKind, false
 }
 
+// Ignored returns true if the port must not be exposed automatically
+func (configs *Configs) Ignored(port uint32) bool {
+	if configs == nil {
+		return false
+	}
+	if _, ignored := configs.ignoredPorts[port]; ignored {
+		return true
+	}
+	for _, ignoredRange := range configs.ignoredRanges {
+		if ignoredRange.Start <= port && port <= ignoredRange.End {
+			return true
+		}
+	}
+	return false
+}
+
 // ConfigInterace allows to watch port configurations
 type ConfigInterace interface {
 	// Observe provides channels triggered whenever the port configurations are changed.
@@ -92,7 +119,11 @@ type ConfigInterace interface {
 type ConfigService struct {
 	workspaceID   string
 	configService gitpod.ConfigInterface
-	gitpodAPI     gitpod.APIInterface
+
+	// gitpodAPI is guarded by mu, use SetGitpodAPI to replace it
+	gitpodAPI gitpod.APIInterface
+	mu        sync.Mutex
+	apiSwaps  chan struct{}
 }
 
 // NewConfigService creates a new instance of ConfigService
@@ -101,9 +132,43 @@ func NewConfigService(workspaceID string, configService gitpod.ConfigInterface,
 		workspaceID:   workspaceID,
 		configService: configService,
 		gitpodAPI:     gitpodAPI,
+		apiSwaps:      make(chan struct{}, 1),
 	}
 }
 
+// SetGitpodAPI replaces the connection to the Gitpod API, e.g. once it becomes available after
+// the service was started. Observers fetch the workspace port configs again using the new connection.
+func (service *ConfigService) SetGitpodAPI(gitpodAPI gitpod.APIInterface) {
+	service.mu.Lock()
+	service.gitpodAPI = gitpodAPI
+	service.mu.Unlock()
+
+	select {
+	case service.apiSwaps <- struct{}{}:
+	default:
+		// a swap is pending already which will pick up this connection
+	}
+}
+
+func (service *ConfigService) getGitpodAPI() gitpod.APIInterface {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.gitpodAPI
+}
+
+// fetchWorkspaceConfigs fetches the port configs of the workspace from the Gitpod API
+func (service *ConfigService) fetchWorkspaceConfigs(ctx context.Context) (map[uint32]*gitpod.PortConfig, error) {
+	gitpodAPI := service.getGitpodAPI()
+	if gitpodAPI == nil {
+		return nil, errors.New("could not connect to Gitpod API to fetch workspace port configs")
+	}
+	info, err := gitpodAPI.GetWorkspace(ctx, service.workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	return parseWorkspaceConfigs(info.Workspace.Config.Ports), nil
+}
+
 // Observe provides channels triggered whenever the port configurations are changed.
 func (service *ConfigService) Observe(ctx context.Context) (<-chan *Configs, <-chan error) {
 	updatesChan := make(chan *Configs)
@@ -116,22 +181,32 @@ func (service *ConfigService) Observe(ctx context.Context) (<-chan *Configs, <-c
 		configs, errs := service.configService.Observe(ctx)
 
 		current := &Configs{}
-		if service.gitpodAPI != nil {
-			info, err := service.gitpodAPI.GetWorkspace(ctx, service.workspaceID)
-			if err != nil {
-				errorsChan <- err
-			} else {
-				current.workspaceConfigs = parseWorkspaceConfigs(info.Workspace.Config.Ports)
-				updatesChan <- &Configs{workspaceConfigs: current.workspaceConfigs}
-			}
+		workspaceConfigs, err := service.fetchWorkspaceConfigs(ctx)
+		if err != nil {
+			errorsChan <- err
 		} else {
-			errorsChan <- errors.New("could not connect to Gitpod API to fetch workspace port configs")
+			current.workspaceConfigs = workspaceConfigs
+			updatesChan <- &Configs{workspaceConfigs: current.workspaceConfigs}
 		}
 
 		for {
 			select {
 			case <-ctx.Done():
 				return
+			case <-service.apiSwaps:
+				workspaceConfigs, err := service.fetchWorkspaceConfigs(ctx)
+				if err != nil {
+					errorsChan <- err
+					continue
+				}
+				current.workspaceConfigs = workspaceConfigs
+				updatesChan <- &Configs{
+					workspaceConfigs:     current.workspaceConfigs,
+					instancePortConfigs:  current.instancePortConfigs,
+					instanceRangeConfigs: current.instanceRangeConfigs,
+					ignoredPorts:         current.ignoredPorts,
+					ignoredRanges:        current.ignoredRanges,
+				}
 			case err := <-errs:
 				errorsChan <- err
 			case config := <-configs:
@@ -143,6 +218,8 @@ func (service *ConfigService) Observe(ctx context.Context) (<-chan *Configs, <-c
 					workspaceConfigs:     current.workspaceConfigs,
 					instancePortConfigs:  current.instancePortConfigs,
 					instanceRangeConfigs: current.instanceRangeConfigs,
+					ignoredPorts:         current.ignoredPorts,
+					ignoredRanges:        current.ignoredRanges,
 				}
 			}
 		}
@@ -152,14 +229,23 @@ func (service *ConfigService) Observe(ctx context.Context) (<-chan *Configs, <-c
 
 func (service *ConfigService) update(config *gitpod.GitpodConfig, current *Configs) bool {
 	currentPortConfigs, currentRangeConfigs := current.instancePortConfigs, current.instanceRangeConfigs
-	var ports []*gitpod.PortsItems
+	currentIgnoredPorts, currentIgnoredRanges := current.ignoredPorts, current.ignoredRanges
+	var (
+		ports       []*gitpod.PortsItems
+		ignorePorts []interface{}
+	)
 	if config != nil {
 		ports = config.Ports
+		ignorePorts = config.IgnorePorts
 	}
 	portConfigs, rangeConfigs := parseInstanceConfigs(ports)
 	current.instancePortConfigs = portConfigs
 	current.instanceRangeConfigs = rangeConfigs
-	return !reflect.DeepEqual(currentPortConfigs, portConfigs) || !reflect.DeepEqual(currentRangeConfigs, rangeConfigs)
+	ignoredPorts, ignoredRanges := parseIgnorePorts(ignorePorts)
+	current.ignoredPorts = ignoredPorts
+	current.ignoredRanges = ignoredRanges
+	return !reflect.DeepEqual(currentPortConfigs, portConfigs) || !reflect.DeepEqual(currentRangeConfigs, rangeConfigs) ||
+		!reflect.DeepEqual(currentIgnoredPorts, ignoredPorts) || !reflect.DeepEqual(currentIgnoredRanges, ignoredRanges)
 }
 
 var portRangeRegexp = regexp.MustCompile("^(\\d+)[-:](\\d+)$")
@@ -195,9 +281,11 @@ func parseInstanceConfigs(ports []*gitpod.PortsItems) (portConfigs map[uint32]*g
 			_, exists := portConfigs[port]
 			if !exists {
 				portConfigs[port] = &gitpod.PortConfig{
-					OnOpen:     config.OnOpen,
-					Port:       float64(Port),
-					Visibility: config.Visibility,
+					OnOpen:      config.OnOpen,
+					Port:        float64(Port),
+					Visibility:  config.Visibility,
+					Name:        config.Name,
+					Description: config.Description,
 				}
 			}
 			continue
@@ -222,3 +310,40 @@ func parseInstanceConfigs(ports []*gitpod.PortsItems) (portConfigs map[uint32]*g
 	}
 	return portConfigs, rangeConfigs
 }
+
+// parseIgnorePorts parses the ignorePorts list of .gitpod.yml. Entries are either single ports or port ranges
+// like 3000-3010, invalid entries are skipped.
+func parseIgnorePorts(ignorePorts []interface{}) (ports map[uint32]struct{}, ranges []*IgnoredRange) {
+	for _, ignorePort := range ignorePorts {
+		if ignorePort == nil {
+			continue
+		}
+
+		rawPort := fmt.Sprintf("%v", ignorePort)
+		port, err := strconv.ParseUint(rawPort, 10, 16)
+		if err == nil {
+			if ports == nil {
+				ports = make(map[uint32]struct{})
+			}
+			ports[uint32(port)] = struct{}{}
+			continue
+		}
+		matches := portRangeRegexp.FindStringSubmatch(rawPort)
+		if len(matches) != 3 {
+			continue
+		}
+		start, err := strconv.ParseUint(matches[1], 10, 16)
+		if err != nil {
+			continue
+		}
+		end, err := strconv.ParseUint(matches[2], 10, 16)
+		if err != nil || start >= end {
+			continue
+		}
+		ranges = append(ranges, &IgnoredRange{
+			Start: uint32(start),
+			End:   uint32(end),
+		})
+	}
+	return ports, ranges
+}
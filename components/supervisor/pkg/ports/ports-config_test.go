@@ -90,6 +90,16 @@ func TestPortsConfig(t *testing.T) {
 				},
 			},
 		},
+		{
+			Desc: "ignored ports",
+			GitpodConfig: &gitpod.GitpodConfig{
+				IgnorePorts: []interface{}{9229, "3000-3010"},
+			},
+			Expectation: &PortConfigTestExpectations{
+				IgnoredPorts:  map[uint32]struct{}{9229: {}},
+				IgnoredRanges: []*IgnoredRange{{Start: 3000, End: 3010}},
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.Desc, func(t *testing.T) {
@@ -139,6 +149,8 @@ func TestPortsConfig(t *testing.T) {
 					t.Fatal(err)
 				case change := <-updates:
 					actual.InstanceRangeConfigs = change.instanceRangeConfigs
+					actual.IgnoredPorts = change.ignoredPorts
+					actual.IgnoredRanges = change.ignoredRanges
 					for _, config := range change.instancePortConfigs {
 						actual.InstancePortConfigs = append(actual.InstancePortConfigs, config)
 					}
@@ -152,10 +164,121 @@ func TestPortsConfig(t *testing.T) {
 	}
 }
 
+func TestPortsConfigSetGitpodAPI(t *testing.T) {
+	configService := &testGitpodConfigService{
+		configs: make(chan *gitpod.GitpodConfig),
+		errors:  make(chan error),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := NewConfigService("test", configService, nil)
+	updates, errors := service.Observe(ctx)
+
+	// without a connection to the Gitpod API there are no workspace port configs
+	select {
+	case <-errors:
+	case change := <-updates:
+		t.Fatalf("unexpected update: %v", change)
+	}
+
+	workspacePorts := []*gitpod.PortConfig{{Port: 3000, Visibility: "public"}}
+	gitpodAPI := gitpod.NewMockAPIInterface(ctrl)
+	gitpodAPI.EXPECT().GetWorkspace(gomock.Any(), "test").Times(1).Return(&gitpod.WorkspaceInfo{
+		Workspace: &gitpod.Workspace{Config: &gitpod.WorkspaceConfig{Ports: workspacePorts}},
+	}, nil)
+	service.SetGitpodAPI(gitpodAPI)
+
+	select {
+	case err := <-errors:
+		t.Fatal(err)
+	case change := <-updates:
+		var act []*gitpod.PortConfig
+		for _, config := range change.workspaceConfigs {
+			act = append(act, config)
+		}
+		if diff := cmp.Diff(workspacePorts, act); diff != "" {
+			t.Errorf("unexpected workspace configs (-want +got):\n%s", diff)
+		}
+	}
+}
+
 type PortConfigTestExpectations struct {
 	WorkspaceConfigs     []*gitpod.PortConfig
 	InstancePortConfigs  []*gitpod.PortConfig
 	InstanceRangeConfigs []*RangeConfig
+	IgnoredPorts         map[uint32]struct{}
+	IgnoredRanges        []*IgnoredRange
+}
+
+func TestParseIgnorePorts(t *testing.T) {
+	tests := []struct {
+		Desc           string
+		IgnorePorts    []interface{}
+		ExpectedPorts  map[uint32]struct{}
+		ExpectedRanges []*IgnoredRange
+	}{
+		{
+			Desc: "empty",
+		},
+		{
+			Desc:          "ports",
+			IgnorePorts:   []interface{}{8080, float64(9229), "3000"},
+			ExpectedPorts: map[uint32]struct{}{8080: {}, 9229: {}, 3000: {}},
+		},
+		{
+			Desc:           "ranges",
+			IgnorePorts:    []interface{}{"3000-3010", "5000:5005"},
+			ExpectedRanges: []*IgnoredRange{{Start: 3000, End: 3010}, {Start: 5000, End: 5005}},
+		},
+		{
+			Desc:           "ports and ranges",
+			IgnorePorts:    []interface{}{8080, "3000-3010"},
+			ExpectedPorts:  map[uint32]struct{}{8080: {}},
+			ExpectedRanges: []*IgnoredRange{{Start: 3000, End: 3010}},
+		},
+		{
+			Desc:        "invalid",
+			IgnorePorts: []interface{}{nil, "foo", -1, 70000, "3010-3000", "3000-3000", "3000-70000", "3000-", "1.5"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			ports, ranges := parseIgnorePorts(test.IgnorePorts)
+			if diff := cmp.Diff(test.ExpectedPorts, ports); diff != "" {
+				t.Errorf("unexpected ports (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(test.ExpectedRanges, ranges); diff != "" {
+				t.Errorf("unexpected ranges (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConfigsIgnored(t *testing.T) {
+	var configs *Configs
+	if configs.Ignored(8080) {
+		t.Errorf("nil configs must not ignore ports")
+	}
+
+	configs = &Configs{}
+	configs.ignoredPorts, configs.ignoredRanges = parseIgnorePorts([]interface{}{8080, "3000-3010"})
+	for port, expectation := range map[uint32]bool{
+		8080: true,
+		8081: false,
+		2999: false,
+		3000: true,
+		3005: true,
+		3010: true,
+		3011: false,
+	} {
+		if act := configs.Ignored(port); act != expectation {
+			t.Errorf("unexpected ignored state of port %d: expected %v, got %v", port, expectation, act)
+		}
+	}
 }
 
 type testGitpodConfigService struct {
@@ -14,6 +14,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"reflect"
+	"sort"
 	"sync"
 	"time"
 
@@ -51,6 +52,7 @@ func NewManager(exposed ExposedPortsInterface, served ServedPortsObserver, confi
 		state:         state,
 		subscriptions: make(map[*Subscription]struct{}),
 		proxyStarter:  startLocalhostProxy,
+		exposedSwaps:  make(chan struct{}, 1),
 	}
 }
 
@@ -62,10 +64,13 @@ type localhostProxy struct {
 // Manager brings together served and exposed ports. It keeps track of which port is exposed, which one is served,
 // auto-exposes ports and proxies ports served on localhost only.
 type Manager struct {
+	// E is guarded by mu, use SetExposedPorts to replace it once the manager runs
 	E ExposedPortsInterface
 	S ServedPortsObserver
 	C ConfigInterace
 
+	exposedSwaps chan struct{}
+
 	internal     map[uint32]struct{}
 	proxies      map[uint32]*localhostProxy
 	proxyStarter func(LocalhostPort uint32, GlobalPort uint32) (proxy io.Closer, err error)
@@ -83,11 +88,13 @@ type Manager struct {
 }
 
 type managedPort struct {
-	Served     bool
-	Exposed    bool
-	Visibility api.PortVisibility
-	URL        string
-	OnExposed  api.OnPortExposedAction
+	Served      bool
+	Exposed     bool
+	Visibility  api.PortVisibility
+	URL         string
+	OnExposed   api.OnPortExposedAction
+	Name        string
+	Description string
 
 	LocalhostPort uint32
 	GlobalPort    uint32
@@ -127,8 +134,18 @@ func (pm *Manager) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}()
 	defer cancel()
 
-	go pm.E.Run(ctx)
-	exposedUpdates, exposedErrors := pm.E.Observe(ctx)
+	startExposed := func() (<-chan []ExposedPort, <-chan error, context.CancelFunc) {
+		pm.mu.RLock()
+		exposed := pm.E
+		pm.mu.RUnlock()
+
+		ctx, cancel := context.WithCancel(ctx)
+		go exposed.Run(ctx)
+		updates, errs := exposed.Observe(ctx)
+		return updates, errs, cancel
+	}
+	exposedUpdates, exposedErrors, cancelExposed := startExposed()
+	defer func() { cancelExposed() }()
 	servedUpdates, servedErrors := pm.S.Observe(ctx)
 	configUpdates, configErrors := pm.C.Observe(ctx)
 	for {
@@ -138,6 +155,14 @@ func (pm *Manager) Run(ctx context.Context, wg *sync.WaitGroup) {
 			configured *Configs
 		)
 		select {
+		case <-pm.exposedSwaps:
+			// we stop selecting on the channels of the previous implementation before they're closed
+			cancelExposed()
+			exposedUpdates, exposedErrors, cancelExposed = startExposed()
+			log.Info("exposed ports implementation replaced")
+			// re-evaluate the state so that served ports get auto-exposed using the new implementation
+			pm.updateState(ctx, nil, nil, nil)
+			continue
 		case exposed = <-exposedUpdates:
 			if exposed == nil {
 				log.Error("exposed ports observer stopped")
@@ -182,6 +207,32 @@ func (pm *Manager) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 }
 
+// SetExposedPorts replaces the exposed ports implementation, e.g. once the Gitpod server becomes
+// available after the manager was started. Ports auto-exposed using the previous implementation
+// are auto-exposed again using the new one.
+func (pm *Manager) SetExposedPorts(exposed ExposedPortsInterface) {
+	pm.mu.Lock()
+	pm.E = exposed
+	pm.exposed = nil
+	pm.autoExposed = make(map[uint32]uint32)
+	pm.mu.Unlock()
+
+	select {
+	case pm.exposedSwaps <- struct{}{}:
+	default:
+		// a swap is pending already which will pick up this implementation
+	}
+}
+
+// ExposureDisabled returns true if ports cannot be exposed because the manager uses NoopExposedPorts
+func (pm *Manager) ExposureDisabled() bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	_, noop := pm.E.(*NoopExposedPorts)
+	return noop
+}
+
 // Status provides the current port status
 func (pm *Manager) Status() []*api.PortsStatus {
 	pm.mu.RLock()
@@ -289,7 +340,7 @@ func (pm *Manager) nextState(ctx context.Context) map[uint32]*managedPort {
 			mp.OnExposed = getOnExposedAction(config, port)
 
 			_, autoExposed := pm.autoExposed[port]
-			if autoExposed {
+			if autoExposed || pm.configs.Ignored(port) {
 				return
 			}
 			mp.GlobalPort = port
@@ -340,6 +391,9 @@ func (pm *Manager) nextState(ctx context.Context) map[uint32]*managedPort {
 		if mp.GlobalPort == 0 || ((mp.Exposed || autoExposed) && mp.GlobalPort == exposedGlobalPort) {
 			continue
 		}
+		if pm.configs.Ignored(port) {
+			continue
+		}
 
 		var public bool
 		config, kind, exists := pm.configs.Get(mp.LocalhostPort)
@@ -352,21 +406,33 @@ func (pm *Manager) nextState(ctx context.Context) map[uint32]*managedPort {
 
 		pm.autoExpose(ctx, mp, public)
 	}
+
+	// 4. label all ports with the name and description of their config, if any
+	for port, mp := range state {
+		config, _, exists := pm.configs.Get(port)
+		if !exists {
+			continue
+		}
+		mp.Name = config.Name
+		mp.Description = config.Description
+	}
 	return state
 }
 
 // clients should guard a call with check whether such port is already exposed or auto exposed
 func (pm *Manager) autoExpose(ctx context.Context, mp *managedPort, public bool) {
 	exposing := pm.E.Expose(ctx, mp.LocalhostPort, mp.GlobalPort, public)
+	// the goroutine logs a copy because mp keeps changing while we wait
+	port := *mp
 	go func() {
 		err := <-exposing
 		if err != nil {
 			if err != context.Canceled {
-				log.WithError(err).WithField("port", *mp).Warn("cannot auto-expose port")
+				log.WithError(err).WithField("port", port).Warn("cannot auto-expose port")
 			}
 			return
 		}
-		log.WithField("port", *mp).Info("auto-exposed port")
+		log.WithField("port", port).Info("auto-exposed port")
 	}()
 	pm.autoExposed[mp.LocalhostPort] = mp.GlobalPort
 	log.WithField("port", *mp).Info("auto-exposing port")
@@ -465,8 +531,11 @@ func (pm *Manager) boundInternally(port uint32) bool {
 	return exists
 }
 
-// Expose exposes a port
-func (pm *Manager) Expose(ctx context.Context, port uint32, targetPort uint32) error {
+// Expose exposes a port. The port is exposed publicly if public is set or its configuration asks for it.
+// Exposing an exposed port again only changes its visibility from private to public. Ports which are
+// configured are auto-exposed and never exposed here, unless they are ignored. All other ports must be served
+// before they can be exposed. Ignored ports can be exposed like any other port.
+func (pm *Manager) Expose(ctx context.Context, port uint32, targetPort uint32, public bool) error {
 	unlock := true
 	pm.mu.RLock()
 	defer func() {
@@ -475,44 +544,155 @@ func (pm *Manager) Expose(ctx context.Context, port uint32, targetPort uint32) e
 		}
 	}()
 
+	if pm.boundInternally(port) {
+		return ErrInternalPort
+	}
+
 	mp, ok := pm.state[port]
-	if ok {
-		if mp.Exposed {
+	exposed := ok && mp.Exposed
+	if exposed && (!public || mp.Visibility == api.PortVisibility_public) {
+		return nil
+	}
+
+	config, kind, exists := pm.configs.Get(port)
+	if !exposed {
+		configured := exists && kind == PortConfigKind
+		if configured && !pm.configs.Ignored(port) {
+			// will be auto-exposed
 			return nil
 		}
-		if pm.boundInternally(port) {
-			return xerrors.New("internal service cannot be exposed")
+		if !configured && (!ok || !mp.Served) {
+			return ErrPortNotServed
 		}
 	}
 
-	config, kind, exists := pm.configs.Get(port)
-	if exists && kind == PortConfigKind {
-		// will be auto-exposed
-		return nil
+	global := targetPort
+	if global == 0 && exposed {
+		global = pm.exposedGlobalPort(mp)
 	}
+	exposedPorts := pm.E
 
 	// we don't need the lock anymore. Let's unlock and make sure the defer doesn't try
 	// the same thing again.
 	pm.mu.RUnlock()
 	unlock = false
 
-	global := targetPort
 	if global == 0 {
 		global = port
 	}
-	public := exists && config.Visibility != "private"
-	err := <-pm.E.Expose(ctx, port, global, public)
+	public = public || (exists && config.Visibility != "private")
+	err := <-exposedPorts.Expose(ctx, port, global, public)
 	if err != nil && err != context.Canceled {
 		log.WithError(err).WithField("port", port).WithField("targetPort", targetPort).Error("cannot expose port")
 	}
 	return err
 }
 
+// ChangeVisibility makes a port public or private. Ports which are not exposed yet are exposed with
+// the visibility, which takes precedence over the visibility of their configuration.
+func (pm *Manager) ChangeVisibility(ctx context.Context, port uint32, public bool) error {
+	pm.mu.RLock()
+	if pm.boundInternally(port) {
+		pm.mu.RUnlock()
+		return ErrInternalPort
+	}
+	mp, ok := pm.state[port]
+	if !ok {
+		pm.mu.RUnlock()
+		return ErrPortNotServed
+	}
+	visibility := api.PortVisibility_private
+	if public {
+		visibility = api.PortVisibility_public
+	}
+	if mp.Exposed && mp.Visibility == visibility {
+		pm.mu.RUnlock()
+		return nil
+	}
+	global := pm.exposedGlobalPort(mp)
+	exposedPorts := pm.E
+	pm.mu.RUnlock()
+
+	if global == 0 {
+		global = port
+	}
+	// exposing a port again updates its visibility
+	err := <-exposedPorts.Expose(ctx, port, global, public)
+	if err != nil && err != context.Canceled {
+		log.WithError(err).WithField("port", port).WithField("public", public).Error("cannot change port visibility")
+	}
+	return err
+}
+
+// exposedGlobalPort returns the global port a port is exposed on, or the global port it would be auto-exposed
+// on if it isn't exposed yet. Callers are expected to hold mu.
+func (pm *Manager) exposedGlobalPort(mp *managedPort) uint32 {
+	if mp.Exposed {
+		for _, e := range pm.exposed {
+			if e.LocalPort == mp.LocalhostPort {
+				return e.GlobalPort
+			}
+		}
+	}
+	return mp.GlobalPort
+}
+
+// Unexpose stops exposing a port. Auto-exposed ports are not exposed again automatically afterwards.
+func (pm *Manager) Unexpose(ctx context.Context, port uint32) error {
+	pm.mu.RLock()
+	mp, ok := pm.state[port]
+	exposed := ok && mp.Exposed
+	exposedPorts := pm.E
+	pm.mu.RUnlock()
+	if !exposed {
+		return ErrPortNotExposed
+	}
+
+	err := <-exposedPorts.Unexpose(ctx, port)
+	if err != nil && err != context.Canceled {
+		log.WithError(err).WithField("port", port).Error("cannot unexpose port")
+	}
+	return err
+}
+
+// Exposed lists the currently exposed ports ordered by their local port
+func (pm *Manager) Exposed() []*api.ExposedPortStatus {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	res := make([]*api.ExposedPortStatus, 0, len(pm.state))
+	for port, mp := range pm.state {
+		if !mp.Exposed {
+			continue
+		}
+		origin := api.PortExposureOrigin_manual
+		if _, autoExposed := pm.autoExposed[port]; autoExposed {
+			origin = api.PortExposureOrigin_auto
+		}
+		res = append(res, &api.ExposedPortStatus{
+			LocalPort:  mp.LocalhostPort,
+			GlobalPort: mp.GlobalPort,
+			Visibility: mp.Visibility,
+			Url:        mp.URL,
+			Served:     mp.Served,
+			Origin:     origin,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].LocalPort < res[j].LocalPort })
+	return res
+}
+
 var (
 	// ErrClosed when the port management is stopped
 	ErrClosed = errors.New("closed")
 	// ErrTooManySubscriptions when max allowed subscriptions exceed
 	ErrTooManySubscriptions = errors.New("too many subscriptions")
+	// ErrInternalPort when exposing a port used by supervisor itself
+	ErrInternalPort = errors.New("internal service cannot be exposed")
+	// ErrPortNotServed when exposing a port no process in the workspace serves yet
+	ErrPortNotServed = errors.New("port is not served")
+	// ErrPortNotExposed when unexposing a port which is not exposed
+	ErrPortNotExposed = errors.New("port is not exposed")
 )
 
 // Subscribe subscribes for status updates
@@ -561,9 +741,11 @@ func (pm *Manager) getStatus() []*api.PortsStatus {
 func (pm *Manager) getPortStatus(port uint32) *api.PortsStatus {
 	mp := pm.state[port]
 	ps := &api.PortsStatus{
-		GlobalPort: mp.GlobalPort,
-		LocalPort:  mp.LocalhostPort,
-		Served:     mp.Served,
+		GlobalPort:  mp.GlobalPort,
+		LocalPort:   mp.LocalhostPort,
+		Served:      mp.Served,
+		Name:        mp.Name,
+		Description: mp.Description,
 	}
 	if mp.Exposed && mp.URL != "" {
 		ps.Exposed = &api.ExposedPortInfo{
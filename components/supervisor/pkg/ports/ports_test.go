@@ -27,6 +27,7 @@ func TestPortsUpdateState(t *testing.T) {
 	type ConfigChange struct {
 		workspace []*gitpod.PortConfig
 		instance  []*gitpod.PortsItems
+		ignore    []interface{}
 	}
 	type Change struct {
 		Config     *ConfigChange
@@ -102,6 +103,21 @@ func TestPortsUpdateState(t *testing.T) {
 			ExpectedExposure: ExposureExpectation(nil),
 			ExpectedUpdates:  UpdateExpectation{{}},
 		},
+		{
+			Desc: "ignored ports",
+			Changes: []Change{
+				{Config: &ConfigChange{ignore: []interface{}{8080, "9000-9010"}}},
+				{Served: []ServedPort{{"00000000", 8080, false}, {"00000000", 9005, false}}},
+				{Config: &ConfigChange{ignore: []interface{}{"9000-9010"}}},
+			},
+			ExpectedExposure: []ExposedPort{
+				{LocalPort: 8080, GlobalPort: 8080},
+			},
+			ExpectedUpdates: UpdateExpectation{
+				{},
+				[]*api.PortsStatus{{LocalPort: 8080, GlobalPort: 8080, Served: true}, {LocalPort: 9005, GlobalPort: 9005, Served: true}},
+			},
+		},
 		{
 			Desc: "serving configured workspace port",
 			Changes: []Change{
@@ -166,6 +182,32 @@ func TestPortsUpdateState(t *testing.T) {
 				},
 			},
 		},
+		{
+			Desc: "port names and descriptions",
+			Changes: []Change{
+				{Config: &ConfigChange{
+					instance: []*gitpod.PortsItems{
+						{Port: 3000, Name: "frontend", Description: "the web app"},
+						{Port: "4000-5000", Name: "backends", Description: "the microservices"},
+					},
+				}},
+				{Served: []ServedPort{{"00000000", 3000, false}, {"00000000", 4040, false}, {"00000000", 8080, false}}},
+			},
+			ExpectedExposure: []ExposedPort{
+				{LocalPort: 3000, GlobalPort: 3000, Public: true},
+				{LocalPort: 4040, GlobalPort: 4040, Public: true},
+				{LocalPort: 8080, GlobalPort: 8080},
+			},
+			ExpectedUpdates: UpdateExpectation{
+				{},
+				[]*api.PortsStatus{{LocalPort: 3000, GlobalPort: 3000, Name: "frontend", Description: "the web app"}},
+				[]*api.PortsStatus{
+					{LocalPort: 3000, GlobalPort: 3000, Served: true, Name: "frontend", Description: "the web app"},
+					{LocalPort: 4040, GlobalPort: 4040, Served: true, Name: "backends", Description: "the microservices"},
+					{LocalPort: 8080, GlobalPort: 8080, Served: true},
+				},
+			},
+		},
 		{
 			Desc: "auto expose configured ports",
 			Changes: []Change{
@@ -504,6 +546,7 @@ func TestPortsUpdateState(t *testing.T) {
 						portConfigs, rangeConfigs := parseInstanceConfigs(c.Config.instance)
 						change.instancePortConfigs = portConfigs
 						change.instanceRangeConfigs = rangeConfigs
+						change.ignoredPorts, change.ignoredRanges = parseIgnorePorts(c.Config.ignore)
 						config.Changes <- change
 					} else if c.ConfigErr != nil {
 						config.Error <- c.ConfigErr
@@ -541,6 +584,292 @@ func TestPortsUpdateState(t *testing.T) {
 	}
 }
 
+func TestManagerExpose(t *testing.T) {
+	type Expose struct {
+		Port       uint32
+		TargetPort uint32
+		Public     bool
+	}
+	tests := []struct {
+		Desc             string
+		InternalPorts    []uint32
+		Config           []*gitpod.PortConfig
+		Ignore           []interface{}
+		Served           []ServedPort
+		Exposed          []ExposedPort
+		Expose           Expose
+		ExpectedErr      error
+		ExpectedExposure []ExposedPort
+	}{
+		{
+			Desc:        "not served",
+			Expose:      Expose{Port: 8080},
+			ExpectedErr: ErrPortNotServed,
+		},
+		{
+			Desc:          "internal",
+			InternalPorts: []uint32{24999},
+			Served:        []ServedPort{{"00000000", 24999, false}},
+			Expose:        Expose{Port: 24999},
+			ExpectedErr:   ErrInternalPort,
+		},
+		{
+			Desc:             "served",
+			Served:           []ServedPort{{"00000000", 8080, false}},
+			Expose:           Expose{Port: 8080},
+			ExpectedExposure: []ExposedPort{{LocalPort: 8080, GlobalPort: 8080}},
+		},
+		{
+			Desc:             "served public",
+			Served:           []ServedPort{{"00000000", 8080, false}},
+			Expose:           Expose{Port: 8080, Public: true},
+			ExpectedExposure: []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, Public: true}},
+		},
+		{
+			Desc:             "target port",
+			Served:           []ServedPort{{"00000000", 8080, false}},
+			Expose:           Expose{Port: 8080, TargetPort: 9000},
+			ExpectedExposure: []ExposedPort{{LocalPort: 8080, GlobalPort: 9000}},
+		},
+		{
+			Desc:   "configured",
+			Config: []*gitpod.PortConfig{{Port: 3000}},
+			Expose: Expose{Port: 3000},
+		},
+		{
+			Desc:             "ignored",
+			Ignore:           []interface{}{"8000-8100"},
+			Served:           []ServedPort{{"00000000", 8080, false}},
+			Expose:           Expose{Port: 8080},
+			ExpectedExposure: []ExposedPort{{LocalPort: 8080, GlobalPort: 8080}},
+		},
+		{
+			Desc:             "ignored configured",
+			Config:           []*gitpod.PortConfig{{Port: 3000, Visibility: "public"}},
+			Ignore:           []interface{}{3000},
+			Expose:           Expose{Port: 3000},
+			ExpectedExposure: []ExposedPort{{LocalPort: 3000, GlobalPort: 3000, Public: true}},
+		},
+		{
+			Desc:    "exposed",
+			Served:  []ServedPort{{"00000000", 8080, false}},
+			Exposed: []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, URL: "foobar"}},
+			Expose:  Expose{Port: 8080},
+		},
+		{
+			Desc:             "exposed private made public",
+			Served:           []ServedPort{{"00000000", 8080, false}},
+			Exposed:          []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, URL: "foobar"}},
+			Expose:           Expose{Port: 8080, Public: true},
+			ExpectedExposure: []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, Public: true}},
+		},
+		{
+			Desc:    "exposed public is not made private",
+			Served:  []ServedPort{{"00000000", 8080, false}},
+			Exposed: []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, URL: "foobar", Public: true}},
+			Expose:  Expose{Port: 8080},
+		},
+	}
+
+	log.Log.Logger.SetLevel(logrus.FatalLevel)
+
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			exposed := &testExposedPorts{}
+			pm := NewManager(exposed, &testServedPorts{}, &testConfigService{}, test.InternalPorts...)
+			pm.proxyStarter = func(localPort uint32, globalPort uint32) (io.Closer, error) {
+				return io.NopCloser(nil), nil
+			}
+
+			ctx := context.Background()
+			configs := &Configs{workspaceConfigs: parseWorkspaceConfigs(test.Config)}
+			configs.ignoredPorts, configs.ignoredRanges = parseIgnorePorts(test.Ignore)
+			pm.updateState(ctx, test.Exposed, test.Served, configs)
+			// we're only interested in the exposures of Expose, not the auto-exposures
+			exposed.Exposures = nil
+
+			err := pm.Expose(ctx, test.Expose.Port, test.Expose.TargetPort, test.Expose.Public)
+			if err != test.ExpectedErr {
+				t.Errorf("unexpected error: expected %v, got %v", test.ExpectedErr, err)
+			}
+			if diff := cmp.Diff(test.ExpectedExposure, exposed.Exposures); diff != "" {
+				t.Errorf("unexpected exposures (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestManagerChangeVisibility(t *testing.T) {
+	tests := []struct {
+		Desc             string
+		InternalPorts    []uint32
+		Config           []*gitpod.PortConfig
+		Served           []ServedPort
+		Exposed          []ExposedPort
+		Port             uint32
+		Public           bool
+		ExpectedErr      error
+		ExpectedExposure []ExposedPort
+		ExpectedStatus   *api.ExposedPortInfo
+	}{
+		{
+			Desc:        "unknown port",
+			Port:        8080,
+			ExpectedErr: ErrPortNotServed,
+		},
+		{
+			Desc:          "internal",
+			InternalPorts: []uint32{24999},
+			Served:        []ServedPort{{"00000000", 24999, false}},
+			Port:          24999,
+			ExpectedErr:   ErrInternalPort,
+		},
+		{
+			Desc:             "private to public",
+			Served:           []ServedPort{{"00000000", 8080, false}},
+			Exposed:          []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, URL: "foobar"}},
+			Port:             8080,
+			Public:           true,
+			ExpectedExposure: []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, Public: true}},
+			ExpectedStatus:   &api.ExposedPortInfo{Visibility: api.PortVisibility_public, Url: "foobar", OnExposed: api.OnPortExposedAction_notify_private},
+		},
+		{
+			Desc:             "public to private",
+			Served:           []ServedPort{{"00000000", 8080, false}},
+			Exposed:          []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, URL: "foobar", Public: true}},
+			Port:             8080,
+			ExpectedExposure: []ExposedPort{{LocalPort: 8080, GlobalPort: 8080}},
+			ExpectedStatus:   &api.ExposedPortInfo{Visibility: api.PortVisibility_private, Url: "foobar", OnExposed: api.OnPortExposedAction_notify_private},
+		},
+		{
+			Desc:           "unchanged",
+			Served:         []ServedPort{{"00000000", 8080, false}},
+			Exposed:        []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, URL: "foobar", Public: true}},
+			Port:           8080,
+			Public:         true,
+			ExpectedStatus: &api.ExposedPortInfo{Visibility: api.PortVisibility_public, Url: "foobar", OnExposed: api.OnPortExposedAction_notify_private},
+		},
+		{
+			Desc:             "exposed on a different global port",
+			Served:           []ServedPort{{"0100007F", 8080, true}},
+			Exposed:          []ExposedPort{{LocalPort: 8080, GlobalPort: 60000, URL: "foobar"}},
+			Port:             8080,
+			Public:           true,
+			ExpectedExposure: []ExposedPort{{LocalPort: 8080, GlobalPort: 60000, Public: true}},
+			ExpectedStatus:   &api.ExposedPortInfo{Visibility: api.PortVisibility_public, Url: "foobar", OnExposed: api.OnPortExposedAction_notify_private},
+		},
+		{
+			Desc:             "not exposed yet",
+			Served:           []ServedPort{{"00000000", 8080, false}},
+			Port:             8080,
+			Public:           true,
+			ExpectedExposure: []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, Public: true}},
+			ExpectedStatus:   &api.ExposedPortInfo{Visibility: api.PortVisibility_public, Url: "foobar", OnExposed: api.OnPortExposedAction_notify_private},
+		},
+		{
+			Desc:             "configured public made private",
+			Config:           []*gitpod.PortConfig{{Port: 3000, Visibility: "public"}},
+			Port:             3000,
+			ExpectedExposure: []ExposedPort{{LocalPort: 3000, GlobalPort: 3000}},
+			ExpectedStatus:   &api.ExposedPortInfo{Visibility: api.PortVisibility_private, Url: "foobar", OnExposed: api.OnPortExposedAction_notify},
+		},
+	}
+
+	log.Log.Logger.SetLevel(logrus.FatalLevel)
+
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			exposed := &testExposedPorts{}
+			pm := NewManager(exposed, &testServedPorts{}, &testConfigService{}, test.InternalPorts...)
+			pm.proxyStarter = func(localPort uint32, globalPort uint32) (io.Closer, error) {
+				return io.NopCloser(nil), nil
+			}
+
+			ctx := context.Background()
+			configs := &Configs{workspaceConfigs: parseWorkspaceConfigs(test.Config)}
+			pm.updateState(ctx, nil, test.Served, configs)
+			if test.Exposed != nil {
+				pm.updateState(ctx, test.Exposed, nil, nil)
+			}
+			// we're only interested in the exposures of ChangeVisibility, not the auto-exposures
+			exposed.Exposures = nil
+
+			err := pm.ChangeVisibility(ctx, test.Port, test.Public)
+			if err != test.ExpectedErr {
+				t.Errorf("unexpected error: expected %v, got %v", test.ExpectedErr, err)
+			}
+			if diff := cmp.Diff(test.ExpectedExposure, exposed.Exposures); diff != "" {
+				t.Errorf("unexpected exposures (-want +got):\n%s", diff)
+			}
+			if test.ExpectedStatus == nil {
+				return
+			}
+
+			// the Gitpod server reports the port with its new visibility, which must show in the port status
+			update := make([]ExposedPort, 0, len(exposed.Exposures))
+			for _, e := range exposed.Exposures {
+				e.URL = "foobar"
+				update = append(update, e)
+			}
+			if len(update) > 0 {
+				pm.updateState(ctx, update, nil, nil)
+			}
+			var status *api.ExposedPortInfo
+			for _, s := range pm.Status() {
+				if s.LocalPort == test.Port {
+					status = s.Exposed
+				}
+			}
+			if diff := cmp.Diff(test.ExpectedStatus, status, cmpopts.IgnoreUnexported(api.ExposedPortInfo{})); diff != "" {
+				t.Errorf("unexpected port status (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestManagerUnexpose(t *testing.T) {
+	exposed := &testExposedPorts{}
+	pm := NewManager(exposed, &testServedPorts{}, &testConfigService{})
+
+	ctx := context.Background()
+	pm.updateState(ctx, []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, URL: "foobar"}}, nil, nil)
+
+	err := pm.Unexpose(ctx, 3000)
+	if err != ErrPortNotExposed {
+		t.Errorf("unexpected error unexposing a port which is not exposed: expected %v, got %v", ErrPortNotExposed, err)
+	}
+	err = pm.Unexpose(ctx, 8080)
+	if err != nil {
+		t.Errorf("cannot unexpose port: %v", err)
+	}
+	if diff := cmp.Diff([]uint32{8080}, exposed.Unexposures); diff != "" {
+		t.Errorf("unexpected unexposures (-want +got):\n%s", diff)
+	}
+}
+
+func TestManagerExposed(t *testing.T) {
+	pm := NewManager(&testExposedPorts{}, &testServedPorts{}, &testConfigService{})
+	pm.proxyStarter = func(localPort uint32, globalPort uint32) (io.Closer, error) {
+		return io.NopCloser(nil), nil
+	}
+
+	ctx := context.Background()
+	// 8080 is served first and hence auto-exposed, 9000 was exposed on request
+	pm.updateState(ctx, nil, []ServedPort{{"00000000", 8080, false}, {"00000000", 3000, false}}, nil)
+	pm.updateState(ctx, []ExposedPort{
+		{LocalPort: 9000, GlobalPort: 9000, URL: "foo", Public: true},
+		{LocalPort: 8080, GlobalPort: 8080, URL: "bar"},
+	}, nil, nil)
+
+	expectation := []*api.ExposedPortStatus{
+		{LocalPort: 8080, GlobalPort: 8080, Visibility: api.PortVisibility_private, Url: "bar", Served: true, Origin: api.PortExposureOrigin_auto},
+		{LocalPort: 9000, GlobalPort: 9000, Visibility: api.PortVisibility_public, Url: "foo", Origin: api.PortExposureOrigin_manual},
+	}
+	if diff := cmp.Diff(expectation, pm.Exposed(), cmpopts.IgnoreUnexported(api.ExposedPortStatus{})); diff != "" {
+		t.Errorf("unexpected exposed ports (-want +got):\n%s", diff)
+	}
+}
+
 type testConfigService struct {
 	Changes chan *Configs
 	Error   chan error
@@ -550,12 +879,70 @@ func (tep *testConfigService) Observe(ctx context.Context) (<-chan *Configs, <-c
 	return tep.Changes, tep.Error
 }
 
+func TestManagerSetExposedPorts(t *testing.T) {
+	var (
+		served = &testServedPorts{
+			Changes: make(chan []ServedPort),
+			Error:   make(chan error, 1),
+		}
+		config = &testConfigService{
+			Changes: make(chan *Configs),
+			Error:   make(chan error, 1),
+		}
+		pm = NewManager(&NoopExposedPorts{}, served, config)
+	)
+	pm.proxyStarter = func(localPort uint32, globalPort uint32) (io.Closer, error) {
+		return io.NopCloser(nil), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go pm.Run(ctx, &wg)
+
+	// the port gets auto-exposed using the noop implementation first
+	served.Changes <- []ServedPort{{"00000000", 8080, false}}
+
+	exposed := &testExposedPorts{
+		Changes: make(chan []ExposedPort),
+		Error:   make(chan error, 1),
+	}
+	pm.SetExposedPorts(exposed)
+
+	var exposures []ExposedPort
+	for i := 0; i < 100; i++ {
+		exposed.mu.Lock()
+		exposures = append([]ExposedPort(nil), exposed.Exposures...)
+		exposed.mu.Unlock()
+		if len(exposures) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if diff := cmp.Diff([]ExposedPort{{LocalPort: 8080, GlobalPort: 8080}}, exposures); diff != "" {
+		t.Errorf("unexpected exposures (-want +got):\n%s", diff)
+	}
+
+	// the manager observes the new implementation
+	select {
+	case exposed.Changes <- []ExposedPort{{LocalPort: 8080, GlobalPort: 8080, URL: "foobar"}}:
+	case <-time.After(time.Second):
+		t.Fatal("manager does not observe the new exposed ports implementation")
+	}
+
+	// the manager stops once one of its observers stops
+	close(served.Changes)
+	wg.Wait()
+}
+
 type testExposedPorts struct {
 	Changes chan []ExposedPort
 	Error   chan error
 
-	Exposures []ExposedPort
-	mu        sync.Mutex
+	Exposures   []ExposedPort
+	Unexposures []uint32
+	mu          sync.Mutex
 }
 
 func (tep *testExposedPorts) Observe(ctx context.Context) (<-chan []ExposedPort, <-chan error) {
@@ -574,7 +961,19 @@ func (tep *testExposedPorts) Expose(ctx context.Context, local, global uint32, p
 		LocalPort:  local,
 		Public:     public,
 	})
-	return nil
+	done := make(chan error)
+	close(done)
+	return done
+}
+
+func (tep *testExposedPorts) Unexpose(ctx context.Context, local uint32) <-chan error {
+	tep.mu.Lock()
+	defer tep.mu.Unlock()
+
+	tep.Unexposures = append(tep.Unexposures, local)
+	done := make(chan error)
+	close(done)
+	return done
 }
 
 type testServedPorts struct {
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -44,11 +45,57 @@ const (
 
 // PollingServedPortsObserver regularly polls "/proc" to observe port changes
 type PollingServedPortsObserver struct {
+	// RefreshInterval is the time between two polls unless Adaptive is set
 	RefreshInterval time.Duration
 
+	// Adaptive enables adaptive polling, which replaces the fixed RefreshInterval
+	Adaptive *AdaptivePolling
+
 	fileOpener func(fn string) (io.ReadCloser, error)
 }
 
+// AdaptivePolling polls frequently while the served ports change and backs off while they are stable.
+// This way port changes are picked up quickly during development, and idle workspaces don't waste cycles.
+type AdaptivePolling struct {
+	// FastInterval is the time between two polls within the settle window
+	FastInterval time.Duration
+	// SlowInterval is the maximum time between two polls once the served ports are stable
+	SlowInterval time.Duration
+	// SettleWindow is the time after a change of the served ports during which we poll with FastInterval.
+	// Afterwards the interval doubles with every poll until it reaches SlowInterval.
+	SettleWindow time.Duration
+}
+
+// pollSchedule decides on the time until the next poll
+type pollSchedule struct {
+	Fixed    time.Duration
+	Adaptive *AdaptivePolling
+
+	interval   time.Duration
+	lastChange time.Time
+}
+
+// Next returns the time until the next poll, given whether the served ports changed in the poll at now
+func (s *pollSchedule) Next(changed bool, now time.Time) time.Duration {
+	if s.Adaptive == nil {
+		return s.Fixed
+	}
+
+	if changed || s.lastChange.IsZero() {
+		s.lastChange = now
+	}
+	if now.Sub(s.lastChange) < s.Adaptive.SettleWindow || s.interval == 0 {
+		s.interval = s.Adaptive.FastInterval
+		return s.interval
+	}
+
+	s.interval *= 2
+	if s.interval > s.Adaptive.SlowInterval {
+		s.interval = s.Adaptive.SlowInterval
+	}
+	return s.interval
+}
+
 // Observe starts observing the served ports until the context is canceled.
 func (p *PollingServedPortsObserver) Observe(ctx context.Context) (<-chan []ServedPort, <-chan error) {
 	if p.fileOpener == nil {
@@ -57,53 +104,69 @@ func (p *PollingServedPortsObserver) Observe(ctx context.Context) (<-chan []Serv
 		}
 	}
 
+	schedule := &pollSchedule{Fixed: p.RefreshInterval, Adaptive: p.Adaptive}
+	return pollServedPorts(ctx, schedule, func(errchan chan<- error) (ports []ServedPort) {
+		for _, fn := range []string{fnNetTCP, fnNetTCP6} {
+			fc, err := p.fileOpener(fn)
+			if err != nil {
+				errchan <- err
+				continue
+			}
+			ps, err := readNetTCPFile(fc, true)
+			fc.Close()
+
+			if err != nil {
+				errchan <- err
+				continue
+			}
+			ports = append(ports, ps...)
+		}
+		return ports
+	})
+}
+
+// pollServedPorts calls read whenever the schedule says so and forwards the served ports it reads,
+// until the context is canceled.
+func pollServedPorts(ctx context.Context, schedule *pollSchedule, read func(errchan chan<- error) []ServedPort) (<-chan []ServedPort, <-chan error) {
 	var (
-		errchan = make(chan error, 1)
-		reschan = make(chan []ServedPort)
-		ticker  = time.NewTicker(p.RefreshInterval)
+		errchan  = make(chan error, 1)
+		reschan  = make(chan []ServedPort)
+		timer    = time.NewTimer(schedule.Next(false, time.Now()))
+		previous []ServedPort
 	)
 
 	go func() {
 		defer close(errchan)
 		defer close(reschan)
+		defer timer.Stop()
 
 		for {
 			select {
 			case <-ctx.Done():
 				log.Warn("done")
 				return
-			case <-ticker.C:
+			case <-timer.C:
 			}
 
 			var (
 				visited = make(map[string]struct{})
 				ports   []ServedPort
 			)
-			for _, fn := range []string{fnNetTCP, fnNetTCP6} {
-				fc, err := p.fileOpener(fn)
-				if err != nil {
-					errchan <- err
-					continue
-				}
-				ps, err := readNetTCPFile(fc, true)
-				fc.Close()
-
-				if err != nil {
-					errchan <- err
+			for _, port := range read(errchan) {
+				key := fmt.Sprintf("%s:%d", port.Address, port.Port)
+				_, exists := visited[key]
+				if exists {
+					log.WithField("addr", port.Address).WithField("port", port.Port).Error("unexpected duplicate served port")
 					continue
 				}
-				for _, port := range ps {
-					key := fmt.Sprintf("%s:%d", port.Address, port.Port)
-					_, exists := visited[key]
-					if exists {
-						log.WithField("addr", port.Address).WithField("port", port.Port).Error("unexpected duplicate served port")
-						continue
-					}
-					visited[key] = struct{}{}
-					ports = append(ports, port)
-				}
+				visited[key] = struct{}{}
+				ports = append(ports, port)
 			}
 
+			changed := !reflect.DeepEqual(previous, ports)
+			previous = ports
+			timer.Reset(schedule.Next(changed, time.Now()))
+
 			if len(ports) > 0 {
 				reschan <- ports
 			}
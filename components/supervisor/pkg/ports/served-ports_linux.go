@@ -0,0 +1,223 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+// +build linux
+
+package ports
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+)
+
+// NetlinkServedPortsObserver observes the served ports using the sock_diag netlink interface of the kernel.
+//
+// The kernel does not notify about new listening sockets, hence we still have to ask for them. Unlike reading
+// /proc/net/tcp* though, a sock_diag request only returns the listening sockets and needs no text formatting
+// and parsing. It's cheap enough to ask frequently, which reduces the time between a service starting to
+// listen and its port being auto-exposed.
+//
+// If netlink is not permitted, e.g. because of a seccomp profile, the observer falls back to Fallback.
+type NetlinkServedPortsObserver struct {
+	// RefreshInterval is the time between two sock_diag requests
+	RefreshInterval time.Duration
+
+	// Fallback observes the served ports if netlink is not permitted
+	Fallback ServedPortsObserver
+
+	dump func(family uint8) ([]ServedPort, error)
+}
+
+// Observe starts observing the served ports until the context is canceled.
+func (p *NetlinkServedPortsObserver) Observe(ctx context.Context) (<-chan []ServedPort, <-chan error) {
+	if p.dump == nil {
+		p.dump = dumpListeningSockets
+	}
+
+	_, err := p.dump(unix.AF_INET)
+	if err != nil {
+		log.WithError(err).Warn("cannot use netlink to observe served ports - falling back to polling")
+		return p.Fallback.Observe(ctx)
+	}
+
+	schedule := &pollSchedule{Fixed: p.RefreshInterval}
+	return pollServedPorts(ctx, schedule, func(errchan chan<- error) (ports []ServedPort) {
+		for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+			ps, err := p.dump(family)
+			if err != nil {
+				errchan <- err
+				continue
+			}
+			ports = append(ports, ps...)
+		}
+		return ports
+	})
+}
+
+const (
+	// sockDiagByFamily is SOCK_DIAG_BY_FAMILY from linux/sock_diag.h
+	sockDiagByFamily = 20
+	// tcpListen is TCP_LISTEN from net/tcp_states.h
+	tcpListen = 10
+)
+
+// inetDiagSockID is struct inet_diag_sockid from linux/inet_diag.h
+type inetDiagSockID struct {
+	SPort  [2]byte
+	DPort  [2]byte
+	Src    [16]byte
+	Dst    [16]byte
+	If     uint32
+	Cookie [2]uint32
+}
+
+// inetDiagReqV2 is struct inet_diag_req_v2 from linux/inet_diag.h
+type inetDiagReqV2 struct {
+	Family   uint8
+	Protocol uint8
+	Ext      uint8
+	Pad      uint8
+	States   uint32
+	ID       inetDiagSockID
+}
+
+// inetDiagMsg is struct inet_diag_msg from linux/inet_diag.h
+type inetDiagMsg struct {
+	Family  uint8
+	State   uint8
+	Timer   uint8
+	Retrans uint8
+	ID      inetDiagSockID
+	Expires uint32
+	RQueue  uint32
+	WQueue  uint32
+	UID     uint32
+	Inode   uint32
+}
+
+const (
+	sizeofInetDiagReqV2 = int(unsafe.Sizeof(inetDiagReqV2{}))
+	sizeofInetDiagMsg   = int(unsafe.Sizeof(inetDiagMsg{}))
+)
+
+// netlinkDiagRequest is a sock_diag request including its netlink header
+type netlinkDiagRequest struct {
+	Header unix.NlMsghdr
+	Req    inetDiagReqV2
+}
+
+// dumpListeningSockets asks the kernel for all TCP sockets of the address family which are listening
+func dumpListeningSockets(family uint8) ([]ServedPort, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	req := netlinkDiagRequest{
+		Header: unix.NlMsghdr{
+			Len:   uint32(unix.SizeofNlMsghdr + sizeofInetDiagReqV2),
+			Type:  sockDiagByFamily,
+			Flags: unix.NLM_F_REQUEST | unix.NLM_F_DUMP,
+			Seq:   1,
+		},
+		Req: inetDiagReqV2{
+			Family:   family,
+			Protocol: unix.IPPROTO_TCP,
+			States:   1 << tcpListen,
+		},
+	}
+	reqb := (*[unix.SizeofNlMsghdr + sizeofInetDiagReqV2]byte)(unsafe.Pointer(&req))[:]
+	err = unix.Sendto(fd, reqb, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot send sock_diag request: %w", err)
+	}
+
+	var (
+		ports []ServedPort
+		buf   = make([]byte, 32*1024)
+	)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot receive sock_diag response: %w", err)
+		}
+		ps, done, err := parseInetDiagMessages(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, ps...)
+		if done {
+			return ports, nil
+		}
+	}
+}
+
+// parseInetDiagMessages parses a netlink response to a sock_diag request. done is true once the response
+// is complete.
+func parseInetDiagMessages(b []byte) (ports []ServedPort, done bool, err error) {
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, false, xerrors.Errorf("cannot parse sock_diag response: %w", err)
+	}
+	for _, msg := range msgs {
+		switch msg.Header.Type {
+		case unix.NLMSG_DONE:
+			return ports, true, nil
+		case unix.NLMSG_ERROR:
+			if len(msg.Data) < 4 {
+				return nil, false, xerrors.Errorf("invalid sock_diag error response")
+			}
+			errno := -int32(nativeEndian.Uint32(msg.Data))
+			return nil, false, xerrors.Errorf("sock_diag request failed: %w", unix.Errno(errno))
+		}
+		if len(msg.Data) < sizeofInetDiagMsg {
+			continue
+		}
+		diag := (*inetDiagMsg)(unsafe.Pointer(&msg.Data[0]))
+		if diag.State != tcpListen {
+			continue
+		}
+
+		addr := formatDiagAddress(diag.Family, diag.ID.Src)
+		ports = append(ports, ServedPort{
+			Address:          addr,
+			Port:             uint32(binary.BigEndian.Uint16(diag.ID.SPort[:])),
+			BoundToLocalhost: strings.Trim(addr, "0") != "",
+		})
+	}
+	return ports, false, nil
+}
+
+// formatDiagAddress formats an address the way /proc/net/tcp* does, i.e. as hex-encoded 32 bit words
+// in host byte order. This way the served ports are the same no matter how we observed them.
+func formatDiagAddress(family uint8, src [16]byte) string {
+	words := 4
+	if family == unix.AF_INET {
+		words = 1
+	}
+	var res strings.Builder
+	for i := 0; i < words; i++ {
+		fmt.Fprintf(&res, "%08X", nativeEndian.Uint32(src[i*4:i*4+4]))
+	}
+	return res.String()
+}
+
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	i := uint16(1)
+	if (*[2]byte)(unsafe.Pointer(&i))[0] == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
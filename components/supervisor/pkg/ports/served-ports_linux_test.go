@@ -0,0 +1,188 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+// +build linux
+
+package ports
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+func TestFormatDiagAddress(t *testing.T) {
+	if nativeEndian != binary.LittleEndian {
+		t.Skip("expectations assume a little endian host")
+	}
+
+	tests := []struct {
+		Desc        string
+		Family      uint8
+		Addr        net.IP
+		Expectation string
+	}{
+		{Desc: "ip4 any", Family: unix.AF_INET, Addr: net.IPv4zero.To4(), Expectation: "00000000"},
+		{Desc: "ip4 localhost", Family: unix.AF_INET, Addr: net.IPv4(127, 0, 0, 1).To4(), Expectation: "0100007F"},
+		{Desc: "ip6 any", Family: unix.AF_INET6, Addr: net.IPv6unspecified, Expectation: "00000000000000000000000000000000"},
+		{Desc: "ip6 localhost", Family: unix.AF_INET6, Addr: net.IPv6loopback, Expectation: "00000000000000000000000001000000"},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var src [16]byte
+			copy(src[:], test.Addr)
+
+			act := formatDiagAddress(test.Family, src)
+			if act != test.Expectation {
+				t.Errorf("unexpected address: expected %s, got %s", test.Expectation, act)
+			}
+		})
+	}
+}
+
+func TestParseInetDiagMessages(t *testing.T) {
+	if nativeEndian != binary.LittleEndian {
+		t.Skip("expectations assume a little endian host")
+	}
+
+	diagMessage := func(family uint8, state uint8, addr net.IP, port uint16) []byte {
+		msg := inetDiagMsg{Family: family, State: state}
+		copy(msg.ID.Src[:], addr)
+		binary.BigEndian.PutUint16(msg.ID.SPort[:], port)
+		return netlinkMessage(sockDiagByFamily, (*[sizeofInetDiagMsg]byte)(unsafe.Pointer(&msg))[:])
+	}
+	concat := func(msgs ...[]byte) (res []byte) {
+		for _, msg := range msgs {
+			res = append(res, msg...)
+		}
+		return res
+	}
+
+	type Expectation struct {
+		Ports []ServedPort
+		Done  bool
+		Error string
+	}
+	tests := []struct {
+		Desc        string
+		Input       []byte
+		Expectation Expectation
+	}{
+		{
+			Desc: "listening sockets",
+			Input: concat(
+				diagMessage(unix.AF_INET, tcpListen, net.IPv4zero.To4(), 8080),
+				diagMessage(unix.AF_INET, tcpListen, net.IPv4(127, 0, 0, 1).To4(), 5900),
+			),
+			Expectation: Expectation{
+				Ports: []ServedPort{
+					{Address: "00000000", Port: 8080},
+					{Address: "0100007F", Port: 5900, BoundToLocalhost: true},
+				},
+			},
+		},
+		{
+			Desc: "done",
+			Input: concat(
+				diagMessage(unix.AF_INET6, tcpListen, net.IPv6loopback, 3000),
+				netlinkMessage(unix.NLMSG_DONE, make([]byte, 4)),
+			),
+			Expectation: Expectation{
+				Ports: []ServedPort{
+					{Address: "00000000000000000000000001000000", Port: 3000, BoundToLocalhost: true},
+				},
+				Done: true,
+			},
+		},
+		{
+			Desc:        "sockets which are not listening",
+			Input:       diagMessage(unix.AF_INET, 1, net.IPv4zero.To4(), 8080),
+			Expectation: Expectation{},
+		},
+		{
+			Desc:        "error",
+			Input:       netlinkMessage(unix.NLMSG_ERROR, []byte{0xff, 0xff, 0xff, 0xff}),
+			Expectation: Expectation{Error: "sock_diag request failed: operation not permitted"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var act Expectation
+			ports, done, err := parseInetDiagMessages(test.Input)
+			act.Ports, act.Done = ports, done
+			if err != nil {
+				act.Error = err.Error()
+			}
+
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func netlinkMessage(tpe uint16, data []byte) []byte {
+	res := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(data))
+	binary.LittleEndian.PutUint32(res[0:4], uint32(unix.SizeofNlMsghdr+len(data)))
+	binary.LittleEndian.PutUint16(res[4:6], tpe)
+	return append(res, data...)
+}
+
+func TestNetlinkServedPortsObserver(t *testing.T) {
+	if _, err := dumpListeningSockets(unix.AF_INET); err != nil {
+		t.Skipf("netlink is not permitted: %v", err)
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	obs := &NetlinkServedPortsObserver{RefreshInterval: 10 * time.Millisecond}
+	updates, errs := obs.Observe(ctx)
+	go func() {
+		for range errs {
+		}
+	}()
+
+	expectation := ServedPort{Address: "0100007F", Port: port, BoundToLocalhost: true}
+	for up := range updates {
+		for _, p := range up {
+			if p == expectation {
+				return
+			}
+		}
+	}
+	t.Errorf("listening port %d was not observed", port)
+}
+
+func TestNetlinkServedPortsObserverFallback(t *testing.T) {
+	fallback := &testServedPorts{
+		Changes: make(chan []ServedPort),
+		Error:   make(chan error),
+	}
+	obs := &NetlinkServedPortsObserver{
+		RefreshInterval: 10 * time.Millisecond,
+		Fallback:        fallback,
+		dump: func(family uint8) ([]ServedPort, error) {
+			return nil, unix.EPERM
+		},
+	}
+
+	updates, errs := obs.Observe(context.Background())
+	if updates != (<-chan []ServedPort)(fallback.Changes) || errs != (<-chan error)(fallback.Error) {
+		t.Errorf("observer did not fall back when netlink is not permitted")
+	}
+}
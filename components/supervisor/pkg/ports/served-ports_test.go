@@ -173,6 +173,82 @@ func TestObserve(t *testing.T) {
 	}
 }
 
+func TestPollSchedule(t *testing.T) {
+	type Poll struct {
+		After    time.Duration
+		Changed  bool
+		Interval time.Duration
+	}
+	adaptive := &AdaptivePolling{
+		FastInterval: 500 * time.Millisecond,
+		SlowInterval: 5 * time.Second,
+		SettleWindow: 2 * time.Second,
+	}
+	tests := []struct {
+		Desc     string
+		Fixed    time.Duration
+		Adaptive *AdaptivePolling
+		Polls    []Poll
+	}{
+		{
+			Desc:  "fixed",
+			Fixed: 2 * time.Second,
+			Polls: []Poll{
+				{Interval: 2 * time.Second},
+				{After: 2 * time.Second, Changed: true, Interval: 2 * time.Second},
+				{After: 2 * time.Second, Interval: 2 * time.Second},
+			},
+		},
+		{
+			Desc:     "fast while settling after start",
+			Adaptive: adaptive,
+			Polls: []Poll{
+				{Interval: 500 * time.Millisecond},
+				{After: 500 * time.Millisecond, Interval: 500 * time.Millisecond},
+				{After: 500 * time.Millisecond, Interval: 500 * time.Millisecond},
+				{After: 500 * time.Millisecond, Interval: 500 * time.Millisecond},
+			},
+		},
+		{
+			Desc:     "back off once stable",
+			Adaptive: adaptive,
+			Polls: []Poll{
+				{Interval: 500 * time.Millisecond},
+				{After: 2 * time.Second, Interval: 1 * time.Second},
+				{After: 1 * time.Second, Interval: 2 * time.Second},
+				{After: 2 * time.Second, Interval: 4 * time.Second},
+				{After: 4 * time.Second, Interval: 5 * time.Second},
+				{After: 5 * time.Second, Interval: 5 * time.Second},
+			},
+		},
+		{
+			Desc:     "change resets back-off",
+			Adaptive: adaptive,
+			Polls: []Poll{
+				{Interval: 500 * time.Millisecond},
+				{After: 2 * time.Second, Interval: 1 * time.Second},
+				{After: 1 * time.Second, Interval: 2 * time.Second},
+				{After: 2 * time.Second, Changed: true, Interval: 500 * time.Millisecond},
+				{After: 500 * time.Millisecond, Interval: 500 * time.Millisecond},
+				{After: 1500 * time.Millisecond, Interval: 1 * time.Second},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			schedule := &pollSchedule{Fixed: test.Fixed, Adaptive: test.Adaptive}
+			now := time.Now()
+			for i, poll := range test.Polls {
+				now = now.Add(poll.After)
+				act := schedule.Next(poll.Changed, now)
+				if act != poll.Interval {
+					t.Errorf("unexpected interval after poll %d: expected %v, got %v", i, poll.Interval, act)
+				}
+			}
+		})
+	}
+}
+
 func TestReadNetTCPFile(t *testing.T) {
 	type Expectation struct {
 		Ports []ServedPort
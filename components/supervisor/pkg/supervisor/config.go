@@ -9,17 +9,26 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	env "github.com/Netflix/go-env"
 	"golang.org/x/xerrors"
 
+	"github.com/gitpod-io/gitpod/common-go/util"
+	csapi "github.com/gitpod-io/gitpod/content-service/api"
 	gitpod "github.com/gitpod-io/gitpod/gitpod-protocol"
 	"github.com/gitpod-io/gitpod/supervisor/api"
+	"github.com/gitpod-io/gitpod/supervisor/pkg/ports"
 )
 
 const supervisorConfigFile = "supervisor-config.json"
@@ -62,6 +71,147 @@ func (c Config) LogRateLimit() int {
 	return c.IDELogRateLimit
 }
 
+// LogRateLimitStdout returns the log rate limit for the IDE's stdout in kib/sec.
+// Falls back to LogRateLimit if no stdout specific limit is configured.
+func (c Config) LogRateLimitStdout() int {
+	return c.streamLogRateLimit(c.IDELogRateLimitStdout)
+}
+
+// LogRateLimitStderr returns the log rate limit for the IDE's stderr in kib/sec.
+// Falls back to LogRateLimit if no stderr specific limit is configured.
+func (c Config) LogRateLimitStderr() int {
+	return c.streamLogRateLimit(c.IDELogRateLimitStderr)
+}
+
+func (c Config) streamLogRateLimit(ideLimit int) int {
+	if ideLimit == 0 {
+		return c.LogRateLimit()
+	}
+	if c.WorkspaceLogRateLimit < ideLimit {
+		return c.WorkspaceLogRateLimit
+	}
+	return ideLimit
+}
+
+// defaultIDEBindHost is the address the IDE binds to if IDEBindHost is empty
+const defaultIDEBindHost = "0.0.0.0"
+
+// IDELaunchHost returns the address the IDE binds to
+func (c Config) IDELaunchHost() string {
+	if c.IDEBindHost == "" {
+		return defaultIDEBindHost
+	}
+	return c.IDEBindHost
+}
+
+// IDELaunchWorkdir returns the working directory of the IDE
+func (c Config) IDELaunchWorkdir() string {
+	if c.IDEWorkdir == "" {
+		return c.WorkspaceRoot
+	}
+	return c.IDEWorkdir
+}
+
+// IDEProbeHost returns the host the readiness probes connect to. If the IDE binds to
+// all interfaces, localhost is used.
+func (c Config) IDEProbeHost() string {
+	host := c.IDELaunchHost()
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return "localhost"
+	}
+	return host
+}
+
+// IDELaunchArgs returns the arguments the IDE entrypoint is launched with
+func (c Config) IDELaunchArgs() []string {
+	args := c.IDEArgs
+	if len(args) == 0 {
+		args = defaultIDEArgs
+	}
+
+	r := strings.NewReplacer(
+		"{port}", strconv.Itoa(c.IDEPort),
+		"{hostname}", c.IDELaunchHost(),
+		"{workdir}", c.IDELaunchWorkdir(),
+		"{workspaceRoot}", c.WorkspaceRoot,
+	)
+	res := make([]string, len(args))
+	for i, arg := range args {
+		res[i] = r.Replace(arg)
+	}
+	return res
+}
+
+// liveConfig holds the configuration of a running supervisor. Reloading the
+// configuration replaces the config rather than modifying it, hence a config
+// obtained using Get must be treated as read-only.
+type liveConfig struct {
+	mu  sync.RWMutex
+	cfg *Config
+}
+
+func newLiveConfig(cfg *Config) *liveConfig {
+	return &liveConfig{cfg: cfg}
+}
+
+// Get returns the current configuration
+func (l *liveConfig) Get() *Config {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg
+}
+
+// Set replaces the current configuration
+func (l *liveConfig) Set(cfg *Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+}
+
+// applyLiveConfig returns a copy of cur with all changes from next applied which can be changed
+// while supervisor is running, i.e. the IDE log rate limits and readiness probe. Changed fields which
+// require a restart are listed in ignored, but are not applied. The workspace config is read from the
+// environment which cannot change while supervisor is running, hence it is never applied.
+func applyLiveConfig(cur, next *Config) (res *Config, applied, ignored []string) {
+	r := *cur
+	if r.IDELogRateLimit != next.IDELogRateLimit {
+		r.IDELogRateLimit = next.IDELogRateLimit
+		applied = append(applied, "IDELogRateLimit")
+	}
+	if r.IDELogRateLimitStdout != next.IDELogRateLimitStdout {
+		r.IDELogRateLimitStdout = next.IDELogRateLimitStdout
+		applied = append(applied, "IDELogRateLimitStdout")
+	}
+	if r.IDELogRateLimitStderr != next.IDELogRateLimitStderr {
+		r.IDELogRateLimitStderr = next.IDELogRateLimitStderr
+		applied = append(applied, "IDELogRateLimitStderr")
+	}
+	if !reflect.DeepEqual(r.ReadinessProbe, next.ReadinessProbe) {
+		r.ReadinessProbe = next.ReadinessProbe
+		applied = append(applied, "ReadinessProbe")
+	}
+
+	// all remaining differences are changes we cannot apply
+	ignored = append(ignored, changedFields(r.StaticConfig, next.StaticConfig)...)
+	ignored = append(ignored, changedFields(r.IDEConfig, next.IDEConfig)...)
+	ignored = append(ignored, changedFields(r.WorkspaceConfig, next.WorkspaceConfig)...)
+
+	return &r, applied, ignored
+}
+
+// changedFields returns the names of the top-level fields which differ between the structs a and b
+func changedFields(a, b interface{}) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+
+	var res []string
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			res = append(res, va.Type().Field(i).Name)
+		}
+	}
+	return res
+}
+
 // StaticConfig is the supervisor-wide configuration
 type StaticConfig struct {
 	// IDEConfigLocation is a path in the filesystem where to find the IDE configuration
@@ -70,10 +220,191 @@ type StaticConfig struct {
 	// FrontendLocation is a path in the filesystem where to find supervisor's frontend assets
 	FrontendLocation string `json:"frontendLocation"`
 
+	// FrontendFallbackLocations are tried in order if FrontendLocation does not exist,
+	// e.g. because IDE images mount the frontend at different paths.
+	FrontendFallbackLocations []string `json:"frontendFallbackLocations,omitempty"`
+
 	// APIEndpointPort is the port where to serve the API endpoint on
 	APIEndpointPort int `json:"apiEndpointPort"`
+
+	// IDEShutdownTimeout is the time we give the IDE to shut down before we SIGKILL it.
+	// Defaults to 5 seconds.
+	IDEShutdownTimeout util.Duration `json:"ideShutdownTimeout,omitempty"`
+
+	// ChildProcessGracePeriod is the time child processes get to exit after they received SIGTERM
+	// during shutdown, before we SIGKILL them. Defaults to 5 seconds. Set to a negative value to disable.
+	ChildProcessGracePeriod util.Duration `json:"childProcessGracePeriod,omitempty"`
+
+	// IDECrashLoop configures when we consider the IDE to be crash looping.
+	IDECrashLoop struct {
+		// MaxRestarts is the number of times the IDE may exit within the window
+		// before we notify the user. Defaults to 5.
+		MaxRestarts int `json:"maxRestarts,omitempty"`
+
+		// Window is the rolling time window in which IDE exits are counted.
+		// Defaults to 5 minutes.
+		Window util.Duration `json:"window,omitempty"`
+	} `json:"ideCrashLoop"`
+
+	// InWorkspaceDaemon configures the connection to ws-daemon's in-workspace service.
+	InWorkspaceDaemon struct {
+		// Socket is the unix socket at which ws-daemon offers the service.
+		// Defaults to /.workspace/daemon.sock.
+		Socket string `json:"socket,omitempty"`
+
+		// PollInterval is the time between two checks if the socket exists. Defaults to 500ms.
+		PollInterval util.Duration `json:"pollInterval,omitempty"`
+
+		// TeardownInNamespace makes supervisor attempt the daemon teardown even if it runs in a namespace,
+		// where the teardown is skipped by default. The attempt has a short time budget and may fail.
+		TeardownInNamespace bool `json:"teardownInNamespace,omitempty"`
+
+		// Credentials configures how supervisor authenticates the daemon. Defaults to an insecure connection.
+		Credentials struct {
+			// Type is either empty (insecure), "peer" or "tls"
+			Type DaemonCredentialsType `json:"type,omitempty"`
+
+			// PeerUID is the UID the daemon must run as if Type is "peer"
+			PeerUID int `json:"peerUID,omitempty"`
+
+			// TLS configures the TLS connection if Type is "tls"
+			TLS struct {
+				// CA is the path to the CA certificate used to verify the daemon.
+				// Defaults to the system's root CAs.
+				CA string `json:"ca,omitempty"`
+
+				// Cert and Key are the paths to the client certificate presented to the daemon
+				Cert string `json:"cert,omitempty"`
+				Key  string `json:"key,omitempty"`
+
+				// ServerName is the name the daemon's certificate is verified against
+				ServerName string `json:"serverName,omitempty"`
+			} `json:"tls"`
+		} `json:"credentials"`
+	} `json:"inWorkspaceDaemon"`
+
+	// ContentInitTimeout is the time we wait for the workspace content to become available
+	// before we fail the workspace. Defaults to 30 minutes.
+	ContentInitTimeout util.Duration `json:"contentInitTimeout,omitempty"`
+
+	// ContentInitAllowlist lists the initializer types the content init descriptor may use, i.e. empty,
+	// git, snapshot, prebuild and backup. All initializer types are allowed if this list is empty.
+	ContentInitAllowlist []ContentInitType `json:"contentInitAllowlist,omitempty"`
+
+	// ContentReadyVerification configures the verification of the content ready file written by ws-daemon
+	// or a content layer. Unless configured the file is trusted.
+	ContentReadyVerification struct {
+		// Sources lists the init sources the content ready file may name. Any source is accepted if empty.
+		Sources []csapi.WorkspaceInitSource `json:"sources,omitempty"`
+
+		// KeyFile is the path of the HMAC key the content ready file's signature must be made with.
+		// The signature is not checked if empty.
+		KeyFile string `json:"keyFile,omitempty"`
+	} `json:"contentReadyVerification"`
+
+	// EnvvarAllowlist is a list of environment variable name prefixes. If this list is not empty,
+	// only matching environment variables are passed to the IDE and the blacklist is ignored.
+	EnvvarAllowlist []string `json:"envvarAllowlist,omitempty"`
+
+	// EnvvarBlacklistPrefixes is a list of environment variable name prefixes which are not passed
+	// to the IDE. These prefixes are used in addition to the built-in ones.
+	EnvvarBlacklistPrefixes []string `json:"envvarBlacklistPrefixes,omitempty"`
+
+	// EnvvarBlacklist is a list of environment variable names which are not passed to the IDE.
+	// Unlike EnvvarBlacklistPrefixes the names have to match exactly.
+	EnvvarBlacklist []string `json:"envvarBlacklist,omitempty"`
+
+	// TokenSweepInterval is the time between two sweeps which remove expired tokens from the token service.
+	// Defaults to 1 minute.
+	TokenSweepInterval util.Duration `json:"tokenSweepInterval,omitempty"`
+
+	// MetadataAccessCheck lists the cloud providers (gcp, aws, azure) whose instance metadata endpoints
+	// we probe when metadata access is to be prevented. Defaults to all of them.
+	MetadataAccessCheck []string `json:"metadataAccessCheck,omitempty"`
+
+	// MetadataAccessConfirmations is the number of consecutive successful metadata access checks
+	// required before we shut down the workspace. Defaults to 2.
+	MetadataAccessConfirmations int `json:"metadataAccessConfirmations,omitempty"`
+
+	// SupervisorLogRateLimit limits supervisor's own log output. Log entries exceeding this limit are dropped,
+	// except for fatal ones. Expressed in kb/sec. Disabled if 0.
+	SupervisorLogRateLimit int `json:"supervisorLogRateLimit,omitempty"`
+
+	// LogFormat determines the format of supervisor's own log output. The output of the
+	// IDE process is never reformatted. Defaults to json.
+	LogFormat LogFormat `json:"logFormat,omitempty"`
+
+	// GitpodAPIScopes are the scopes supervisor requests for its Gitpod API token in addition to
+	// the ones supervisor itself requires, e.g. function:getWorkspace.
+	GitpodAPIScopes []string `json:"gitpodAPIScopes,omitempty"`
+
+	// ServedPortsPolling configures how often we poll for served ports.
+	ServedPortsPolling struct {
+		// Interval is the time between two polls unless adaptive polling is enabled. Defaults to 2 seconds.
+		Interval util.Duration `json:"interval,omitempty"`
+
+		// Adaptive enables adaptive polling: we poll with the fast interval for the settle window
+		// after the served ports changed, and back off towards the slow interval once they are stable.
+		Adaptive bool `json:"adaptive,omitempty"`
+
+		// FastInterval is the time between two polls while the served ports change. Defaults to 500 milliseconds.
+		FastInterval util.Duration `json:"fastInterval,omitempty"`
+
+		// SlowInterval is the maximum time between two polls while the served ports are stable.
+		// Defaults to 5 seconds.
+		SlowInterval util.Duration `json:"slowInterval,omitempty"`
+
+		// SettleWindow is the time we keep polling with the fast interval after the served ports changed.
+		// Defaults to 30 seconds.
+		SettleWindow util.Duration `json:"settleWindow,omitempty"`
+
+		// DisableNetlink disables observing the served ports using netlink, i.e. we always poll /proc.
+		// Netlink is used only where it's permitted anyways.
+		DisableNetlink bool `json:"disableNetlink,omitempty"`
+
+		// NetlinkInterval is the time between two netlink requests for the served ports.
+		// Defaults to 250 milliseconds.
+		NetlinkInterval util.Duration `json:"netlinkInterval,omitempty"`
+	} `json:"servedPortsPolling"`
+
+	// TerminalBacklogSize is the number of bytes of output we retain per terminal, and replay to clients
+	// which attach to the terminal later on, e.g. after reconnecting. Defaults to 256 KiB.
+	TerminalBacklogSize int `json:"terminalBacklogSize,omitempty"`
+
+	// TerminalIdleTimeout is the time after which terminals without clients and without output are closed,
+	// e.g. because their browser tab was closed. Terminals which run tasks are never closed.
+	// Disabled if 0, which is the default.
+	TerminalIdleTimeout util.Duration `json:"terminalIdleTimeout,omitempty"`
+
+	// ReaperSignalBuffer is the number of SIGCHLD signals the reaper buffers while it is busy reaping.
+	// Defaults to 128.
+	ReaperSignalBuffer int `json:"reaperSignalBuffer,omitempty"`
+
+	// TokenAudit configures the audit log of tokens handed out by the token service.
+	TokenAudit struct {
+		// Enabled turns on token auditing. Disabled by default.
+		Enabled bool `json:"enabled,omitempty"`
+
+		// File is the path of a file to which audit records are appended as JSON lines.
+		// Audit records go to supervisor's log if empty.
+		File string `json:"file,omitempty"`
+	} `json:"tokenAudit"`
 }
 
+// maxTerminalBacklogSize bounds the memory the output of a single terminal may consume
+const maxTerminalBacklogSize = 16 << 20
+
+// LogFormat determines the format of supervisor's log output
+type LogFormat string
+
+const (
+	// LogFormatJSON produces one JSON object per log entry
+	LogFormatJSON LogFormat = "json"
+
+	// LogFormatText produces human readable log entries
+	LogFormatText LogFormat = "text"
+)
+
 // Validate validates this configuration
 func (c StaticConfig) Validate() error {
 	if c.IDEConfigLocation == "" {
@@ -82,13 +413,261 @@ func (c StaticConfig) Validate() error {
 	if c.FrontendLocation == "" {
 		return fmt.Errorf("frontendLocation is required")
 	}
+	for _, loc := range c.FrontendFallbackLocations {
+		if strings.TrimSpace(loc) == "" {
+			return fmt.Errorf("frontendFallbackLocations must not contain empty paths")
+		}
+	}
 	if !(0 < c.APIEndpointPort && c.APIEndpointPort <= math.MaxUint16) {
 		return fmt.Errorf("apiEndpointPort must be between 0 and %d", math.MaxUint16)
 	}
+	if c.IDEShutdownTimeout < 0 {
+		return fmt.Errorf("ideShutdownTimeout must be >= 0")
+	}
+	if c.IDECrashLoop.MaxRestarts < 0 {
+		return fmt.Errorf("ideCrashLoop.maxRestarts must be >= 0")
+	}
+	if c.IDECrashLoop.Window < 0 {
+		return fmt.Errorf("ideCrashLoop.window must be >= 0")
+	}
+	if c.ContentInitTimeout < 0 {
+		return fmt.Errorf("contentInitTimeout must be >= 0")
+	}
+	for _, tpe := range c.ContentInitAllowlist {
+		if _, ok := contentInitTypes[tpe]; !ok {
+			return fmt.Errorf("contentInitAllowlist: unknown initializer type %s", tpe)
+		}
+	}
+	if c.TokenSweepInterval < 0 {
+		return fmt.Errorf("tokenSweepInterval must be >= 0")
+	}
+	if c.MetadataAccessConfirmations < 0 {
+		return fmt.Errorf("metadataAccessConfirmations must be >= 0")
+	}
+	if c.SupervisorLogRateLimit < 0 {
+		return fmt.Errorf("supervisorLogRateLimit must be >= 0")
+	}
+	polling := c.ServedPortsPolling
+	if polling.Interval < 0 || polling.FastInterval < 0 || polling.SlowInterval < 0 || polling.SettleWindow < 0 || polling.NetlinkInterval < 0 {
+		return fmt.Errorf("servedPortsPolling intervals must be >= 0")
+	}
+	if adaptive := c.servedPortsPollingObserver().Adaptive; adaptive != nil && adaptive.FastInterval > adaptive.SlowInterval {
+		return fmt.Errorf("servedPortsPolling.fastInterval must not exceed servedPortsPolling.slowInterval")
+	}
+	if c.TerminalIdleTimeout < 0 {
+		return fmt.Errorf("terminalIdleTimeout must be >= 0")
+	}
+	if c.ReaperSignalBuffer < 0 {
+		return fmt.Errorf("reaperSignalBuffer must not be negative")
+	}
+	if !(0 <= c.TerminalBacklogSize && c.TerminalBacklogSize <= maxTerminalBacklogSize) {
+		return fmt.Errorf("terminalBacklogSize must be between 0 and %d", maxTerminalBacklogSize)
+	}
+	if c.InWorkspaceDaemon.Socket != "" && !filepath.IsAbs(c.InWorkspaceDaemon.Socket) {
+		return fmt.Errorf("inWorkspaceDaemon.socket must be an absolute path")
+	}
+	if c.InWorkspaceDaemon.PollInterval < 0 {
+		return fmt.Errorf("inWorkspaceDaemon.pollInterval must be >= 0")
+	}
+	switch creds := c.InWorkspaceDaemon.Credentials; creds.Type {
+	case DaemonCredentialsInsecure:
+	case DaemonCredentialsPeer:
+		if creds.PeerUID < 0 {
+			return fmt.Errorf("inWorkspaceDaemon.credentials.peerUID must be >= 0")
+		}
+	case DaemonCredentialsTLS:
+		if creds.TLS.ServerName == "" {
+			return fmt.Errorf("inWorkspaceDaemon.credentials.tls.serverName is required")
+		}
+		if (creds.TLS.Cert == "") != (creds.TLS.Key == "") {
+			return fmt.Errorf("inWorkspaceDaemon.credentials.tls.cert and inWorkspaceDaemon.credentials.tls.key must be set together")
+		}
+	default:
+		return fmt.Errorf("unknown inWorkspaceDaemon.credentials.type: %s", creds.Type)
+	}
+	switch c.LogFormat {
+	case "", LogFormatJSON, LogFormatText:
+	default:
+		return fmt.Errorf("unknown logFormat: %s", c.LogFormat)
+	}
+	for _, scp := range c.GitpodAPIScopes {
+		if strings.TrimSpace(scp) == "" {
+			return fmt.Errorf("gitpodAPIScopes must not contain empty scopes")
+		}
+	}
+	if c.ContentReadyVerification.KeyFile != "" && !filepath.IsAbs(c.ContentReadyVerification.KeyFile) {
+		return fmt.Errorf("contentReadyVerification.keyFile must be an absolute path")
+	}
+	if c.TokenAudit.File != "" && !filepath.IsAbs(c.TokenAudit.File) {
+		return fmt.Errorf("tokenAudit.file must be an absolute path")
+	}
+	for _, p := range c.MetadataAccessCheck {
+		if _, ok := metadataEndpoints[p]; !ok {
+			return fmt.Errorf("metadataAccessCheck: unknown cloud provider %s", p)
+		}
+	}
 
 	return nil
 }
 
+// inWorkspaceDaemonOptions returns the options for connecting to ws-daemon's in-workspace service.
+// This loads the configured credentials, hence callers should build the options once and reuse them.
+func (c StaticConfig) inWorkspaceDaemonOptions() ([]InWorkspaceDaemonOption, error) {
+	dialOpts, err := c.daemonDialOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []InWorkspaceDaemonOption{WithDaemonDialOptions(dialOpts...)}
+	if c.InWorkspaceDaemon.Socket != "" {
+		opts = append(opts, WithDaemonSocket(c.InWorkspaceDaemon.Socket))
+	}
+	if c.InWorkspaceDaemon.PollInterval != 0 {
+		opts = append(opts, WithDaemonPollInterval(time.Duration(c.InWorkspaceDaemon.PollInterval)))
+	}
+	return opts, nil
+}
+
+// ChildProcessGraceBudget returns the time child processes have to exit during shutdown before they get SIGKILL'ed
+func (c StaticConfig) ChildProcessGraceBudget() time.Duration {
+	if c.ChildProcessGracePeriod == 0 {
+		return defaultTimeBudgetChildProcessGrace
+	}
+	if c.ChildProcessGracePeriod < 0 {
+		return 0
+	}
+	return time.Duration(c.ChildProcessGracePeriod)
+}
+
+// IDEShutdownBudget returns the time the IDE has to shut down before it gets SIGKILL'ed
+func (c StaticConfig) IDEShutdownBudget() time.Duration {
+	if c.IDEShutdownTimeout == 0 {
+		return defaultTimeBudgetIDEShutdown
+	}
+	return time.Duration(c.IDEShutdownTimeout)
+}
+
+// IDECrashLoopThreshold returns the number of IDE exits within the window returned
+// by IDECrashLoopWindow which we consider a crash loop.
+func (c StaticConfig) IDECrashLoopThreshold() int {
+	if c.IDECrashLoop.MaxRestarts == 0 {
+		return 5
+	}
+	return c.IDECrashLoop.MaxRestarts
+}
+
+// IDECrashLoopWindow returns the rolling time window in which IDE exits are counted.
+func (c StaticConfig) IDECrashLoopWindow() time.Duration {
+	if c.IDECrashLoop.Window == 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.IDECrashLoop.Window)
+}
+
+// ContentInitBudget returns the time we wait for the workspace content to become available
+func (c StaticConfig) ContentInitBudget() time.Duration {
+	if c.ContentInitTimeout == 0 {
+		return 30 * time.Minute
+	}
+	return time.Duration(c.ContentInitTimeout)
+}
+
+// TokenSweepPeriod returns the time between two sweeps of expired tokens
+func (c StaticConfig) TokenSweepPeriod() time.Duration {
+	if c.TokenSweepInterval == 0 {
+		return 1 * time.Minute
+	}
+	return time.Duration(c.TokenSweepInterval)
+}
+
+// ReaperSignalBufferSize returns the number of SIGCHLD signals the reaper buffers
+func (c StaticConfig) ReaperSignalBufferSize() int {
+	if c.ReaperSignalBuffer == 0 {
+		return 128
+	}
+	return c.ReaperSignalBuffer
+}
+
+// ServedPortsObserver returns an observer for the served ports as configured. Unless disabled, it uses
+// netlink and falls back to polling /proc where netlink is not permitted.
+func (c StaticConfig) ServedPortsObserver() ports.ServedPortsObserver {
+	polling := c.servedPortsPollingObserver()
+	if c.ServedPortsPolling.DisableNetlink {
+		return polling
+	}
+	return &ports.NetlinkServedPortsObserver{
+		RefreshInterval: durationOrDefault(c.ServedPortsPolling.NetlinkInterval, 250*time.Millisecond),
+		Fallback:        polling,
+	}
+}
+
+func (c StaticConfig) servedPortsPollingObserver() *ports.PollingServedPortsObserver {
+	polling := c.ServedPortsPolling
+	obs := &ports.PollingServedPortsObserver{
+		RefreshInterval: durationOrDefault(polling.Interval, 2*time.Second),
+	}
+	if polling.Adaptive {
+		obs.Adaptive = &ports.AdaptivePolling{
+			FastInterval: durationOrDefault(polling.FastInterval, 500*time.Millisecond),
+			SlowInterval: durationOrDefault(polling.SlowInterval, 5*time.Second),
+			SettleWindow: durationOrDefault(polling.SettleWindow, 30*time.Second),
+		}
+	}
+	return obs
+}
+
+func durationOrDefault(d util.Duration, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// requiredGitpodAPIScopes are the Gitpod API token scopes supervisor's own features depend on
+var requiredGitpodAPIScopes = []string{
+	"function:getToken",
+	"function:openPort",
+	"function:getOpenPorts",
+	"function:guessGitTokenScopes",
+}
+
+// GitpodAPITokenScopes returns the scopes of the Gitpod API token, i.e. the required scopes followed
+// by the configured ones, without duplicates.
+func (c StaticConfig) GitpodAPITokenScopes() []string {
+	var (
+		res  = make([]string, 0, len(requiredGitpodAPIScopes)+len(c.GitpodAPIScopes))
+		seen = make(map[string]struct{}, cap(res))
+	)
+	for _, scopes := range [][]string{requiredGitpodAPIScopes, c.GitpodAPIScopes} {
+		for _, scp := range scopes {
+			scp = strings.TrimSpace(scp)
+			if _, exists := seen[scp]; exists || scp == "" {
+				continue
+			}
+			seen[scp] = struct{}{}
+			res = append(res, scp)
+		}
+	}
+	return res
+}
+
+// MetadataAccessProviders returns the cloud providers whose instance metadata endpoints we probe
+func (c StaticConfig) MetadataAccessProviders() []string {
+	if len(c.MetadataAccessCheck) == 0 {
+		return []string{"gcp", "aws", "azure"}
+	}
+	return c.MetadataAccessCheck
+}
+
+// MetadataAccessConfirmationCount returns the number of consecutive successful metadata access
+// checks required before we consider metadata access possible
+func (c StaticConfig) MetadataAccessConfirmationCount() int {
+	if c.MetadataAccessConfirmations == 0 {
+		return 2
+	}
+	return c.MetadataAccessConfirmations
+}
+
 // ReadinessProbeType determines the IDE readiness probe type
 type ReadinessProbeType string
 
@@ -98,6 +677,12 @@ const (
 
 	// ReadinessHTTPProbe returns ready once a single HTTP request against the IDE was successful
 	ReadinessHTTPProbe ReadinessProbeType = "http"
+
+	// ReadinessTCPProbe returns ready once a TCP connection to the IDE could be established
+	ReadinessTCPProbe ReadinessProbeType = "tcp"
+
+	// ReadinessGRPCProbe returns ready once the IDE's gRPC health service reports SERVING
+	ReadinessGRPCProbe ReadinessProbeType = "grpc"
 )
 
 // IDEConfig is the IDE specific configuration
@@ -108,23 +693,106 @@ type IDEConfig struct {
 	// code the workspace is stopped.
 	Entrypoint string `json:"entrypoint"`
 
+	// IDEArgs are the arguments passed to the entrypoint. Arguments can reference
+	// {port}, {hostname}, {workdir} and {workspaceRoot}, which are replaced when the IDE is launched.
+	// If empty, the IDE is launched with "{workdir} --port {port} --hostname {hostname}".
+	IDEArgs []string `json:"args,omitempty"`
+
+	// IDEBindHost is the IP address the IDE binds to, i.e. the {hostname} in IDEArgs. Defaults to 0.0.0.0.
+	// Binding to 127.0.0.1 restricts access to the IDE to processes in the workspace and port forwarding.
+	IDEBindHost string `json:"bindHost,omitempty"`
+
+	// IDEWorkdir is the working directory of the IDE and the directory it opens, i.e. the {workdir}
+	// in IDEArgs. Defaults to the workspace root.
+	IDEWorkdir string `json:"workdir,omitempty"`
+
 	// LogRateLimit can be used to limit the log output of the IDE process.
 	// Any output that exceeds this limit is silently dropped.
 	// Expressed in kb/sec. Can be overriden by the workspace config (smallest value wins).
 	IDELogRateLimit int `json:"logRateLimit"`
 
+	// LogRateLimitStdout and LogRateLimitStderr limit the stdout and stderr output of the IDE process
+	// independently. If unset, LogRateLimit applies. Expressed in kb/sec.
+	IDELogRateLimitStdout int `json:"logRateLimitStdout,omitempty"`
+	IDELogRateLimitStderr int `json:"logRateLimitStderr,omitempty"`
+
 	// ReadinessProbe configures the probe used to serve the IDE status
 	ReadinessProbe struct {
 		// Type determines the type of readiness probe we'll use.
 		// Defaults to process.
 		Type ReadinessProbeType `json:"type"`
 
+		// Interval is the time between two probe attempts. Defaults to 5 seconds.
+		Interval util.Duration `json:"interval,omitempty"`
+
 		// HTTPProbe configures the HTTP readiness probe.
 		HTTPProbe struct {
 			// Path is the path to make requests to. Defaults to "/"
 			Path string `json:"path"`
+
+			// SuccessThreshold is the number of consecutive successful requests
+			// required before the IDE is considered ready. Defaults to 1.
+			SuccessThreshold int `json:"successThreshold,omitempty"`
 		} `json:"http"`
+
+		// TCPProbe configures the TCP readiness probe.
+		TCPProbe struct {
+			// Port is the port to connect to. Defaults to the IDE port.
+			Port int `json:"port,omitempty"`
+
+			// Timeout is the dial timeout of a single probe attempt. Defaults to 5 seconds.
+			Timeout util.Duration `json:"timeout,omitempty"`
+		} `json:"tcp"`
+
+		// GRPCProbe configures the gRPC readiness probe which uses the standard gRPC health service.
+		GRPCProbe struct {
+			// Addr is the address of the gRPC server. Defaults to <bind host>:<IDE port>, or to
+			// localhost:<IDE port> if the IDE binds to all interfaces.
+			Addr string `json:"addr,omitempty"`
+
+			// Service is the name of the service whose health is checked. Defaults to the overall server health.
+			Service string `json:"service,omitempty"`
+
+			// Timeout is the timeout of a single health check. Defaults to 5 seconds.
+			Timeout util.Duration `json:"timeout,omitempty"`
+		} `json:"grpc"`
 	} `json:"readinessProbe"`
+
+	// PreLaunchHook configures a command which runs once the workspace content is ready
+	// and before the IDE is launched for the first time, e.g. to decrypt secrets or mount a cache.
+	// The hook runs with the same environment as the IDE. If it fails the IDE is not started.
+	PreLaunchHook struct {
+		// Command is the command to run. No hook runs if this is empty.
+		Command string `json:"command,omitempty"`
+
+		// Args are the arguments passed to the command.
+		Args []string `json:"args,omitempty"`
+
+		// Timeout is the time the hook has to complete. Defaults to 5 minutes.
+		Timeout util.Duration `json:"timeout,omitempty"`
+	} `json:"preLaunchHook"`
+}
+
+// ReadinessProbeInterval returns the time between two readiness probe attempts
+func (c IDEConfig) ReadinessProbeInterval() time.Duration {
+	if c.ReadinessProbe.Interval == 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.ReadinessProbe.Interval)
+}
+
+// ideArgPlaceholder matches the placeholders in IDEArgs
+var ideArgPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// defaultIDEArgs are the IDE arguments used if IDEArgs is empty
+var defaultIDEArgs = []string{"{workdir}", "--port", "{port}", "--hostname", "{hostname}"}
+
+// PreLaunchHookTimeout returns the time the pre-launch hook has to complete
+func (c IDEConfig) PreLaunchHookTimeout() time.Duration {
+	if c.PreLaunchHook.Timeout == 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.PreLaunchHook.Timeout)
 }
 
 // Validate validates this configuration
@@ -138,9 +806,70 @@ func (c IDEConfig) Validate() error {
 		return fmt.Errorf("entrypoint is a directory, but should be a file")
 	}
 
+	if len(c.IDEArgs) > 0 {
+		var hasPort bool
+		for _, arg := range c.IDEArgs {
+			for _, p := range ideArgPlaceholder.FindAllString(arg, -1) {
+				switch p {
+				case "{port}":
+					hasPort = true
+				case "{hostname}", "{workdir}", "{workspaceRoot}":
+				default:
+					return fmt.Errorf("args contain unknown placeholder %s", p)
+				}
+			}
+		}
+		if !hasPort {
+			return fmt.Errorf("args must contain the {port} placeholder")
+		}
+	}
+	if c.IDEBindHost != "" && net.ParseIP(c.IDEBindHost) == nil {
+		return fmt.Errorf("bindHost must be an IP address")
+	}
+	if c.IDEWorkdir != "" && !filepath.IsAbs(c.IDEWorkdir) {
+		return fmt.Errorf("workdir must be an absolute path")
+	}
+
 	if c.IDELogRateLimit < 0 {
 		return fmt.Errorf("logRateLimit must be >= 0")
 	}
+	if c.IDELogRateLimitStdout < 0 {
+		return fmt.Errorf("logRateLimitStdout must be >= 0")
+	}
+	if c.IDELogRateLimitStderr < 0 {
+		return fmt.Errorf("logRateLimitStderr must be >= 0")
+	}
+
+	switch c.ReadinessProbe.Type {
+	case ReadinessProcessProbe:
+	case ReadinessHTTPProbe:
+		if c.ReadinessProbe.HTTPProbe.SuccessThreshold < 0 {
+			return fmt.Errorf("readinessProbe.http.successThreshold must be >= 0")
+		}
+	case ReadinessTCPProbe:
+		if !(0 <= c.ReadinessProbe.TCPProbe.Port && c.ReadinessProbe.TCPProbe.Port <= math.MaxUint16) {
+			return fmt.Errorf("readinessProbe.tcp.port must be between 0 and %d", math.MaxUint16)
+		}
+		if c.ReadinessProbe.TCPProbe.Timeout < 0 {
+			return fmt.Errorf("readinessProbe.tcp.timeout must be >= 0")
+		}
+	case ReadinessGRPCProbe:
+		if c.ReadinessProbe.GRPCProbe.Timeout < 0 {
+			return fmt.Errorf("readinessProbe.grpc.timeout must be >= 0")
+		}
+	default:
+		return fmt.Errorf("unknown readinessProbe.type: %s", c.ReadinessProbe.Type)
+	}
+	if c.ReadinessProbe.Interval < 0 {
+		return fmt.Errorf("readinessProbe.interval must be >= 0")
+	}
+
+	if c.PreLaunchHook.Command == "" && len(c.PreLaunchHook.Args) > 0 {
+		return fmt.Errorf("preLaunchHook.args requires preLaunchHook.command")
+	}
+	if c.PreLaunchHook.Timeout < 0 {
+		return fmt.Errorf("preLaunchHook.timeout must be >= 0")
+	}
 
 	return nil
 }
@@ -175,6 +904,8 @@ type WorkspaceConfig struct {
 	GitUsername string `env:"GITPOD_GIT_USER_NAME"`
 	// GitEmail makes supervisor configure the global user.email Git setting.
 	GitEmail string `env:"GITPOD_GIT_USER_EMAIL"`
+	// EnableGitLFS makes supervisor configure Git LFS to use the Gitpod credential helper.
+	EnableGitLFS bool `env:"SUPERVISOR_ENABLE_GIT_LFS"`
 
 	// Tokens is a JSON encoded list of WorkspaceGitpodToken
 	Tokens string `env:"THEIA_SUPERVISOR_TOKENS"`
@@ -197,6 +928,9 @@ type WorkspaceConfig struct {
 	// DebugEnabled controls whether the supervisor debugging facilities (pprof, grpc tracing) shoudl be enabled
 	DebugEnable bool `env:"SUPERVISOR_DEBUG_ENABLE"`
 
+	// MetricsEnable controls whether supervisor serves Prometheus metrics. Metrics are also served if debugging is enabled.
+	MetricsEnable bool `env:"SUPERVISOR_METRICS_ENABLE"`
+
 	// WorkspaceContext is a context for this workspace
 	WorkspaceContext string `env:"GITPOD_WORKSPACE_CONTEXT"`
 }
@@ -217,6 +951,47 @@ type TaskConfig struct {
 	Env      *map[string]string `json:"env,omitempty"`
 	OpenIn   *string            `json:"openIn,omitempty"`
 	OpenMode *string            `json:"openMode,omitempty"`
+	Timeout  *TaskTimeouts      `json:"timeout,omitempty"`
+
+	// DependsOn lists the names of the tasks which must be ready before this task starts
+	DependsOn []string `json:"dependsOn,omitempty"`
+
+	Restart *TaskRestart `json:"restart,omitempty"`
+}
+
+// TaskRestartPolicy decides whether the command of a task is restarted when it exits
+type TaskRestartPolicy string
+
+const (
+	// TaskRestartNever never restarts the command. This is the default.
+	TaskRestartNever TaskRestartPolicy = "never"
+	// TaskRestartOnFailure restarts the command if it exits with a non-zero exit code
+	TaskRestartOnFailure TaskRestartPolicy = "on-failure"
+	// TaskRestartAlways restarts the command whenever it exits
+	TaskRestartAlways TaskRestartPolicy = "always"
+)
+
+// TaskRestart configures the restarts of the command of a task. The before and init commands are never restarted,
+// such that a failing build does not loop.
+type TaskRestart struct {
+	Policy TaskRestartPolicy `json:"policy,omitempty"`
+	// MaxRetries limits the number of restarts. 0 means no limit.
+	MaxRetries int `json:"maxRetries,omitempty"`
+	// Backoff is the time to wait before the first restart. It doubles with every restart up to maxRestartBackoff.
+	Backoff util.Duration `json:"backoff,omitempty"`
+}
+
+// Enabled returns true if the command may be restarted
+func (c *TaskRestart) Enabled() bool {
+	return c != nil && c.Policy != "" && c.Policy != TaskRestartNever
+}
+
+// TaskTimeouts limits the time the phases of a task may take. Phases without a limit may take any time.
+type TaskTimeouts struct {
+	Before util.Duration `json:"before,omitempty"`
+	// Init limits the init phase, which includes the prebuild command during prebuilds.
+	Init    util.Duration `json:"init,omitempty"`
+	Command util.Duration `json:"command,omitempty"`
 }
 
 // Validate validates this configuration
@@ -312,9 +1087,112 @@ func (c WorkspaceConfig) getGitpodTasks() (tasks *[]TaskConfig, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot parse tasks: %w", err)
 	}
+	if tasks != nil {
+		_, err = resolveTaskDependencies(*tasks)
+		if err != nil {
+			return nil, err
+		}
+		for i, task := range *tasks {
+			if task.Restart == nil {
+				continue
+			}
+			switch task.Restart.Policy {
+			case "", TaskRestartNever, TaskRestartOnFailure, TaskRestartAlways:
+			default:
+				return nil, fmt.Errorf("task %d has an unknown restart policy %q", i, task.Restart.Policy)
+			}
+			if task.Restart.MaxRetries < 0 {
+				return nil, fmt.Errorf("task %d has a negative restart maxRetries", i)
+			}
+		}
+	}
 	return
 }
 
+// resolveTaskDependencies resolves the dependencies of tasks, which refer to other tasks by name, to task indices.
+// It fails if a task depends on a task which does not exist or whose name is ambiguous, or if the dependencies
+// contain a cycle.
+func resolveTaskDependencies(tasks []TaskConfig) (deps [][]int, err error) {
+	byName := make(map[string]int)
+	for i, task := range tasks {
+		if task.Name == nil {
+			continue
+		}
+		if _, exists := byName[*task.Name]; exists {
+			byName[*task.Name] = -1
+			continue
+		}
+		byName[*task.Name] = i
+	}
+
+	deps = make([][]int, len(tasks))
+	for i, task := range tasks {
+		for _, name := range task.DependsOn {
+			dep, exists := byName[name]
+			if !exists {
+				return nil, fmt.Errorf("task %d depends on unknown task %q", i, name)
+			}
+			if dep < 0 {
+				return nil, fmt.Errorf("task %d depends on task %q, but there are multiple tasks with this name", i, name)
+			}
+			deps[i] = append(deps[i], dep)
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	var (
+		state = make([]int, len(tasks))
+		path  []int
+		visit func(i int) error
+	)
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			var cycle []string
+			for j := len(path) - 1; j >= 0; j-- {
+				cycle = append([]string{taskName(tasks, path[j])}, cycle...)
+				if path[j] == i {
+					break
+				}
+			}
+			cycle = append(cycle, taskName(tasks, i))
+			return fmt.Errorf("task dependencies contain a cycle: %s", strings.Join(cycle, " -> "))
+		}
+
+		state[i] = visiting
+		path = append(path, i)
+		for _, dep := range deps[i] {
+			err := visit(dep)
+			if err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+	for i := range tasks {
+		err := visit(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deps, nil
+}
+
+func taskName(tasks []TaskConfig, i int) string {
+	if tasks[i].Name == nil {
+		return strconv.Itoa(i)
+	}
+	return *tasks[i].Name
+}
+
 // getCommit returns a commit from which this workspace was created
 func (c WorkspaceConfig) getCommit() (commit *gitpod.Commit, err error) {
 	if c.WorkspaceContext == "" {
@@ -327,9 +1205,21 @@ func (c WorkspaceConfig) getCommit() (commit *gitpod.Commit, err error) {
 	return
 }
 
-// GetConfig loads the supervisor configuration
+// GetConfig loads the supervisor configuration. The static configuration is read from
+// a file named "supervisor-config.json" which is expected right next to the supervisor executable.
 func GetConfig() (*Config, error) {
-	static, err := loadStaticConfigFromFile()
+	loc, err := os.Executable()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot get executable path: %w", err)
+	}
+
+	return loadConfig(filepath.Join(filepath.Dir(loc), supervisorConfigFile))
+}
+
+// loadConfig loads the supervisor configuration from the static config file at loc, the IDE config
+// file it points to and the environment.
+func loadConfig(loc string) (*Config, error) {
+	static, err := loadStaticConfigFromFile(loc)
 	if err != nil {
 		return nil, err
 	}
@@ -351,16 +1241,8 @@ func GetConfig() (*Config, error) {
 	}, nil
 }
 
-// loadStaticConfigFromFile loads the static supervisor configuration from
-// a file named "supervisor-config.json" which is expected right next to
-// the supervisor executable.
-func loadStaticConfigFromFile() (*StaticConfig, error) {
-	loc, err := os.Executable()
-	if err != nil {
-		return nil, xerrors.Errorf("cannot get executable path: %w", err)
-	}
-
-	loc = filepath.Join(filepath.Dir(loc), supervisorConfigFile)
+// loadStaticConfigFromFile loads the static supervisor configuration from a JSON file.
+func loadStaticConfigFromFile(loc string) (*StaticConfig, error) {
 	fc, err := os.ReadFile(loc)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot read supervisor config file %s: %w", loc, err)
@@ -0,0 +1,322 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/gitpod-io/gitpod/common-go/util"
+)
+
+func TestStaticConfigValidate(t *testing.T) {
+	tests := []struct {
+		Desc      string
+		Change    func(cfg *StaticConfig)
+		ExpectErr bool
+	}{
+		{Desc: "valid", Change: func(cfg *StaticConfig) {}},
+		{Desc: "IDE shutdown timeout", Change: func(cfg *StaticConfig) { cfg.IDEShutdownTimeout = util.Duration(10 * time.Second) }},
+		{Desc: "negative IDE shutdown timeout", Change: func(cfg *StaticConfig) { cfg.IDEShutdownTimeout = util.Duration(-1) }, ExpectErr: true},
+		{Desc: "content init timeout", Change: func(cfg *StaticConfig) { cfg.ContentInitTimeout = util.Duration(time.Minute) }},
+		{Desc: "negative content init timeout", Change: func(cfg *StaticConfig) { cfg.ContentInitTimeout = util.Duration(-1) }, ExpectErr: true},
+		{Desc: "JSON log format", Change: func(cfg *StaticConfig) { cfg.LogFormat = LogFormatJSON }},
+		{Desc: "text log format", Change: func(cfg *StaticConfig) { cfg.LogFormat = LogFormatText }},
+		{Desc: "unknown log format", Change: func(cfg *StaticConfig) { cfg.LogFormat = "xml" }, ExpectErr: true},
+		{Desc: "adaptive port polling", Change: func(cfg *StaticConfig) { cfg.ServedPortsPolling.Adaptive = true }},
+		{Desc: "negative port polling interval", Change: func(cfg *StaticConfig) { cfg.ServedPortsPolling.Interval = util.Duration(-1) }, ExpectErr: true},
+		{Desc: "adaptive port polling fast interval exceeds slow interval", Change: func(cfg *StaticConfig) {
+			cfg.ServedPortsPolling.Adaptive = true
+			cfg.ServedPortsPolling.FastInterval = util.Duration(10 * time.Second)
+		}, ExpectErr: true},
+		{Desc: "terminal backlog size", Change: func(cfg *StaticConfig) { cfg.TerminalBacklogSize = 1 << 20 }},
+		{Desc: "negative terminal backlog size", Change: func(cfg *StaticConfig) { cfg.TerminalBacklogSize = -1 }, ExpectErr: true},
+		{Desc: "terminal idle timeout", Change: func(cfg *StaticConfig) { cfg.TerminalIdleTimeout = util.Duration(time.Hour) }},
+		{Desc: "negative terminal idle timeout", Change: func(cfg *StaticConfig) { cfg.TerminalIdleTimeout = util.Duration(-1) }, ExpectErr: true},
+		{Desc: "excessive terminal backlog size", Change: func(cfg *StaticConfig) { cfg.TerminalBacklogSize = 1 << 30 }, ExpectErr: true},
+		{Desc: "in-workspace daemon socket", Change: func(cfg *StaticConfig) { cfg.InWorkspaceDaemon.Socket = "/run/daemon.sock" }},
+		{Desc: "relative in-workspace daemon socket", Change: func(cfg *StaticConfig) { cfg.InWorkspaceDaemon.Socket = "daemon.sock" }, ExpectErr: true},
+		{Desc: "negative in-workspace daemon poll interval", Change: func(cfg *StaticConfig) { cfg.InWorkspaceDaemon.PollInterval = util.Duration(-1) }, ExpectErr: true},
+		{Desc: "in-workspace daemon peer credentials", Change: func(cfg *StaticConfig) { cfg.InWorkspaceDaemon.Credentials.Type = DaemonCredentialsPeer }},
+		{Desc: "in-workspace daemon TLS credentials", Change: func(cfg *StaticConfig) {
+			cfg.InWorkspaceDaemon.Credentials.Type = DaemonCredentialsTLS
+			cfg.InWorkspaceDaemon.Credentials.TLS.ServerName = "ws-daemon"
+		}},
+		{Desc: "in-workspace daemon TLS credentials without server name", Change: func(cfg *StaticConfig) { cfg.InWorkspaceDaemon.Credentials.Type = DaemonCredentialsTLS }, ExpectErr: true},
+		{Desc: "in-workspace daemon TLS client cert without key", Change: func(cfg *StaticConfig) {
+			cfg.InWorkspaceDaemon.Credentials.Type = DaemonCredentialsTLS
+			cfg.InWorkspaceDaemon.Credentials.TLS.ServerName = "ws-daemon"
+			cfg.InWorkspaceDaemon.Credentials.TLS.Cert = "/run/tls.crt"
+		}, ExpectErr: true},
+		{Desc: "frontend fallback locations", Change: func(cfg *StaticConfig) { cfg.FrontendFallbackLocations = []string{"/ide/supervisor-frontend"} }},
+		{Desc: "empty frontend fallback location", Change: func(cfg *StaticConfig) { cfg.FrontendFallbackLocations = []string{""} }, ExpectErr: true},
+		{Desc: "token audit file", Change: func(cfg *StaticConfig) { cfg.TokenAudit.File = "/workspace/.gitpod/token-audit.log" }},
+		{Desc: "relative token audit file", Change: func(cfg *StaticConfig) { cfg.TokenAudit.File = "token-audit.log" }, ExpectErr: true},
+		{Desc: "negative reaper signal buffer", Change: func(cfg *StaticConfig) { cfg.ReaperSignalBuffer = -1 }, ExpectErr: true},
+		{Desc: "content init allowlist", Change: func(cfg *StaticConfig) {
+			cfg.ContentInitAllowlist = []ContentInitType{ContentInitGit, ContentInitBackup}
+		}},
+		{Desc: "unknown content init type", Change: func(cfg *StaticConfig) { cfg.ContentInitAllowlist = []ContentInitType{"ftp"} }, ExpectErr: true},
+		{Desc: "Gitpod API scopes", Change: func(cfg *StaticConfig) { cfg.GitpodAPIScopes = []string{"function:getWorkspace"} }},
+		{Desc: "empty Gitpod API scope", Change: func(cfg *StaticConfig) { cfg.GitpodAPIScopes = []string{" "} }, ExpectErr: true},
+		{Desc: "unknown in-workspace daemon credentials", Change: func(cfg *StaticConfig) { cfg.InWorkspaceDaemon.Credentials.Type = "kerberos" }, ExpectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			cfg := StaticConfig{
+				IDEConfigLocation: "/ide/supervisor-ide-config.json",
+				FrontendLocation:  "/.supervisor/frontend",
+				APIEndpointPort:   22999,
+			}
+			test.Change(&cfg)
+
+			err := cfg.Validate()
+			if (err != nil) != test.ExpectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestContentInitBudget(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Config      StaticConfig
+		Expectation time.Duration
+	}{
+		{Desc: "default", Expectation: 30 * time.Minute},
+		{Desc: "configured", Config: StaticConfig{ContentInitTimeout: util.Duration(time.Minute)}, Expectation: time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := test.Config.ContentInitBudget()
+			if act != test.Expectation {
+				t.Errorf("unexpected content init budget: expected %v, got %v", test.Expectation, act)
+			}
+		})
+	}
+}
+
+func TestIDEShutdownBudget(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Config      StaticConfig
+		Expectation time.Duration
+	}{
+		{Desc: "default", Expectation: defaultTimeBudgetIDEShutdown},
+		{Desc: "configured", Config: StaticConfig{IDEShutdownTimeout: util.Duration(10 * time.Second)}, Expectation: 10 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := test.Config.IDEShutdownBudget()
+			if act != test.Expectation {
+				t.Errorf("unexpected IDE shutdown budget: expected %v, got %v", test.Expectation, act)
+			}
+		})
+	}
+}
+
+func TestGitpodAPITokenScopes(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Config      StaticConfig
+		Expectation []string
+	}{
+		{Desc: "default", Expectation: requiredGitpodAPIScopes},
+		{
+			Desc:        "additional scopes",
+			Config:      StaticConfig{GitpodAPIScopes: []string{"function:getWorkspace", "function:getContentBlobUploadUrl"}},
+			Expectation: append(append([]string{}, requiredGitpodAPIScopes...), "function:getWorkspace", "function:getContentBlobUploadUrl"),
+		},
+		{
+			Desc:        "duplicate scopes",
+			Config:      StaticConfig{GitpodAPIScopes: []string{"function:getWorkspace", "function:getToken", " function:getWorkspace"}},
+			Expectation: append(append([]string{}, requiredGitpodAPIScopes...), "function:getWorkspace"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := test.Config.GitpodAPITokenScopes()
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected scopes (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestResolveTaskDependencies(t *testing.T) {
+	named := func(name string, dependsOn ...string) TaskConfig {
+		return TaskConfig{Name: &name, DependsOn: dependsOn}
+	}
+	type Expectation struct {
+		Dependencies [][]int
+		Error        string
+	}
+	tests := []struct {
+		Desc        string
+		Tasks       []TaskConfig
+		Expectation Expectation
+	}{
+		{
+			Desc:        "no dependencies",
+			Tasks:       []TaskConfig{{}, named("a")},
+			Expectation: Expectation{Dependencies: [][]int{nil, nil}},
+		},
+		{
+			Desc:  "dag",
+			Tasks: []TaskConfig{named("a"), named("b", "a"), named("c", "a"), named("d", "b", "c")},
+			Expectation: Expectation{
+				Dependencies: [][]int{nil, {0}, {0}, {1, 2}},
+			},
+		},
+		{
+			Desc:        "unknown dependency",
+			Tasks:       []TaskConfig{named("a", "b")},
+			Expectation: Expectation{Error: `task 0 depends on unknown task "b"`},
+		},
+		{
+			Desc:        "ambiguous dependency",
+			Tasks:       []TaskConfig{named("a"), named("a"), named("b", "a")},
+			Expectation: Expectation{Error: `task 2 depends on task "a", but there are multiple tasks with this name`},
+		},
+		{
+			Desc:        "self dependency",
+			Tasks:       []TaskConfig{named("a", "a")},
+			Expectation: Expectation{Error: "task dependencies contain a cycle: a -> a"},
+		},
+		{
+			Desc:        "cycle",
+			Tasks:       []TaskConfig{named("a"), named("b", "a", "d"), named("c", "b"), named("d", "c")},
+			Expectation: Expectation{Error: "task dependencies contain a cycle: b -> d -> c -> b"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var act Expectation
+			deps, err := resolveTaskDependencies(test.Tasks)
+			act.Dependencies = deps
+			if err != nil {
+				act.Error = err.Error()
+			}
+
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestIDEConfigValidate(t *testing.T) {
+	tests := []struct {
+		Desc      string
+		Change    func(cfg *IDEConfig)
+		ExpectErr bool
+	}{
+		{Desc: "valid", Change: func(cfg *IDEConfig) {}},
+		{Desc: "args", Change: func(cfg *IDEConfig) { cfg.IDEArgs = []string{"--bind", "{hostname}:{port}", "{workspaceRoot}"} }},
+		{Desc: "args without port", Change: func(cfg *IDEConfig) { cfg.IDEArgs = []string{"--hostname", "{hostname}"} }, ExpectErr: true},
+		{Desc: "args with unknown placeholder", Change: func(cfg *IDEConfig) { cfg.IDEArgs = []string{"--port", "{port}", "{foo}"} }, ExpectErr: true},
+		{Desc: "bind host", Change: func(cfg *IDEConfig) { cfg.IDEBindHost = "127.0.0.1" }},
+		{Desc: "bind host is no IP", Change: func(cfg *IDEConfig) { cfg.IDEBindHost = "localhost" }, ExpectErr: true},
+		{Desc: "workdir", Change: func(cfg *IDEConfig) { cfg.IDEWorkdir = "/workspace/project" }},
+		{Desc: "relative workdir", Change: func(cfg *IDEConfig) { cfg.IDEWorkdir = "project" }, ExpectErr: true},
+		{Desc: "pre-launch hook", Change: func(cfg *IDEConfig) {
+			cfg.PreLaunchHook.Command = "/bin/true"
+			cfg.PreLaunchHook.Timeout = util.Duration(time.Minute)
+		}},
+		{Desc: "pre-launch hook args without command", Change: func(cfg *IDEConfig) { cfg.PreLaunchHook.Args = []string{"foo"} }, ExpectErr: true},
+		{Desc: "negative pre-launch hook timeout", Change: func(cfg *IDEConfig) { cfg.PreLaunchHook.Timeout = util.Duration(-1) }, ExpectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			cfg := IDEConfig{
+				Entrypoint: os.Args[0],
+			}
+			test.Change(&cfg)
+
+			err := cfg.Validate()
+			if (err != nil) != test.ExpectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestIDELaunchArgs(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Args        []string
+		Config      IDEConfig
+		Expectation []string
+	}{
+		{
+			Desc:        "default",
+			Expectation: []string{"/workspace", "--port", "23000", "--hostname", "0.0.0.0"},
+		},
+		{
+			Desc:        "configured",
+			Args:        []string{"--listen={hostname}:{port}", "--folder", "{workspaceRoot}", "--no-browser"},
+			Expectation: []string{"--listen=0.0.0.0:23000", "--folder", "/workspace", "--no-browser"},
+		},
+		{
+			Desc:        "repeated placeholder",
+			Args:        []string{"--port", "{port}", "--debug-port", "1{port}"},
+			Expectation: []string{"--port", "23000", "--debug-port", "123000"},
+		},
+		{
+			Desc:        "bind host and workdir",
+			Config:      IDEConfig{IDEBindHost: "127.0.0.1", IDEWorkdir: "/workspace/project"},
+			Expectation: []string{"/workspace/project", "--port", "23000", "--hostname", "127.0.0.1"},
+		},
+		{
+			Desc:        "workdir and workspace root",
+			Args:        []string{"{workdir}", "--root", "{workspaceRoot}", "--port", "{port}"},
+			Config:      IDEConfig{IDEWorkdir: "/workspace/project"},
+			Expectation: []string{"/workspace/project", "--root", "/workspace", "--port", "23000"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var cfg Config
+			cfg.IDEConfig = test.Config
+			cfg.IDEArgs = test.Args
+			cfg.IDEPort = 23000
+			cfg.WorkspaceRoot = "/workspace"
+
+			act := cfg.IDELaunchArgs()
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected IDE launch args (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestIDEProbeHost(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		BindHost    string
+		Expectation string
+	}{
+		{Desc: "default", Expectation: "localhost"},
+		{Desc: "all IPv4 interfaces", BindHost: "0.0.0.0", Expectation: "localhost"},
+		{Desc: "all IPv6 interfaces", BindHost: "::", Expectation: "localhost"},
+		{Desc: "loopback", BindHost: "127.0.0.1", Expectation: "127.0.0.1"},
+		{Desc: "IPv6 loopback", BindHost: "::1", Expectation: "::1"},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var cfg Config
+			cfg.IDEBindHost = test.BindHost
+
+			act := cfg.IDEProbeHost()
+			if act != test.Expectation {
+				t.Errorf("unexpected probe host: expected %s, got %s", test.Expectation, act)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	csapi "github.com/gitpod-io/gitpod/content-service/api"
+)
+
+// ContentInitType is the type of initializer a content init descriptor uses
+type ContentInitType string
+
+const (
+	// ContentInitEmpty starts with an empty workspace
+	ContentInitEmpty ContentInitType = "empty"
+	// ContentInitGit clones a Git repository
+	ContentInitGit ContentInitType = "git"
+	// ContentInitSnapshot restores a snapshot
+	ContentInitSnapshot ContentInitType = "snapshot"
+	// ContentInitPrebuild restores a prebuild and updates its Git checkout
+	ContentInitPrebuild ContentInitType = "prebuild"
+	// ContentInitBackup restores a workspace backup
+	ContentInitBackup ContentInitType = "backup"
+)
+
+var contentInitTypes = map[ContentInitType]struct{}{
+	ContentInitEmpty:    {},
+	ContentInitGit:      {},
+	ContentInitSnapshot: {},
+	ContentInitPrebuild: {},
+	ContentInitBackup:   {},
+}
+
+// contentInitDescriptor is the part of the content-service executor config we need to determine the initializer type
+type contentInitDescriptor struct {
+	Req        json.RawMessage `json:"req,omitempty"`
+	FromBackup string          `json:"fromBackupURL,omitempty"`
+}
+
+// contentInitDescriptorType returns the initializer type of the content init descriptor
+func contentInitDescriptorType(descriptor []byte) (ContentInitType, error) {
+	var desc contentInitDescriptor
+	err := json.Unmarshal(descriptor, &desc)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse content init descriptor: %w", err)
+	}
+	if desc.FromBackup != "" {
+		return ContentInitBackup, nil
+	}
+
+	var req csapi.WorkspaceInitializer
+	err = protojson.Unmarshal(desc.Req, &req)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse content init descriptor: %w", err)
+	}
+	switch req.Spec.(type) {
+	case *csapi.WorkspaceInitializer_Empty:
+		return ContentInitEmpty, nil
+	case *csapi.WorkspaceInitializer_Git:
+		return ContentInitGit, nil
+	case *csapi.WorkspaceInitializer_Snapshot:
+		return ContentInitSnapshot, nil
+	case *csapi.WorkspaceInitializer_Prebuild:
+		return ContentInitPrebuild, nil
+	default:
+		return "", fmt.Errorf("content init descriptor has no initializer")
+	}
+}
+
+// checkContentInitAllowed returns an error unless the content init descriptor uses an initializer type
+// on the allowlist. All types are allowed if the allowlist is empty.
+func checkContentInitAllowed(descriptor []byte, allowlist []ContentInitType) error {
+	if len(allowlist) == 0 {
+		return nil
+	}
+
+	tpe, err := contentInitDescriptorType(descriptor)
+	if err != nil {
+		return err
+	}
+	for _, allowed := range allowlist {
+		if tpe == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("content init descriptor uses the %s initializer, which is not allowed (allowed: %v)", tpe, allowlist)
+}
+
+// contentReadyVerifier verifies the content ready file's message before we trust it
+type contentReadyVerifier struct {
+	Sources map[csapi.WorkspaceInitSource]struct{}
+	Key     []byte
+}
+
+// contentReadyVerifier returns the verifier for the content ready file as configured, or nil if it's not verified
+func (c StaticConfig) contentReadyVerifier() (*contentReadyVerifier, error) {
+	cfg := c.ContentReadyVerification
+	if len(cfg.Sources) == 0 && cfg.KeyFile == "" {
+		return nil, nil
+	}
+
+	res := &contentReadyVerifier{}
+	if len(cfg.Sources) > 0 {
+		res.Sources = make(map[csapi.WorkspaceInitSource]struct{}, len(cfg.Sources))
+		for _, src := range cfg.Sources {
+			res.Sources[src] = struct{}{}
+		}
+	}
+	if cfg.KeyFile != "" {
+		key, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read content ready key: %w", err)
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("content ready key %s is empty", cfg.KeyFile)
+		}
+		res.Key = key
+	}
+	return res, nil
+}
+
+// Verify returns an error unless the message names an expected source and carries a valid signature.
+// A nil verifier accepts all messages.
+func (v *contentReadyVerifier) Verify(m csapi.WorkspaceReadyMessage) error {
+	if v == nil {
+		return nil
+	}
+
+	if v.Sources != nil {
+		if _, ok := v.Sources[m.Source]; !ok {
+			return fmt.Errorf("unexpected content source %q", m.Source)
+		}
+	}
+	if v.Key != nil {
+		if m.Signature == "" {
+			return fmt.Errorf("content ready message is not signed")
+		}
+		sig, err := hex.DecodeString(m.Signature)
+		if err != nil {
+			return fmt.Errorf("invalid content ready signature: %w", err)
+		}
+		if !hmac.Equal(sig, signContentReadySource(v.Key, m.Source)) {
+			return fmt.Errorf("content ready signature does not match")
+		}
+	}
+	return nil
+}
+
+// signContentReadySource computes the signature of a content ready message for the source
+func signContentReadySource(key []byte, src csapi.WorkspaceInitSource) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(src))
+	return mac.Sum(nil)
+}
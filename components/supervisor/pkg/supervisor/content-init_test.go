@@ -0,0 +1,193 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	csapi "github.com/gitpod-io/gitpod/content-service/api"
+	"github.com/gitpod-io/gitpod/content-service/pkg/executor"
+)
+
+func TestCheckContentInitAllowed(t *testing.T) {
+	prepare := func(t *testing.T, req *csapi.WorkspaceInitializer) []byte {
+		desc, err := executor.Prepare(req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	var (
+		git = func(t *testing.T) []byte {
+			return prepare(t, &csapi.WorkspaceInitializer{Spec: &csapi.WorkspaceInitializer_Git{Git: &csapi.GitInitializer{RemoteUri: "https://github.com/gitpod-io/gitpod"}}})
+		}
+		snapshot = func(t *testing.T) []byte {
+			return prepare(t, &csapi.WorkspaceInitializer{Spec: &csapi.WorkspaceInitializer_Snapshot{Snapshot: &csapi.SnapshotInitializer{Snapshot: "workspaces/foo/snapshot.tar"}}})
+		}
+		backup = func(t *testing.T) []byte {
+			desc, err := executor.PrepareFromBackup("https://storage.example.com/backup.tar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return desc
+		}
+	)
+
+	tests := []struct {
+		Desc       string
+		Descriptor func(t *testing.T) []byte
+		Allowlist  []ContentInitType
+		ExpectErr  bool
+	}{
+		{Desc: "permissive by default", Descriptor: snapshot},
+		{Desc: "allowed", Descriptor: git, Allowlist: []ContentInitType{ContentInitGit, ContentInitPrebuild}},
+		{Desc: "disallowed", Descriptor: snapshot, Allowlist: []ContentInitType{ContentInitGit, ContentInitPrebuild}, ExpectErr: true},
+		{Desc: "allowed backup", Descriptor: backup, Allowlist: []ContentInitType{ContentInitBackup}},
+		{Desc: "disallowed backup", Descriptor: backup, Allowlist: []ContentInitType{ContentInitGit}, ExpectErr: true},
+		{Desc: "no initializer", Descriptor: func(t *testing.T) []byte { return prepare(t, &csapi.WorkspaceInitializer{}) }, Allowlist: []ContentInitType{ContentInitEmpty}, ExpectErr: true},
+		{Desc: "invalid descriptor", Descriptor: func(t *testing.T) []byte { return []byte("{") }, Allowlist: []ContentInitType{ContentInitGit}, ExpectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			err := checkContentInitAllowed(test.Descriptor(t), test.Allowlist)
+			if (err != nil) != test.ExpectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckContentReadyFileVerification(t *testing.T) {
+	key := []byte("secret")
+	signature := func(key []byte, src csapi.WorkspaceInitSource) string {
+		return hex.EncodeToString(signContentReadySource(key, src))
+	}
+	verifier := &contentReadyVerifier{
+		Sources: map[csapi.WorkspaceInitSource]struct{}{csapi.WorkspaceInitFromOther: {}, csapi.WorkspaceInitFromPrebuild: {}},
+		Key:     key,
+	}
+
+	tests := []struct {
+		Desc        string
+		Content     string
+		Verifier    *contentReadyVerifier
+		Expectation csapi.WorkspaceInitSource
+		ExpectDone  bool
+		ExpectErr   bool
+	}{
+		{
+			Desc:        "valid",
+			Content:     `{"source":"from-prebuild","signature":"` + signature(key, csapi.WorkspaceInitFromPrebuild) + `"}`,
+			Verifier:    verifier,
+			Expectation: csapi.WorkspaceInitFromPrebuild,
+			ExpectDone:  true,
+		},
+		{
+			Desc:     "malformed",
+			Content:  `{"source":"from-prebuild","sig`,
+			Verifier: verifier,
+		},
+		{
+			Desc:     "unexpected source",
+			Content:  `{"source":"from-backup","signature":"` + signature(key, csapi.WorkspaceInitFromBackup) + `"}`,
+			Verifier: verifier,
+		},
+		{
+			Desc:     "mismatched signature",
+			Content:  `{"source":"from-other","signature":"` + signature(key, csapi.WorkspaceInitFromPrebuild) + `"}`,
+			Verifier: verifier,
+		},
+		{
+			Desc:     "signed with another key",
+			Content:  `{"source":"from-other","signature":"` + signature([]byte("other"), csapi.WorkspaceInitFromOther) + `"}`,
+			Verifier: verifier,
+		},
+		{
+			Desc:     "not signed",
+			Content:  `{"source":"from-other"}`,
+			Verifier: verifier,
+		},
+		{
+			Desc:     "invalid signature encoding",
+			Content:  `{"source":"from-other","signature":"not-hex"}`,
+			Verifier: verifier,
+		},
+		{
+			Desc:        "sources only",
+			Content:     `{"source":"from-other"}`,
+			Verifier:    &contentReadyVerifier{Sources: verifier.Sources},
+			Expectation: csapi.WorkspaceInitFromOther,
+			ExpectDone:  true,
+		},
+		{
+			Desc:        "not verified",
+			Content:     `{"source":"from-backup"}`,
+			Expectation: csapi.WorkspaceInitFromBackup,
+			ExpectDone:  true,
+		},
+		{
+			Desc:      "malformed without verification",
+			Content:   `{"source":"from-prebuild","sig`,
+			ExpectErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "ready")
+			err := os.WriteFile(fn, []byte(test.Content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			src, done, err := checkContentReadyFile(fn, test.Verifier)
+			if (err != nil) != test.ExpectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if done != test.ExpectDone {
+				t.Errorf("unexpected done: expected %v, got %v", test.ExpectDone, done)
+			}
+			if src != test.Expectation {
+				t.Errorf("unexpected source: expected %q, got %q", test.Expectation, src)
+			}
+		})
+	}
+}
+
+func TestContentReadyVerifier(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	err := os.WriteFile(keyFile, []byte("secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg StaticConfig
+	verifier, err := cfg.contentReadyVerifier()
+	if err != nil || verifier != nil {
+		t.Errorf("expected no verifier by default, got %v (%v)", verifier, err)
+	}
+
+	cfg.ContentReadyVerification.KeyFile = filepath.Join(t.TempDir(), "missing")
+	_, err = cfg.contentReadyVerifier()
+	if err == nil {
+		t.Errorf("expected an error for a missing key file")
+	}
+
+	cfg.ContentReadyVerification.KeyFile = keyFile
+	cfg.ContentReadyVerification.Sources = []csapi.WorkspaceInitSource{csapi.WorkspaceInitFromOther}
+	verifier, err = cfg.contentReadyVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifier.Verify(csapi.WorkspaceReadyMessage{
+		Source:    csapi.WorkspaceInitFromOther,
+		Signature: hex.EncodeToString(signContentReadySource([]byte("secret"), csapi.WorkspaceInitFromOther)),
+	})
+	if err != nil {
+		t.Errorf("unexpected verification error: %v", err)
+	}
+}
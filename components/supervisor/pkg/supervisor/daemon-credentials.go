@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// DaemonCredentialsType determines how supervisor authenticates the in-workspace daemon
+type DaemonCredentialsType string
+
+const (
+	// DaemonCredentialsInsecure does not authenticate the daemon
+	DaemonCredentialsInsecure DaemonCredentialsType = ""
+
+	// DaemonCredentialsPeer checks the UID of the process listening on the daemon socket
+	DaemonCredentialsPeer DaemonCredentialsType = "peer"
+
+	// DaemonCredentialsTLS uses TLS over the daemon socket
+	DaemonCredentialsTLS DaemonCredentialsType = "tls"
+)
+
+// WithDaemonDialOptions sets the gRPC dial options used to connect to the daemon, e.g. to configure
+// transport credentials. Defaults to an insecure connection.
+func WithDaemonDialOptions(opts ...grpc.DialOption) InWorkspaceDaemonOption {
+	return func(o *inWorkspaceDaemonOptions) {
+		o.DialOptions = opts
+	}
+}
+
+// daemonDialOptions returns the gRPC dial options for connecting to the daemon as configured
+func (c StaticConfig) daemonDialOptions() ([]grpc.DialOption, error) {
+	creds := c.InWorkspaceDaemon.Credentials
+	switch creds.Type {
+	case DaemonCredentialsInsecure:
+		return []grpc.DialOption{grpc.WithInsecure()}, nil
+
+	case DaemonCredentialsPeer:
+		return []grpc.DialOption{
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(peerCredentialsDialer(creds.PeerUID)),
+		}, nil
+
+	case DaemonCredentialsTLS:
+		cfg := &tls.Config{
+			ServerName: creds.TLS.ServerName,
+			MinVersion: tls.VersionTLS12,
+		}
+		if creds.TLS.CA != "" {
+			ca, err := os.ReadFile(creds.TLS.CA)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read daemon CA: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("daemon CA %s contains no certificates", creds.TLS.CA)
+			}
+			cfg.RootCAs = pool
+		}
+		if creds.TLS.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(creds.TLS.Cert, creds.TLS.Key)
+			if err != nil {
+				return nil, fmt.Errorf("cannot load daemon client certificate: %w", err)
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+		return []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(cfg))}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown daemon credentials type: %s", creds.Type)
+	}
+}
+
+// peerCredentialsDialer dials a unix socket and fails unless the process listening on it runs as uid
+func peerCredentialsDialer(uid int) func(ctx context.Context, addr string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "unix", strings.TrimPrefix(addr, "unix://"))
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkPeerUID(conn.(*net.UnixConn), uid)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func checkPeerUID(conn *net.UnixConn, uid int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return err
+	}
+	if credErr != nil {
+		return fmt.Errorf("cannot get peer credentials: %w", credErr)
+	}
+	if int(cred.Uid) != uid {
+		return fmt.Errorf("daemon runs as UID %d, expected %d", cred.Uid, uid)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	daemon "github.com/gitpod-io/gitpod/ws-daemon/api"
+)
+
+func TestDaemonCredentials(t *testing.T) {
+	tests := []struct {
+		Desc      string
+		Change    func(cfg *StaticConfig)
+		ExpectErr bool
+	}{
+		{Desc: "insecure default", Change: func(cfg *StaticConfig) {}},
+		{Desc: "peer credentials", Change: func(cfg *StaticConfig) {
+			cfg.InWorkspaceDaemon.Credentials.Type = DaemonCredentialsPeer
+			cfg.InWorkspaceDaemon.Credentials.PeerUID = os.Getuid()
+		}},
+		{Desc: "peer credentials with foreign UID", Change: func(cfg *StaticConfig) {
+			cfg.InWorkspaceDaemon.Credentials.Type = DaemonCredentialsPeer
+			cfg.InWorkspaceDaemon.Credentials.PeerUID = os.Getuid() + 1
+		}, ExpectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "daemon.sock")
+			l, err := net.Listen("unix", fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := grpc.NewServer()
+			defer srv.Stop()
+			go srv.Serve(l)
+
+			var cfg StaticConfig
+			cfg.InWorkspaceDaemon.Socket = fn
+			test.Change(&cfg)
+			opts, err := cfg.inWorkspaceDaemonOptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+			// the options are reused for every connection, hence we connect twice
+			for i := 0; i < 2; i++ {
+				client, conn, err := ConnectToInWorkspaceDaemonService(ctx, opts...)
+				if test.ExpectErr {
+					if err == nil {
+						conn.Close()
+						t.Fatal("expected an error but got none")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				// the server does not implement the service, but the request must get through to it
+				_, err = client.Teardown(ctx, &daemon.TeardownRequest{})
+				conn.Close()
+				if status.Code(err) != codes.Unimplemented {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/supervisor/pkg/ports"
+	"github.com/gitpod-io/gitpod/supervisor/pkg/terminal"
+)
+
+// debugStateTimeout is the time the debug state handler waits for all probes.
+// Probes can block, e.g. on locks held during shutdown, hence we must not wait for them indefinitely.
+const debugStateTimeout = 2 * time.Second
+
+// debugStateProbe collects a part of the debug state
+type debugStateProbe struct {
+	Name  string
+	Probe func() interface{}
+}
+
+// debugStateHandler serves a JSON snapshot of the state collected by the probes. Probes which
+// do not complete within the timeout are listed as unavailable.
+func debugStateHandler(timeout time.Duration, probes ...debugStateProbe) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type result struct {
+			Name  string
+			Value interface{}
+		}
+		// the channel is buffered so that probes which time out do not leak their goroutine forever
+		results := make(chan result, len(probes))
+		for _, p := range probes {
+			go func(p debugStateProbe) {
+				results <- result{Name: p.Name, Value: p.Probe()}
+			}(p)
+		}
+
+		var (
+			state       = make(map[string]interface{}, len(probes)+1)
+			deadline    = time.NewTimer(timeout)
+			unavailable []string
+		)
+		defer deadline.Stop()
+	collect:
+		for range probes {
+			select {
+			case res := <-results:
+				state[res.Name] = res.Value
+			case <-deadline.C:
+				break collect
+			}
+		}
+		for _, p := range probes {
+			if _, ok := state[p.Name]; !ok {
+				unavailable = append(unavailable, p.Name)
+			}
+		}
+		if len(unavailable) > 0 {
+			sort.Strings(unavailable)
+			state["unavailable"] = unavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(state)
+		if err != nil {
+			log.WithError(err).Warn("cannot write debug state")
+		}
+	})
+}
+
+// supervisorDebugProbes returns the probes for the debug state of supervisor
+func supervisorDebugProbes(ideReady *ideReadyState, ideSuspend *ideSuspender, ideExits *ideExitLog, termMux *terminal.Mux, portMgmt *ports.Manager, cstate ContentState) []debugStateProbe {
+	type childProcess struct {
+		PID int `json:"pid"`
+		UID int `json:"uid"`
+	}
+	return []debugStateProbe{
+		{Name: "ide", Probe: func() interface{} {
+			return map[string]interface{}{
+				"ready":     ideReady.Get(),
+				"suspended": ideSuspend.Suspended(),
+				"exits":     ideExits.Exits(),
+			}
+		}},
+		{Name: "terminals", Probe: func() interface{} { return termMux.Count() }},
+		{Name: "exposedPorts", Probe: func() interface{} { return portMgmt.Exposed() }},
+		{Name: "contentReady", Probe: func() interface{} {
+			select {
+			case <-cstate.ContentReady():
+				return true
+			default:
+				return false
+			}
+		}},
+		{Name: "childProcesses", Probe: func() interface{} {
+			children, err := processesWithParent(os.Getpid(), false)
+			if err != nil {
+				return map[string]string{"error": err.Error()}
+			}
+			res := make([]childProcess, 0, len(children))
+			for pid, uid := range children {
+				res = append(res, childProcess{PID: pid, UID: uid})
+			}
+			sort.Slice(res, func(i, j int) bool { return res[i].PID < res[j].PID })
+			return res
+		}},
+	}
+}
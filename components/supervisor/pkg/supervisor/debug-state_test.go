@@ -0,0 +1,106 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	csapi "github.com/gitpod-io/gitpod/content-service/api"
+	"github.com/gitpod-io/gitpod/supervisor/pkg/ports"
+	"github.com/gitpod-io/gitpod/supervisor/pkg/terminal"
+)
+
+func TestDebugStateHandler(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	tests := []struct {
+		Desc        string
+		Probes      []debugStateProbe
+		Expectation map[string]interface{}
+	}{
+		{
+			Desc: "all probes complete",
+			Probes: []debugStateProbe{
+				{Name: "terminals", Probe: func() interface{} { return 2 }},
+				{Name: "contentReady", Probe: func() interface{} { return true }},
+			},
+			Expectation: map[string]interface{}{
+				"terminals":    float64(2),
+				"contentReady": true,
+			},
+		},
+		{
+			Desc: "blocking probe",
+			Probes: []debugStateProbe{
+				{Name: "terminals", Probe: func() interface{} { return 2 }},
+				{Name: "exposedPorts", Probe: func() interface{} { <-block; return nil }},
+				{Name: "ide", Probe: func() interface{} { <-block; return nil }},
+			},
+			Expectation: map[string]interface{}{
+				"terminals":   float64(2),
+				"unavailable": []interface{}{"exposedPorts", "ide"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			t0 := time.Now()
+			debugStateHandler(100*time.Millisecond, test.Probes...).ServeHTTP(rec, httptest.NewRequest("GET", "/_supervisor/debug/state", nil))
+			if dt := time.Since(t0); dt > time.Second {
+				t.Errorf("debug state handler blocked for %s", dt)
+			}
+
+			var act map[string]interface{}
+			err := json.Unmarshal(rec.Body.Bytes(), &act)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected debug state (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSupervisorDebugProbes(t *testing.T) {
+	var (
+		ideReady = &ideReadyState{cond: sync.NewCond(&sync.Mutex{})}
+		cstate   = NewInMemoryContentState("/workspace")
+	)
+	ideReady.Set(true)
+	cstate.MarkContentReady(csapi.WorkspaceInitFromOther)
+	probes := supervisorDebugProbes(ideReady, newIDESuspender(), &ideExitLog{}, terminal.NewMux(), &ports.Manager{}, cstate)
+
+	rec := httptest.NewRecorder()
+	debugStateHandler(debugStateTimeout, probes...).ServeHTTP(rec, httptest.NewRequest("GET", "/_supervisor/debug/state", nil))
+
+	var act map[string]json.RawMessage
+	err := json.Unmarshal(rec.Body.Bytes(), &act)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectation := map[string]string{
+		"ide":          `{"exits":null,"ready":true,"suspended":false}`,
+		"terminals":    `0`,
+		"exposedPorts": `[]`,
+		"contentReady": `true`,
+	}
+	for k, v := range expectation {
+		if diff := cmp.Diff(v, string(act[k])); diff != "" {
+			t.Errorf("unexpected %s (-want +got):\n%s", k, diff)
+		}
+	}
+	if _, ok := act["childProcesses"]; !ok {
+		t.Error("child processes are missing")
+	}
+}
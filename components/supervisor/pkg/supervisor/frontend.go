@@ -0,0 +1,208 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+)
+
+// frontendCacheControl makes browsers revalidate the frontend assets on every use. Revalidation is
+// cheap thanks to the ETag, and the assets never go stale when the supervisor image changes.
+const frontendCacheControl = "no-cache"
+
+// frontendNotFoundPage is served instead of the frontend if none of the frontend locations exist
+const frontendNotFoundPage = `<!DOCTYPE html>
+<html>
+<head><title>Supervisor frontend not found</title></head>
+<body>
+<h1>Supervisor frontend not found</h1>
+<p>None of the configured frontend locations exist. Please check the supervisor logs.</p>
+</body>
+</html>
+`
+
+// resolveFrontendLocation returns the first of the frontend locations which is an existing directory
+func resolveFrontendLocation(locations ...string) (location string, ok bool) {
+	for _, loc := range locations {
+		stat, err := os.Stat(loc)
+		if err != nil {
+			log.WithError(err).WithField("location", loc).Warn("frontend location does not exist")
+			continue
+		}
+		if !stat.IsDir() {
+			log.WithField("location", loc).Warn("frontend location is not a directory")
+			continue
+		}
+		return loc, true
+	}
+	return "", false
+}
+
+// frontendNotFoundHandler serves frontendNotFoundPage for all requests
+func frontendNotFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, frontendNotFoundPage)
+	})
+}
+
+// frontendHandler serves the supervisor frontend assets from dir. Responses carry an ETag based on
+// the content hash of the file and are gzip compressed if the client accepts it.
+func frontendHandler(dir string) http.Handler {
+	root := http.Dir(dir)
+	return &frontendServer{
+		root:  root,
+		files: http.FileServer(root),
+		etags: make(map[string]frontendETag),
+	}
+}
+
+type frontendETag struct {
+	ModTime time.Time
+	Size    int64
+	Hash    string
+}
+
+type frontendServer struct {
+	root  http.FileSystem
+	files http.Handler
+
+	mu    sync.Mutex
+	etags map[string]frontendETag
+}
+
+func (s *frontendServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", frontendCacheControl)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	gz := r.Method == http.MethodGet && acceptsGzip(r)
+	if hash, ok := s.hash(r.URL.Path); ok {
+		// different encodings of the same file must not share an ETag
+		if gz {
+			hash += "-gzip"
+		}
+		w.Header().Set("ETag", `"`+hash+`"`)
+	}
+	if !gz {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+
+	gw := &gzipResponseWriter{ResponseWriter: w}
+	defer gw.Close()
+	s.files.ServeHTTP(gw, r)
+}
+
+// hash returns the content hash of the file at name. The hash is cached until the file's modtime or size changes.
+func (s *frontendServer) hash(name string) (hash string, ok bool) {
+	name = path.Clean("/" + name)
+	f, err := s.root.Open(name)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		return "", false
+	}
+
+	s.mu.Lock()
+	etag, cached := s.etags[name]
+	s.mu.Unlock()
+	if cached && etag.ModTime.Equal(stat.ModTime()) && etag.Size == stat.Size() {
+		return etag.Hash, true
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		log.WithError(err).WithField("file", name).Warn("cannot hash frontend asset")
+		return "", false
+	}
+	hash = hex.EncodeToString(h.Sum(nil))[:16]
+
+	s.mu.Lock()
+	s.etags[name] = frontendETag{ModTime: stat.ModTime(), Size: stat.Size(), Hash: hash}
+	s.mu.Unlock()
+	return hash, true
+}
+
+// acceptsGzip returns true if the client accepts gzip encoded responses. Range requests are never
+// compressed because the ranges refer to the uncompressed content.
+func acceptsGzip(r *http.Request) bool {
+	if r.Header.Get("Range") != "" {
+		return false
+	}
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if i := strings.Index(enc, ";"); i >= 0 {
+			if strings.TrimSpace(enc[i+1:]) == "q=0" {
+				continue
+			}
+			enc = strings.TrimSpace(enc[:i])
+		}
+		if enc == "gzip" || enc == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses successful responses. Other responses, e.g. 304 or 404, are passed through as they are.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+
+	wroteHeader bool
+	gz          *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if code == http.StatusOK {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Close flushes the compressed response
+func (w *gzipResponseWriter) Close() {
+	if w.gz == nil {
+		return
+	}
+	err := w.gz.Close()
+	if err != nil {
+		log.WithError(err).Debug("cannot finish gzip response")
+	}
+}
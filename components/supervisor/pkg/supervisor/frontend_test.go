@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFrontendHandler(t *testing.T) {
+	content := strings.Repeat("console.log('supervisor');\n", 100)
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "main.js"), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := frontendHandler(dir)
+
+	get := func(t *testing.T, header http.Header) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/main.js", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	readBody := func(t *testing.T, resp *http.Response) string {
+		var r io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			gr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = gr
+		}
+		body, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	tests := []struct {
+		Desc           string
+		AcceptEncoding string
+		ExpectGzip     bool
+	}{
+		{Desc: "no accept-encoding"},
+		{Desc: "gzip", AcceptEncoding: "gzip, deflate, br", ExpectGzip: true},
+		{Desc: "gzip refused", AcceptEncoding: "gzip;q=0, deflate"},
+		{Desc: "other encodings", AcceptEncoding: "br"},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			header := make(http.Header)
+			if test.AcceptEncoding != "" {
+				header.Set("Accept-Encoding", test.AcceptEncoding)
+			}
+
+			resp := get(t, header)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status code: expected %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			if gz := resp.Header.Get("Content-Encoding") == "gzip"; gz != test.ExpectGzip {
+				t.Errorf("unexpected gzip encoding: expected %v, got %v", test.ExpectGzip, gz)
+			}
+			if body := readBody(t, resp); body != content {
+				t.Errorf("unexpected body: %q", body)
+			}
+			if cc := resp.Header.Get("Cache-Control"); cc != frontendCacheControl {
+				t.Errorf("unexpected Cache-Control: %q", cc)
+			}
+
+			etag := resp.Header.Get("ETag")
+			if etag == "" {
+				t.Fatal("expected an ETag")
+			}
+			header.Set("If-None-Match", etag)
+			resp = get(t, header)
+			if resp.StatusCode != http.StatusNotModified {
+				t.Errorf("unexpected status code for conditional request: expected %d, got %d", http.StatusNotModified, resp.StatusCode)
+			}
+			if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+				t.Errorf("unexpected Content-Encoding for conditional request: %q", enc)
+			}
+		})
+	}
+
+	t.Run("changed content", func(t *testing.T) {
+		etag := get(t, nil).Header.Get("ETag")
+
+		err := os.WriteFile(filepath.Join(dir, "main.js"), []byte("changed"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := get(t, http.Header{"If-None-Match": []string{etag}})
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: expected %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if body := readBody(t, resp); body != "changed" {
+			t.Errorf("unexpected body: %q", body)
+		}
+	})
+}
+
+func TestResolveFrontendLocation(t *testing.T) {
+	base := t.TempDir()
+	var (
+		missing  = filepath.Join(base, "missing")
+		file     = filepath.Join(base, "file")
+		primary  = filepath.Join(base, "primary")
+		fallback = filepath.Join(base, "fallback")
+	)
+	for _, dir := range []string{primary, fallback} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name        string
+		Locations   []string
+		Expectation string
+		OK          bool
+	}{
+		{Name: "primary exists", Locations: []string{primary, fallback}, Expectation: primary, OK: true},
+		{Name: "primary missing", Locations: []string{missing, fallback}, Expectation: fallback, OK: true},
+		{Name: "primary is a file", Locations: []string{file, fallback}, Expectation: fallback, OK: true},
+		{Name: "fallbacks in order", Locations: []string{missing, primary, fallback}, Expectation: primary, OK: true},
+		{Name: "none exist", Locations: []string{missing, file}},
+		{Name: "no locations"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			act, ok := resolveFrontendLocation(test.Locations...)
+			if act != test.Expectation || ok != test.OK {
+				t.Errorf("unexpected location: want (%q, %v), got (%q, %v)", test.Expectation, test.OK, act, ok)
+			}
+		})
+	}
+}
+
+func TestFrontendNotFoundHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	frontendNotFoundHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/main.js", nil))
+
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status: want %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "frontend not found") {
+		t.Errorf("unexpected body: %s", body)
+	}
+}
@@ -7,19 +7,39 @@ package supervisor
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"os/exec"
 	"strings"
+	"sync"
 
+	"golang.org/x/sync/singleflight"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
 	gitpod "github.com/gitpod-io/gitpod/gitpod-protocol"
 	"github.com/gitpod-io/gitpod/supervisor/api"
 )
 
 // GitTokenProvider provides tokens for Git hosting services by asking
-// the Gitpod server.
+// the Gitpod server. Tokens are resolved per host, hence a workspace can
+// talk to several Git hosts at once.
 type GitTokenProvider struct {
 	notificationService *NotificationService
 	workspaceConfig     WorkspaceConfig
-	gitpodAPI           gitpod.APIInterface
+
+	mu sync.Mutex
+	// gitpodAPI is guarded by mu, use SetGitpodAPI to replace it
+	gitpodAPI gitpod.APIInterface
+	hosts     map[string]*gitHost
+
+	// permissions makes sure we ask the user only once per host to grant missing permissions.
+	// Requests which lack permissions while the user is asked share the outcome.
+	permissions singleflight.Group
+}
+
+// gitHost is the state the GitTokenProvider keeps per Git host
+type gitHost struct {
+	// mu serializes token requests to the Gitpod server
+	mu sync.Mutex
 }
 
 // NewGitTokenProvider creates a new instance of gitTokenProvider
@@ -28,17 +48,51 @@ func NewGitTokenProvider(gitpodAPI gitpod.APIInterface, workspaceConfig Workspac
 		notificationService: notificationService,
 		workspaceConfig:     workspaceConfig,
 		gitpodAPI:           gitpodAPI,
+		hosts:               make(map[string]*gitHost),
 	}
 }
 
+// SetGitpodAPI replaces the connection to the Gitpod API, e.g. once it becomes available after supervisor started
+func (p *GitTokenProvider) SetGitpodAPI(gitpodAPI gitpod.APIInterface) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gitpodAPI = gitpodAPI
+}
+
+func (p *GitTokenProvider) getGitpodAPI() gitpod.APIInterface {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.gitpodAPI
+}
+
+func (p *GitTokenProvider) host(host string) *gitHost {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.hosts[host]
+	if !ok {
+		h = &gitHost{}
+		p.hosts[host] = h
+	}
+	return h
+}
+
 // GetToken resolves a token from a git hosting service
 func (p *GitTokenProvider) GetToken(ctx context.Context, req *api.GetTokenRequest) (tkn *Token, err error) {
-	if p.gitpodAPI == nil {
+	gitpodAPI := p.getGitpodAPI()
+	if gitpodAPI == nil {
 		return nil, nil
 	}
-	token, err := p.gitpodAPI.GetToken(ctx, &gitpod.GetTokenSearchOptions{
+	if req.Host == "" {
+		return nil, fmt.Errorf("host is required")
+	}
+
+	host := p.host(req.Host)
+	host.mu.Lock()
+	token, err := gitpodAPI.GetToken(ctx, &gitpod.GetTokenSearchOptions{
 		Host: req.Host,
 	})
+	host.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
@@ -51,29 +105,18 @@ func (p *GitTokenProvider) GetToken(ctx context.Context, req *api.GetTokenReques
 	}
 	missing := getMissingScopes(req.Scope, scopes)
 	if len(missing) > 0 {
-		message := fmt.Sprintf("An operation requires additional permissions: %s. Please grant permissions and try again.", strings.Join(missing, ", "))
-		result, err := p.notificationService.Notify(ctx, &api.NotifyRequest{
-			Level:   api.NotifyRequest_INFO,
-			Message: message,
-			Actions: []string{"Open Access Control"},
+		// We must not hold the host lock while waiting for the user, otherwise all other requests for this host
+		// would block. Requests which lack permissions wait for the pending permission request instead.
+		res := p.permissions.DoChan(req.Host, func() (interface{}, error) {
+			return nil, p.requestPermissions(ctx, gitpodAPI, req.Host, token, missing)
 		})
-		if err != nil {
-			return nil, err
-		}
-		if result.Action == "Open Access Control" {
-			gpPath, err := exec.LookPath("gp")
-			if err != nil {
-				return nil, err
-			}
-			gpCmd := exec.Command(gpPath, "preview", "--external", p.workspaceConfig.GitpodHost+"/access-control")
-			err = gpCmd.Start()
-			if err != nil {
-				return nil, err
-			}
-			err = gpCmd.Process.Release()
-			if err != nil {
-				return nil, err
+		select {
+		case r := <-res:
+			if r.Err != nil {
+				return nil, r.Err
 			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 		return nil, nil
 	}
@@ -87,6 +130,83 @@ func (p *GitTokenProvider) GetToken(ctx context.Context, req *api.GetTokenReques
 	return tkn, nil
 }
 
+// requestPermissions asks the user to grant the missing scopes for a Git host
+func (p *GitTokenProvider) requestPermissions(ctx context.Context, gitpodAPI gitpod.APIInterface, host string, token *gitpod.Token, missing []string) error {
+	message := fmt.Sprintf("An operation on %s requires additional permissions: %s. Please grant permissions and try again.", host, strings.Join(missing, ", "))
+	guessed, err := gitpodAPI.GuessGitTokenScopes(ctx, &gitpod.GuessGitTokenScopesParams{
+		Host: host,
+		CurrentToken: &gitpod.GitToken{
+			Token:  token.Value,
+			User:   token.Username,
+			Scopes: token.Scopes,
+		},
+	})
+	var guessedScopes []string
+	if err != nil {
+		log.WithError(err).WithField("host", host).Warn("cannot guess Git token scopes")
+	} else if guessed != nil {
+		guessedScopes = guessed.Scopes
+		if guessed.Message != "" {
+			message = fmt.Sprintf("%s Please grant the necessary permissions.", guessed.Message)
+		}
+	}
+
+	result, err := p.notificationService.Notify(ctx, &api.NotifyRequest{
+		Level:   api.NotifyRequest_INFO,
+		Message: message,
+		Actions: []string{grantPermissionsAction},
+	})
+	if err != nil {
+		return err
+	}
+	if result.Action != grantPermissionsAction {
+		return nil
+	}
+
+	gpPath, err := exec.LookPath("gp")
+	if err != nil {
+		return err
+	}
+	scopes := permissionScopes(token.Scopes, missing, guessedScopes)
+	gpCmd := exec.Command(gpPath, "preview", "--external", authorizeURL(p.workspaceConfig.GitpodHost, host, scopes))
+	err = gpCmd.Start()
+	if err != nil {
+		return err
+	}
+	return gpCmd.Process.Release()
+}
+
+// grantPermissionsAction is the notification action which makes us ask the Git host for more permissions
+const grantPermissionsAction = "Grant Permissions"
+
+// permissionScopes returns the scopes we ask a Git host for. We keep the scopes the token has already,
+// so that granting missing permissions does not revoke others.
+func permissionScopes(current, missing, guessed []string) []string {
+	var (
+		res  []string
+		seen = make(map[string]struct{})
+	)
+	for _, scopes := range [][]string{current, missing, guessed} {
+		for _, scp := range scopes {
+			if _, ok := seen[scp]; ok {
+				continue
+			}
+			seen[scp] = struct{}{}
+			res = append(res, scp)
+		}
+	}
+	return res
+}
+
+// authorizeURL produces the URL of the Gitpod page which asks the Git host for the given scopes
+func authorizeURL(gitpodHost, host string, scopes []string) string {
+	q := url.Values{}
+	q.Set("returnTo", "about:blank")
+	q.Set("host", host)
+	q.Set("scopes", strings.Join(scopes, ","))
+	return strings.TrimSuffix(gitpodHost, "/") + "/api/authorize?" + q.Encode()
+}
+
 func getMissingScopes(required []string, provided map[string]struct{}) []string {
 	var missing []string
 	for _, r := range required {
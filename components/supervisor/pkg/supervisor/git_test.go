@@ -0,0 +1,249 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+
+	gitpod "github.com/gitpod-io/gitpod/gitpod-protocol"
+	"github.com/gitpod-io/gitpod/supervisor/api"
+)
+
+func TestGitTokenProviderMultipleHosts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		hosts = []string{"github.com", "gitlab.com"}
+		// each host's request only returns once both requests are in flight, i.e. requests for
+		// different hosts must not block each other
+		inflight sync.WaitGroup
+	)
+	inflight.Add(len(hosts))
+
+	gitpodAPI := gitpod.NewMockAPIInterface(ctrl)
+	for _, host := range hosts {
+		host := host
+		gitpodAPI.EXPECT().GetToken(gomock.Any(), &gitpod.GetTokenSearchOptions{Host: host}).DoAndReturn(func(ctx context.Context, query *gitpod.GetTokenSearchOptions) (*gitpod.Token, error) {
+			inflight.Done()
+			inflight.Wait()
+			return &gitpod.Token{Value: "token-" + host, Username: "user-" + host, Scopes: []string{"repo"}}, nil
+		})
+	}
+
+	p := NewGitTokenProvider(gitpodAPI, WorkspaceConfig{}, NewNotificationService())
+
+	var (
+		mu  sync.Mutex
+		act = make(map[string]string)
+		wg  sync.WaitGroup
+	)
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+
+			tkn, err := p.GetToken(context.Background(), &api.GetTokenRequest{Host: host, Kind: KindGit, Scope: []string{"repo"}})
+			if err != nil {
+				t.Errorf("unexpected error for %s: %v", host, err)
+				return
+			}
+
+			mu.Lock()
+			act[tkn.Host] = tkn.Token
+			mu.Unlock()
+		}(host)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("token requests for different hosts blocked each other")
+	}
+
+	expectation := map[string]string{
+		"github.com": "token-github.com",
+		"gitlab.com": "token-gitlab.com",
+	}
+	if diff := cmp.Diff(expectation, act); diff != "" {
+		t.Errorf("unexpected tokens (-want +got):\n%s", diff)
+	}
+}
+
+func TestGitTokenProviderRequiresHost(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	p := NewGitTokenProvider(gitpod.NewMockAPIInterface(ctrl), WorkspaceConfig{}, NewNotificationService())
+	_, err := p.GetToken(context.Background(), &api.GetTokenRequest{Kind: KindGit, Scope: []string{"repo"}})
+	if err == nil {
+		t.Fatal("expected an error for a request without host")
+	}
+}
+
+func TestGitTokenProviderRequestPermissions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	gitpodAPI := gitpod.NewMockAPIInterface(ctrl)
+	gitpodAPI.EXPECT().GetToken(gomock.Any(), &gitpod.GetTokenSearchOptions{Host: "gitlab.com"}).Return(&gitpod.Token{Value: "token", Username: "user", Scopes: []string{"read_repository"}}, nil)
+	gitpodAPI.EXPECT().GuessGitTokenScopes(gomock.Any(), &gitpod.GuessGitTokenScopesParams{
+		Host:         "gitlab.com",
+		CurrentToken: &gitpod.GitToken{Token: "token", User: "user", Scopes: []string{"read_repository"}},
+	}).Return(&gitpod.GuessedGitTokenScopes{Scopes: []string{"api"}, Message: "Pushing to GitLab requires the api scope."}, nil)
+
+	notifications := NewNotificationService()
+	subscriber := NewSubscribeServer()
+	defer subscriber.cancel()
+	go notifications.Subscribe(&api.SubscribeRequest{}, subscriber)
+
+	p := NewGitTokenProvider(gitpodAPI, WorkspaceConfig{}, notifications)
+	type result struct {
+		Token *Token
+		Err   error
+	}
+	res := make(chan result, 1)
+	go func() {
+		tkn, err := p.GetToken(context.Background(), &api.GetTokenRequest{Host: "gitlab.com", Kind: KindGit, Scope: []string{"api"}})
+		res <- result{tkn, err}
+	}()
+
+	var notification *api.SubscribeResponse
+	select {
+	case notification = <-subscriber.resps:
+	case <-time.After(5 * time.Second):
+		t.Fatal("user was not asked to grant permissions")
+	}
+	if diff := cmp.Diff("Pushing to GitLab requires the api scope. Please grant the necessary permissions.", notification.Request.Message); diff != "" {
+		t.Errorf("unexpected message (-want +got):\n%s", diff)
+	}
+
+	_, err := notifications.Respond(context.Background(), &api.RespondRequest{RequestId: notification.RequestId, Response: &api.NotifyResponse{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-res
+	if r.Err != nil || r.Token != nil {
+		t.Errorf("expected no token and no error, got %v and %v", r.Token, r.Err)
+	}
+}
+
+func TestGitTokenProviderPendingPermissionRequest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	gitpodAPI := gitpod.NewMockAPIInterface(ctrl)
+	gitpodAPI.EXPECT().GetToken(gomock.Any(), &gitpod.GetTokenSearchOptions{Host: "github.com"}).Return(&gitpod.Token{Value: "token", Username: "user", Scopes: []string{"repo"}}, nil).AnyTimes()
+	gitpodAPI.EXPECT().GuessGitTokenScopes(gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("not available")).Times(1)
+
+	notifications := NewNotificationService()
+	subscriber := NewSubscribeServer()
+	defer subscriber.cancel()
+	go notifications.Subscribe(&api.SubscribeRequest{}, subscriber)
+
+	p := NewGitTokenProvider(gitpodAPI, WorkspaceConfig{}, notifications)
+	getToken := func(scope string) <-chan *Token {
+		res := make(chan *Token, 1)
+		go func() {
+			tkn, err := p.GetToken(context.Background(), &api.GetTokenRequest{Host: "github.com", Kind: KindGit, Scope: []string{scope}})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			res <- tkn
+		}()
+		return res
+	}
+
+	// the first request lacks permissions and waits for the user
+	first := getToken("workflow")
+	var notification *api.SubscribeResponse
+	select {
+	case notification = <-subscriber.resps:
+	case <-time.After(5 * time.Second):
+		t.Fatal("user was not asked to grant permissions")
+	}
+	if !strings.Contains(notification.Request.Message, "github.com") {
+		t.Errorf("message does not name the host: %s", notification.Request.Message)
+	}
+
+	// requests for the same host must not block while the user is asked
+	select {
+	case tkn := <-getToken("repo"):
+		if tkn == nil || tkn.Token != "token" {
+			t.Errorf("unexpected token: %v", tkn)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was blocked by pending permission request")
+	}
+
+	// and we don't ask the user again while they have not answered, but wait for their answer
+	second := getToken("workflow")
+	select {
+	case tkn := <-second:
+		t.Fatalf("request did not wait for the pending permission request: %v", tkn)
+	case notification := <-subscriber.resps:
+		t.Fatalf("user was asked twice to grant the same permissions: %s", notification.Request.Message)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err := notifications.Respond(context.Background(), &api.RespondRequest{RequestId: notification.RequestId, Response: &api.NotifyResponse{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range []<-chan *Token{first, second} {
+		select {
+		case tkn := <-res:
+			if tkn != nil {
+				t.Errorf("unexpected token: %v", tkn)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("request did not complete once the user answered")
+		}
+	}
+}
+
+func TestPermissionScopes(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Current     []string
+		Missing     []string
+		Guessed     []string
+		Expectation []string
+	}{
+		{Desc: "missing only", Missing: []string{"api"}, Expectation: []string{"api"}},
+		{Desc: "keeps current scopes", Current: []string{"read_repository"}, Missing: []string{"api"}, Expectation: []string{"read_repository", "api"}},
+		{Desc: "adds guessed scopes", Current: []string{"repo"}, Missing: []string{"workflow"}, Guessed: []string{"repo", "workflow", "read:org"}, Expectation: []string{"repo", "workflow", "read:org"}},
+		{Desc: "no guess", Current: []string{"repo"}, Missing: []string{"workflow"}, Expectation: []string{"repo", "workflow"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := permissionScopes(test.Current, test.Missing, test.Guessed)
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected scopes (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAuthorizeURL(t *testing.T) {
+	act := authorizeURL("https://gitpod.io/", "github.com", []string{"repo", "read:org"})
+	expectation := "https://gitpod.io/api/authorize?host=github.com&returnTo=about%3Ablank&scopes=repo%2Cread%3Aorg"
+	if act != expectation {
+		t.Errorf("unexpected URL: expected %s, got %s", expectation, act)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"syscall"
+
+	"google.golang.org/grpc"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+)
+
+// errIDENotRunning is returned if the IDE is asked to suspend while it is not running
+var errIDENotRunning = errors.New("IDE is not running")
+
+// ideSuspender suspends and resumes the process group of the IDE
+type ideSuspender struct {
+	// Signal sends a signal to all processes of a process group
+	Signal func(pgid int, sig syscall.Signal) error
+
+	mu        sync.Mutex
+	pgid      int
+	suspended bool
+}
+
+func newIDESuspender() *ideSuspender {
+	return &ideSuspender{Signal: signalProcessGroup}
+}
+
+func signalProcessGroup(pgid int, sig syscall.Signal) error {
+	return syscall.Kill(-pgid, sig)
+}
+
+// SetProcessGroup sets the process group of the IDE. Use 0 if the IDE is not running.
+// A new process group is never suspended.
+func (s *ideSuspender) SetProcessGroup(pgid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pgid = pgid
+	s.suspended = false
+}
+
+// Suspend stops all processes of the IDE's process group
+func (s *ideSuspender) Suspend() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pgid == 0 {
+		return errIDENotRunning
+	}
+	if s.suspended {
+		return nil
+	}
+	err := s.Signal(s.pgid, syscall.SIGSTOP)
+	if err != nil {
+		return err
+	}
+	s.suspended = true
+	log.WithField("pgid", s.pgid).Info("IDE suspended")
+	return nil
+}
+
+// Resume continues all processes of the IDE's process group if they were suspended
+func (s *ideSuspender) Resume() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.suspended {
+		return nil
+	}
+	err := s.Signal(s.pgid, syscall.SIGCONT)
+	if err != nil {
+		return err
+	}
+	s.suspended = false
+	log.WithField("pgid", s.pgid).Info("IDE resumed")
+	return nil
+}
+
+// Suspended returns true if the IDE is suspended
+func (s *ideSuspender) Suspended() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.suspended
+}
+
+// UnaryServerInterceptor resumes the IDE when a client calls the supervisor API
+func (s *ideSuspender) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	s.resumeOnActivity(info.FullMethod)
+	return handler(ctx, req)
+}
+
+// StreamServerInterceptor resumes the IDE when a client calls the supervisor API
+func (s *ideSuspender) StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	s.resumeOnActivity(info.FullMethod)
+	return handler(srv, ss)
+}
+
+func (s *ideSuspender) resumeOnActivity(fullMethod string) {
+	if !isClientActivity(fullMethod) {
+		return
+	}
+	err := s.Resume()
+	if err != nil {
+		log.WithError(err).WithField("method", fullMethod).Warn("cannot resume IDE")
+	}
+}
+
+// isClientActivity returns false for calls which must not resume a suspended IDE,
+// e.g. because the frontend polls the IDE status while the IDE is suspended.
+func isClientActivity(fullMethod string) bool {
+	if strings.HasPrefix(fullMethod, "/supervisor.StatusService/") {
+		return false
+	}
+	switch fullMethod {
+	case "/supervisor.ControlService/SuspendIDE", "/supervisor.ControlService/ResumeIDE":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+)
+
+func TestIDESuspender(t *testing.T) {
+	type signal struct {
+		PGID int
+		Sig  syscall.Signal
+	}
+	type op func(s *ideSuspender) error
+	var (
+		setPGID = func(pgid int) op {
+			return func(s *ideSuspender) error { s.SetProcessGroup(pgid); return nil }
+		}
+		suspend = func(s *ideSuspender) error { return s.Suspend() }
+		resume  = func(s *ideSuspender) error { return s.Resume() }
+		call    = func(method string) op {
+			return func(s *ideSuspender) error {
+				_, err := s.UnaryServerInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return nil, nil
+				})
+				return err
+			}
+		}
+	)
+	tests := []struct {
+		Name              string
+		Ops               []op
+		ExpectedSignals   []signal
+		ExpectedSuspended bool
+		ExpectedErr       error
+	}{
+		{
+			Name:        "not running",
+			Ops:         []op{suspend},
+			ExpectedErr: errIDENotRunning,
+		},
+		{
+			Name:              "suspend",
+			Ops:               []op{setPGID(42), suspend, suspend},
+			ExpectedSignals:   []signal{{42, syscall.SIGSTOP}},
+			ExpectedSuspended: true,
+		},
+		{
+			Name:            "resume",
+			Ops:             []op{setPGID(42), suspend, resume, resume},
+			ExpectedSignals: []signal{{42, syscall.SIGSTOP}, {42, syscall.SIGCONT}},
+		},
+		{
+			Name: "resume not suspended",
+			Ops:  []op{setPGID(42), resume},
+		},
+		{
+			Name:            "resume on activity",
+			Ops:             []op{setPGID(42), suspend, call("/supervisor.TerminalService/Listen")},
+			ExpectedSignals: []signal{{42, syscall.SIGSTOP}, {42, syscall.SIGCONT}},
+		},
+		{
+			Name:              "status is no activity",
+			Ops:               []op{setPGID(42), suspend, call("/supervisor.StatusService/IDEStatus"), call("/supervisor.ControlService/SuspendIDE")},
+			ExpectedSignals:   []signal{{42, syscall.SIGSTOP}},
+			ExpectedSuspended: true,
+		},
+		{
+			Name:            "restarted",
+			Ops:             []op{setPGID(42), suspend, setPGID(0), setPGID(43), resume, suspend},
+			ExpectedSignals: []signal{{42, syscall.SIGSTOP}, {43, syscall.SIGSTOP}},
+			// the last suspend suspended the new process group
+			ExpectedSuspended: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var signals []signal
+			s := &ideSuspender{Signal: func(pgid int, sig syscall.Signal) error {
+				signals = append(signals, signal{pgid, sig})
+				return nil
+			}}
+
+			var err error
+			for _, o := range test.Ops {
+				err = o(s)
+				if err != nil {
+					break
+				}
+			}
+
+			if err != test.ExpectedErr {
+				t.Errorf("unexpected error: want %v, got %v", test.ExpectedErr, err)
+			}
+			if diff := cmp.Diff(test.ExpectedSignals, signals); diff != "" {
+				t.Errorf("unexpected signals (-want +got):\n%s", diff)
+			}
+			if s.Suspended() != test.ExpectedSuspended {
+				t.Errorf("unexpected suspended state: want %v, got %v", test.ExpectedSuspended, s.Suspended())
+			}
+		})
+	}
+}
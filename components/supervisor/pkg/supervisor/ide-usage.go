@@ -0,0 +1,150 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/procfs"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/supervisor/api"
+)
+
+// ideUsageSampleInterval is the time between two samples of the IDE's resource usage.
+// Sampling reads the stat file of every process, hence we don't do it too often.
+const ideUsageSampleInterval = 10 * time.Second
+
+// processGroupUsage is the resource usage of all processes in a process group
+type processGroupUsage struct {
+	// CPUTime is the total user and system CPU time of the processes in seconds
+	CPUTime float64
+	// RSS is the resident memory of the processes in bytes
+	RSS uint64
+	// Processes is the number of processes
+	Processes int
+}
+
+// processGroupSource reads the resource usage of process groups
+type processGroupSource interface {
+	Usage(pgid int) (processGroupUsage, error)
+}
+
+// procfsProcessGroupSource reads the resource usage of process groups from /proc
+type procfsProcessGroupSource struct{}
+
+func (procfsProcessGroupSource) Usage(pgid int) (res processGroupUsage, err error) {
+	procs, err := procfs.AllProcs()
+	if err != nil {
+		return res, err
+	}
+	for _, proc := range procs {
+		stat, err := proc.Stat()
+		if err != nil {
+			// the process might have exited in the meantime
+			continue
+		}
+		if stat.PGRP != pgid {
+			continue
+		}
+		res.CPUTime += stat.CPUTime()
+		res.RSS += uint64(stat.ResidentMemory())
+		res.Processes++
+	}
+	return res, nil
+}
+
+// ideUsageSampler periodically samples the resource usage of the IDE's process group
+type ideUsageSampler struct {
+	Source processGroupSource
+
+	mu     sync.RWMutex
+	pgid   int
+	prev   *processGroupUsage
+	prevAt time.Time
+	latest *api.IDEResourceUsageResponse
+}
+
+func newIDEUsageSampler() *ideUsageSampler {
+	return &ideUsageSampler{Source: procfsProcessGroupSource{}}
+}
+
+// SetProcessGroup sets the process group of the IDE. Use 0 if the IDE is not running.
+func (s *ideUsageSampler) SetProcessGroup(pgid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pgid = pgid
+	s.prev = nil
+	s.latest = nil
+}
+
+// Run samples the resource usage until the context is canceled
+func (s *ideUsageSampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(ideUsageSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.sample(time.Now())
+	}
+}
+
+func (s *ideUsageSampler) sample(now time.Time) {
+	s.mu.RLock()
+	pgid := s.pgid
+	s.mu.RUnlock()
+	if pgid == 0 {
+		return
+	}
+
+	usage, err := s.Source.Usage(pgid)
+	if err != nil {
+		log.WithError(err).Debug("cannot sample IDE resource usage")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pgid != pgid {
+		// the IDE was restarted while we were sampling
+		return
+	}
+
+	var cpuMillicores int64
+	if s.prev != nil {
+		elapsed := now.Sub(s.prevAt).Seconds()
+		// the CPU time of processes which exited is gone, hence the delta can be negative
+		if delta := usage.CPUTime - s.prev.CPUTime; elapsed > 0 && delta > 0 {
+			cpuMillicores = int64(delta / elapsed * 1000)
+		}
+	}
+	s.prev, s.prevAt = &usage, now
+	s.latest = &api.IDEResourceUsageResponse{
+		Available:     true,
+		CpuMillicores: cpuMillicores,
+		RssBytes:      usage.RSS,
+		Processes:     int32(usage.Processes),
+		Time:          timestamppb.New(now),
+	}
+}
+
+// Usage returns the latest sample
+func (s *ideUsageSampler) Usage() *api.IDEResourceUsageResponse {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.latest == nil {
+		return &api.IDEResourceUsageResponse{}
+	}
+	return s.latest
+}
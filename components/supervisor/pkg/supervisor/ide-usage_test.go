@@ -0,0 +1,121 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/gitpod-io/gitpod/supervisor/api"
+)
+
+type testProcessGroupSource map[int]processGroupUsage
+
+func (s testProcessGroupSource) Usage(pgid int) (processGroupUsage, error) {
+	return s[pgid], nil
+}
+
+func TestIDEUsageSampler(t *testing.T) {
+	t0 := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	type sample struct {
+		PGID  int
+		Usage processGroupUsage
+		At    time.Duration
+	}
+	tests := []struct {
+		Name        string
+		Samples     []sample
+		Expectation *api.IDEResourceUsageResponse
+	}{
+		{
+			Name:        "not running",
+			Samples:     []sample{{PGID: 0, Usage: processGroupUsage{CPUTime: 1, RSS: 1, Processes: 1}}},
+			Expectation: &api.IDEResourceUsageResponse{},
+		},
+		{
+			Name:    "first sample",
+			Samples: []sample{{PGID: 42, Usage: processGroupUsage{CPUTime: 5, RSS: 1024, Processes: 3}}},
+			Expectation: &api.IDEResourceUsageResponse{
+				Available: true,
+				RssBytes:  1024,
+				Processes: 3,
+				Time:      timestamppb.New(t0),
+			},
+		},
+		{
+			Name: "cpu usage",
+			Samples: []sample{
+				{PGID: 42, Usage: processGroupUsage{CPUTime: 5, RSS: 1024, Processes: 3}},
+				{PGID: 42, Usage: processGroupUsage{CPUTime: 10, RSS: 2048, Processes: 4}, At: 10 * time.Second},
+			},
+			Expectation: &api.IDEResourceUsageResponse{
+				Available:     true,
+				CpuMillicores: 500,
+				RssBytes:      2048,
+				Processes:     4,
+				Time:          timestamppb.New(t0.Add(10 * time.Second)),
+			},
+		},
+		{
+			Name: "processes exited",
+			Samples: []sample{
+				{PGID: 42, Usage: processGroupUsage{CPUTime: 10, RSS: 2048, Processes: 4}},
+				{PGID: 42, Usage: processGroupUsage{CPUTime: 2, RSS: 1024, Processes: 1}, At: 10 * time.Second},
+			},
+			Expectation: &api.IDEResourceUsageResponse{
+				Available: true,
+				RssBytes:  1024,
+				Processes: 1,
+				Time:      timestamppb.New(t0.Add(10 * time.Second)),
+			},
+		},
+		{
+			Name: "restarted",
+			Samples: []sample{
+				{PGID: 42, Usage: processGroupUsage{CPUTime: 5, RSS: 1024, Processes: 3}},
+				{PGID: 43, Usage: processGroupUsage{CPUTime: 100, RSS: 512, Processes: 1}, At: 10 * time.Second},
+			},
+			Expectation: &api.IDEResourceUsageResponse{
+				Available: true,
+				RssBytes:  512,
+				Processes: 1,
+				Time:      timestamppb.New(t0.Add(10 * time.Second)),
+			},
+		},
+		{
+			Name: "stopped",
+			Samples: []sample{
+				{PGID: 42, Usage: processGroupUsage{CPUTime: 5, RSS: 1024, Processes: 3}},
+				{PGID: 0, At: 10 * time.Second},
+			},
+			Expectation: &api.IDEResourceUsageResponse{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var (
+				src     = make(testProcessGroupSource)
+				sampler = &ideUsageSampler{Source: src}
+				pgid    int
+			)
+			for _, s := range test.Samples {
+				if s.PGID != pgid {
+					sampler.SetProcessGroup(s.PGID)
+					pgid = s.PGID
+				}
+				src[s.PGID] = s.Usage
+				sampler.sample(t0.Add(s.At))
+			}
+
+			if diff := cmp.Diff(test.Expectation, sampler.Usage(), protocmp.Transform()); diff != "" {
+				t.Errorf("unexpected usage (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/gitpod-io/gitpod/supervisor/pkg/ports"
+	"github.com/gitpod-io/gitpod/supervisor/pkg/terminal"
+)
+
+// metrics combine custom metrics exported by supervisor
+type metrics struct {
+	IDERestarts         prometheus.Counter
+	IDEUp               prometheus.Gauge
+	ContentInitDuration prometheus.Histogram
+	ReapedProcesses     prometheus.Counter
+	ReaperSIGTERMs      prometheus.Counter
+	ReapedPerWake       prometheus.Histogram
+
+	GRPCHandled         *prometheus.CounterVec
+	GRPCHandlingSeconds *prometheus.HistogramVec
+}
+
+func newMetrics(reg prometheus.Registerer, termMux *terminal.Mux, portMgmt *ports.Manager) (*metrics, error) {
+	ideRestarts := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ide_restarts_total",
+		Help: "number of times the IDE was restarted after it stopped",
+	})
+	err := reg.Register(ideRestarts)
+	if err != nil {
+		return nil, err
+	}
+
+	ideUp := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ide_up",
+		Help: "1 if the IDE is ready, 0 otherwise",
+	})
+	err = reg.Register(ideUp)
+	if err != nil {
+		return nil, err
+	}
+
+	contentInitDuration := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "content_init_seconds",
+		Help:    "time it took until the workspace content became available",
+		Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800},
+	})
+	err = reg.Register(contentInitDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	err = reg.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "terminals_active",
+		Help: "number of open terminals",
+	}, func() float64 {
+		return float64(termMux.Count())
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = reg.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ports_exposed",
+		Help: "number of exposed ports",
+	}, func() float64 {
+		var exposed int
+		for _, p := range portMgmt.Status() {
+			if p.Exposed != nil {
+				exposed++
+			}
+		}
+		return float64(exposed)
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = reg.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ports_exposure_disabled",
+		Help: "1 if ports cannot be exposed because there is no connection to the Gitpod server, 0 otherwise",
+	}, func() float64 {
+		if portMgmt.ExposureDisabled() {
+			return 1
+		}
+		return 0
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	reapedProcesses := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "reaper_reaped_total",
+		Help: "number of child processes reaped by supervisor",
+	})
+	err = reg.Register(reapedProcesses)
+	if err != nil {
+		return nil, err
+	}
+
+	reaperSIGTERMs := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "reaper_sigterm_total",
+		Help: "number of SIGTERMs sent to re-parented processes while the reaper was terminating",
+	})
+	err = reg.Register(reaperSIGTERMs)
+	if err != nil {
+		return nil, err
+	}
+
+	reapedPerWake := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "reaper_reaped_per_wake",
+		Help:    "number of child processes reaped each time the reaper received SIGCHLD",
+		Buckets: []float64{0, 1, 2, 5, 10, 25, 50, 100},
+	})
+	err = reg.Register(reapedPerWake)
+	if err != nil {
+		return nil, err
+	}
+
+	err = reg.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "reaper_children",
+		Help: "number of child processes supervisor currently has to reap eventually",
+	}, func() float64 {
+		children, err := processesWithParent(os.Getpid(), true)
+		if err != nil {
+			return 0
+		}
+		return float64(len(children))
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	grpcHandled := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_total",
+		Help: "total number of gRPC calls completed by the supervisor API, regardless of success or failure",
+	}, []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"})
+	err = reg.Register(grpcHandled)
+	if err != nil {
+		return nil, err
+	}
+
+	grpcHandlingSeconds := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_handling_seconds",
+		Help:    "time it took the supervisor API to handle a gRPC call",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"grpc_type", "grpc_service", "grpc_method"})
+	err = reg.Register(grpcHandlingSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metrics{
+		IDERestarts:         ideRestarts,
+		IDEUp:               ideUp,
+		ContentInitDuration: contentInitDuration,
+		ReapedProcesses:     reapedProcesses,
+		ReaperSIGTERMs:      reaperSIGTERMs,
+		ReapedPerWake:       reapedPerWake,
+		GRPCHandled:         grpcHandled,
+		GRPCHandlingSeconds: grpcHandlingSeconds,
+	}, nil
+}
+
+// UnaryServerInterceptor records the count and latency of unary gRPC calls
+func (m *metrics) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.observeGRPCCall("unary", info.FullMethod, start, err)
+	return resp, err
+}
+
+// StreamServerInterceptor records the count and latency of streaming gRPC calls
+func (m *metrics) StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+
+	tpe := "bidi_stream"
+	if info.IsClientStream && !info.IsServerStream {
+		tpe = "client_stream"
+	} else if !info.IsClientStream && info.IsServerStream {
+		tpe = "server_stream"
+	}
+	m.observeGRPCCall(tpe, info.FullMethod, start, err)
+	return err
+}
+
+func (m *metrics) observeGRPCCall(tpe, fullMethod string, start time.Time, err error) {
+	service, method := splitGRPCMethodName(fullMethod)
+	code := status.Code(err)
+	m.GRPCHandled.WithLabelValues(tpe, service, method, code.String()).Inc()
+	m.GRPCHandlingSeconds.WithLabelValues(tpe, service, method).Observe(time.Since(start).Seconds())
+}
+
+// splitGRPCMethodName splits a full method name of the form /package.Service/Method
+func splitGRPCMethodName(fullMethod string) (service, method string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", "unknown"
+}
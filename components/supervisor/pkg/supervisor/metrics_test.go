@@ -0,0 +1,231 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/gitpod-io/gitpod/supervisor/pkg/ports"
+	"github.com/gitpod-io/gitpod/supervisor/pkg/terminal"
+)
+
+func TestGRPCMetricsInterceptors(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := newMetrics(reg, terminal.NewMux(), &ports.Manager{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unaryInfo := &grpc.UnaryServerInfo{FullMethod: "/supervisor.StatusService/SupervisorStatus"}
+	for i := 0; i < 2; i++ {
+		_, _ = m.UnaryServerInterceptor(context.Background(), nil, unaryInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+	}
+	_, _ = m.UnaryServerInterceptor(context.Background(), nil, unaryInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "not found")
+	})
+
+	streamInfo := &grpc.StreamServerInfo{FullMethod: "/supervisor.TerminalService/Listen", IsServerStream: true}
+	_ = m.StreamServerInterceptor(nil, nil, streamInfo, func(srv interface{}, stream grpc.ServerStream) error {
+		return nil
+	})
+	clientStreamInfo := &grpc.StreamServerInfo{FullMethod: "/supervisor.TerminalService/Write", IsClientStream: true}
+	_ = m.StreamServerInterceptor(nil, nil, clientStreamInfo, func(srv interface{}, stream grpc.ServerStream) error {
+		return status.Error(codes.Canceled, "canceled")
+	})
+	bidiStreamInfo := &grpc.StreamServerInfo{FullMethod: "/supervisor.TerminalService/Attach", IsClientStream: true, IsServerStream: true}
+	_ = m.StreamServerInterceptor(nil, nil, bidiStreamInfo, func(srv interface{}, stream grpc.ServerStream) error {
+		return nil
+	})
+
+	t.Run("handled", func(t *testing.T) {
+		tests := []struct {
+			Desc   string
+			Labels []string
+			Expect float64
+		}{
+			{"unary ok", []string{"unary", "supervisor.StatusService", "SupervisorStatus", "OK"}, 2},
+			{"unary not found", []string{"unary", "supervisor.StatusService", "SupervisorStatus", "NotFound"}, 1},
+			{"server stream ok", []string{"server_stream", "supervisor.TerminalService", "Listen", "OK"}, 1},
+			{"client stream canceled", []string{"client_stream", "supervisor.TerminalService", "Write", "Canceled"}, 1},
+			{"bidi stream ok", []string{"bidi_stream", "supervisor.TerminalService", "Attach", "OK"}, 1},
+			{"unknown method", []string{"unary", "supervisor.StatusService", "PortsStatus", "OK"}, 0},
+		}
+		for _, test := range tests {
+			t.Run(test.Desc, func(t *testing.T) {
+				act := testutil.ToFloat64(m.GRPCHandled.WithLabelValues(test.Labels...))
+				if act != test.Expect {
+					t.Errorf("unexpected count: expected %v, got %v", test.Expect, act)
+				}
+			})
+		}
+	})
+
+	t.Run("handling seconds", func(t *testing.T) {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		act := make(map[string]uint64)
+		for _, mf := range mfs {
+			if mf.GetName() != "grpc_server_handling_seconds" {
+				continue
+			}
+			for _, metric := range mf.GetMetric() {
+				labels := make(map[string]string)
+				for _, l := range metric.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				act[labels["grpc_type"]+" "+labels["grpc_service"]+"/"+labels["grpc_method"]] = metric.GetHistogram().GetSampleCount()
+			}
+		}
+
+		// the latency is recorded regardless of the status code
+		expectation := map[string]uint64{
+			"unary supervisor.StatusService/SupervisorStatus": 3,
+			"server_stream supervisor.TerminalService/Listen": 1,
+			"client_stream supervisor.TerminalService/Write":  1,
+			"bidi_stream supervisor.TerminalService/Attach":   1,
+		}
+		if diff := cmp.Diff(expectation, act); diff != "" {
+			t.Errorf("unexpected sample counts (-want +got):\n%s", diff)
+		}
+	})
+}
+
+type fakeExposedPorts struct {
+	ports.NoopExposedPorts
+	Changes chan []ports.ExposedPort
+}
+
+func (f *fakeExposedPorts) Observe(ctx context.Context) (<-chan []ports.ExposedPort, <-chan error) {
+	return f.Changes, make(chan error)
+}
+
+func TestMetricsGaugeFuncs(t *testing.T) {
+	var (
+		reg      = prometheus.NewRegistry()
+		termMux  = terminal.NewMux()
+		exposed  = make(chan []ports.ExposedPort)
+		served   = make(chan []ports.ServedPort)
+		portMgmt = ports.NewManager(&fakeExposedPorts{Changes: exposed}, &fakeServedPorts{Changes: served}, &fakePortsConfig{})
+	)
+	defer termMux.Close()
+	_, err := newMetrics(reg, termMux, portMgmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gauge := func(name string) float64 {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() == name {
+				return mf.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		t.Fatalf("metric %s not found", name)
+		return 0
+	}
+
+	t.Run("terminals_active", func(t *testing.T) {
+		if act := gauge("terminals_active"); act != 0 {
+			t.Errorf("unexpected number of terminals: expected 0, got %v", act)
+		}
+		_, err := termMux.Start(exec.Command("sleep", "60"), terminal.TermOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act := gauge("terminals_active"); act != 1 {
+			t.Errorf("unexpected number of terminals: expected 1, got %v", act)
+		}
+	})
+
+	t.Run("ports", func(t *testing.T) {
+		if act := gauge("ports_exposed"); act != 0 {
+			t.Errorf("unexpected number of exposed ports: expected 0, got %v", act)
+		}
+		if act := gauge("ports_exposure_disabled"); act != 0 {
+			t.Errorf("exposure should be enabled, got %v", act)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go portMgmt.Run(ctx, &wg)
+		exposed <- []ports.ExposedPort{
+			{LocalPort: 8080, GlobalPort: 8080, URL: "https://8080-foobar.gitpod.io/"},
+			{LocalPort: 3000, GlobalPort: 3000, URL: "https://3000-foobar.gitpod.io/"},
+		}
+		var act float64
+		for i := 0; i < 100 && act != 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+			act = gauge("ports_exposed")
+		}
+		if act != 2 {
+			t.Errorf("unexpected number of exposed ports: expected 2, got %v", act)
+		}
+
+		portMgmt.SetExposedPorts(&ports.NoopExposedPorts{})
+		if act := gauge("ports_exposure_disabled"); act != 1 {
+			t.Errorf("exposure should be disabled, got %v", act)
+		}
+
+		// the port manager stops once one of its observers stops
+		close(served)
+		wg.Wait()
+	})
+
+	t.Run("reaper_children", func(t *testing.T) {
+		before := gauge("reaper_children")
+		cmd := exec.Command("sleep", "60")
+		err := cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}()
+		if act := gauge("reaper_children"); act != before+1 {
+			t.Errorf("unexpected number of children: expected %v, got %v", before+1, act)
+		}
+	})
+}
+
+func TestSplitGRPCMethodName(t *testing.T) {
+	tests := []struct {
+		FullMethod string
+		Service    string
+		Method     string
+	}{
+		{"/supervisor.StatusService/SupervisorStatus", "supervisor.StatusService", "SupervisorStatus"},
+		{"supervisor.TokenService/GetToken", "supervisor.TokenService", "GetToken"},
+		{"garbage", "unknown", "unknown"},
+	}
+	for _, test := range tests {
+		t.Run(test.FullMethod, func(t *testing.T) {
+			service, method := splitGRPCMethodName(test.FullMethod)
+			if service != test.Service || method != test.Method {
+				t.Errorf("unexpected result: expected %s/%s, got %s/%s", test.Service, test.Method, service, method)
+			}
+		})
+	}
+}
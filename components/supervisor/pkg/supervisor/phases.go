@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/supervisor/api"
+)
+
+// phaseCount is the number of phases which can be recorded, i.e. all but the unknown phase
+var phaseCount = len(api.SupervisorPhase_name) - 1
+
+// phaseEvent marks the time supervisor entered a startup phase
+type phaseEvent struct {
+	Phase api.SupervisorPhase
+	Time  time.Time
+}
+
+// phaseLog records the startup phases supervisor went through in the order they happened.
+// Every phase is recorded once only, i.e. IDE restarts do not add events.
+type phaseLog struct {
+	mu      sync.Mutex
+	events  []phaseEvent
+	changed chan struct{}
+}
+
+func newPhaseLog() *phaseLog {
+	return &phaseLog{changed: make(chan struct{})}
+}
+
+// Record records that supervisor entered phase now. Phases which were recorded before are ignored.
+func (l *phaseLog) Record(phase api.SupervisorPhase) {
+	if phase == api.SupervisorPhase_phase_unknown {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, evt := range l.events {
+		if evt.Phase == phase {
+			return
+		}
+	}
+	l.events = append(l.events, phaseEvent{Phase: phase, Time: time.Now()})
+	log.WithField("phase", phase.String()).Debug("supervisor phase changed")
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Events returns the recorded phase events, oldest first, and a chan that closes once a new phase is recorded
+func (l *phaseLog) Events() (events []phaseEvent, changed <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]phaseEvent(nil), l.events...), l.changed
+}
@@ -6,6 +6,7 @@ package supervisor
 
 import (
 	"context"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
@@ -16,9 +17,11 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/gitpod-io/gitpod/common-go/log"
 	csapi "github.com/gitpod-io/gitpod/content-service/api"
+	"github.com/gitpod-io/gitpod/content-service/pkg/initializer"
 	"github.com/gitpod-io/gitpod/supervisor/api"
 	"github.com/gitpod-io/gitpod/supervisor/pkg/ports"
 )
@@ -38,6 +41,26 @@ type RegisterableRESTService interface {
 	RegisterREST(mux *runtime.ServeMux, grpcEndpoint string) error
 }
 
+// RegisterableHTTPService can register plain HTTP handlers. The handlers are served under /_supervisor,
+// i.e. a handler registered for /hello is available at /_supervisor/hello.
+type RegisterableHTTPService interface {
+	// RegisterHTTP registers HTTP handlers
+	RegisterHTTP(mux HTTPMux)
+}
+
+// HTTPMux is the part of http.ServeMux HTTP services register their handlers with
+type HTTPMux interface {
+	Handle(pattern string, handler http.Handler)
+	HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+}
+
+// Shutdownable services take part in the graceful shutdown of supervisor. Shutdown is called once
+// the IDE and its child processes are gone, and before the workspace is torn down.
+type Shutdownable interface {
+	// Shutdown releases the service's resources and must return once ctx is done
+	Shutdown(ctx context.Context) error
+}
+
 type ideReadyState struct {
 	ready bool
 	cond  *sync.Cond
@@ -81,6 +104,11 @@ type statusService struct {
 	Ports        *ports.Manager
 	Tasks        *tasksManager
 	ideReady     *ideReadyState
+	reapEvents   *reapEventLog
+	ideUsage     *ideUsageSampler
+	ideSuspend   *ideSuspender
+	ideExits     *ideExitLog
+	phases       *phaseLog
 }
 
 func (s *statusService) RegisterGRPC(srv *grpc.Server) {
@@ -99,14 +127,35 @@ func (s *statusService) IDEStatus(ctx context.Context, req *api.IDEStatusRequest
 	if req.Wait {
 		select {
 		case <-s.ideReady.Wait():
-			return &api.IDEStatusResponse{Ok: true}, nil
+			return &api.IDEStatusResponse{Ok: true, Suspended: s.ideSuspended(), Exits: s.ideExitStatus()}, nil
 		case <-ctx.Done():
 			return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
 		}
 	}
 
 	ok := s.ideReady.Get()
-	return &api.IDEStatusResponse{Ok: ok}, nil
+	return &api.IDEStatusResponse{Ok: ok, Suspended: s.ideSuspended(), Exits: s.ideExitStatus()}, nil
+}
+
+func (s *statusService) ideExitStatus() []*api.IDEExit {
+	if s.ideExits == nil {
+		return nil
+	}
+
+	exits := s.ideExits.Exits()
+	res := make([]*api.IDEExit, 0, len(exits))
+	for _, exit := range exits {
+		res = append(res, &api.IDEExit{
+			ExitCode: int32(exit.ExitCode),
+			Signal:   exit.Signal,
+			Time:     timestamppb.New(exit.Time),
+		})
+	}
+	return res
+}
+
+func (s *statusService) ideSuspended() bool {
+	return s.ideSuspend != nil && s.ideSuspend.Suspended()
 }
 
 // ContentStatus provides feedback regarding the workspace content readiness
@@ -144,14 +193,102 @@ func (s *statusService) ContentStatus(ctx context.Context, req *api.ContentStatu
 	}, nil
 }
 
+// ContentProgress streams the progress of the workspace content initialization until the content is available
+func (s *statusService) ContentProgress(req *api.ContentProgressRequest, srv api.StatusService_ContentProgressServer) error {
+	cs := s.ContentState
+	for {
+		progress, changed := cs.ContentProgress()
+		_, available := cs.ContentSource()
+		err := srv.Send(&api.ContentProgressResponse{
+			Phase:     string(progress.Phase),
+			Percent:   int32(progress.Percent),
+			Available: available,
+		})
+		if err != nil {
+			return err
+		}
+		if available {
+			return nil
+		}
+
+		select {
+		case <-srv.Context().Done():
+			return nil
+		case <-cs.ContentReady():
+		case <-changed:
+		}
+	}
+}
+
 func (s *statusService) BackupStatus(ctx context.Context, req *api.BackupStatusRequest) (*api.BackupStatusResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "not implemented")
 }
 
+func (s *statusService) ReaperStatus(ctx context.Context, req *api.ReaperStatusRequest) (*api.ReaperStatusResponse, error) {
+	if s.reapEvents == nil {
+		return &api.ReaperStatusResponse{}, nil
+	}
+
+	events := s.reapEvents.Events()
+	res := make([]*api.ReapEvent, 0, len(events))
+	for _, evt := range events {
+		ts, err := ptypes.TimestampProto(evt.Time)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		res = append(res, &api.ReapEvent{
+			Pid:      int64(evt.PID),
+			Signaled: evt.Signaled,
+			Time:     ts,
+		})
+	}
+	return &api.ReaperStatusResponse{Events: res}, nil
+}
+
+// IDEResourceUsage returns the latest sample of the CPU and memory used by the IDE and its child processes.
+func (s *statusService) IDEResourceUsage(ctx context.Context, req *api.IDEResourceUsageRequest) (*api.IDEResourceUsageResponse, error) {
+	if s.ideUsage == nil {
+		return &api.IDEResourceUsageResponse{}, nil
+	}
+	return s.ideUsage.Usage(), nil
+}
+
+// PhaseEvents streams the startup phases supervisor went through. Phases recorded before the call are sent first.
+func (s *statusService) PhaseEvents(req *api.PhaseEventsRequest, srv api.StatusService_PhaseEventsServer) error {
+	if s.phases == nil {
+		return nil
+	}
+
+	var sent int
+	for {
+		events, changed := s.phases.Events()
+		for _, evt := range events[sent:] {
+			err := srv.Send(&api.PhaseEventsResponse{
+				Phase: evt.Phase,
+				Time:  timestamppb.New(evt.Time),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		sent = len(events)
+		if sent == phaseCount {
+			return nil
+		}
+
+		select {
+		case <-srv.Context().Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
 func (s *statusService) PortsStatus(req *api.PortsStatusRequest, srv api.StatusService_PortsStatusServer) error {
 	if !req.Observe {
 		return srv.Send(&api.PortsStatusResponse{
-			Ports: s.Ports.Status(),
+			Ports:            s.Ports.Status(),
+			ExposureDisabled: s.Ports.ExposureDisabled(),
 		})
 	}
 
@@ -173,7 +310,8 @@ func (s *statusService) PortsStatus(req *api.PortsStatusRequest, srv api.StatusS
 				return nil
 			}
 			err := srv.Send(&api.PortsStatusResponse{
-				Ports: update,
+				Ports:            update,
+				ExposureDisabled: s.Ports.ExposureDisabled(),
 			})
 			if err != nil {
 				return err
@@ -256,7 +394,7 @@ func (tkn *Token) Match(host string, scopes []string) bool {
 		return false
 	}
 
-	if tkn.ExpiryDate != nil && time.Now().After(*tkn.ExpiryDate) {
+	if tkn.Expired(time.Now()) {
 		return false
 	}
 
@@ -274,6 +412,11 @@ func (tkn *Token) Match(host string, scopes []string) bool {
 	return true
 }
 
+// Expired checks whether the token has expired at the given time
+func (tkn *Token) Expired(now time.Time) bool {
+	return tkn.ExpiryDate != nil && now.After(*tkn.ExpiryDate)
+}
+
 // HasScopes checks whether token can be used to access for the given scopes
 func (tkn *Token) HasScopes(scopes []string) bool {
 	if len(scopes) == 0 {
@@ -297,10 +440,38 @@ type InMemoryTokenService struct {
 	token    map[string][]*Token
 	provider map[string][]tokenProvider
 	mu       sync.RWMutex
+
+	// audit receives a record for every token request if not nil
+	audit TokenAuditSink
 }
 
 // GetToken returns a token for a host
 func (s *InMemoryTokenService) GetToken(ctx context.Context, req *api.GetTokenRequest) (*api.GetTokenResponse, error) {
+	tkn, cached, err := s.getToken(ctx, req)
+	if s.audit != nil {
+		rec := TokenAuditRecord{
+			Time:    time.Now(),
+			Kind:    req.Kind,
+			Host:    req.Host,
+			Scopes:  req.Scope,
+			Caller:  tokenCaller(ctx),
+			Granted: err == nil,
+			Cached:  cached,
+		}
+		if err != nil {
+			rec.Error = status.Convert(err).Message()
+		} else {
+			rec.GrantedScopes = sortedScopes(tkn.Scope)
+		}
+		s.audit.AuditToken(rec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return asGetTokenResponse(tkn), nil
+}
+
+func (s *InMemoryTokenService) getToken(ctx context.Context, req *api.GetTokenRequest) (tkn *Token, cached bool, err error) {
 	// filter empty scopes, when no scopes are requested, i.e. empty list [] we return an arbitrary/max scoped token, see Token.HasScopes
 	var scopes []string
 	for _, scope := range req.Scope {
@@ -311,9 +482,11 @@ func (s *InMemoryTokenService) GetToken(ctx context.Context, req *api.GetTokenRe
 	}
 	req.Scope = scopes
 
-	tkn := s.getCachedTokenFor(req.Kind, req.Host, req.Scope)
+	s.evictExpiredTokens(time.Now())
+
+	tkn = s.getCachedTokenFor(req.Kind, req.Host, req.Scope)
 	if tkn != nil {
-		return asGetTokenResponse(tkn), nil
+		return tkn, true, nil
 	}
 
 	s.mu.RLock()
@@ -331,10 +504,10 @@ func (s *InMemoryTokenService) GetToken(ctx context.Context, req *api.GetTokenRe
 		}
 
 		s.cacheToken(req.Kind, tkn)
-		return asGetTokenResponse(tkn), nil
+		return tkn, false, nil
 	}
 
-	return nil, status.Error(codes.NotFound, "no token available")
+	return nil, false, status.Error(codes.NotFound, "no token available")
 }
 
 func asGetTokenResponse(tkn *Token) *api.GetTokenResponse {
@@ -370,6 +543,37 @@ func (s *InMemoryTokenService) cacheToken(kind string, tkn *Token) {
 	log.WithField("kind", kind).WithField("host", tkn.Host).WithField("scopes", tkn.Scope).WithField("reuse", tkn.Reuse.String()).Info("registered new token")
 }
 
+// SweepExpiredTokens periodically removes expired tokens from the cache until the context is canceled
+func (s *InMemoryTokenService) SweepExpiredTokens(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.evictExpiredTokens(time.Now())
+		}
+	}
+}
+
+func (s *InMemoryTokenService) evictExpiredTokens(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for kind, tkns := range s.token {
+		var valid []*Token
+		for _, tkn := range tkns {
+			if tkn.Expired(now) {
+				log.WithField("kind", kind).WithField("host", tkn.Host).WithField("scopes", tkn.Scope).Info("evicted expired token")
+				continue
+			}
+			valid = append(valid, tkn)
+		}
+		s.token[kind] = valid
+	}
+}
+
 func convertReceivedToken(req *api.SetTokenRequest) (tkn *Token, err error) {
 	if req.Token == "" {
 		return nil, status.Error(codes.InvalidArgument, "token is required")
@@ -429,23 +633,10 @@ func (s *InMemoryTokenService) ClearToken(ctx context.Context, req *api.ClearTok
 		return &api.ClearTokenResponse{}, nil
 	}
 	if tkn := req.GetValue(); tkn != "" {
-		s.mu.Lock()
-		defer s.mu.Unlock()
-
-		var found bool
-		token := s.token[req.Kind]
-		for i, t := range token {
-			if t.Token != tkn {
-				continue
-			}
-
-			found = true
-			token = append(token[:i], token[i+1:]...)
-			log.WithField("kind", req.Kind).WithField("host", t.Host).WithField("scopes", t.Scope).Info("cleared token")
-			break
-		}
-		s.token[req.Kind] = token
-		if !found {
+		found := s.clearTokens(req.Kind, "cleared token", func(t *Token) bool {
+			return t.Token == tkn
+		})
+		if found == 0 {
 			return nil, status.Error(codes.NotFound, "token not found")
 		}
 
@@ -455,6 +646,54 @@ func (s *InMemoryTokenService) ClearToken(ctx context.Context, req *api.ClearTok
 	return nil, status.Error(codes.Unknown, "unknown operation")
 }
 
+// RevokeToken removes cached tokens for a host, optionally limited to tokens granting the requested scopes
+func (s *InMemoryTokenService) RevokeToken(ctx context.Context, req *api.RevokeTokenRequest) (*api.RevokeTokenResponse, error) {
+	if req.Host == "" {
+		return nil, status.Error(codes.InvalidArgument, "host is required")
+	}
+	if !s.knownKind(req.Kind) {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown token kind %q", req.Kind)
+	}
+
+	s.clearTokens(req.Kind, "revoked token", func(t *Token) bool {
+		return t.Host == req.Host && t.HasScopes(req.Scope)
+	})
+
+	return &api.RevokeTokenResponse{}, nil
+}
+
+// clearTokens removes the cached tokens of a kind which match and returns how many it removed
+func (s *InMemoryTokenService) clearTokens(kind string, msg string, match func(t *Token) bool) (cleared int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var token []*Token
+	for _, t := range s.token[kind] {
+		if !match(t) {
+			token = append(token, t)
+			continue
+		}
+
+		cleared++
+		log.WithField("kind", kind).WithField("host", t.Host).WithField("scopes", t.Scope).Info(msg)
+	}
+	s.token[kind] = token
+	return cleared
+}
+
+// knownKind returns true if kind is one of the kinds supervisor provides, or tokens or providers of that kind were registered
+func (s *InMemoryTokenService) knownKind(kind string) bool {
+	if kind == KindGit || kind == KindGitpod {
+		return true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, hasTokens := s.token[kind]
+	_, hasProviders := s.provider[kind]
+	return hasTokens || hasProviders
+}
+
 // ProvideToken registers a token provider
 func (s *InMemoryTokenService) ProvideToken(srv api.TokenService_ProvideTokenServer) error {
 	req, err := srv.Recv()
@@ -625,6 +864,8 @@ func (is *InfoService) WorkspaceInfo(context.Context, *api.WorkspaceInfoRequest)
 // ControlService implements the supervisor control service
 type ControlService struct {
 	portsManager *ports.Manager
+	ideRestarts  *ideRestarter
+	ideSuspend   *ideSuspender
 }
 
 // RegisterGRPC registers the gRPC info service
@@ -632,10 +873,110 @@ func (c *ControlService) RegisterGRPC(srv *grpc.Server) {
 	api.RegisterControlServiceServer(srv, c)
 }
 
+// RegisterREST registers the REST control service
+func (c *ControlService) RegisterREST(mux *runtime.ServeMux, grpcEndpoint string) error {
+	return api.RegisterControlServiceHandlerFromEndpoint(context.Background(), mux, grpcEndpoint, []grpc.DialOption{grpc.WithInsecure()})
+}
+
 // ExposePort exposes a port
 func (c *ControlService) ExposePort(ctx context.Context, req *api.ExposePortRequest) (*api.ExposePortResponse, error) {
-	err := c.portsManager.Expose(ctx, req.Port, req.TargetPort)
-	return &api.ExposePortResponse{}, err
+	err := c.portsManager.Expose(ctx, req.Port, req.TargetPort, req.Visibility == api.PortVisibility_public)
+	if err != nil {
+		return nil, portsError(err)
+	}
+	return &api.ExposePortResponse{}, nil
+}
+
+// UnexposePort stops exposing a port
+func (c *ControlService) UnexposePort(ctx context.Context, req *api.UnexposePortRequest) (*api.UnexposePortResponse, error) {
+	err := c.portsManager.Unexpose(ctx, req.Port)
+	if err != nil {
+		return nil, portsError(err)
+	}
+	return &api.UnexposePortResponse{}, nil
+}
+
+// ChangePortVisibility makes a port public or private
+func (c *ControlService) ChangePortVisibility(ctx context.Context, req *api.ChangePortVisibilityRequest) (*api.ChangePortVisibilityResponse, error) {
+	err := c.portsManager.ChangeVisibility(ctx, req.Port, req.Visibility == api.PortVisibility_public)
+	if err != nil {
+		return nil, portsError(err)
+	}
+	return &api.ChangePortVisibilityResponse{}, nil
+}
+
+// ListExposedPorts lists the currently exposed ports
+func (c *ControlService) ListExposedPorts(ctx context.Context, req *api.ListExposedPortsRequest) (*api.ListExposedPortsResponse, error) {
+	return &api.ListExposedPortsResponse{Ports: c.portsManager.Exposed()}, nil
+}
+
+// ideRestartTimeout is the time RestartIDE waits for the IDE to stop and become ready again
+const ideRestartTimeout = 5 * time.Minute
+
+// RestartIDE restarts the IDE and waits until it is ready again
+func (c *ControlService) RestartIDE(ctx context.Context, req *api.RestartIDERequest) (*api.RestartIDEResponse, error) {
+	if c.ideRestarts == nil {
+		return nil, status.Error(codes.FailedPrecondition, errIDERestartUnavailable.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ideRestartTimeout)
+	defer cancel()
+	err := c.ideRestarts.Restart(ctx)
+	switch err {
+	case nil:
+		return &api.RestartIDEResponse{}, nil
+	case errIDERestartUnavailable:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case errIDERestartInProgress:
+		return nil, status.Error(codes.Aborted, err.Error())
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, status.FromContextError(err).Err()
+	default:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+}
+
+// SuspendIDE stops the IDE's processes until it is resumed
+func (c *ControlService) SuspendIDE(ctx context.Context, req *api.SuspendIDERequest) (*api.SuspendIDEResponse, error) {
+	if c.ideSuspend == nil {
+		return nil, status.Error(codes.FailedPrecondition, errIDENotRunning.Error())
+	}
+	err := c.ideSuspend.Suspend()
+	if err == errIDENotRunning {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &api.SuspendIDEResponse{}, nil
+}
+
+// ResumeIDE continues the IDE's processes if they were suspended
+func (c *ControlService) ResumeIDE(ctx context.Context, req *api.ResumeIDERequest) (*api.ResumeIDEResponse, error) {
+	if c.ideSuspend == nil {
+		return &api.ResumeIDEResponse{}, nil
+	}
+	err := c.ideSuspend.Resume()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &api.ResumeIDEResponse{}, nil
+}
+
+// portsError translates errors of the ports manager to gRPC status errors
+func portsError(err error) error {
+	switch err {
+	case ports.ErrPortNotServed:
+		return status.Error(codes.FailedPrecondition, "port is not served yet - start serving the port before exposing it")
+	case ports.ErrPortNotExposed:
+		return status.Error(codes.NotFound, err.Error())
+	case ports.ErrInternalPort:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case context.Canceled, context.DeadlineExceeded:
+		return status.FromContextError(err).Err()
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
 }
 
 // ContentState signals the workspace content state
@@ -643,13 +984,25 @@ type ContentState interface {
 	MarkContentReady(src csapi.WorkspaceInitSource)
 	ContentReady() <-chan struct{}
 	ContentSource() (src csapi.WorkspaceInitSource, ok bool)
+
+	MarkContentProgress(phase initializer.InitializePhase, percent int)
+	ContentProgress() (progress ContentProgress, changed <-chan struct{})
+}
+
+// ContentProgress describes the progress of the workspace content initialization
+type ContentProgress struct {
+	Phase initializer.InitializePhase
+	// Percent is the progress of the phase in the range of 0-100, or -1 if unknown
+	Percent int
 }
 
 // NewInMemoryContentState creates a new InMemoryContentState
 func NewInMemoryContentState(checkoutLocation string) *InMemoryContentState {
 	return &InMemoryContentState{
-		checkoutLocation: checkoutLocation,
-		contentReadyChan: make(chan struct{}),
+		checkoutLocation:    checkoutLocation,
+		contentReadyChan:    make(chan struct{}),
+		contentProgress:     ContentProgress{Percent: -1},
+		contentProgressChan: make(chan struct{}),
 	}
 }
 
@@ -659,6 +1012,10 @@ type InMemoryContentState struct {
 
 	contentReadyChan chan struct{}
 	contentSource    csapi.WorkspaceInitSource
+
+	mu                  sync.RWMutex
+	contentProgress     ContentProgress
+	contentProgressChan chan struct{}
 }
 
 // MarkContentReady marks the workspace content as available.
@@ -683,3 +1040,26 @@ func (state *InMemoryContentState) ContentSource() (src csapi.WorkspaceInitSourc
 	}
 	return state.contentSource, true
 }
+
+// MarkContentProgress updates the progress of the workspace content initialization
+func (state *InMemoryContentState) MarkContentProgress(phase initializer.InitializePhase, percent int) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	progress := ContentProgress{Phase: phase, Percent: percent}
+	if state.contentProgress == progress {
+		return
+	}
+	state.contentProgress = progress
+	close(state.contentProgressChan)
+	state.contentProgressChan = make(chan struct{})
+}
+
+// ContentProgress returns the current progress of the workspace content initialization
+// and a chan that closes when the progress changes.
+func (state *InMemoryContentState) ContentProgress() (progress ContentProgress, changed <-chan struct{}) {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	return state.contentProgress, state.contentProgressChan
+}
@@ -12,10 +12,15 @@ import (
 	"github.com/golang/protobuf/ptypes"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
 
+	csapi "github.com/gitpod-io/gitpod/content-service/api"
+	"github.com/gitpod-io/gitpod/content-service/pkg/initializer"
 	"github.com/gitpod-io/gitpod/supervisor/api"
+	"github.com/gitpod-io/gitpod/supervisor/pkg/ports"
 )
 
 func TestInMemoryTokenServiceGetToken(t *testing.T) {
@@ -384,3 +389,362 @@ type tokenProviderFunc func(ctx context.Context, req *api.GetTokenRequest) (tkn
 func (f tokenProviderFunc) GetToken(ctx context.Context, req *api.GetTokenRequest) (tkn *Token, err error) {
 	return f(ctx, req)
 }
+
+func TestInMemoryTokenServiceRevokeToken(t *testing.T) {
+	var (
+		kind = "myprovider"
+		host = "gitpod.io"
+	)
+	tests := []struct {
+		Desc          string
+		Req           *api.RevokeTokenRequest
+		Expectation   []string
+		ExpectErr     codes.Code
+		ProviderCalls int
+	}{
+		{
+			Desc:          "all tokens of host",
+			Req:           &api.RevokeTokenRequest{Kind: kind, Host: host},
+			Expectation:   []string{"other-host"},
+			ProviderCalls: 1,
+		},
+		{
+			Desc:        "by scope",
+			Req:         &api.RevokeTokenRequest{Kind: kind, Host: host, Scope: []string{"write"}},
+			Expectation: []string{"read", "other-host"},
+		},
+		{
+			Desc:        "no match",
+			Req:         &api.RevokeTokenRequest{Kind: kind, Host: "unknown.io"},
+			Expectation: []string{"read", "read-write", "other-host"},
+		},
+		{
+			Desc:        "unknown kind",
+			Req:         &api.RevokeTokenRequest{Kind: "unknown", Host: host},
+			Expectation: []string{"read", "read-write", "other-host"},
+			ExpectErr:   codes.InvalidArgument,
+		},
+		{
+			Desc:        "no host",
+			Req:         &api.RevokeTokenRequest{Kind: kind},
+			Expectation: []string{"read", "read-write", "other-host"},
+			ExpectErr:   codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var providerCalls int
+			service := NewInMemoryTokenService()
+			service.provider[kind] = []tokenProvider{tokenProviderFunc(func(ctx context.Context, req *api.GetTokenRequest) (tkn *Token, err error) {
+				providerCalls++
+				return &Token{Host: req.Host, Token: "provided", Scope: mapScopes(req.Scope)}, nil
+			})}
+			service.token[kind] = []*Token{
+				{Host: host, Token: "read", Scope: mapScopes([]string{"read"}), Reuse: api.TokenReuse_REUSE_WHEN_POSSIBLE},
+				{Host: host, Token: "read-write", Scope: mapScopes([]string{"read", "write"}), Reuse: api.TokenReuse_REUSE_WHEN_POSSIBLE},
+				{Host: "other." + host, Token: "other-host", Reuse: api.TokenReuse_REUSE_WHEN_POSSIBLE},
+			}
+
+			_, err := service.RevokeToken(context.Background(), test.Req)
+			if code := status.Code(err); code != test.ExpectErr {
+				t.Fatalf("unexpected status code: expected %v, got %v (%v)", test.ExpectErr, code, err)
+			}
+
+			var act []string
+			for _, tkn := range service.token[kind] {
+				act = append(act, tkn.Token)
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected tokens (-want +got):\n%s", diff)
+			}
+
+			_, err = service.GetToken(context.Background(), &api.GetTokenRequest{Kind: kind, Host: host, Scope: []string{"read"}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if providerCalls != test.ProviderCalls {
+				t.Errorf("unexpected provider calls: expected %d, got %d", test.ProviderCalls, providerCalls)
+			}
+		})
+	}
+}
+
+func TestInMemoryTokenServiceClearToken(t *testing.T) {
+	kind := "myprovider"
+	tests := []struct {
+		Desc        string
+		Req         *api.ClearTokenRequest
+		Expectation []string
+		ExpectErr   codes.Code
+	}{
+		{
+			Desc:        "by value",
+			Req:         &api.ClearTokenRequest{Kind: kind, Token: &api.ClearTokenRequest_Value{Value: "read"}},
+			Expectation: []string{"read-write"},
+		},
+		{
+			Desc: "all",
+			Req:  &api.ClearTokenRequest{Kind: kind, Token: &api.ClearTokenRequest_All{All: true}},
+		},
+		{
+			Desc:        "unknown value",
+			Req:         &api.ClearTokenRequest{Kind: kind, Token: &api.ClearTokenRequest_Value{Value: "unknown"}},
+			Expectation: []string{"read", "read-write"},
+			ExpectErr:   codes.NotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			service := NewInMemoryTokenService()
+			service.token[kind] = []*Token{
+				{Host: "gitpod.io", Token: "read", Scope: mapScopes([]string{"read"})},
+				{Host: "gitpod.io", Token: "read-write", Scope: mapScopes([]string{"read", "write"})},
+			}
+
+			_, err := service.ClearToken(context.Background(), test.Req)
+			if code := status.Code(err); code != test.ExpectErr {
+				t.Fatalf("unexpected status code: expected %v, got %v (%v)", test.ExpectErr, code, err)
+			}
+
+			var act []string
+			for _, tkn := range service.token[kind] {
+				act = append(act, tkn.Token)
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected tokens (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestInMemoryTokenServiceSweepExpiredTokens(t *testing.T) {
+	var (
+		expired = time.Now().Add(-1 * time.Minute)
+		valid   = time.Now().Add(1 * time.Hour)
+	)
+	service := NewInMemoryTokenService()
+	service.token["myprovider"] = []*Token{
+		{Host: "expired.gitpod.io", Token: "expired", ExpiryDate: &expired},
+		{Host: "valid.gitpod.io", Token: "valid", ExpiryDate: &valid},
+		{Host: "noexpiry.gitpod.io", Token: "noexpiry"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		service.SweepExpiredTokens(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	var act []string
+	for _, tkn := range service.token["myprovider"] {
+		act = append(act, tkn.Token)
+	}
+	if diff := cmp.Diff([]string{"valid", "noexpiry"}, act); diff != "" {
+		t.Errorf("unexpected tokens (-want +got):\n%s", diff)
+	}
+}
+
+func TestStatusServiceContentProgress(t *testing.T) {
+	cs := NewInMemoryContentState("")
+	steps := []func(){
+		func() { cs.MarkContentProgress(initializer.InitializePhaseDownloading, 50) },
+		func() {
+			// duplicate updates must not produce another response
+			cs.MarkContentProgress(initializer.InitializePhaseDownloading, 50)
+			cs.MarkContentProgress(initializer.InitializePhaseInitializing, -1)
+		},
+		func() { cs.MarkContentReady(csapi.WorkspaceInitFromOther) },
+	}
+
+	srv := &testContentProgressServer{ctx: context.Background()}
+	srv.onSend = func() {
+		if len(steps) == 0 {
+			return
+		}
+		steps[0]()
+		steps = steps[1:]
+	}
+
+	err := (&statusService{ContentState: cs}).ContentProgress(&api.ContentProgressRequest{}, srv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectation := []*api.ContentProgressResponse{
+		{Percent: -1},
+		{Phase: "downloading", Percent: 50},
+		{Phase: "initializing", Percent: -1},
+		{Phase: "initializing", Percent: -1, Available: true},
+	}
+	if diff := cmp.Diff(expectation, srv.updates, protocmp.Transform()); diff != "" {
+		t.Errorf("unexpected updates (-want +got):\n%s", diff)
+	}
+}
+
+type testContentProgressServer struct {
+	grpc.ServerStream
+
+	ctx     context.Context
+	onSend  func()
+	updates []*api.ContentProgressResponse
+}
+
+func (srv *testContentProgressServer) Context() context.Context {
+	return srv.ctx
+}
+
+func (srv *testContentProgressServer) Send(resp *api.ContentProgressResponse) error {
+	srv.updates = append(srv.updates, resp)
+	srv.onSend()
+	return nil
+}
+
+func TestStatusServicePhaseEvents(t *testing.T) {
+	phases := newPhaseLog()
+	// the subscriber is late and must receive the phases which already happened
+	phases.Record(api.SupervisorPhase_phase_config_loaded)
+	phases.Record(api.SupervisorPhase_phase_content_init_started)
+
+	steps := []func(){
+		nil,
+		func() {
+			phases.Record(api.SupervisorPhase_phase_content_ready)
+			phases.Record(api.SupervisorPhase_phase_ide_launching)
+		},
+		nil,
+		func() {
+			// phases are recorded once only, e.g. when the IDE restarts
+			phases.Record(api.SupervisorPhase_phase_ide_launching)
+			phases.Record(api.SupervisorPhase_phase_tasks_started)
+		},
+		func() { phases.Record(api.SupervisorPhase_phase_ide_ready) },
+	}
+
+	srv := &testPhaseEventsServer{ctx: context.Background()}
+	srv.onSend = func() {
+		if len(steps) == 0 {
+			return
+		}
+		if steps[0] != nil {
+			steps[0]()
+		}
+		steps = steps[1:]
+	}
+
+	err := (&statusService{phases: phases}).PhaseEvents(&api.PhaseEventsRequest{}, srv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var act []api.SupervisorPhase
+	for i, evt := range srv.events {
+		act = append(act, evt.Phase)
+		if i > 0 && evt.Time.AsTime().Before(srv.events[i-1].Time.AsTime()) {
+			t.Errorf("phase %s happened before the previous one", evt.Phase)
+		}
+	}
+	expectation := []api.SupervisorPhase{
+		api.SupervisorPhase_phase_config_loaded,
+		api.SupervisorPhase_phase_content_init_started,
+		api.SupervisorPhase_phase_content_ready,
+		api.SupervisorPhase_phase_ide_launching,
+		api.SupervisorPhase_phase_tasks_started,
+		api.SupervisorPhase_phase_ide_ready,
+	}
+	if diff := cmp.Diff(expectation, act); diff != "" {
+		t.Errorf("unexpected phases (-want +got):\n%s", diff)
+	}
+}
+
+type testPhaseEventsServer struct {
+	grpc.ServerStream
+
+	ctx    context.Context
+	onSend func()
+	events []*api.PhaseEventsResponse
+}
+
+func (srv *testPhaseEventsServer) Context() context.Context {
+	return srv.ctx
+}
+
+func (srv *testPhaseEventsServer) Send(resp *api.PhaseEventsResponse) error {
+	srv.events = append(srv.events, resp)
+	srv.onSend()
+	return nil
+}
+
+func TestStatusServicePortsExposureDisabled(t *testing.T) {
+	cfg := &Config{}
+	pm := ports.NewManager(createExposedPortsImpl(cfg, nil), nil, nil)
+	svc := &statusService{Ports: pm}
+
+	exposureDisabled := func() bool {
+		srv := &testPortsStatusServer{ctx: context.Background()}
+		err := svc.PortsStatus(&api.PortsStatusRequest{}, srv)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(srv.updates) != 1 {
+			t.Fatalf("unexpected number of updates: expected 1, got %d", len(srv.updates))
+		}
+		return srv.updates[0].ExposureDisabled
+	}
+
+	if !exposureDisabled() {
+		t.Errorf("exposure should be disabled with the noop implementation")
+	}
+
+	pm.SetExposedPorts(createExposedPortsImpl(cfg, &fakeGitpodAPI{}))
+	if exposureDisabled() {
+		t.Errorf("exposure should be enabled once connected to the Gitpod server")
+	}
+}
+
+type testPortsStatusServer struct {
+	grpc.ServerStream
+
+	ctx     context.Context
+	updates []*api.PortsStatusResponse
+}
+
+func (srv *testPortsStatusServer) Context() context.Context {
+	return srv.ctx
+}
+
+func (srv *testPortsStatusServer) Send(resp *api.PortsStatusResponse) error {
+	srv.updates = append(srv.updates, resp)
+	return nil
+}
+
+func TestControlServicePortErrors(t *testing.T) {
+	pm := ports.NewManager(&ports.NoopExposedPorts{}, nil, nil)
+	svc := &ControlService{portsManager: pm}
+	ctx := context.Background()
+
+	_, err := svc.ExposePort(ctx, &api.ExposePortRequest{Port: 8080})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("unexpected status code exposing a port which is not served: expected %v, got %v (%v)", codes.FailedPrecondition, code, err)
+	}
+	_, err = svc.ChangePortVisibility(ctx, &api.ChangePortVisibilityRequest{Port: 8080, Visibility: api.PortVisibility_public})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("unexpected status code changing the visibility of a port which is not served: expected %v, got %v (%v)", codes.FailedPrecondition, code, err)
+	}
+	_, err = svc.UnexposePort(ctx, &api.UnexposePortRequest{Port: 8080})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("unexpected status code unexposing a port which is not exposed: expected %v, got %v (%v)", codes.NotFound, code, err)
+	}
+	resp, err := svc.ListExposedPorts(ctx, &api.ListExposedPortsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Ports) != 0 {
+		t.Errorf("unexpected exposed ports: %v", resp.Ports)
+	}
+}
@@ -5,26 +5,38 @@
 package supervisor
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	grpcruntime "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/procfs"
+	"github.com/sirupsen/logrus"
 	"github.com/soheilhy/cmux"
 	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 
 	"github.com/gitpod-io/gitpod/common-go/log"
 	"github.com/gitpod-io/gitpod/common-go/pprof"
@@ -58,8 +70,9 @@ func AddAPIEndpointOpts(opts ...grpc.ServerOption) {
 }
 
 type runOptions struct {
-	Args        []string
-	InNamespace bool
+	Args           []string
+	InNamespace    bool
+	TokenAuditSink TokenAuditSink
 }
 
 // RunOption customizes the run behaviour
@@ -81,8 +94,34 @@ func InNamespace() RunOption {
 
 // The sum of those timeBudget* times has to fit within the terminationGracePeriod of the workspace pod.
 const (
-	timeBudgetIDEShutdown    = 5 * time.Second
-	timeBudgetDaemonTeardown = 10 * time.Second
+	defaultTimeBudgetIDEShutdown       = 5 * time.Second
+	defaultTimeBudgetChildProcessGrace = 5 * time.Second
+	timeBudgetServiceShutdown          = 3 * time.Second
+	timeBudgetDaemonTeardown           = 10 * time.Second
+
+	// timeBudgetNamespaceDaemonTeardown is the time budget of the best-effort daemon teardown in a namespace.
+	// It's well below timeBudgetDaemonTeardown, because the daemon is usually not available there.
+	timeBudgetNamespaceDaemonTeardown = 2 * time.Second
+
+	// namespaceDaemonPollInterval is the time between two checks if the daemon socket exists in a namespace
+	namespaceDaemonPollInterval = 100 * time.Millisecond
+
+	// childProcessPollInterval is the time between two checks if child processes have exited during shutdown
+	childProcessPollInterval = 100 * time.Millisecond
+
+	// childProcessSignalConcurrency is the number of child processes we signal concurrently during shutdown
+	childProcessSignalConcurrency = 8
+
+	// terminationGracePeriod is the time Kubernetes gives the workspace pod to shut down
+	terminationGracePeriod = 30 * time.Second
+
+	// metadataAccessRetryInterval is the time between two consecutive metadata access checks
+	metadataAccessRetryInterval = 5 * time.Second
+
+	// gitpodServiceReconnectBackoff is the time we wait before reconnecting to the Gitpod API if that
+	// failed at startup. It doubles with every attempt up to gitpodServiceMaxReconnectBackoff.
+	gitpodServiceReconnectBackoff    = 2 * time.Second
+	gitpodServiceMaxReconnectBackoff = 1 * time.Minute
 )
 
 const (
@@ -112,11 +151,30 @@ func Run(options ...RunOption) {
 		fmt.Println("supervisor makes sure your workspace/IDE keeps running smoothly.\nYou don't have to call this thing, Gitpod calls it for you.")
 		return
 	}
+	phases := newPhaseLog()
+	phases.Record(api.SupervisorPhase_phase_config_loaded)
+	checkShutdownBudget(cfg)
+	daemonOpts, err := cfg.inWorkspaceDaemonOptions()
+	if err != nil {
+		log.WithError(err).Fatal("cannot configure in-workspace daemon connection")
+	}
+
+	log.Log.Logger.SetFormatter(logFormatter(cfg.LogFormat, log.Log.Logger.Formatter))
+	if lrr := cfg.SupervisorLogRateLimit; lrr > 0 {
+		limit := int64(lrr)
+		log.Log.Logger.SetFormatter(dropwriter.Formatter(log.Log.Logger.Formatter, dropwriter.NewBucket(limit*1024*3, limit*1024)))
+		log.WithField("limit_kb_per_sec", limit).Info("rate limiting supervisor log output")
+	}
 
 	buildIDEEnv(&Config{})
-	configureGit(cfg)
+	configureGit(cfg, nil)
 
 	tokenService := NewInMemoryTokenService()
+	tokenService.audit, err = cfg.tokenAuditSink(opts.TokenAuditSink)
+	if err != nil {
+		log.WithError(err).Warn("cannot set up token auditing - auditing to supervisor's log instead")
+		tokenService.audit = logTokenAuditSink{}
+	}
 	tkns, err := cfg.GetTokens(true)
 	if err != nil {
 		log.WithError(err).Warn("cannot prepare tokens")
@@ -128,6 +186,8 @@ func Run(options ...RunOption) {
 		}
 	}
 
+	liveCfg := newLiveConfig(cfg)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	var (
 		shutdown            = make(chan struct{})
@@ -135,24 +195,41 @@ func Run(options ...RunOption) {
 		cstate              = NewInMemoryContentState(cfg.RepoRoot)
 		gitpodService       = createGitpodService(cfg, tokenService)
 		gitpodConfigService = gitpod.NewConfigService(cfg.RepoRoot+"/.gitpod.yml", cstate.ContentReady(), log.Log)
+		portsConfigService  = ports.NewConfigService(cfg.WorkspaceID, gitpodConfigService, gitpodService)
 		portMgmt            = ports.NewManager(
 			createExposedPortsImpl(cfg, gitpodService),
-			&ports.PollingServedPortsObserver{
-				RefreshInterval: 2 * time.Second,
-			},
-			ports.NewConfigService(cfg.WorkspaceID, gitpodConfigService, gitpodService),
+			cfg.ServedPortsObserver(),
+			portsConfigService,
 			uint32(cfg.IDEPort),
 			uint32(cfg.APIEndpointPort),
 		)
-		termMux     = terminal.NewMux()
-		termMuxSrv  = terminal.NewMuxTerminalService(termMux)
-		taskManager = newTasksManager(cfg, termMuxSrv, cstate, &loggingHeadlessTaskProgressReporter{})
+		termMux             = terminal.NewMux()
+		termMuxSrv          = terminal.NewMuxTerminalService(termMux)
+		notificationService = NewNotificationService()
+		taskManager         = newTasksManager(cfg, termMuxSrv, cstate, &loggingHeadlessTaskProgressReporter{}, notificationService)
+	)
+	reapEvents := &reapEventLog{}
+	ideExits := &ideExitLog{}
+	ideUsage := newIDEUsageSampler()
+	ideRestarts := newIDERestarter(ideReady)
+	ideSuspend := newIDESuspender()
+
+	metricsRegistry := prometheus.NewRegistry()
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
 	)
-	notificationService := NewNotificationService()
-	tokenService.provider[KindGit] = []tokenProvider{NewGitTokenProvider(gitpodService, cfg.WorkspaceConfig, notificationService)}
+	supervisorMetrics, err := newMetrics(prometheus.WrapRegistererWithPrefix("gitpod_supervisor_", metricsRegistry), termMux, portMgmt)
+	if err != nil {
+		log.WithError(err).Fatal("cannot register metrics")
+	}
+	gitTokenProvider := NewGitTokenProvider(gitpodService, cfg.WorkspaceConfig, notificationService)
+	tokenService.provider[KindGit] = []tokenProvider{gitTokenProvider}
 
+	termMux.IdleTimeout = time.Duration(cfg.TerminalIdleTimeout)
 	termMuxSrv.DefaultWorkdir = cfg.RepoRoot
 	termMuxSrv.Env = buildIDEEnv(cfg)
+	termMuxSrv.DefaultBacklogSize = int64(cfg.TerminalBacklogSize)
 
 	apiServices := []RegisterableService{
 		&statusService{
@@ -160,12 +237,17 @@ func Run(options ...RunOption) {
 			Ports:        portMgmt,
 			Tasks:        taskManager,
 			ideReady:     ideReady,
+			reapEvents:   reapEvents,
+			ideUsage:     ideUsage,
+			ideSuspend:   ideSuspend,
+			ideExits:     ideExits,
+			phases:       phases,
 		},
 		termMuxSrv,
 		RegistrableTokenService{tokenService},
 		notificationService,
 		&InfoService{cfg: cfg, ContentState: cstate},
-		&ControlService{portsManager: portMgmt},
+		&ControlService{portsManager: portMgmt, ideRestarts: ideRestarts, ideSuspend: ideSuspend},
 	}
 	apiServices = append(apiServices, additionalServices...)
 
@@ -177,26 +259,50 @@ func Run(options ...RunOption) {
 	// We keep the reaper until the bitter end because:
 	//   - it doesn't need graceful shutdown
 	//   - we want to do as much work as possible (SIGTERM'ing reparented processes during shutdown).
-	go reaper(terminatingReaper)
+	go reaper(context.Background(), terminatingReaper, cfg.ReaperSignalBufferSize(), supervisorMetrics, reapEvents)
+
+	go tokenService.SweepExpiredTokens(ctx, cfg.TokenSweepPeriod())
+	go configureGitFromGitpodConfig(ctx, cfg, gitpodConfigService)
+	go ideUsage.Run(ctx)
 
 	var ideWG sync.WaitGroup
 	ideWG.Add(1)
-	go startAndWatchIDE(ctx, cfg, &ideWG, ideReady)
+	go startAndWatchIDE(ctx, liveCfg, &ideWG, cstate, ideReady, phases, ideExits, ideUsage, ideRestarts, ideSuspend, notificationService, supervisorMetrics)
 
 	var wg sync.WaitGroup
 	wg.Add(4)
-	go startContentInit(ctx, cfg, &wg, cstate)
-	go startAPIEndpoint(ctx, cfg, &wg, apiServices, apiEndpointOpts...)
+	go startContentInit(ctx, cfg, &wg, cstate, phases, supervisorMetrics)
+	// any call to the API, e.g. from a terminal or the IDE frontend, resumes a suspended IDE
+	endpointOpts := append([]grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(ideSuspend.UnaryServerInterceptor),
+		grpc.ChainStreamInterceptor(ideSuspend.StreamServerInterceptor),
+	}, apiEndpointOpts...)
+	debugState := debugStateHandler(debugStateTimeout, supervisorDebugProbes(ideReady, ideSuspend, ideExits, termMux, portMgmt, cstate)...)
+	go startAPIEndpoint(ctx, cfg, &wg, apiServices, ideReady, debugState, metricsRegistry, supervisorMetrics, endpointOpts...)
 	go taskManager.Run(ctx, &wg)
+	go func() {
+		select {
+		case <-taskManager.ready:
+			phases.Record(api.SupervisorPhase_phase_tasks_started)
+		case <-ctx.Done():
+		}
+	}()
 
 	if !cfg.isHeadless() {
 		wg.Add(1)
 		go portMgmt.Run(ctx, &wg)
+
+		if _, _, err := cfg.GitpodAPIEndpoint(); gitpodService == nil && err == nil {
+			connect := func() gitpod.APIInterface { return createGitpodService(cfg, tokenService) }
+			go reconnectGitpodService(ctx, connect, gitpodServiceReconnectBackoff, useGitpodService(cfg, portMgmt, portsConfigService, gitTokenProvider))
+		}
 	}
 
 	if cfg.PreventMetadataAccess {
 		go func() {
-			if !hasMetadataAccess() {
+			providers := cfg.MetadataAccessProviders()
+			check := func() bool { return hasMetadataAccess(providers) }
+			if !confirmMetadataAccess(ctx, check, cfg.MetadataAccessConfirmationCount(), metadataAccessRetryInterval) {
 				return
 			}
 
@@ -207,9 +313,18 @@ func Run(options ...RunOption) {
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	select {
-	case <-sigChan:
-	case <-shutdown:
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+waitForShutdown:
+	for {
+		select {
+		case <-reloadChan:
+			reloadConfig(liveCfg, GetConfig)
+		case <-sigChan:
+			break waitForShutdown
+		case <-shutdown:
+			break waitForShutdown
+		}
 	}
 
 	log.Info("received SIGTERM - tearing down")
@@ -222,30 +337,85 @@ func Run(options ...RunOption) {
 
 	// terminate all child processes once the IDE is gone
 	ideWG.Wait()
-	terminateChildProcesses()
+	terminateChildProcesses(childProcessGraceWindow(cfg))
+	shutdownServices(apiServices, timeBudgetServiceShutdown)
 
-	if !opts.InNamespace {
-		callDaemonTeardown()
-	}
+	teardownDaemon(opts.InNamespace, cfg.InWorkspaceDaemon.TeardownInNamespace, daemonOpts)
 
 	wg.Wait()
 }
 
-func createGitpodService(cfg *Config, tknsrv api.TokenServiceServer) *gitpod.APIoverJSONRPC {
+// reloadConfig re-reads the supervisor config using load and applies the changes which do not require a restart.
+// Log rate limits and readiness probe changes take effect the next time the IDE is started. The global Git settings
+// are configured once at startup and are not reconfigured, because that would override the changes the user and
+// .gitpod.yml made in the meantime.
+func reloadConfig(liveCfg *liveConfig, load func() (*Config, error)) {
+	log.Info("received SIGHUP - reloading configuration")
+
+	next, err := load()
+	if err != nil {
+		log.WithError(err).Error("cannot reload configuration - keeping the current one")
+		return
+	}
+	err = next.Validate()
+	if err != nil {
+		log.WithError(err).Error("reloaded configuration is invalid - keeping the current one")
+		return
+	}
+
+	cur := liveCfg.Get()
+	res, applied, ignored := applyLiveConfig(cur, next)
+	git, other := splitGitConfigFields(ignored)
+	if len(git) > 0 {
+		log.WithField("fields", git).Warn("ignoring Git configuration changes - Git is configured at startup only, hence they require a workspace restart")
+	}
+	if len(other) > 0 {
+		log.WithField("fields", other).Warn("ignoring configuration changes which require a supervisor restart")
+	}
+	if len(applied) == 0 {
+		log.Info("no applicable configuration changes")
+		return
+	}
+	liveCfg.Set(res)
+	log.WithField("fields", applied).Info("applied configuration changes")
+}
+
+// healthHandler serves a plain HTTP health check which responds with 200 if ok returns true, and with 503 otherwise
+func healthHandler(ok func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !ok() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"ok":false}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	})
+}
+
+// readyzHandler serves the readiness check of the workspace. Headless workspaces have no IDE to wait for
+// and are ready right away.
+func readyzHandler(cfg *Config, ideReady *ideReadyState) http.Handler {
+	return healthHandler(func() bool {
+		return cfg.isHeadless() || ideReady.Get()
+	})
+}
+
+// createGitpodService connects to the Gitpod API. If that's not possible it returns nil and supervisor
+// continues without the features which depend on the API, e.g. port exposure and Git token scopes.
+// The result is an interface so that callers can rely on nil checks.
+func createGitpodService(cfg *Config, tknsrv api.TokenServiceServer) gitpod.APIInterface {
 	endpoint, host, err := cfg.GitpodAPIEndpoint()
 	if err != nil {
-		log.WithError(err).Fatal("cannot find Gitpod API endpoint")
+		log.WithError(err).Error("cannot find Gitpod API endpoint")
 		return nil
 	}
+	scopes := cfg.GitpodAPITokenScopes()
+	log.WithField("scopes", scopes).Info("requesting Gitpod API token")
 	tknres, err := tknsrv.GetToken(context.Background(), &api.GetTokenRequest{
-		Kind: KindGitpod,
-		Host: host,
-		Scope: []string{
-			"function:getToken",
-			"function:openPort",
-			"function:getOpenPorts",
-			"function:guessGitTokenScopes",
-		},
+		Kind:  KindGitpod,
+		Host:  host,
+		Scope: scopes,
 	})
 	if err != nil {
 		log.WithError(err).Error("cannot get token for Gitpod API")
@@ -263,7 +433,61 @@ func createGitpodService(cfg *Config, tknsrv api.TokenServiceServer) *gitpod.API
 	return gitpodService
 }
 
-func createExposedPortsImpl(cfg *Config, gitpodService *gitpod.APIoverJSONRPC) ports.ExposedPortsInterface {
+// reconnectGitpodService tries to connect to the Gitpod API until it succeeds or ctx is canceled.
+// The time between two attempts starts at backoff and doubles up to gitpodServiceMaxReconnectBackoff.
+func reconnectGitpodService(ctx context.Context, connect func() gitpod.APIInterface, backoff time.Duration, onConnected func(gitpod.APIInterface)) {
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		gitpodService := connect()
+		if gitpodService != nil {
+			log.WithField("attempt", attempt).Info("connected to Gitpod API")
+			onConnected(gitpodService)
+			return
+		}
+
+		backoff *= 2
+		if backoff > gitpodServiceMaxReconnectBackoff {
+			backoff = gitpodServiceMaxReconnectBackoff
+		}
+		log.WithField("attempt", attempt).WithField("backoff", backoff.String()).Warn("cannot connect to Gitpod API - retrying")
+	}
+}
+
+// gitLFSSettings returns the global Git settings required for LFS, or nil if git lfs is not available
+func gitLFSSettings() [][]string {
+	out, err := exec.Command("git", "lfs", "version").CombinedOutput()
+	if err != nil {
+		log.WithError(err).WithField("out", string(out)).Warn("git lfs is not available - not configuring Git LFS")
+		return nil
+	}
+
+	return [][]string{
+		// same as `git lfs install --skip-repo`
+		{"filter.lfs.clean", "git-lfs clean -- %f"},
+		{"filter.lfs.smudge", "git-lfs smudge -- %f"},
+		{"filter.lfs.process", "git-lfs filter-process"},
+		{"filter.lfs.required", "true"},
+		// LFS endpoints authenticate using the credential helper configured above
+		{"lfs.cachecredentials", "true"},
+		{"lfs.concurrenttransfers", "8"},
+	}
+}
+
+// useGitpodService returns a function which makes everything that talks to the Gitpod API use a new connection
+func useGitpodService(cfg *Config, portMgmt *ports.Manager, portsConfig *ports.ConfigService, gitTokens *GitTokenProvider) func(gitpod.APIInterface) {
+	return func(service gitpod.APIInterface) {
+		portMgmt.SetExposedPorts(createExposedPortsImpl(cfg, service))
+		portsConfig.SetGitpodAPI(service)
+		gitTokens.SetGitpodAPI(service)
+	}
+}
+
+func createExposedPortsImpl(cfg *Config, gitpodService gitpod.APIInterface) ports.ExposedPortsInterface {
 	if gitpodService == nil {
 		log.Error("auto-port exposure won't work")
 		return &ports.NoopExposedPorts{}
@@ -271,7 +495,93 @@ func createExposedPortsImpl(cfg *Config, gitpodService *gitpod.APIoverJSONRPC) p
 	return ports.NewGitpodExposedPorts(cfg.WorkspaceID, cfg.WorkspaceInstanceID, gitpodService)
 }
 
-func configureGit(cfg *Config) {
+// gitConfigKeyRegexp matches Git config keys, i.e. section.key or section.subsection.key
+var gitConfigKeyRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]*(\.[^\n]+)?\.[a-zA-Z][a-zA-Z0-9-]*$`)
+
+// gitConfigDebounce is the time we wait for .gitpod.yml to settle before we apply its Git config
+const gitConfigDebounce = 1 * time.Second
+
+// configureGitFromGitpodConfig applies the Git config from .gitpod.yml once it becomes available and
+// whenever it changes. Only keys whose value changed in .gitpod.yml are applied, s.t. we don't override
+// settings the user changed manually in the meantime.
+func configureGitFromGitpodConfig(ctx context.Context, cfg *Config, gitpodConfigService gitpod.ConfigInterface) {
+	var (
+		applied  map[string]string
+		pending  map[string]string
+		debounce = time.NewTimer(gitConfigDebounce)
+	)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	configs, errs := gitpodConfigService.Observe(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case config, ok := <-configs:
+			if !ok {
+				return
+			}
+			pending = nil
+			if config != nil {
+				pending = config.GitConfig
+			}
+			debounce.Reset(gitConfigDebounce)
+		case err, ok := <-errs:
+			if !ok {
+				return
+			}
+			log.WithError(err).Warn("cannot read Git config from .gitpod.yml")
+		case <-debounce.C:
+			applyGitSettings(userGitSettings(changedGitConfig(applied, pending)))
+			applied = pending
+		}
+	}
+}
+
+// changedGitConfig returns the entries of next which are not present in prev or have a different value
+func changedGitConfig(prev, next map[string]string) map[string]string {
+	res := make(map[string]string)
+	for key, value := range next {
+		if pv, ok := prev[key]; ok && pv == value {
+			continue
+		}
+		res[key] = value
+	}
+	return res
+}
+
+// splitGitConfigFields separates the config fields which configureGit derives the global Git settings from
+func splitGitConfigFields(fields []string) (git, other []string) {
+	for _, f := range fields {
+		switch f {
+		case "GitUsername", "GitEmail", "EnableGitLFS":
+			git = append(git, f)
+		default:
+			other = append(other, f)
+		}
+	}
+	return
+}
+
+func configureGit(cfg *Config, gitConfig map[string]string) {
+	applyGitSettings(gitSettings(cfg, gitConfig))
+}
+
+func applyGitSettings(settings [][]string) {
+	for _, s := range settings {
+		cmd := exec.Command("git", append([]string{"config", "--global"}, s...)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err != nil {
+			log.WithError(err).WithField("args", s).Warn("git config error")
+		}
+	}
+}
+
+// gitSettings returns the global Git settings we apply. Settings from gitConfig override the defaults.
+func gitSettings(cfg *Config, gitConfig map[string]string) [][]string {
 	settings := [][]string{
 		{"push.default", "simple"},
 		{"alias.lg", "log --color --graph --pretty=format:'%Cred%h%Creset -%C(yellow)%d%Creset %s %Cgreen(%cr) %C(bold blue)<%an>%Creset' --abbrev-commit"},
@@ -283,95 +593,306 @@ func configureGit(cfg *Config) {
 	if cfg.GitEmail != "" {
 		settings = append(settings, []string{"user.email", cfg.GitEmail})
 	}
+	if cfg.EnableGitLFS {
+		settings = append(settings, gitLFSSettings()...)
+	}
 
-	for _, s := range settings {
-		cmd := exec.Command("git", append([]string{"config", "--global"}, s...)...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
-		if err != nil {
-			log.WithError(err).WithField("args", s).Warn("git config error")
+	for _, us := range userGitSettings(gitConfig) {
+		var overridden bool
+		for _, s := range settings {
+			if strings.EqualFold(s[0], us[0]) {
+				s[1] = us[1]
+				overridden = true
+			}
+		}
+		if !overridden {
+			settings = append(settings, us)
+		}
+	}
+
+	return settings
+}
+
+// userGitSettings returns the valid Git settings of a gitConfig from .gitpod.yml sorted by key
+func userGitSettings(gitConfig map[string]string) [][]string {
+	keys := make([]string, 0, len(gitConfig))
+	for key := range gitConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var settings [][]string
+	for _, key := range keys {
+		if !gitConfigKeyRegexp.MatchString(key) {
+			log.WithField("key", key).Warn("invalid Git config key in .gitpod.yml - ignoring it")
+			continue
+		}
+		settings = append(settings, []string{key, gitConfig[key]})
+	}
+	return settings
+}
+
+// confirmMetadataAccess runs check until it reported metadata access attempts consecutive times, interval apart.
+// Returns false as soon as a check reports no access, or if the context is canceled.
+func confirmMetadataAccess(ctx context.Context, check func() bool, attempts int, interval time.Duration) bool {
+	for i := 1; ; i++ {
+		accessible := check()
+		log.WithField("attempt", i).WithField("attempts", attempts).WithField("accessible", accessible).Info("checked metadata access")
+		if !accessible {
+			return false
+		}
+		if i >= attempts {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(interval):
 		}
 	}
 }
 
-func hasMetadataAccess() bool {
+// metadataEndpoint is an instance metadata API of a cloud provider
+type metadataEndpoint struct {
+	Method string
+	URL    string
+	Header map[string]string
+}
+
+// metadataEndpoints are the instance metadata APIs we know, indexed by cloud provider
+var metadataEndpoints = map[string]metadataEndpoint{
 	// curl --connect-timeout 10 -s -H "Metadata-Flavor: Google" 'http://169.254.169.254/computeMetadata/v1/instance/'
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+	"gcp": {
+		Method: http.MethodGet,
+		URL:    "http://169.254.169.254/computeMetadata/v1/instance/",
+		Header: map[string]string{"Metadata-Flavor": "Google"},
+	},
+	// IMDSv2 requires a session token which is obtained using a PUT request
+	"aws": {
+		Method: http.MethodPut,
+		URL:    "http://169.254.169.254/latest/api/token",
+		Header: map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"},
+	},
+	"azure": {
+		Method: http.MethodGet,
+		URL:    "http://169.254.169.254/metadata/instance?api-version=2021-02-01",
+		Header: map[string]string{"Metadata": "true"},
+	},
+}
+
+func hasMetadataAccess(providers []string) bool {
+	endpoints := make(map[string]metadataEndpoint, len(providers))
+	for _, p := range providers {
+		ep, ok := metadataEndpoints[p]
+		if !ok {
+			log.WithField("provider", p).Error("cannot check metadata access - unknown cloud provider")
+			continue
+		}
+		endpoints[p] = ep
 	}
-	req, err := http.NewRequest("GET", "http://169.254.169.254/computeMetadata/v1/instance/", nil)
-	if err != nil {
-		log.WithError(err).Error("cannot check metadata access - this should never happen")
-		return true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return probeMetadataEndpoints(ctx, endpoints)
+}
+
+// probeMetadataEndpoints requests all endpoints concurrently and returns true if any of them is reachable
+func probeMetadataEndpoints(ctx context.Context, endpoints map[string]metadataEndpoint) bool {
+	reachable := make(chan bool, len(endpoints))
+	for provider, ep := range endpoints {
+		go func(provider string, ep metadataEndpoint) {
+			req, err := http.NewRequestWithContext(ctx, ep.Method, ep.URL, nil)
+			if err != nil {
+				// we cannot tell if the endpoint is reachable - don't shut down because of that
+				log.WithError(err).WithField("provider", provider).Error("cannot check metadata access - this should never happen")
+				reachable <- false
+				return
+			}
+			for k, v := range ep.Header {
+				req.Header.Add(k, v)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			// if we see any error here we're good because then the request timed out or failed for some other reason.
+			if err != nil {
+				reachable <- false
+				return
+			}
+			resp.Body.Close()
+
+			// We did not see an error. That's a problem becuase that means that users can reach the metadata endpoint.
+			log.WithField("provider", provider).WithField("url", ep.URL).Warn("metadata endpoint is reachable")
+			reachable <- true
+		}(provider, ep)
 	}
-	req.Header.Add("Metadata-Flavor", "Google")
 
-	resp, err := client.Do(req)
-	// We did not see an error. That's a problem becuase that means that users can reach the metadata endpoint.
-	if err == nil {
-		resp.Body.Close()
-		return true
+	var res bool
+	for range endpoints {
+		if <-reachable {
+			res = true
+		}
 	}
+	return res
+}
 
-	// if we see any error here we're good because then the request timed out or failed for some other reason.
-	return false
+// reapEventHistory is the number of reap events we keep for debugging
+const reapEventHistory = 64
+
+type reapEvent struct {
+	PID      int
+	Signaled bool
+	Time     time.Time
+}
+
+// reapEventLog is a fixed-size ring buffer of the most recent reap events.
+// Adding events does not allocate so that the reaper stays responsive.
+type reapEventLog struct {
+	mu     sync.Mutex
+	events [reapEventHistory]reapEvent
+	next   int
+	full   bool
+}
+
+func (l *reapEventLog) Add(evt reapEvent) {
+	l.mu.Lock()
+	l.events[l.next] = evt
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.mu.Unlock()
+}
+
+// Events returns a copy of the recorded events, oldest first
+func (l *reapEventLog) Events() []reapEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]reapEvent(nil), l.events[:l.next]...)
+	}
+	res := make([]reapEvent, 0, len(l.events))
+	res = append(res, l.events[l.next:]...)
+	res = append(res, l.events[:l.next]...)
+	return res
 }
 
-func reaper(terminatingReaper <-chan bool) {
+// reaper reaps re-parented child processes until ctx is canceled
+func reaper(ctx context.Context, terminatingReaper <-chan bool, signalBuffer int, metrics *metrics, events *reapEventLog) {
 	defer log.Debug("reaper shutdown")
 
 	var terminating bool
-	sigs := make(chan os.Signal, 128)
+	sigs := make(chan os.Signal, signalBuffer)
 	signal.Notify(sigs, syscall.SIGCHLD)
+	defer signal.Stop(sigs)
 	for {
 		select {
 		case <-sigs:
 		case terminating = <-terminatingReaper:
 			continue
+		case <-ctx.Done():
+			return
 		}
 
-		// "pid: 0, options: 0" to follow https://github.com/ramr/go-reaper/issues/11 to make agent-smith work again
-		pid, err := unix.Wait4(0, nil, 0, nil)
+		reaped := reapChildren(terminating, metrics, events)
+		metrics.ReapedPerWake.Observe(float64(reaped))
+	}
+}
 
+// reapChildren reaps all child processes which have exited so far. Pending SIGCHLDs coalesce, hence
+// a single signal can stand for any number of exited children.
+func reapChildren(terminating bool, metrics *metrics, events *reapEventLog) (reaped int) {
+	for {
+		// "pid: 0" to follow https://github.com/ramr/go-reaper/issues/11 to make agent-smith work again
+		var ws unix.WaitStatus
+		pid, err := unix.Wait4(0, &ws, unix.WNOHANG, nil)
+		if err == unix.EINTR {
+			continue
+		}
 		if err == unix.ECHILD {
 			// The calling process does not have any unwaited-for children.
-			continue
+			return reaped
 		}
 		if err != nil {
 			log.WithField("pid", pid).WithError(err).Debug("cannot call waitpid() for re-parented child")
+			return reaped
+		}
+		if pid <= 0 {
+			// none of the remaining children has exited yet
+			return reaped
+		}
+		if !isTerminated(ws) {
+			// the child merely stopped or continued, e.g. because the IDE was suspended - it is still alive
+			log.WithField("pid", pid).WithField("stopped", ws.Stopped()).WithField("continued", ws.Continued()).Debug("re-parented child changed state but did not terminate")
 			continue
 		}
+		reaped++
+		metrics.ReapedProcesses.Inc()
 
 		if !terminating {
+			events.Add(reapEvent{PID: pid, Time: time.Now()})
 			continue
 		}
-		proc, err := os.FindProcess(pid)
-		if err != nil {
-			log.WithField("pid", pid).WithError(err).Debug("cannot find re-parented process")
-			continue
+		signaled := sigtermReparentedProcess(pid)
+		if signaled {
+			metrics.ReaperSIGTERMs.Inc()
 		}
-		err = proc.Signal(syscall.SIGTERM)
-		if err != nil {
-			if !strings.Contains(err.Error(), "os: process already finished") {
-				log.WithField("pid", pid).WithError(err).Debug("cannot send SIGTERM to re-parented process")
-			}
+		events.Add(reapEvent{PID: pid, Signaled: signaled, Time: time.Now()})
+	}
+}
 
-			continue
+// isTerminated returns true if the wait status belongs to a child which exited or was killed, i.e. has been reaped
+func isTerminated(ws unix.WaitStatus) bool {
+	return ws.Exited() || ws.Signaled()
+}
+
+func sigtermReparentedProcess(pid int) (signaled bool) {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		log.WithField("pid", pid).WithError(err).Debug("cannot find re-parented process")
+		return false
+	}
+	err = proc.Signal(syscall.SIGTERM)
+	if err != nil {
+		if !strings.Contains(err.Error(), "os: process already finished") {
+			log.WithField("pid", pid).WithError(err).Debug("cannot send SIGTERM to re-parented process")
 		}
-		log.WithField("pid", pid).Debug("SIGTERM'ed reparented child process")
+
+		return false
 	}
+	log.WithField("pid", pid).Debug("SIGTERM'ed reparented child process")
+	return true
 }
 
-func startAndWatchIDE(ctx context.Context, cfg *Config, wg *sync.WaitGroup, ideReady *ideReadyState) {
+func startAndWatchIDE(ctx context.Context, liveCfg *liveConfig, wg *sync.WaitGroup, cstate ContentState, ideReady *ideReadyState, phases *phaseLog, ideExits *ideExitLog, ideUsage *ideUsageSampler, restarts *ideRestarter, suspender *ideSuspender, notifications *NotificationService, metrics *metrics) {
 	defer wg.Done()
 	defer log.Debug("startAndWatchIDE shutdown")
 
+	cfg := liveCfg.Get()
+
 	if cfg.isHeadless() {
 		ideReady.Set(true)
+		restarts.disable()
 		return
 	}
 
+	if cfg.PreLaunchHook.Command != "" {
+		select {
+		case <-cstate.ContentReady():
+		case <-ctx.Done():
+			return
+		}
+
+		err := runPreLaunchHook(ctx, cfg)
+		if err != nil {
+			log.WithError(err).Error("IDE pre-launch hook failed - not starting the IDE")
+			restarts.disable()
+			go notifyPreLaunchHookFailed(notifications, err)
+			return
+		}
+	}
+
 	type status int
 	const (
 		statusNeverRan status = iota
@@ -382,7 +903,9 @@ func startAndWatchIDE(ctx context.Context, cfg *Config, wg *sync.WaitGroup, ideR
 
 	var (
 		cmd        *exec.Cmd
+		launch     *ideLaunch
 		ideStopped chan struct{}
+		crashLoop  = newCrashLoopDetector(cfg.IDECrashLoopThreshold(), cfg.IDECrashLoopWindow())
 	)
 supervisorLoop:
 	for {
@@ -391,8 +914,15 @@ supervisorLoop:
 		}
 
 		ideStopped = make(chan struct{}, 1)
+		probeCtx, cancelProbe := context.WithCancel(ctx)
+		current := &ideLaunch{stopped: ideStopped, cancelProbe: cancelProbe}
+		launch = current
+		// the config might have been reloaded since the IDE was last started
+		launchCfg := liveCfg.Get()
 		go func() {
-			cmd = prepareIDELaunch(cfg)
+			defer cancelProbe()
+
+			cmd = prepareIDELaunch(launchCfg)
 
 			// prepareIDELaunch sets Pdeathsig, which on on Linux, will kill the
 			// child process when the thread dies, not when the process dies.
@@ -403,6 +933,7 @@ supervisorLoop:
 			runtime.LockOSThread()
 			defer runtime.UnlockOSThread()
 
+			phases.Record(api.SupervisorPhase_phase_ide_launching)
 			err := cmd.Start()
 			if err != nil {
 				if s == statusNeverRan {
@@ -412,24 +943,53 @@ supervisorLoop:
 				return
 			}
 			s = statusShouldRun
+			// the IDE runs in its own process group (see prepareIDELaunch), hence its PID is the PGID
+			ideUsage.SetProcessGroup(cmd.Process.Pid)
+			suspender.SetProcessGroup(cmd.Process.Pid)
 
 			go func() {
-				runIDEReadinessProbe(cfg)
-				ideReady.Set(true)
+				if !runIDEReadinessProbe(probeCtx, launchCfg) {
+					return
+				}
+				current.markReady(func() {
+					ideReady.Set(true)
+					phases.Record(api.SupervisorPhase_phase_ide_ready)
+					metrics.IDEUp.Set(1)
+				})
 			}()
 
 			err = cmd.Wait()
-			if err != nil && !(strings.Contains(err.Error(), "signal: interrupt") || strings.Contains(err.Error(), "wait: no child processes")) {
-				log.WithError(err).Warn("IDE was stopped")
+			stopRequested := current.markExited()
+			exit, exitKnown := ideExitFromError(err, time.Now())
+			if exitKnown {
+				ideExits.Add(exit)
+			}
+			if stopRequested {
+				// we stopped the IDE ourselves - how it exited says nothing about its health
+				log.WithError(err).Debug("IDE was stopped on request")
+			} else if err != nil && !(strings.Contains(err.Error(), "signal: interrupt") || strings.Contains(err.Error(), "wait: no child processes")) {
+				logEntry := log.WithError(err)
+				if exitKnown {
+					logEntry = logEntry.WithField("exitCode", exit.ExitCode).WithField("signal", exit.Signal)
+				}
+				logEntry.Warn("IDE was stopped")
 
 				ideWasReady := ideReady.Get()
 				if !ideWasReady {
 					log.WithError(err).Fatal("IDE failed to start")
 					return
 				}
+
+				if crashLoop.Exited(time.Now()) {
+					log.WithError(err).WithField("exits", crashLoop.Threshold).WithField("window", crashLoop.Window.String()).Error("IDE is crash looping")
+					go notifyIDECrashLoop(notifications, crashLoop, err, exit, exitKnown)
+				}
 			}
 
 			ideReady.Set(false)
+			ideUsage.SetProcessGroup(0)
+			suspender.SetProcessGroup(0)
+			metrics.IDEUp.Set(0)
 			close(ideStopped)
 		}()
 
@@ -439,15 +999,27 @@ supervisorLoop:
 			if s == statusShouldShutdown {
 				break supervisorLoop
 			}
+			metrics.IDERestarts.Inc()
 			time.Sleep(1 * time.Second)
+		case stopped := <-restarts.requests:
+			// we've been asked to restart the IDE - stop it and start it again in the next round
+			log.Info("restarting IDE on request")
+			resumeIDE(suspender)
+			stopIDE(cmd, launch, cfg.IDEShutdownBudget())
+			close(stopped)
+			metrics.IDERestarts.Inc()
 		case <-ctx.Done():
 			// we've been asked to shut down
 			s = statusShouldShutdown
+			// a suspended IDE would not handle the interrupt
+			resumeIDE(suspender)
+			launch.requestStop()
 			cmd.Process.Signal(os.Interrupt)
 			break supervisorLoop
 		}
 	}
 
+	timeBudgetIDEShutdown := cfg.IDEShutdownBudget()
 	log.WithField("budget", timeBudgetIDEShutdown.String()).Info("IDE supervisor loop ended - waiting for IDE to come down")
 	select {
 	case <-ideStopped:
@@ -458,48 +1030,365 @@ supervisorLoop:
 	}
 }
 
-func prepareIDELaunch(cfg *Config) *exec.Cmd {
-	var args []string
-	args = append(args, cfg.WorkspaceRoot)
-	args = append(args, "--port", strconv.Itoa(cfg.IDEPort))
-	args = append(args, "--hostname", "0.0.0.0")
-	log.WithField("args", args).WithField("entrypoint", cfg.Entrypoint).Info("launching IDE")
+// ideLaunch is a single launch of the IDE process
+type ideLaunch struct {
+	// stopped is closed once the IDE process has exited
+	stopped chan struct{}
+	// cancelProbe stops the readiness probe of this launch
+	cancelProbe context.CancelFunc
 
-	cmd := exec.Command(cfg.Entrypoint, args...)
-	cmd.Env = buildIDEEnv(cfg)
+	mu            sync.Mutex
+	stopRequested bool
+	exited        bool
+}
 
-	// We need the IDE to run in its own process group, s.t. we can suspend and resume
-	// IDE and its children.
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid:   true,
-		Pdeathsig: syscall.SIGKILL,
+// requestStop marks the IDE as being stopped on purpose, e.g. to restart it, and stops its readiness probe
+func (l *ideLaunch) requestStop() {
+	l.mu.Lock()
+	l.stopRequested = true
+	l.mu.Unlock()
+	l.cancelProbe()
+}
+
+// markExited records that the IDE process has exited and returns true if we asked it to stop
+func (l *ideLaunch) markExited() (stopRequested bool) {
+	l.mu.Lock()
+	l.exited = true
+	stopRequested = l.stopRequested
+	l.mu.Unlock()
+	l.cancelProbe()
+	return
+}
+
+// markReady calls setReady unless the IDE was stopped or has exited in the meantime,
+// so that a stale readiness probe cannot mark a later launch as ready
+func (l *ideLaunch) markReady(setReady func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopRequested || l.exited {
+		return
 	}
+	setReady()
+}
 
-	// Here we must resist the temptation to "neaten up" the IDE output for headless builds.
-	// This would break the JSON parsing of the headless builds.
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if lrr := cfg.LogRateLimit(); lrr > 0 {
-		limit := int64(lrr)
-		cmd.Stdout = dropwriter.Writer(cmd.Stdout, dropwriter.NewBucket(limit*1024*3, limit*1024))
-		cmd.Stderr = dropwriter.Writer(cmd.Stderr, dropwriter.NewBucket(limit*1024*3, limit*1024))
-		log.WithField("limit_kb_per_sec", limit).Info("rate limiting IDE log output")
+// stopIDE interrupts the IDE and waits for it to stop. If the IDE does not stop within the budget
+// it is killed.
+func stopIDE(cmd *exec.Cmd, launch *ideLaunch, budget time.Duration) {
+	if cmd == nil || cmd.Process == nil || launch == nil {
+		return
 	}
 
-	return cmd
+	launch.requestStop()
+	cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-launch.stopped:
+		return
+	case <-time.After(budget):
+		log.WithField("budget", budget.String()).Error("IDE did not stop in time - sending SIGKILL")
+		cmd.Process.Signal(syscall.SIGKILL)
+	}
+	<-launch.stopped
 }
 
-func buildIDEEnv(cfg *Config) []string {
-	var env, envn []string
-	for _, e := range os.Environ() {
-		segs := strings.Split(e, "=")
-		if len(segs) < 2 {
-			log.Printf("\"%s\" has invalid format, not including in IDE environment", e)
-			continue
+func resumeIDE(suspender *ideSuspender) {
+	err := suspender.Resume()
+	if err != nil {
+		log.WithError(err).Warn("cannot resume IDE")
+	}
+}
+
+// errIDERestartInProgress is returned if the IDE is asked to restart while it is already restarting
+var errIDERestartInProgress = errors.New("IDE restart is already in progress")
+
+// errIDERestartUnavailable is returned if there is no IDE which could be restarted, e.g. in headless workspaces
+var errIDERestartUnavailable = errors.New("workspace does not run an IDE")
+
+// ideRestarter asks the IDE supervisor loop to restart the IDE
+type ideRestarter struct {
+	ideReady *ideReadyState
+
+	// requests are received by the IDE supervisor loop, which closes the channel
+	// it received once the IDE was stopped.
+	requests chan chan struct{}
+
+	mu         sync.Mutex
+	restarting bool
+	disabled   bool
+}
+
+func newIDERestarter(ideReady *ideReadyState) *ideRestarter {
+	return &ideRestarter{
+		ideReady: ideReady,
+		requests: make(chan chan struct{}),
+	}
+}
+
+func (r *ideRestarter) disable() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disabled = true
+}
+
+// Restart stops the IDE and waits until it was launched again and is ready.
+// Only one restart can be in progress at a time.
+func (r *ideRestarter) Restart(ctx context.Context) error {
+	r.mu.Lock()
+	if r.disabled {
+		r.mu.Unlock()
+		return errIDERestartUnavailable
+	}
+	if r.restarting {
+		r.mu.Unlock()
+		return errIDERestartInProgress
+	}
+	r.restarting = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.restarting = false
+		r.mu.Unlock()
+	}()
+
+	stopped := make(chan struct{})
+	select {
+	case r.requests <- stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-r.ideReady.Wait():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ideExitHistory is the number of IDE exits we keep for debugging
+const ideExitHistory = 16
+
+// ideExit describes how the IDE process exited
+type ideExit struct {
+	// ExitCode is the exit code of the IDE, or -1 if it was terminated by a signal
+	ExitCode int `json:"exitCode"`
+	// Signal is the signal which terminated the IDE, if any
+	Signal string    `json:"signal,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+func (e ideExit) String() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("terminated by signal: %s", e.Signal)
+	}
+	return fmt.Sprintf("exit code %d", e.ExitCode)
+}
+
+// ideExitFromError determines the IDE exit from the result of cmd.Wait. The exit is unknown
+// if the process could not be waited for, e.g. because the reaper collected it first.
+func ideExitFromError(err error, t time.Time) (exit ideExit, ok bool) {
+	exit.Time = t
+	if err == nil {
+		return exit, true
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return exit, false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		exit.ExitCode = exitErr.ExitCode()
+		return exit, true
+	}
+	if status.Signaled() {
+		exit.ExitCode = -1
+		exit.Signal = status.Signal().String()
+		return exit, true
+	}
+	exit.ExitCode = status.ExitStatus()
+	return exit, true
+}
+
+// ideExitLog is a fixed-size ring buffer of the most recent IDE exits
+type ideExitLog struct {
+	mu    sync.Mutex
+	exits [ideExitHistory]ideExit
+	next  int
+	full  bool
+}
+
+func (l *ideExitLog) Add(exit ideExit) {
+	l.mu.Lock()
+	l.exits[l.next] = exit
+	l.next = (l.next + 1) % len(l.exits)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.mu.Unlock()
+}
+
+// Exits returns a copy of the recorded exits, oldest first
+func (l *ideExitLog) Exits() []ideExit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]ideExit(nil), l.exits[:l.next]...)
+	}
+	res := make([]ideExit, 0, len(l.exits))
+	res = append(res, l.exits[l.next:]...)
+	res = append(res, l.exits[:l.next]...)
+	return res
+}
+
+// crashLoopDetector detects if the IDE exits more than Threshold times within Window
+type crashLoopDetector struct {
+	Threshold int
+	Window    time.Duration
+
+	exits   []time.Time
+	looping bool
+}
+
+func newCrashLoopDetector(threshold int, window time.Duration) *crashLoopDetector {
+	return &crashLoopDetector{
+		Threshold: threshold,
+		Window:    window,
+	}
+}
+
+// Exited records an IDE exit and returns true if this exit starts a crash loop.
+// Once a crash loop was detected this function will return false until the IDE
+// exited no more than Threshold times within Window, i.e. until it stabilized.
+func (d *crashLoopDetector) Exited(t time.Time) (newLoop bool) {
+	var recent []time.Time
+	for _, e := range d.exits {
+		if t.Sub(e) < d.Window {
+			recent = append(recent, e)
+		}
+	}
+	d.exits = append(recent, t)
+
+	if len(d.exits) <= d.Threshold {
+		d.looping = false
+		return false
+	}
+	if d.looping {
+		return false
+	}
+	d.looping = true
+	return true
+}
+
+func notifyIDECrashLoop(notifications *NotificationService, crashLoop *crashLoopDetector, exitErr error, exit ideExit, exitKnown bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	msg := fmt.Sprintf("The IDE keeps crashing: it exited more than %d times within %s. Please check the workspace logs for details. Last error: %s", crashLoop.Threshold, crashLoop.Window, exitErr)
+	if exitKnown {
+		msg += fmt.Sprintf(" (%s)", exit)
+	}
+	_, err := notifications.Notify(ctx, &api.NotifyRequest{
+		Level:   api.NotifyRequest_ERROR,
+		Message: msg,
+	})
+	if err != nil {
+		log.WithError(err).Warn("cannot notify user about IDE crash loop")
+	}
+}
+
+// runPreLaunchHook runs the IDE's pre-launch hook and waits for it to exit successfully
+func runPreLaunchHook(ctx context.Context, cfg *Config) error {
+	hook := cfg.PreLaunchHook
+	timeout := cfg.PreLaunchHookTimeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.Command, hook.Args...)
+	cmd.Env = buildIDEEnv(cfg)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	log.WithField("command", hook.Command).WithField("args", hook.Args).Info("running IDE pre-launch hook")
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("pre-launch hook did not complete within %s", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("pre-launch hook failed: %w", err)
+	}
+	log.Info("IDE pre-launch hook completed")
+	return nil
+}
+
+func notifyPreLaunchHookFailed(notifications *NotificationService, hookErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	msg := fmt.Sprintf("The IDE was not started because its pre-launch hook failed. Please check the workspace logs for details. Error: %s", hookErr)
+	_, err := notifications.Notify(ctx, &api.NotifyRequest{
+		Level:   api.NotifyRequest_ERROR,
+		Message: msg,
+	})
+	if err != nil {
+		log.WithError(err).Warn("cannot notify user about failed IDE pre-launch hook")
+	}
+}
+
+func prepareIDELaunch(cfg *Config) *exec.Cmd {
+	args := cfg.IDELaunchArgs()
+	log.WithField("args", args).WithField("entrypoint", cfg.Entrypoint).Info("launching IDE")
+
+	cmd := exec.Command(cfg.Entrypoint, args...)
+	cmd.Env = buildIDEEnv(cfg)
+	if cfg.IDEWorkdir != "" {
+		cmd.Dir = cfg.IDEWorkdir
+	}
+
+	// We need the IDE to run in its own process group, s.t. we can suspend and resume
+	// IDE and its children.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+
+	// Here we must resist the temptation to "neaten up" the IDE output for headless builds.
+	// This would break the JSON parsing of the headless builds.
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if lrr := cfg.LogRateLimitStdout(); lrr > 0 {
+		limit := int64(lrr)
+		cmd.Stdout = dropwriter.Writer(cmd.Stdout, dropwriter.NewBucket(limit*1024*3, limit*1024))
+		log.WithField("limit_kb_per_sec", limit).Info("rate limiting IDE stdout")
+	}
+	if lrr := cfg.LogRateLimitStderr(); lrr > 0 {
+		limit := int64(lrr)
+		cmd.Stderr = dropwriter.Writer(cmd.Stderr, dropwriter.NewBucket(limit*1024*3, limit*1024))
+		log.WithField("limit_kb_per_sec", limit).Info("rate limiting IDE stderr")
+	}
+
+	return cmd
+}
+
+func buildIDEEnv(cfg *Config) []string {
+	var env, envn []string
+	for _, e := range os.Environ() {
+		segs := strings.Split(e, "=")
+		if len(segs) < 2 {
+			log.Printf("\"%s\" has invalid format, not including in IDE environment", e)
+			continue
 		}
 		nme := segs[0]
 
-		if isBlacklistedEnvvar(nme) {
+		if len(cfg.EnvvarAllowlist) > 0 {
+			if !isAllowlistedEnvvar(nme, cfg.EnvvarAllowlist) {
+				continue
+			}
+		} else if isBlacklistedEnvvar(cfg, nme) {
 			continue
 		}
 
@@ -521,56 +1410,186 @@ func buildIDEEnv(cfg *Config) []string {
 	return env
 }
 
-func runIDEReadinessProbe(cfg *Config) {
-	defer log.Info("IDE is ready")
+// runIDEReadinessProbe waits until the IDE is ready. It returns false if ctx is done before that.
+func runIDEReadinessProbe(ctx context.Context, cfg *Config) (ready bool) {
+	defer func() {
+		if ready {
+			log.Info("IDE is ready")
+		}
+	}()
+
+	// wait returns false if ctx is done before the next probe is due
+	wait := func(tick *time.Ticker) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-tick.C:
+			return true
+		}
+	}
 
 	switch cfg.ReadinessProbe.Type {
 	case ReadinessProcessProbe:
-		return
+		return true
 
 	case ReadinessHTTPProbe:
+		threshold := cfg.ReadinessProbe.HTTPProbe.SuccessThreshold
+		if threshold == 0 {
+			threshold = 1
+		}
+
+		var (
+			url       = fmt.Sprintf("http://%s/%s", net.JoinHostPort(cfg.IDEProbeHost(), strconv.Itoa(cfg.IDEPort)), strings.TrimPrefix(cfg.ReadinessProbe.HTTPProbe.Path, "/"))
+			client    = http.Client{Timeout: 5 * time.Second}
+			tick      = time.NewTicker(cfg.ReadinessProbeInterval())
+			successes int
+		)
+		defer tick.Stop()
+		for {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				log.WithError(err).Error("cannot create IDE readiness probe request - assuming the IDE is ready")
+				return true
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				successes = 0
+				log.WithError(err).Info("IDE is not ready yet")
+			} else {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					successes = 0
+					log.WithField("status", resp.StatusCode).Info("IDE readiness probe came back with non-200 status code")
+				} else {
+					successes++
+					if successes >= threshold {
+						return true
+					}
+					log.WithField("successes", successes).WithField("threshold", threshold).Info("IDE readiness probe succeeded - waiting for more consecutive successes")
+				}
+			}
+
+			if !wait(tick) {
+				return false
+			}
+		}
+
+	case ReadinessTCPProbe:
+		port := cfg.ReadinessProbe.TCPProbe.Port
+		if port == 0 {
+			port = cfg.IDEPort
+		}
+		timeout := time.Duration(cfg.ReadinessProbe.TCPProbe.Timeout)
+		if timeout == 0 {
+			timeout = 5 * time.Second
+		}
+
 		var (
-			url    = fmt.Sprintf("http://localhost:%d/%s", cfg.IDEPort, strings.TrimPrefix(cfg.ReadinessProbe.HTTPProbe.Path, "/"))
-			client = http.Client{Timeout: 5 * time.Second}
-			tick   = time.NewTicker(5 * time.Second)
+			addr   = net.JoinHostPort(cfg.IDEProbeHost(), strconv.Itoa(port))
+			dialer = net.Dialer{Timeout: timeout}
+			tick   = time.NewTicker(cfg.ReadinessProbeInterval())
 		)
 		defer tick.Stop()
 		for {
-			resp, err := client.Get(url)
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
 			if err != nil {
 				log.WithError(err).Info("IDE is not ready yet")
-			} else if resp.StatusCode != http.StatusOK {
-				log.WithField("status", resp.StatusCode).Info("IDE readiness probe came back with non-200 status code")
 			} else {
-				break
+				conn.Close()
+				return true
+			}
+
+			if !wait(tick) {
+				return false
 			}
+		}
 
-			<-tick.C
+	case ReadinessGRPCProbe:
+		addr := cfg.ReadinessProbe.GRPCProbe.Addr
+		if addr == "" {
+			addr = net.JoinHostPort(cfg.IDEProbeHost(), strconv.Itoa(cfg.IDEPort))
+		}
+		timeout := time.Duration(cfg.ReadinessProbe.GRPCProbe.Timeout)
+		if timeout == 0 {
+			timeout = 5 * time.Second
+		}
+
+		// grpc.Dial does not block, hence the connection is established during the first health check
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			log.WithError(err).WithField("addr", addr).Error("cannot create gRPC readiness probe client - assuming the IDE is ready")
+			return true
+		}
+		defer conn.Close()
+
+		var (
+			client = healthpb.NewHealthClient(conn)
+			req    = &healthpb.HealthCheckRequest{Service: cfg.ReadinessProbe.GRPCProbe.Service}
+			tick   = time.NewTicker(cfg.ReadinessProbeInterval())
+		)
+		defer tick.Stop()
+		for {
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			resp, err := client.Check(checkCtx, req)
+			cancel()
+			if err != nil {
+				log.WithError(err).Info("IDE is not ready yet")
+			} else if resp.Status != healthpb.HealthCheckResponse_SERVING {
+				log.WithField("status", resp.Status.String()).Info("IDE readiness probe came back with non-serving status")
+			} else {
+				return true
+			}
+
+			if !wait(tick) {
+				return false
+			}
 		}
 	}
+	return true
+}
+
+// defaultEnvvarBlacklistPrefixes are the prefixes of environment variables we never pass to the IDE
+var defaultEnvvarBlacklistPrefixes = []string{
+	"THEIA_SUPERVISOR_",
+	"GITPOD_TOKENS",
+	// The following vars are meant to filter out the kubernetes-injected env vars that we do not know how to turn of (yet)
+	"KUBERNETES_SERVICE",
+	"KUBERNETES_PORT",
+	// This is a magic env var is set to /theia/supervisor. We do not want to point users at it.
+	"   ", // 3 spaces
 }
 
-func isBlacklistedEnvvar(name string) bool {
+func isBlacklistedEnvvar(cfg *Config, name string) bool {
 	// exclude blacklisted
-	prefixBlacklist := []string{
-		"THEIA_SUPERVISOR_",
-		"GITPOD_TOKENS",
-		// The following vars are meant to filter out the kubernetes-injected env vars that we do not know how to turn of (yet)
-		"KUBERNETES_SERVICE",
-		"KUBERNETES_PORT",
-		// This is a magic env var is set to /theia/supervisor. We do not want to point users at it.
-		"   ", // 3 spaces
-	}
-	for _, wep := range prefixBlacklist {
+	for _, wep := range defaultEnvvarBlacklistPrefixes {
 		if strings.HasPrefix(name, wep) {
 			return true
 		}
 	}
+	for _, wep := range cfg.EnvvarBlacklistPrefixes {
+		if strings.HasPrefix(name, wep) {
+			return true
+		}
+	}
+	for _, nme := range cfg.EnvvarBlacklist {
+		if name == nme {
+			return true
+		}
+	}
 
 	return false
 }
 
-func startAPIEndpoint(ctx context.Context, cfg *Config, wg *sync.WaitGroup, services []RegisterableService, opts ...grpc.ServerOption) {
+func isAllowlistedEnvvar(name string, prefixAllowlist []string) bool {
+	for _, p := range prefixAllowlist {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func startAPIEndpoint(ctx context.Context, cfg *Config, wg *sync.WaitGroup, services []RegisterableService, ideReady *ideReadyState, debugState http.Handler, metricsRegistry *prometheus.Registry, metrics *metrics, opts ...grpc.ServerOption) {
 	defer wg.Done()
 	defer log.Debug("startAPIEndpoint shutdown")
 
@@ -579,12 +1598,17 @@ func startAPIEndpoint(ctx context.Context, cfg *Config, wg *sync.WaitGroup, serv
 		log.WithError(err).Fatal("cannot start health endpoint")
 	}
 
+	// metrics come first in the chain so that the recorded latency includes the time spent logging
+	unaryInterceptors := []grpc.UnaryServerInterceptor{metrics.UnaryServerInterceptor}
+	streamInterceptors := []grpc.StreamServerInterceptor{metrics.StreamServerInterceptor}
 	if cfg.DebugEnable {
-		opts = append(opts,
-			grpc.UnaryInterceptor(grpc_logrus.UnaryServerInterceptor(log.Log)),
-			grpc.StreamInterceptor(grpc_logrus.StreamServerInterceptor(log.Log)),
-		)
+		unaryInterceptors = append(unaryInterceptors, grpc_logrus.UnaryServerInterceptor(log.Log))
+		streamInterceptors = append(streamInterceptors, grpc_logrus.StreamServerInterceptor(log.Log))
 	}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	)
 
 	m := cmux.New(l)
 	restMux := grpcruntime.NewServeMux()
@@ -605,12 +1629,32 @@ func startAPIEndpoint(ctx context.Context, cfg *Config, wg *sync.WaitGroup, serv
 	go grpcServer.Serve(grpcMux)
 
 	httpMux := m.Match(cmux.HTTP1Fast())
-	routes := http.NewServeMux()
-	routes.Handle("/_supervisor/v1/", http.StripPrefix("/_supervisor", restMux))
-	routes.Handle("/_supervisor/frontend", http.FileServer(http.Dir(cfg.FrontendLocation)))
+	var (
+		routes   = http.NewServeMux()
+		reserved []string
+		handle   = func(path string, handler http.Handler) {
+			routes.Handle(apiRoutePrefix+path, handler)
+			reserved = append(reserved, path)
+		}
+	)
+	handle("/v1/", http.StripPrefix(apiRoutePrefix, restMux))
+	// the endpoint is healthy if it answers at all
+	handle("/v1/healthz", healthHandler(func() bool { return true }))
+	handle("/v1/readyz", readyzHandler(cfg, ideReady))
+	if loc, ok := resolveFrontendLocation(append([]string{cfg.FrontendLocation}, cfg.FrontendFallbackLocations...)...); ok {
+		handle("/frontend", frontendHandler(loc))
+	} else {
+		log.WithField("frontendLocation", cfg.FrontendLocation).Error("supervisor frontend not found - serving a placeholder")
+		handle("/frontend", frontendNotFoundHandler())
+	}
 	if cfg.DebugEnable {
-		routes.Handle("/_supervisor"+pprof.Path, http.StripPrefix("/_supervisor", pprof.Handler()))
+		handle(pprof.Path, http.StripPrefix(apiRoutePrefix, pprof.Handler()))
+		handle("/debug/state", debugState)
+	}
+	if cfg.DebugEnable || cfg.MetricsEnable {
+		handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
 	}
+	registerHTTPServices(routes, reserved, services)
 	go http.Serve(httpMux, routes)
 
 	go m.Serve()
@@ -620,10 +1664,108 @@ func startAPIEndpoint(ctx context.Context, cfg *Config, wg *sync.WaitGroup, serv
 	l.Close()
 }
 
-func startContentInit(ctx context.Context, cfg *Config, wg *sync.WaitGroup, cst ContentState) {
+// apiRoutePrefix is the path prefix of all HTTP routes served by the API endpoint
+const apiRoutePrefix = "/_supervisor"
+
+// registerHTTPServices mounts the HTTP handlers of all RegisterableHTTPService under apiRoutePrefix.
+// reserved are the patterns (relative to apiRoutePrefix) served by supervisor itself. A service is registered
+// with all of its routes or not at all: if one of its patterns collides with a reserved pattern or with the
+// pattern of a service registered before, none of its handlers are served.
+func registerHTTPServices(routes *http.ServeMux, reserved []string, services []RegisterableService) {
+	var (
+		mux      = http.NewServeMux()
+		patterns = make(map[string]struct{})
+	)
+	for _, reg := range services {
+		reg, ok := reg.(RegisterableHTTPService)
+		if !ok {
+			continue
+		}
+
+		var rec httpRouteRecorder
+		reg.RegisterHTTP(&rec)
+		err := rec.validate(reserved, patterns)
+		if err != nil {
+			log.WithError(err).WithField("service", fmt.Sprintf("%T", reg)).Error("cannot register HTTP service - route collision")
+			continue
+		}
+		for _, r := range rec.routes {
+			mux.Handle(r.Pattern, r.Handler)
+			patterns[r.Pattern] = struct{}{}
+		}
+	}
+	if len(patterns) == 0 {
+		return
+	}
+	routes.Handle(apiRoutePrefix+"/", http.StripPrefix(apiRoutePrefix, mux))
+}
+
+// httpRoute is a handler registered by an HTTP service
+type httpRoute struct {
+	Pattern string
+	Handler http.Handler
+}
+
+// httpRouteRecorder records the routes of an HTTP service so that we can check them before serving any of them
+type httpRouteRecorder struct {
+	routes []httpRoute
+}
+
+// Handle records a route
+func (rec *httpRouteRecorder) Handle(pattern string, handler http.Handler) {
+	rec.routes = append(rec.routes, httpRoute{Pattern: pattern, Handler: handler})
+}
+
+// HandleFunc records a route
+func (rec *httpRouteRecorder) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	if handler == nil {
+		rec.Handle(pattern, nil)
+		return
+	}
+	rec.Handle(pattern, http.HandlerFunc(handler))
+}
+
+// validate checks the recorded routes for everything that would make http.ServeMux panic or a route unreachable
+func (rec *httpRouteRecorder) validate(reserved []string, registered map[string]struct{}) error {
+	own := make(map[string]struct{}, len(rec.routes))
+	for _, r := range rec.routes {
+		if r.Pattern == "" {
+			return fmt.Errorf("invalid pattern")
+		}
+		if r.Handler == nil {
+			return fmt.Errorf("nil handler for %s", r.Pattern)
+		}
+		if _, exists := own[r.Pattern]; exists {
+			return fmt.Errorf("%s is registered twice", r.Pattern)
+		}
+		own[r.Pattern] = struct{}{}
+		if _, exists := registered[r.Pattern]; exists {
+			return fmt.Errorf("%s is registered by another service already", r.Pattern)
+		}
+		for _, res := range reserved {
+			if patternShadows(res, r.Pattern) {
+				return fmt.Errorf("%s is served by supervisor (%s)", r.Pattern, apiRoutePrefix+res)
+			}
+		}
+	}
+	return nil
+}
+
+// patternShadows returns true if requests for pattern would be served by the handler registered for reserved
+func patternShadows(reserved, pattern string) bool {
+	if reserved == pattern {
+		return true
+	}
+	return strings.HasSuffix(reserved, "/") && strings.HasPrefix(pattern, reserved)
+}
+
+func startContentInit(ctx context.Context, cfg *Config, wg *sync.WaitGroup, cst ContentState, phases *phaseLog, metrics *metrics) {
 	defer wg.Done()
 	defer log.Info("supervisor: workspace content available")
 
+	t0 := time.Now()
+	phases.Record(api.SupervisorPhase_phase_content_init_started)
+
 	var err error
 	defer func() {
 		if err == nil {
@@ -639,45 +1781,39 @@ func startContentInit(ctx context.Context, cfg *Config, wg *sync.WaitGroup, cst
 	}()
 
 	fn := "/workspace/.gitpod/content.json"
-	f, err := os.Open(fn)
+	descriptor, err := os.ReadFile(fn)
 	if os.IsNotExist(err) {
 		log.WithError(err).Info("no content init descriptor found - not trying to run it")
 
 		// If there is no content descriptor the content must have come from somewhere (i.e. a layer or ws-daemon).
 		// Let's wait for that to happen.
-		// TODO: rewrite using fsnotify
-		t := time.NewTicker(100 * time.Millisecond)
-		for range t.C {
-			b, err := os.ReadFile("/workspace/.gitpod/ready")
-			if err != nil {
-				if !os.IsNotExist(err) {
-					log.WithError(err).Error("cannot read content ready file")
-				}
-				continue
-			}
-
-			var m csapi.WorkspaceReadyMessage
-			err = json.Unmarshal(b, &m)
-			if err != nil {
-				log.WithError(err).Fatal("cannot unmarshal content ready file")
-				continue
-			}
-
-			log.WithField("source", m.Source).Info("supervisor: workspace content available")
-			cst.MarkContentReady(m.Source)
-			t.Stop()
-			break
+		var src csapi.WorkspaceInitSource
+		src, err = awaitContentReadyFile(ctx, cfg, contentReadyFile)
+		if err != nil && ctx.Err() != nil {
+			// we're shutting down before the content became available
+			err = nil
+			return
+		}
+		if err != nil {
+			return
 		}
 
-		err = nil
+		log.WithField("source", src).Info("supervisor: workspace content available")
+		metrics.ContentInitDuration.Observe(time.Since(t0).Seconds())
+		cst.MarkContentReady(src)
+		phases.Record(api.SupervisorPhase_phase_content_ready)
 		return
 	}
 	if err != nil {
 		log.WithError(err).Error("cannot open init descriptor")
 		return
 	}
+	err = checkContentInitAllowed(descriptor, cfg.ContentInitAllowlist)
+	if err != nil {
+		return
+	}
 
-	src, err := executor.Execute(ctx, "/workspace", f, initializer.WithInWorkspace)
+	src, err := executor.ExecuteWithProgress(ctx, "/workspace", bytes.NewReader(descriptor), cst.MarkContentProgress, initializer.WithInWorkspace)
 	if err != nil {
 		return
 	}
@@ -692,48 +1828,379 @@ func startContentInit(ctx context.Context, cfg *Config, wg *sync.WaitGroup, cst
 	}
 
 	log.WithField("source", src).Info("supervisor: workspace content init finished")
+	metrics.ContentInitDuration.Observe(time.Since(t0).Seconds())
 	cst.MarkContentReady(src)
+	phases.Record(api.SupervisorPhase_phase_content_ready)
+}
+
+// contentReadyFile is written by ws-daemon (or a content layer) once the workspace content is available
+const contentReadyFile = "/workspace/.gitpod/ready"
+
+// awaitContentReadyFile waits for the content ready file fn for at most the content init budget
+func awaitContentReadyFile(ctx context.Context, cfg *Config, fn string) (csapi.WorkspaceInitSource, error) {
+	verify, err := cfg.contentReadyVerifier()
+	if err != nil {
+		return "", err
+	}
+
+	timeout := cfg.ContentInitBudget()
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	src, err := waitForContentReadyFile(waitCtx, fn, verify)
+	if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return "", fmt.Errorf("workspace content did not become available within %s", timeout)
+	}
+	return src, err
 }
 
-func terminateChildProcesses() {
+// waitForContentReadyFile waits until the content ready file fn appears and returns the init source it contains.
+// The file's directory, or its parent if the directory does not exist yet, is watched using fsnotify.
+// If that's not possible we fall back to polling. A content ready file which cannot be parsed might still be
+// written, hence it's an error only if it stays that way for contentReadyFileParseTimeout. If the file is
+// verified, we keep waiting for a valid one.
+func waitForContentReadyFile(ctx context.Context, fn string, verify *contentReadyVerifier) (csapi.WorkspaceInitSource, error) {
+	dir := filepath.Dir(fn)
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		err = watcher.Add(dir)
+		if os.IsNotExist(err) {
+			// we start watching the directory once it's created
+			err = watcher.Add(filepath.Dir(dir))
+		}
+	}
+	if err != nil {
+		log.WithError(err).Warn("cannot watch for content ready file - falling back to polling")
+		return pollContentReadyFile(ctx, fn, verify)
+	}
+
+	var partial partialContentReadyFile
+	defer partial.Stop()
+
+	// the file might have been written before we started watching
+	if src, done, err := partial.Check(fn, verify); done {
+		return src, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-partial.Expired():
+			return "", partial.err
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return pollContentReadyFile(ctx, fn, verify)
+			}
+			if ev.Name == dir && ev.Op&fsnotify.Create != 0 {
+				err := watcher.Add(dir)
+				if err != nil {
+					log.WithError(err).Warn("cannot watch for content ready file - falling back to polling")
+					return pollContentReadyFile(ctx, fn, verify)
+				}
+				// the file might have been written before we started watching the directory
+			} else if ev.Name != fn || ev.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+
+			if src, done, err := partial.Check(fn, verify); done {
+				return src, err
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return pollContentReadyFile(ctx, fn, verify)
+			}
+			log.WithError(err).Warn("error while watching for content ready file")
+		}
+	}
+}
+
+func pollContentReadyFile(ctx context.Context, fn string, verify *contentReadyVerifier) (csapi.WorkspaceInitSource, error) {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+
+	var partial partialContentReadyFile
+	defer partial.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-partial.Expired():
+			return "", partial.err
+		case <-t.C:
+		}
+
+		if src, done, err := partial.Check(fn, verify); done {
+			return src, err
+		}
+	}
+}
+
+// contentReadyFileParseTimeout is the time a content ready file may remain unparseable before we give up on it.
+// Until then we assume it's still being written.
+const contentReadyFileParseTimeout = 2 * time.Second
+
+// partialContentReadyFile keeps track of a content ready file which cannot be parsed (yet)
+type partialContentReadyFile struct {
+	err   error
+	timer *time.Timer
+}
+
+// Check checks the content ready file fn like checkContentReadyFile does. If the file cannot be parsed,
+// Expired fires once that has been the case for contentReadyFileParseTimeout.
+func (p *partialContentReadyFile) Check(fn string, verify *contentReadyVerifier) (src csapi.WorkspaceInitSource, done bool, err error) {
+	src, done, err = checkContentReadyFile(fn, verify)
+	if done {
+		return src, done, err
+	}
+	if err == nil {
+		// the file is gone or empty again - it's being rewritten
+		p.Stop()
+		return "", false, nil
+	}
+
+	if p.timer == nil {
+		log.WithError(err).Debug("cannot parse content ready file - waiting for it to be written completely")
+		p.timer = time.NewTimer(contentReadyFileParseTimeout)
+	}
+	p.err = err
+	return "", false, nil
+}
+
+// Expired fires if the content ready file could not be parsed for contentReadyFileParseTimeout
+func (p *partialContentReadyFile) Expired() <-chan time.Time {
+	if p.timer == nil {
+		return nil
+	}
+	return p.timer.C
+}
+
+// Stop forgets about an unparseable content ready file
+func (p *partialContentReadyFile) Stop() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.timer = nil
+	p.err = nil
+}
+
+// checkContentReadyFile reads the content ready file fn. We're done waiting for the file once it was read
+// successfully. If its content cannot be parsed, err is set, but we're not done because the file might be
+// partially written. If the file is verified, we're done once it passes verification, because an invalid
+// file might be partially written or spoofed.
+func checkContentReadyFile(fn string, verify *contentReadyVerifier) (src csapi.WorkspaceInitSource, done bool, err error) {
+	b, err := os.ReadFile(fn)
+	if os.IsNotExist(err) || (err == nil && len(b) == 0) {
+		// the file does not exist or has not been written yet
+		return "", false, nil
+	}
+	if err != nil {
+		log.WithError(err).Error("cannot read content ready file")
+		return "", false, nil
+	}
+
+	var m csapi.WorkspaceReadyMessage
+	err = json.Unmarshal(b, &m)
+	if err != nil && verify != nil {
+		log.WithError(err).Warn("cannot unmarshal content ready file - waiting for a valid one")
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("cannot unmarshal content ready file: %w", err)
+	}
+	err = verify.Verify(m)
+	if err != nil {
+		log.WithError(err).WithField("source", m.Source).Warn("content ready file failed verification - waiting for a valid one")
+		return "", false, nil
+	}
+	return m.Source, true, nil
+}
+
+// logFormatter returns the formatter for supervisor's own log output in the given format.
+func logFormatter(format LogFormat, current logrus.Formatter) logrus.Formatter {
+	if format == LogFormatText {
+		return &logrus.TextFormatter{}
+	}
+	// the supervisor run command initializes JSON logging, hence there's nothing to do for LogFormatJSON
+	return current
+}
+
+// checkShutdownBudget warns if the time budgets of the shutdown exceed the pod termination grace period
+func checkShutdownBudget(cfg *Config) (exceeded bool) {
+	if budget := cfg.IDEShutdownBudget() + cfg.ChildProcessGraceBudget() + timeBudgetServiceShutdown + timeBudgetDaemonTeardown; budget <= terminationGracePeriod {
+		return false
+	}
+
+	log.WithField("ideShutdownTimeout", cfg.IDEShutdownBudget().String()).
+		WithField("childProcessGracePeriod", cfg.ChildProcessGraceBudget().String()).
+		WithField("timeBudgetServiceShutdown", timeBudgetServiceShutdown.String()).
+		WithField("timeBudgetDaemonTeardown", timeBudgetDaemonTeardown.String()).
+		WithField("terminationGracePeriod", terminationGracePeriod.String()).
+		Warn("IDE shutdown and daemon teardown budgets exceed the pod termination grace period - workspace might be killed before it's shut down properly")
+	return true
+}
+
+// childProcessGraceWindow returns the time child processes get to exit during shutdown. The window is
+// shortened so that the whole shutdown still fits in the termination grace period.
+func childProcessGraceWindow(cfg *Config) time.Duration {
+	window := cfg.ChildProcessGraceBudget()
+	if remaining := terminationGracePeriod - cfg.IDEShutdownBudget() - timeBudgetServiceShutdown - timeBudgetDaemonTeardown; remaining < window {
+		window = remaining
+	}
+	if window < 0 {
+		return 0
+	}
+	return window
+}
+
+// shutdownServices calls Shutdown on all services which implement Shutdownable and waits for them
+// to return for at most timeout. The services are shut down concurrently.
+func shutdownServices(services []RegisterableService, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, s := range services {
+		s, ok := s.(Shutdownable)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Shutdown(ctx)
+			if err != nil {
+				log.WithError(err).WithField("service", fmt.Sprintf("%T", s)).Warn("service shutdown failed")
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.WithField("timeout", timeout.String()).Warn("services did not shut down in time")
+	}
+}
+
+// terminateChildProcesses sends SIGTERM to all child processes and waits for them to exit for gracePeriod.
+// Child processes which are still running after the grace period get SIGKILL'ed.
+func terminateChildProcesses(gracePeriod time.Duration) {
 	parent := os.Getpid()
 
-	children, err := processesWithParent(parent)
+	children, err := processesWithParent(parent, false)
 	if err != nil {
 		log.WithError(err).WithField("pid", parent).Warn("cannot find children processes")
 		return
 	}
 
-	for pid, uid := range children {
-		privileged := false
-		if initializer.GitpodUID != uid {
-			privileged = true
+	signalChildProcesses(children, unix.SIGTERM)
+	if len(children) == 0 || gracePeriod <= 0 {
+		return
+	}
+
+	remaining := waitForChildProcesses(func() (map[int]int, error) { return processesWithParent(parent, false) }, gracePeriod, childProcessPollInterval)
+	if len(remaining) == 0 {
+		log.Debug("all child processes exited")
+		return
+	}
+
+	log.WithField("count", len(remaining)).WithField("gracePeriod", gracePeriod.String()).Warn("child processes did not exit in time - sending SIGKILL")
+	signalChildProcesses(remaining, unix.SIGKILL)
+}
+
+// signalChildProcesses sends sig to all children concurrently and logs failures per process
+func signalChildProcesses(children map[int]int, sig syscall.Signal) {
+	errs := signalProcesses(children, func(pid, uid int) error {
+		return signalProcess(pid, initializer.GitpodUID != uid, sig)
+	}, childProcessSignalConcurrency)
+	for pid, err := range errs {
+		log.WithError(err).WithField("pid", pid).WithField("signal", sig.String()).Warn("cannot signal child process")
+	}
+}
+
+// signalProcesses calls signal for all processes using at most concurrency workers.
+// Returns the errors that occurred per pid.
+func signalProcesses(processes map[int]int, signal func(pid, uid int) error, concurrency int) map[int]error {
+	type process struct{ PID, UID int }
+
+	var (
+		mu   sync.Mutex
+		errs = make(map[int]error)
+		wg   sync.WaitGroup
+		work = make(chan process)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				err := signal(p.PID, p.UID)
+				if err == nil {
+					continue
+				}
+
+				mu.Lock()
+				errs[p.PID] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	for pid, uid := range processes {
+		work <- process{PID: pid, UID: uid}
+	}
+	close(work)
+	wg.Wait()
+
+	return errs
+}
+
+// waitForChildProcesses polls the child processes until none are left or the grace period is over.
+// Returns the child processes which are still running.
+func waitForChildProcesses(children func() (map[int]int, error), gracePeriod, interval time.Duration) map[int]int {
+	deadline := time.Now().Add(gracePeriod)
+	for {
+		remaining, err := children()
+		if err != nil {
+			log.WithError(err).Warn("cannot find children processes")
+			return nil
+		}
+		if len(remaining) == 0 || !time.Now().Before(deadline) {
+			return remaining
 		}
 
-		terminateProcess(pid, privileged)
+		time.Sleep(interval)
 	}
 }
 
-func terminateProcess(pid int, privileged bool) {
+func signalProcess(pid int, privileged bool, sig syscall.Signal) error {
 	var err error
 	if privileged {
-		cmd := exec.Command("sudo", "kill", "-SIGTERM", fmt.Sprintf("%v", pid))
+		cmd := exec.Command("sudo", "kill", fmt.Sprintf("-%d", sig), fmt.Sprintf("%v", pid))
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		err = cmd.Run()
 	} else {
-		err = syscall.Kill(pid, unix.SIGTERM)
+		err = syscall.Kill(pid, sig)
 	}
 
 	if err != nil {
-		log.WithError(err).WithField("pid", pid).Warn("cannot terminate child process")
-		return
+		return err
 	}
 
-	log.WithField("pid", pid).Debug("SIGTERM'ed child process")
+	log.WithField("pid", pid).WithField("signal", sig.String()).Debug("signaled child process")
+	return nil
 }
 
-func processesWithParent(ppid int) (map[int]int, error) {
+// processesWithParent returns the pid and uid of all processes whose parent is ppid.
+// Zombie processes have already exited and are only included if includeZombies is true.
+func processesWithParent(ppid int, includeZombies bool) (map[int]int, error) {
 	procs, err := procfs.AllProcs()
 	if err != nil {
 		return nil, err
@@ -750,6 +2217,9 @@ func processesWithParent(ppid int) (map[int]int, error) {
 		if stat.PPID != ppid {
 			continue
 		}
+		if !includeZombies && stat.State == "Z" {
+			continue
+		}
 
 		status, err := proc.NewStatus()
 		if err != nil {
@@ -767,32 +2237,149 @@ func processesWithParent(ppid int) (map[int]int, error) {
 	return children, nil
 }
 
-func callDaemonTeardown() {
+// teardownDaemon asks ws-daemon to tear down this workspace. In a namespace the teardown is skipped unless
+// inNamespaceTeardown is set, in which case it's a best-effort attempt with a tight time budget.
+func teardownDaemon(inNamespace, inNamespaceTeardown bool, opts []InWorkspaceDaemonOption) (attempted bool) {
+	if !inNamespace {
+		err := callDaemonTeardown(timeBudgetDaemonTeardown, opts)
+		if err != nil {
+			log.WithError(err).Error("ungraceful shutdown - teardown was unsuccessful")
+		}
+		return true
+	}
+	if !inNamespaceTeardown {
+		return false
+	}
+
+	// the daemon socket is likely missing in a namespace, hence we check for it often within the short budget
+	opts = append(opts[:len(opts):len(opts)], WithDaemonPollInterval(namespaceDaemonPollInterval))
+	err := callDaemonTeardown(timeBudgetNamespaceDaemonTeardown, opts)
+	if err != nil {
+		log.WithError(err).Info("best-effort daemon teardown in namespace was unsuccessful")
+	}
+	return true
+}
+
+func callDaemonTeardown(budget time.Duration, opts []InWorkspaceDaemonOption) error {
 	log.Info("asking ws-daemon to tear down this workspace")
-	ctx, cancel := context.WithTimeout(context.Background(), timeBudgetDaemonTeardown)
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
 	defer cancel()
 
-	client, conn, err := ConnectToInWorkspaceDaemonService(ctx)
+	client, conn, err := ConnectToInWorkspaceDaemonService(ctx, opts...)
 	if err != nil {
-		log.WithError(err).Error("ungraceful shutdown - teardown was unsuccessful")
-		return
+		return err
 	}
 
 	defer conn.Close()
-	_, err = client.Teardown(ctx, &daemon.TeardownRequest{})
-	if err != nil {
-		log.WithError(err).Error("ungraceful shutdown - teardown was unsuccessful")
+	return teardownWithRetry(ctx, client, daemonTeardownBackoff)
+}
+
+const (
+	// daemonTeardownAttempts is the maximum number of teardown calls we make
+	daemonTeardownAttempts = 5
+
+	// daemonTeardownBackoff is the time we wait before retrying teardown. It doubles with every attempt.
+	daemonTeardownBackoff = 250 * time.Millisecond
+)
+
+// teardownWithRetry asks the daemon to tear down the workspace and retries transient failures
+// until daemonTeardownAttempts is reached or the context is done.
+func teardownWithRetry(ctx context.Context, client daemon.InWorkspaceServiceClient, backoff time.Duration) (err error) {
+	for attempt := 1; ; attempt++ {
+		_, err = client.Teardown(ctx, &daemon.TeardownRequest{})
+		if err == nil {
+			return nil
+		}
+
+		code := status.Code(err)
+		if code != codes.Unavailable && code != codes.DeadlineExceeded {
+			return err
+		}
+		if attempt >= daemonTeardownAttempts {
+			return err
+		}
+		// there's no point in waiting if the next attempt would not fit into the time budget
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return err
+		}
+
+		log.WithError(err).WithField("attempt", attempt).WithField("backoff", backoff.String()).Warn("daemon teardown failed - retrying")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+const (
+	// DefaultInWorkspaceDaemonSocket is the socket at which ws-daemon offers the InWorkspaceService
+	DefaultInWorkspaceDaemonSocket = "/.workspace/daemon.sock"
+
+	// DefaultInWorkspaceDaemonPollInterval is the time between two checks if the daemon socket exists
+	DefaultInWorkspaceDaemonPollInterval = 500 * time.Millisecond
+)
+
+// ErrDaemonSocketMissing is returned if the daemon socket did not appear before the context was canceled
+var ErrDaemonSocketMissing = errors.New("socket did not appear before context was canceled")
+
+// DaemonDialError is returned if the daemon socket exists, but connecting to it failed
+type DaemonDialError struct {
+	Socket string
+	Err    error
+}
+
+func (e *DaemonDialError) Error() string {
+	return fmt.Sprintf("cannot connect to %s: %v", e.Socket, e.Err)
+}
+
+func (e *DaemonDialError) Unwrap() error {
+	return e.Err
+}
+
+type inWorkspaceDaemonOptions struct {
+	Socket       string
+	PollInterval time.Duration
+	DialOptions  []grpc.DialOption
+}
+
+// InWorkspaceDaemonOption customizes the connection to the in-workspace daemon
+type InWorkspaceDaemonOption func(*inWorkspaceDaemonOptions)
+
+// WithDaemonSocket sets the socket at which the daemon is expected. Defaults to DefaultInWorkspaceDaemonSocket.
+func WithDaemonSocket(fn string) InWorkspaceDaemonOption {
+	return func(o *inWorkspaceDaemonOptions) {
+		o.Socket = fn
+	}
+}
+
+// WithDaemonPollInterval sets the time between two checks if the daemon socket exists.
+// Defaults to DefaultInWorkspaceDaemonPollInterval.
+func WithDaemonPollInterval(interval time.Duration) InWorkspaceDaemonOption {
+	return func(o *inWorkspaceDaemonOptions) {
+		o.PollInterval = interval
 	}
 }
 
 // ConnectToInWorkspaceDaemonService attempts to connect to the InWorkspaceService offered by the ws-daemon.
-func ConnectToInWorkspaceDaemonService(ctx context.Context) (daemon.InWorkspaceServiceClient, *grpc.ClientConn, error) {
-	const socketFN = "/.workspace/daemon.sock"
+// It waits for the daemon socket to appear and for the connection to be established until the context
+// is canceled. If the socket never appears ErrDaemonSocketMissing is returned, if connecting fails
+// the error is a *DaemonDialError.
+func ConnectToInWorkspaceDaemonService(ctx context.Context, opts ...InWorkspaceDaemonOption) (daemon.InWorkspaceServiceClient, *grpc.ClientConn, error) {
+	cfg := inWorkspaceDaemonOptions{
+		Socket:       DefaultInWorkspaceDaemonSocket,
+		PollInterval: DefaultInWorkspaceDaemonPollInterval,
+		DialOptions:  []grpc.DialOption{grpc.WithInsecure()},
+	}
+	for _, o := range opts {
+		o(&cfg)
+	}
 
-	t := time.NewTicker(500 * time.Millisecond)
+	t := time.NewTicker(cfg.PollInterval)
 	defer t.Stop()
 	for {
-		if _, err := os.Stat(socketFN); err == nil {
+		if _, err := os.Stat(cfg.Socket); err == nil {
 			break
 		}
 
@@ -800,13 +2387,17 @@ func ConnectToInWorkspaceDaemonService(ctx context.Context) (daemon.InWorkspaceS
 		case <-t.C:
 			continue
 		case <-ctx.Done():
-			return nil, nil, fmt.Errorf("socket did not appear before context was canceled")
+			return nil, nil, ErrDaemonSocketMissing
 		}
 	}
 
-	conn, err := grpc.DialContext(ctx, "unix://"+socketFN, grpc.WithInsecure())
+	// copy the dial options so that we never modify the caller's slice
+	dialOpts := make([]grpc.DialOption, 0, len(cfg.DialOptions)+1)
+	dialOpts = append(dialOpts, cfg.DialOptions...)
+	dialOpts = append(dialOpts, grpc.WithBlock())
+	conn, err := grpc.DialContext(ctx, "unix://"+cfg.Socket, dialOpts...)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, &DaemonDialError{Socket: cfg.Socket, Err: err}
 	}
 	return daemon.NewInWorkspaceServiceClient(conn), conn, nil
 }
@@ -0,0 +1,2158 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/common-go/util"
+	csapi "github.com/gitpod-io/gitpod/content-service/api"
+	gitpod "github.com/gitpod-io/gitpod/gitpod-protocol"
+	"github.com/gitpod-io/gitpod/supervisor/api"
+	"github.com/gitpod-io/gitpod/supervisor/pkg/ports"
+	"github.com/gitpod-io/gitpod/supervisor/pkg/terminal"
+	daemon "github.com/gitpod-io/gitpod/ws-daemon/api"
+)
+
+func TestCrashLoopDetector(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Threshold   int
+		Window      time.Duration
+		Exits       []time.Duration
+		Expectation []bool
+	}{
+		{
+			Desc:        "below threshold",
+			Threshold:   3,
+			Window:      time.Minute,
+			Exits:       []time.Duration{0, time.Second, 2 * time.Second},
+			Expectation: []bool{false, false, false},
+		},
+		{
+			Desc:        "crash loop notifies once",
+			Threshold:   2,
+			Window:      time.Minute,
+			Exits:       []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second},
+			Expectation: []bool{false, false, true, false, false},
+		},
+		{
+			Desc:        "exits outside window",
+			Threshold:   2,
+			Window:      time.Minute,
+			Exits:       []time.Duration{0, 2 * time.Minute, 4 * time.Minute, 6 * time.Minute},
+			Expectation: []bool{false, false, false, false},
+		},
+		{
+			Desc:        "notifies again after IDE stabilized",
+			Threshold:   1,
+			Window:      time.Minute,
+			Exits:       []time.Duration{0, time.Second, 2 * time.Second, 10 * time.Minute, 10*time.Minute + time.Second},
+			Expectation: []bool{false, true, false, false, true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var (
+				start = time.Now()
+				d     = newCrashLoopDetector(test.Threshold, test.Window)
+				res   []bool
+			)
+			for _, e := range test.Exits {
+				res = append(res, d.Exited(start.Add(e)))
+			}
+
+			if diff := cmp.Diff(test.Expectation, res); diff != "" {
+				t.Errorf("unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWaitForContentReadyFile(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Dir         string
+		Content     string
+		Delay       time.Duration
+		Rest        string
+		Expectation csapi.WorkspaceInitSource
+		ExpectErr   bool
+		ExpectTO    bool
+	}{
+		{
+			Desc:        "file exists already",
+			Content:     `{"source":"from-other"}`,
+			Expectation: csapi.WorkspaceInitFromOther,
+		},
+		{
+			Desc:        "file appears later",
+			Content:     `{"source":"from-backup"}`,
+			Delay:       100 * time.Millisecond,
+			Expectation: csapi.WorkspaceInitFromBackup,
+		},
+		{
+			Desc:        "directory appears later",
+			Dir:         ".gitpod",
+			Content:     `{"source":"from-prebuild"}`,
+			Delay:       100 * time.Millisecond,
+			Expectation: csapi.WorkspaceInitFromPrebuild,
+		},
+		{
+			Desc:      "invalid file",
+			Content:   `{"source":`,
+			ExpectErr: true,
+		},
+		{
+			Desc:      "invalid file appears later",
+			Content:   `not json`,
+			Delay:     100 * time.Millisecond,
+			ExpectErr: true,
+		},
+		{
+			Desc:        "partially written file",
+			Content:     `{"source":`,
+			Rest:        `"from-backup"}`,
+			Expectation: csapi.WorkspaceInitFromBackup,
+		},
+		{
+			Desc:        "partially written file appears later",
+			Content:     `{"sou`,
+			Delay:       100 * time.Millisecond,
+			Rest:        `rce":"from-prebuild"}`,
+			Expectation: csapi.WorkspaceInitFromPrebuild,
+		},
+		{
+			Desc:      "file never appears",
+			ExpectErr: true,
+			ExpectTO:  true,
+		},
+	}
+
+	waitFuncs := map[string]func(context.Context, string, *contentReadyVerifier) (csapi.WorkspaceInitSource, error){
+		"fsnotify": waitForContentReadyFile,
+		"polling":  pollContentReadyFile,
+	}
+	// the fsnotify path must not silently fall back to polling
+	logs := logtest.NewLocal(log.Log.Logger)
+	defer log.Log.Logger.ReplaceHooks(make(logrus.LevelHooks))
+
+	for name, wait := range waitFuncs {
+		for _, test := range tests {
+			wait := wait
+			t.Run(name+" "+test.Desc, func(t *testing.T) {
+				logs.Reset()
+				defer func() {
+					for _, e := range logs.AllEntries() {
+						if e.Level <= logrus.WarnLevel {
+							t.Errorf("unexpected log entry: %s", e.Message)
+						}
+					}
+				}()
+				fn := filepath.Join(t.TempDir(), test.Dir, "ready")
+				writeFile := func() {
+					err := os.MkdirAll(filepath.Dir(fn), 0755)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					err = os.WriteFile(fn, []byte(test.Content), 0644)
+					if err != nil {
+						t.Error(err)
+					}
+				}
+				writeRest := func() {
+					f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0644)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer f.Close()
+					_, err = f.WriteString(test.Rest)
+					if err != nil {
+						t.Error(err)
+					}
+				}
+				if test.Content != "" {
+					if test.Delay == 0 {
+						writeFile()
+					} else {
+						time.AfterFunc(test.Delay, writeFile)
+					}
+				}
+				if test.Rest != "" {
+					// the rest of the file is written well within contentReadyFileParseTimeout
+					time.AfterFunc(test.Delay+500*time.Millisecond, writeRest)
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), 2*contentReadyFileParseTimeout)
+				defer cancel()
+				t0 := time.Now()
+				src, err := wait(ctx, fn, nil)
+				if test.ExpectErr && !test.ExpectTO && time.Since(t0) < contentReadyFileParseTimeout {
+					t.Errorf("gave up on the content ready file after %s", time.Since(t0))
+				}
+				if (err != nil) != test.ExpectErr {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if errors.Is(err, context.DeadlineExceeded) != test.ExpectTO {
+					t.Fatalf("unexpected timeout: %v", err)
+				}
+				if diff := cmp.Diff(test.Expectation, src); diff != "" {
+					t.Errorf("unexpected result (-want +got):\n%s", diff)
+				}
+			})
+		}
+	}
+}
+
+func TestAwaitContentReadyFile(t *testing.T) {
+	tests := []struct {
+		Desc          string
+		Timeout       time.Duration
+		Content       string
+		Cancel        bool
+		Expectation   csapi.WorkspaceInitSource
+		ExpectTimeout bool
+	}{
+		{
+			Desc:        "content available",
+			Timeout:     time.Second,
+			Content:     `{"source":"from-other"}`,
+			Expectation: csapi.WorkspaceInitFromOther,
+		},
+		{
+			Desc:          "timeout",
+			Timeout:       100 * time.Millisecond,
+			ExpectTimeout: true,
+		},
+		{
+			Desc:    "shutdown",
+			Timeout: time.Minute,
+			Cancel:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "ready")
+			if test.Content != "" {
+				err := os.WriteFile(fn, []byte(test.Content), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.Cancel {
+				time.AfterFunc(100*time.Millisecond, cancel)
+			}
+
+			cfg := &Config{StaticConfig: StaticConfig{ContentInitTimeout: util.Duration(test.Timeout)}}
+			t0 := time.Now()
+			src, err := awaitContentReadyFile(ctx, cfg, fn)
+			if dt := time.Since(t0); dt > 5*time.Second {
+				t.Errorf("waited for %s", dt)
+			}
+			if test.ExpectTimeout {
+				if err == nil || !strings.Contains(err.Error(), "did not become available within 100ms") {
+					t.Errorf("expected timeout error, got %v", err)
+				}
+			} else if test.Cancel {
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("expected context.Canceled, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(test.Expectation, src); diff != "" {
+				t.Errorf("unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPrepareIDELaunch(t *testing.T) {
+	tests := []struct {
+		Desc         string
+		Config       IDEConfig
+		ExpectedArgs []string
+		ExpectedDir  string
+	}{
+		{
+			Desc:         "default",
+			ExpectedArgs: []string{"/ide/entrypoint", "/workspace", "--port", "23000", "--hostname", "0.0.0.0"},
+		},
+		{
+			Desc:         "bind host and workdir",
+			Config:       IDEConfig{IDEBindHost: "127.0.0.1", IDEWorkdir: "/workspace/project"},
+			ExpectedArgs: []string{"/ide/entrypoint", "/workspace/project", "--port", "23000", "--hostname", "127.0.0.1"},
+			ExpectedDir:  "/workspace/project",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var cfg Config
+			cfg.IDEConfig = test.Config
+			cfg.Entrypoint = "/ide/entrypoint"
+			cfg.IDEPort = 23000
+			cfg.WorkspaceRoot = "/workspace"
+
+			cmd := prepareIDELaunch(&cfg)
+			if diff := cmp.Diff(test.ExpectedArgs, cmd.Args); diff != "" {
+				t.Errorf("unexpected args (-want +got):\n%s", diff)
+			}
+			if cmd.Dir != test.ExpectedDir {
+				t.Errorf("unexpected working directory: expected %q, got %q", test.ExpectedDir, cmd.Dir)
+			}
+		})
+	}
+}
+
+func TestBuildIDEEnv(t *testing.T) {
+	env := map[string]string{
+		"GITPOD_WORKSPACE_ID":     "foobar",
+		"GITPOD_TOKENS":           "secret",
+		"KUBERNETES_SERVICE_HOST": "10.0.0.1",
+		"MY_VAR":                  "value",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	tests := []struct {
+		Desc        string
+		Allowlist   []string
+		Expectation map[string]bool
+	}{
+		{
+			Desc: "blacklist",
+			Expectation: map[string]bool{
+				"GITPOD_WORKSPACE_ID": true,
+				"MY_VAR":              true,
+				"SUPERVISOR_ADDR":     true,
+			},
+		},
+		{
+			Desc:      "allowlist",
+			Allowlist: []string{"GITPOD_", "KUBERNETES_"},
+			Expectation: map[string]bool{
+				"GITPOD_WORKSPACE_ID":     true,
+				"GITPOD_TOKENS":           true,
+				"KUBERNETES_SERVICE_HOST": true,
+				"SUPERVISOR_ADDR":         true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			cfg := &Config{StaticConfig: StaticConfig{EnvvarAllowlist: test.Allowlist}}
+
+			act := make(map[string]bool)
+			for _, e := range buildIDEEnv(cfg) {
+				nme := strings.Split(e, "=")[0]
+				if _, ok := env[nme]; ok || nme == "SUPERVISOR_ADDR" {
+					act[nme] = true
+				}
+			}
+
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestIsBlacklistedEnvvar(t *testing.T) {
+	cfg := &Config{StaticConfig: StaticConfig{
+		EnvvarBlacklistPrefixes: []string{"AWS_"},
+		EnvvarBlacklist:         []string{"MY_SECRET"},
+	}}
+
+	tests := []struct {
+		Name        string
+		Expectation bool
+	}{
+		{Name: "GITPOD_TOKENS", Expectation: true},
+		{Name: "KUBERNETES_PORT_443_TCP", Expectation: true},
+		{Name: "AWS_SECRET_ACCESS_KEY", Expectation: true},
+		{Name: "MY_SECRET", Expectation: true},
+		{Name: "MY_SECRET_NOT", Expectation: false},
+		{Name: "GITPOD_WORKSPACE_ID", Expectation: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			act := isBlacklistedEnvvar(cfg, test.Name)
+			if act != test.Expectation {
+				t.Errorf("unexpected result: expected %v, got %v", test.Expectation, act)
+			}
+		})
+	}
+}
+
+func TestGRPCReadinessProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Stop()
+
+	var cfg Config
+	cfg.ReadinessProbe.Type = ReadinessGRPCProbe
+	cfg.ReadinessProbe.Interval = util.Duration(10 * time.Millisecond)
+	cfg.ReadinessProbe.GRPCProbe.Addr = l.Addr().String()
+
+	done := make(chan struct{})
+	go func() {
+		runIDEReadinessProbe(context.Background(), &cfg)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("IDE became ready although it is not serving")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("IDE did not become ready")
+	}
+}
+
+func TestHTTPReadinessProbeSuccessThreshold(t *testing.T) {
+	const (
+		ok       = http.StatusOK
+		notReady = http.StatusServiceUnavailable
+	)
+	tests := []struct {
+		Desc      string
+		Threshold int
+		// Statuses are the status codes the IDE responds with. Once they are exhausted, the IDE responds with 200.
+		Statuses []int
+		// Requests is the number of requests the probe makes until the IDE is ready
+		Requests int
+	}{
+		{Desc: "default", Statuses: []int{notReady, ok}, Requests: 2},
+		{Desc: "threshold of one", Threshold: 1, Statuses: []int{notReady, ok}, Requests: 2},
+		{Desc: "consecutive successes", Threshold: 3, Statuses: []int{ok, ok, ok}, Requests: 3},
+		{Desc: "failures before successes", Threshold: 2, Statuses: []int{notReady, notReady, ok, ok}, Requests: 4},
+		{Desc: "failure resets successes", Threshold: 3, Statuses: []int{ok, ok, notReady, ok, ok, ok}, Requests: 6},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				requests int
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if r.URL.Path != "/ready" {
+					t.Errorf("unexpected probe path: %s", r.URL.Path)
+				}
+				status := ok
+				if requests < len(test.Statuses) {
+					status = test.Statuses[requests]
+				}
+				requests++
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			var cfg Config
+			cfg.IDEBindHost = "127.0.0.1"
+			cfg.IDEPort = srv.Listener.Addr().(*net.TCPAddr).Port
+			cfg.ReadinessProbe.Type = ReadinessHTTPProbe
+			cfg.ReadinessProbe.Interval = util.Duration(time.Millisecond)
+			cfg.ReadinessProbe.HTTPProbe.Path = "/ready"
+			cfg.ReadinessProbe.HTTPProbe.SuccessThreshold = test.Threshold
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !runIDEReadinessProbe(ctx, &cfg) {
+				t.Fatal("IDE did not become ready")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if requests != test.Requests {
+				t.Errorf("unexpected number of probe requests: expected %d, got %d", test.Requests, requests)
+			}
+		})
+	}
+}
+
+func TestTCPReadinessProbe(t *testing.T) {
+	tests := []struct {
+		Desc      string
+		ProbePort bool
+		BindHost  string
+	}{
+		{Desc: "probe port", ProbePort: true},
+		{Desc: "IDE port"},
+		{Desc: "bind host", BindHost: "127.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			host := test.BindHost
+			if host == "" {
+				host = "localhost"
+			}
+			// find a free port and leave it unused until the IDE becomes ready
+			l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := l.Addr().String()
+			port := l.Addr().(*net.TCPAddr).Port
+			l.Close()
+
+			var cfg Config
+			cfg.ReadinessProbe.Type = ReadinessTCPProbe
+			cfg.ReadinessProbe.Interval = util.Duration(10 * time.Millisecond)
+			cfg.ReadinessProbe.TCPProbe.Timeout = util.Duration(100 * time.Millisecond)
+			cfg.IDEBindHost = test.BindHost
+			if test.ProbePort {
+				cfg.IDEPort = 1
+				cfg.ReadinessProbe.TCPProbe.Port = port
+			} else {
+				cfg.IDEPort = port
+			}
+
+			done := make(chan struct{})
+			go func() {
+				runIDEReadinessProbe(context.Background(), &cfg)
+				close(done)
+			}()
+
+			select {
+			case <-done:
+				t.Fatal("IDE became ready although it is not listening")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			l, err = net.Listen("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("IDE did not become ready")
+			}
+		})
+	}
+}
+
+func TestGitSettings(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		GitConfig   map[string]string
+		Expectation [][]string
+	}{
+		{
+			Desc: "defaults",
+			Expectation: [][]string{
+				{"push.default", "simple"},
+				{"credential.helper", "/usr/bin/gp credential-helper"},
+			},
+		},
+		{
+			Desc: "user config",
+			GitConfig: map[string]string{
+				"push.default":                      "current",
+				"core.editor":                       "vim",
+				"url.git@github.com:.pushInsteadOf": "https://github.com/",
+				"invalid":                           "foo",
+				"core.":                             "foo",
+			},
+			Expectation: [][]string{
+				{"push.default", "current"},
+				{"credential.helper", "/usr/bin/gp credential-helper"},
+				{"core.editor", "vim"},
+				{"url.git@github.com:.pushInsteadOf", "https://github.com/"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var act [][]string
+			for _, s := range gitSettings(&Config{}, test.GitConfig) {
+				if s[0] == "alias.lg" {
+					continue
+				}
+				act = append(act, s)
+			}
+
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGitLFSSettings(t *testing.T) {
+	lfsSettings := [][]string{
+		{"filter.lfs.clean", "git-lfs clean -- %f"},
+		{"filter.lfs.smudge", "git-lfs smudge -- %f"},
+		{"filter.lfs.process", "git-lfs filter-process"},
+		{"filter.lfs.required", "true"},
+		{"lfs.cachecredentials", "true"},
+		{"lfs.concurrenttransfers", "8"},
+	}
+
+	tests := []struct {
+		Desc         string
+		EnableGitLFS bool
+		LFSAvailable bool
+		Expectation  [][]string
+	}{
+		{Desc: "disabled", LFSAvailable: true},
+		{Desc: "enabled", EnableGitLFS: true, LFSAvailable: true, Expectation: lfsSettings},
+		{Desc: "enabled but not installed", EnableGitLFS: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			// git lfs is available if `git lfs version` succeeds
+			exitCode := 1
+			if test.LFSAvailable {
+				exitCode = 0
+			}
+			bin := t.TempDir()
+			err := os.WriteFile(filepath.Join(bin, "git"), []byte(fmt.Sprintf("#!/bin/sh\nexit %d\n", exitCode)), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Setenv("PATH", os.Getenv("PATH"))
+			os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			var act [][]string
+			for _, s := range gitSettings(&Config{WorkspaceConfig: WorkspaceConfig{EnableGitLFS: test.EnableGitLFS}}, nil) {
+				if strings.HasPrefix(s[0], "filter.lfs.") || strings.HasPrefix(s[0], "lfs.") {
+					act = append(act, s)
+				}
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected LFS settings (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChangedGitConfig(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Prev        map[string]string
+		Next        map[string]string
+		Expectation map[string]string
+	}{
+		{
+			Desc:        "initial config",
+			Next:        map[string]string{"core.editor": "vim"},
+			Expectation: map[string]string{"core.editor": "vim"},
+		},
+		{
+			Desc:        "unchanged",
+			Prev:        map[string]string{"core.editor": "vim"},
+			Next:        map[string]string{"core.editor": "vim"},
+			Expectation: map[string]string{},
+		},
+		{
+			Desc:        "changed and added",
+			Prev:        map[string]string{"core.editor": "vim", "alias.co": "checkout"},
+			Next:        map[string]string{"core.editor": "nano", "alias.co": "checkout", "alias.st": "status"},
+			Expectation: map[string]string{"core.editor": "nano", "alias.st": "status"},
+		},
+		{
+			Desc:        "removed",
+			Prev:        map[string]string{"core.editor": "vim"},
+			Expectation: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := changedGitConfig(test.Prev, test.Next)
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProbeMetadataEndpoints(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests = make(map[string]string)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path] = r.Header.Get("X-Test")
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	unreachable := metadataEndpoint{Method: http.MethodGet, URL: "http://localhost:1/unreachable"}
+	tests := []struct {
+		Desc        string
+		Endpoints   map[string]metadataEndpoint
+		Expectation bool
+	}{
+		{
+			Desc:      "none reachable",
+			Endpoints: map[string]metadataEndpoint{"a": unreachable, "b": unreachable},
+		},
+		{
+			Desc: "one reachable",
+			Endpoints: map[string]metadataEndpoint{
+				"a": unreachable,
+				"b": {Method: http.MethodPut, URL: srv.URL + "/token", Header: map[string]string{"X-Test": "b"}},
+			},
+			Expectation: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			act := probeMetadataEndpoints(ctx, test.Endpoints)
+			if act != test.Expectation {
+				t.Errorf("unexpected result: expected %v, got %v", test.Expectation, act)
+			}
+		})
+	}
+
+	if diff := cmp.Diff(map[string]string{"PUT /token": "b"}, requests); diff != "" {
+		t.Errorf("unexpected requests (-want +got):\n%s", diff)
+	}
+}
+
+func TestConfirmMetadataAccess(t *testing.T) {
+	tests := []struct {
+		Desc          string
+		Results       []bool
+		Attempts      int
+		Expectation   bool
+		ExpectedCalls int
+	}{
+		{Desc: "no access", Results: []bool{false}, Attempts: 2, ExpectedCalls: 1},
+		{Desc: "transient access", Results: []bool{true, false}, Attempts: 2, ExpectedCalls: 2},
+		{Desc: "confirmed access", Results: []bool{true, true}, Attempts: 2, Expectation: true, ExpectedCalls: 2},
+		{Desc: "single attempt", Results: []bool{true}, Attempts: 1, Expectation: true, ExpectedCalls: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var calls int
+			check := func() bool {
+				res := test.Results[calls]
+				calls++
+				return res
+			}
+
+			act := confirmMetadataAccess(context.Background(), check, test.Attempts, time.Millisecond)
+			if act != test.Expectation {
+				t.Errorf("unexpected result: expected %v, got %v", test.Expectation, act)
+			}
+			if calls != test.ExpectedCalls {
+				t.Errorf("unexpected number of checks: expected %d, got %d", test.ExpectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestReapEventLog(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Events      int
+		Expectation []int
+	}{
+		{Desc: "empty", Events: 0, Expectation: nil},
+		{Desc: "partially filled", Events: 3, Expectation: []int{0, 1, 2}},
+		{Desc: "exactly full", Events: reapEventHistory, Expectation: pidRange(0, reapEventHistory)},
+		{Desc: "wrapped around", Events: reapEventHistory + 5, Expectation: pidRange(5, reapEventHistory+5)},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var l reapEventLog
+			for i := 0; i < test.Events; i++ {
+				l.Add(reapEvent{PID: i})
+			}
+
+			var act []int
+			for _, evt := range l.Events() {
+				act = append(act, evt.PID)
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected events (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func pidRange(from, to int) []int {
+	res := make([]int, 0, to-from)
+	for i := from; i < to; i++ {
+		res = append(res, i)
+	}
+	return res
+}
+
+func TestIsTerminated(t *testing.T) {
+	// synthetic wait statuses as encoded by Linux, see wait(2)
+	tests := []struct {
+		Desc        string
+		Status      unix.WaitStatus
+		Expectation bool
+	}{
+		{Desc: "exited", Status: 0, Expectation: true},
+		{Desc: "exited with code", Status: 42 << 8, Expectation: true},
+		{Desc: "killed", Status: unix.WaitStatus(unix.SIGKILL), Expectation: true},
+		{Desc: "killed with core dump", Status: unix.WaitStatus(unix.SIGSEGV) | 0x80, Expectation: true},
+		{Desc: "stopped", Status: unix.WaitStatus(unix.SIGSTOP)<<8 | 0x7f},
+		{Desc: "stopped by terminal", Status: unix.WaitStatus(unix.SIGTSTP)<<8 | 0x7f},
+		{Desc: "continued", Status: 0xffff},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := isTerminated(test.Status)
+			if act != test.Expectation {
+				t.Errorf("unexpected result: expected %v, got %v (exited: %v, signaled: %v, stopped: %v, continued: %v)",
+					test.Expectation, act, test.Status.Exited(), test.Status.Signaled(), test.Status.Stopped(), test.Status.Continued())
+			}
+		})
+	}
+}
+
+func TestReaperStress(t *testing.T) {
+	const children = 200
+
+	bin, err := exec.LookPath("true")
+	if err != nil {
+		t.Skip("true is not available")
+	}
+	m, err := newMetrics(prometheus.NewRegistry(), terminal.NewMux(), &ports.Manager{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		// a signal buffer of one makes sure SIGCHLDs coalesce
+		reaper(ctx, nil, 1, m, &reapEventLog{})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	pids := make([]int, 0, children)
+	for i := 0; i < children; i++ {
+		pid, err := syscall.ForkExec(bin, []string{bin}, &syscall.ProcAttr{})
+		if err != nil {
+			t.Fatalf("cannot start child %d: %v", i, err)
+		}
+		pids = append(pids, pid)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for testutil.ToFloat64(m.ReapedProcesses) < children {
+		if time.Now().After(deadline) {
+			t.Fatalf("reaper did not reap all children: expected %d, got %v", children, testutil.ToFloat64(m.ReapedProcesses))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, pid := range pids {
+		_, err := unix.Wait4(pid, nil, unix.WNOHANG, nil)
+		if err != unix.ECHILD {
+			t.Errorf("child %d was not reaped: %v", pid, err)
+		}
+	}
+}
+
+func TestIDEExitFromError(t *testing.T) {
+	t0 := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Desc        string
+		Script      string
+		Expectation ideExit
+	}{
+		{Desc: "clean exit", Script: "exit 0", Expectation: ideExit{ExitCode: 0, Time: t0}},
+		{Desc: "exit code", Script: "exit 42", Expectation: ideExit{ExitCode: 42, Time: t0}},
+		{Desc: "segmentation fault", Script: "kill -SEGV $$", Expectation: ideExit{ExitCode: -1, Signal: "segmentation fault", Time: t0}},
+		{Desc: "killed", Script: "kill -KILL $$", Expectation: ideExit{ExitCode: -1, Signal: "killed", Time: t0}},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			err := exec.Command("/bin/sh", "-c", test.Script).Run()
+
+			act, ok := ideExitFromError(err, t0)
+			if !ok {
+				t.Fatalf("exit of %v is unknown", err)
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected exit (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("not waited for", func(t *testing.T) {
+		_, ok := ideExitFromError(errors.New("wait: no child processes"), t0)
+		if ok {
+			t.Error("exit is known although the process was not waited for")
+		}
+	})
+}
+
+func TestIDEExitLog(t *testing.T) {
+	var l ideExitLog
+	for i := 0; i < ideExitHistory+3; i++ {
+		l.Add(ideExit{ExitCode: i})
+	}
+
+	var act []int
+	for _, exit := range l.Exits() {
+		act = append(act, exit.ExitCode)
+	}
+	if diff := cmp.Diff(pidRange(3, ideExitHistory+3), act); diff != "" {
+		t.Errorf("unexpected exits (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplyLiveConfig(t *testing.T) {
+	tests := []struct {
+		Desc    string
+		Change  func(cfg *Config)
+		Applied []string
+		Ignored []string
+	}{
+		{
+			Desc:   "no change",
+			Change: func(cfg *Config) {},
+		},
+		{
+			Desc: "live changes",
+			Change: func(cfg *Config) {
+				cfg.IDELogRateLimit = 10
+				cfg.ReadinessProbe.Type = ReadinessHTTPProbe
+				cfg.IDELogRateLimitStderr = 5
+			},
+			Applied: []string{"IDELogRateLimit", "IDELogRateLimitStderr", "ReadinessProbe"},
+		},
+		{
+			Desc: "environment",
+			Change: func(cfg *Config) {
+				cfg.WorkspaceLogRateLimit = 5
+				cfg.GitUsername = "foo"
+				cfg.GitEmail = "foo@bar.com"
+				cfg.EnableGitLFS = true
+			},
+			Ignored: []string{"WorkspaceLogRateLimit", "GitUsername", "GitEmail", "EnableGitLFS"},
+		},
+		{
+			Desc: "restart required",
+			Change: func(cfg *Config) {
+				cfg.APIEndpointPort = 1234
+				cfg.Entrypoint = "/foo"
+				cfg.DebugEnable = true
+			},
+			Ignored: []string{"APIEndpointPort", "Entrypoint", "DebugEnable"},
+		},
+		{
+			Desc: "mixed",
+			Change: func(cfg *Config) {
+				cfg.IDELogRateLimitStdout = 5
+				cfg.EnvvarBlacklist = []string{"FOO"}
+			},
+			Applied: []string{"IDELogRateLimitStdout"},
+			Ignored: []string{"EnvvarBlacklist"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			cur := &Config{
+				StaticConfig: StaticConfig{APIEndpointPort: 22999},
+				IDEConfig:    IDEConfig{Entrypoint: "/ide/startup.sh"},
+			}
+			next := *cur
+			test.Change(&next)
+
+			res, applied, ignored := applyLiveConfig(cur, &next)
+			if diff := cmp.Diff(test.Applied, applied); diff != "" {
+				t.Errorf("unexpected applied fields (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(test.Ignored, ignored); diff != "" {
+				t.Errorf("unexpected ignored fields (-want +got):\n%s", diff)
+			}
+
+			// applying the result again must yield no applicable changes
+			_, reapplied, _ := applyLiveConfig(res, &next)
+			if len(reapplied) != 0 {
+				t.Errorf("live changes were not applied: %v", reapplied)
+			}
+			if cur.IDELogRateLimit != 0 || cur.ReadinessProbe.Type != ReadinessProcessProbe {
+				t.Errorf("current config was modified")
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	env := map[string]string{
+		"GITPOD_THEIA_PORT":     "23000",
+		"THEIA_WORKSPACE_ROOT":  "/workspace",
+		"GITPOD_GIT_USER_EMAIL": "foo@bar.com",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	tmpdir := t.TempDir()
+	var (
+		entrypoint = filepath.Join(tmpdir, "startup.sh")
+		ideFn      = filepath.Join(tmpdir, "ide.json")
+		staticFn   = filepath.Join(tmpdir, "supervisor-config.json")
+	)
+	err := os.WriteFile(entrypoint, nil, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeJSON := func(fn string, content map[string]interface{}) {
+		fc, err := json.Marshal(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fn, fc, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	static := map[string]interface{}{
+		"ideConfigLocation": ideFn,
+		"frontendLocation":  tmpdir,
+		"apiEndpointPort":   22999,
+	}
+	writeJSON(staticFn, static)
+	writeJSON(ideFn, map[string]interface{}{
+		"entrypoint": entrypoint,
+	})
+
+	load := func() (*Config, error) { return loadConfig(staticFn) }
+	cfg, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveCfg := newLiveConfig(cfg)
+
+	// changes to the IDE config are applied
+	writeJSON(ideFn, map[string]interface{}{
+		"entrypoint":     entrypoint,
+		"logRateLimit":   10,
+		"readinessProbe": map[string]interface{}{"type": "http", "http": map[string]interface{}{"path": "/ready"}},
+	})
+	reloadConfig(liveCfg, load)
+	act := liveCfg.Get()
+	if act == cfg {
+		t.Fatal("config was not replaced")
+	}
+	if act.IDELogRateLimit != 10 || act.ReadinessProbe.Type != ReadinessHTTPProbe || act.ReadinessProbe.HTTPProbe.Path != "/ready" {
+		t.Errorf("IDE config changes were not applied: %+v", act.IDEConfig)
+	}
+	if cfg.IDELogRateLimit != 0 || cfg.ReadinessProbe.Type != ReadinessProcessProbe {
+		t.Errorf("previous config was modified")
+	}
+	if act.GitEmail != "foo@bar.com" || act.WorkspaceRoot != "/workspace" {
+		t.Errorf("workspace config was not retained: %+v", act.WorkspaceConfig)
+	}
+
+	// changes which require a restart are ignored
+	static["apiEndpointPort"] = 23001
+	writeJSON(staticFn, static)
+	reloadConfig(liveCfg, load)
+	if liveCfg.Get() != act {
+		t.Errorf("config was replaced although no change could be applied")
+	}
+	if liveCfg.Get().APIEndpointPort != 22999 {
+		t.Errorf("static config change was applied: apiEndpointPort %d", liveCfg.Get().APIEndpointPort)
+	}
+
+	// Git config changes are ignored, but we say so
+	logs := logtest.NewLocal(log.Log.Logger)
+	defer log.Log.Logger.ReplaceHooks(make(logrus.LevelHooks))
+	os.Setenv("GITPOD_GIT_USER_EMAIL", "bar@foo.com")
+	reloadConfig(liveCfg, load)
+	if liveCfg.Get().GitEmail != "foo@bar.com" {
+		t.Errorf("Git config change was applied: %s", liveCfg.Get().GitEmail)
+	}
+	var warned bool
+	for _, e := range logs.AllEntries() {
+		if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "Git") {
+			warned = true
+			if diff := cmp.Diff([]string{"GitEmail"}, e.Data["fields"]); diff != "" {
+				t.Errorf("unexpected ignored Git fields (-want +got):\n%s", diff)
+			}
+		}
+	}
+	if !warned {
+		t.Errorf("ignored Git config change was not logged")
+	}
+	os.Setenv("GITPOD_GIT_USER_EMAIL", "foo@bar.com")
+
+	// invalid configs are not applied
+	writeJSON(ideFn, map[string]interface{}{
+		"entrypoint":   entrypoint,
+		"logRateLimit": -1,
+	})
+	reloadConfig(liveCfg, load)
+	if liveCfg.Get() != act {
+		t.Errorf("invalid config was applied")
+	}
+
+	// unreadable configs are not applied
+	err = os.Remove(ideFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(liveCfg, load)
+	if liveCfg.Get() != act {
+		t.Errorf("config was replaced although it could not be loaded")
+	}
+}
+
+func TestStreamLogRateLimits(t *testing.T) {
+	tests := []struct {
+		Desc      string
+		Workspace int
+		IDE       int
+		Stdout    int
+		Stderr    int
+		ExpStdout int
+		ExpStderr int
+	}{
+		{Desc: "disabled"},
+		{Desc: "shared limit", Workspace: 100, IDE: 10, ExpStdout: 10, ExpStderr: 10},
+		{Desc: "stdout limit", Workspace: 100, IDE: 10, Stdout: 50, ExpStdout: 50, ExpStderr: 10},
+		{Desc: "stderr limit", Workspace: 100, IDE: 10, Stderr: 5, ExpStdout: 10, ExpStderr: 5},
+		{Desc: "workspace limit wins", Workspace: 20, IDE: 10, Stdout: 50, Stderr: 5, ExpStdout: 20, ExpStderr: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			cfg := Config{
+				IDEConfig: IDEConfig{
+					IDELogRateLimit:       test.IDE,
+					IDELogRateLimitStdout: test.Stdout,
+					IDELogRateLimitStderr: test.Stderr,
+				},
+				WorkspaceConfig: WorkspaceConfig{WorkspaceLogRateLimit: test.Workspace},
+			}
+			if act := cfg.LogRateLimitStdout(); act != test.ExpStdout {
+				t.Errorf("unexpected stdout limit: expected %d, got %d", test.ExpStdout, act)
+			}
+			if act := cfg.LogRateLimitStderr(); act != test.ExpStderr {
+				t.Errorf("unexpected stderr limit: expected %d, got %d", test.ExpStderr, act)
+			}
+		})
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		Desc       string
+		OK         bool
+		StatusCode int
+		Body       string
+	}{
+		{Desc: "ok", OK: true, StatusCode: http.StatusOK, Body: `{"ok":true}`},
+		{Desc: "not ok", OK: false, StatusCode: http.StatusServiceUnavailable, Body: `{"ok":false}`},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			healthHandler(func() bool { return test.OK }).ServeHTTP(rec, httptest.NewRequest("GET", "/_supervisor/v1/healthz", nil))
+
+			if rec.Code != test.StatusCode {
+				t.Errorf("unexpected status code: expected %d, got %d", test.StatusCode, rec.Code)
+			}
+			if body := rec.Body.String(); body != test.Body {
+				t.Errorf("unexpected body: expected %s, got %s", test.Body, body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("unexpected content type: %s", ct)
+			}
+		})
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	tests := []struct {
+		Desc       string
+		Headless   bool
+		IDEReady   bool
+		StatusCode int
+	}{
+		{Desc: "IDE not ready", StatusCode: http.StatusServiceUnavailable},
+		{Desc: "IDE ready", IDEReady: true, StatusCode: http.StatusOK},
+		{Desc: "headless", Headless: true, StatusCode: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			cfg := &Config{}
+			if test.Headless {
+				cfg.GitpodHeadless = "true"
+			}
+			ideReady := &ideReadyState{cond: sync.NewCond(&sync.Mutex{})}
+			ideReady.Set(test.IDEReady)
+
+			rec := httptest.NewRecorder()
+			readyzHandler(cfg, ideReady).ServeHTTP(rec, httptest.NewRequest("GET", "/_supervisor/v1/readyz", nil))
+
+			if rec.Code != test.StatusCode {
+				t.Errorf("unexpected status code: expected %d, got %d", test.StatusCode, rec.Code)
+			}
+		})
+	}
+}
+
+func TestChildProcessGraceWindow(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Config      StaticConfig
+		Expectation time.Duration
+	}{
+		{Desc: "default", Expectation: defaultTimeBudgetChildProcessGrace},
+		{Desc: "configured", Config: StaticConfig{ChildProcessGracePeriod: util.Duration(2 * time.Second)}, Expectation: 2 * time.Second},
+		{Desc: "disabled", Config: StaticConfig{ChildProcessGracePeriod: util.Duration(-1)}, Expectation: 0},
+		{Desc: "shortened", Config: StaticConfig{ChildProcessGracePeriod: util.Duration(time.Minute)}, Expectation: terminationGracePeriod - defaultTimeBudgetIDEShutdown - timeBudgetServiceShutdown - timeBudgetDaemonTeardown},
+		{Desc: "no time left", Config: StaticConfig{IDEShutdownTimeout: util.Duration(terminationGracePeriod)}, Expectation: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := childProcessGraceWindow(&Config{StaticConfig: test.Config})
+			if act != test.Expectation {
+				t.Errorf("unexpected grace window: expected %v, got %v", test.Expectation, act)
+			}
+		})
+	}
+}
+
+func TestLogFormatter(t *testing.T) {
+	current := &logrus.JSONFormatter{}
+	tests := []struct {
+		Desc        string
+		Format      LogFormat
+		Expectation logrus.Formatter
+	}{
+		{Desc: "default", Expectation: current},
+		{Desc: "JSON", Format: LogFormatJSON, Expectation: current},
+		{Desc: "text", Format: LogFormatText, Expectation: &logrus.TextFormatter{}},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := logFormatter(test.Format, current)
+			if fmt.Sprintf("%T", act) != fmt.Sprintf("%T", test.Expectation) {
+				t.Errorf("unexpected formatter: expected %T, got %T", test.Expectation, act)
+			}
+			if _, isJSON := test.Expectation.(*logrus.JSONFormatter); isJSON && act != current {
+				t.Errorf("expected the current formatter to be kept")
+			}
+		})
+	}
+}
+
+func TestCheckShutdownBudget(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Config      StaticConfig
+		Expectation bool
+	}{
+		{Desc: "default"},
+		{Desc: "fits exactly", Config: StaticConfig{IDEShutdownTimeout: util.Duration(terminationGracePeriod - defaultTimeBudgetChildProcessGrace - timeBudgetServiceShutdown - timeBudgetDaemonTeardown)}},
+		{Desc: "IDE shutdown exceeds budget", Config: StaticConfig{IDEShutdownTimeout: util.Duration(terminationGracePeriod)}, Expectation: true},
+		{Desc: "child process grace exceeds budget", Config: StaticConfig{ChildProcessGracePeriod: util.Duration(terminationGracePeriod)}, Expectation: true},
+		{
+			Desc: "child process grace disabled",
+			Config: StaticConfig{
+				IDEShutdownTimeout:      util.Duration(terminationGracePeriod - timeBudgetServiceShutdown - timeBudgetDaemonTeardown),
+				ChildProcessGracePeriod: util.Duration(-1),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			act := checkShutdownBudget(&Config{StaticConfig: test.Config})
+			if act != test.Expectation {
+				t.Errorf("unexpected result: expected %v, got %v", test.Expectation, act)
+			}
+		})
+	}
+}
+
+func TestWaitForChildProcesses(t *testing.T) {
+	tests := []struct {
+		Desc        string
+		Polls       []map[int]int
+		Expectation map[int]int
+	}{
+		{Desc: "no children", Polls: []map[int]int{{}}, Expectation: map[int]int{}},
+		{Desc: "children exit", Polls: []map[int]int{{1: 0, 2: 0}, {2: 0}, {}}, Expectation: map[int]int{}},
+		{Desc: "stragglers", Polls: []map[int]int{{1: 0, 2: 0}, {2: 0}}, Expectation: map[int]int{2: 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			var i int
+			children := func() (map[int]int, error) {
+				res := test.Polls[i]
+				if i < len(test.Polls)-1 {
+					i++
+				}
+				return res, nil
+			}
+
+			act := waitForChildProcesses(children, 50*time.Millisecond, 5*time.Millisecond)
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected remaining children (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSignalProcesses(t *testing.T) {
+	const concurrency = 3
+
+	processes := make(map[int]int)
+	for pid := 1; pid <= 20; pid++ {
+		processes[pid] = 33333
+	}
+
+	var (
+		mu        sync.Mutex
+		signaled  = make(map[int]bool)
+		active    int
+		maxActive int
+	)
+	errs := signalProcesses(processes, func(pid, uid int) error {
+		mu.Lock()
+		signaled[pid] = true
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+
+		if pid%5 == 0 {
+			return os.ErrPermission
+		}
+		return nil
+	}, concurrency)
+
+	if len(signaled) != len(processes) {
+		t.Errorf("not all processes were signaled: expected %d, got %d", len(processes), len(signaled))
+	}
+	if maxActive > concurrency {
+		t.Errorf("exceeded concurrency limit: expected at most %d, got %d", concurrency, maxActive)
+	}
+	if diff := cmp.Diff(map[int]error{5: os.ErrPermission, 10: os.ErrPermission, 15: os.ErrPermission, 20: os.ErrPermission}, errs, cmpopts.EquateErrors()); diff != "" {
+		t.Errorf("unexpected errors (-want +got):\n%s", diff)
+	}
+}
+
+func TestRestartIDE(t *testing.T) {
+	dir := t.TempDir()
+	launches := filepath.Join(dir, "launches")
+	entrypoint := filepath.Join(dir, "ide")
+	err := os.WriteFile(entrypoint, []byte(fmt.Sprintf("#!/bin/sh\necho launched >> %s\nexec sleep 60\n", launches)), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the IDE is ready once its process was started, i.e. possibly before the script ran
+	waitForLaunches := func(n int) int {
+		var launched int
+		for i := 0; i < 100; i++ {
+			b, _ := os.ReadFile(launches)
+			launched = strings.Count(string(b), "launched")
+			if launched >= n {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return launched
+	}
+
+	cfg := &Config{}
+	cfg.Entrypoint = entrypoint
+	cfg.WorkspaceRoot = dir
+	cfg.IDEPort = 23000
+	cfg.IDEShutdownTimeout = util.Duration(5 * time.Second)
+
+	m, err := newMetrics(prometheus.NewRegistry(), terminal.NewMux(), &ports.Manager{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		ideReady = &ideReadyState{cond: sync.NewCond(&sync.Mutex{})}
+		restarts = newIDERestarter(ideReady)
+		wg       sync.WaitGroup
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	wg.Add(1)
+	go startAndWatchIDE(ctx, newLiveConfig(cfg), &wg, NewInMemoryContentState(dir), ideReady, newPhaseLog(), &ideExitLog{}, newIDEUsageSampler(), restarts, newIDESuspender(), NewNotificationService(), m)
+
+	select {
+	case <-ideReady.Wait():
+	case <-time.After(10 * time.Second):
+		t.Fatal("IDE did not become ready")
+	}
+	waitForLaunches(1)
+
+	restartCtx, restartCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer restartCancel()
+	err = restarts.Restart(restartCtx)
+	if err != nil {
+		t.Fatalf("unexpected restart error: %v", err)
+	}
+	if !ideReady.Get() {
+		t.Error("IDE is not ready after restart")
+	}
+	if n := waitForLaunches(2); n != 2 {
+		t.Errorf("expected the IDE to be launched twice, but was launched %d times", n)
+	}
+
+	restarts.restarting = true
+	err = restarts.Restart(restartCtx)
+	if err != errIDERestartInProgress {
+		t.Errorf("expected concurrent restart to fail with %v, got %v", errIDERestartInProgress, err)
+	}
+	restarts.restarting = false
+
+	restarts.disable()
+	err = restarts.Restart(restartCtx)
+	if err != errIDERestartUnavailable {
+		t.Errorf("expected restart of a disabled IDE to fail with %v, got %v", errIDERestartUnavailable, err)
+	}
+}
+
+func TestRestartIDEBeforeReady(t *testing.T) {
+	dir := t.TempDir()
+	launches := filepath.Join(dir, "launches")
+	entrypoint := filepath.Join(dir, "ide")
+	// the IDE exits with an error when interrupted, like many real IDEs do
+	err := os.WriteFile(entrypoint, []byte(fmt.Sprintf("#!/bin/sh\ntrap 'kill $!; exit 1' INT\necho launched >> %s\nsleep 60 >/dev/null 2>&1 &\nwait\n", launches)), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	countLaunches := func() int {
+		b, _ := os.ReadFile(launches)
+		return strings.Count(string(b), "launched")
+	}
+	waitForLaunches := func(n int) int {
+		for i := 0; i < 100 && countLaunches() < n; i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return countLaunches()
+	}
+
+	// the IDE becomes ready once something listens on its port
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cfg := &Config{}
+	cfg.Entrypoint = entrypoint
+	cfg.WorkspaceRoot = dir
+	cfg.IDEPort = port
+	cfg.IDEShutdownTimeout = util.Duration(5 * time.Second)
+	cfg.ReadinessProbe.Type = ReadinessTCPProbe
+	cfg.ReadinessProbe.Interval = util.Duration(10 * time.Millisecond)
+
+	m, err := newMetrics(prometheus.NewRegistry(), terminal.NewMux(), &ports.Manager{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		ideReady = &ideReadyState{cond: sync.NewCond(&sync.Mutex{})}
+		restarts = newIDERestarter(ideReady)
+		wg       sync.WaitGroup
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	wg.Add(1)
+	go startAndWatchIDE(ctx, newLiveConfig(cfg), &wg, NewInMemoryContentState(dir), ideReady, newPhaseLog(), &ideExitLog{}, newIDEUsageSampler(), restarts, newIDESuspender(), NewNotificationService(), m)
+	if n := waitForLaunches(1); n != 1 {
+		t.Fatalf("expected the IDE to be launched once, but was launched %d times", n)
+	}
+
+	// the restarted IDE does not become ready either, hence the restart times out waiting for it
+	restartCtx, restartCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer restartCancel()
+	err = restarts.Restart(restartCtx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected restart to time out waiting for the IDE, got %v", err)
+	}
+	if n := waitForLaunches(2); n != 2 {
+		t.Fatalf("expected the IDE to be launched twice, but was launched %d times", n)
+	}
+	if ideReady.Get() {
+		t.Fatal("IDE is ready although it does not listen yet")
+	}
+
+	l, err = net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	select {
+	case <-ideReady.Wait():
+	case <-time.After(10 * time.Second):
+		t.Fatal("restarted IDE did not become ready")
+	}
+	if n := countLaunches(); n != 2 {
+		t.Errorf("expected the IDE to be launched twice, but was launched %d times", n)
+	}
+}
+
+func TestPreLaunchHook(t *testing.T) {
+	const envName = "SUPERVISOR_TEST_PRE_LAUNCH_HOOK"
+	os.Setenv(envName, "from-supervisor")
+	defer os.Unsetenv(envName)
+
+	tests := []struct {
+		Name             string
+		Hook             string
+		ExpectLaunch     bool
+		ExpectHookOutput string
+	}{
+		{
+			Name:             "success",
+			Hook:             "echo $" + envName + " > $1",
+			ExpectLaunch:     true,
+			ExpectHookOutput: "from-supervisor\n",
+		},
+		{
+			Name:             "failure",
+			Hook:             "echo failed > $1\nexit 1",
+			ExpectHookOutput: "failed\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var (
+				dir        = t.TempDir()
+				launches   = filepath.Join(dir, "launches")
+				hookOutput = filepath.Join(dir, "hook-output")
+				entrypoint = filepath.Join(dir, "ide")
+				hook       = filepath.Join(dir, "hook")
+			)
+			err := os.WriteFile(entrypoint, []byte(fmt.Sprintf("#!/bin/sh\necho launched >> %s\nexec sleep 60\n", launches)), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(hook, []byte("#!/bin/sh\n"+test.Hook+"\n"), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := &Config{}
+			cfg.Entrypoint = entrypoint
+			cfg.WorkspaceRoot = dir
+			cfg.IDEPort = 23000
+			cfg.IDEShutdownTimeout = util.Duration(5 * time.Second)
+			cfg.PreLaunchHook.Command = hook
+			cfg.PreLaunchHook.Args = []string{hookOutput}
+
+			m, err := newMetrics(prometheus.NewRegistry(), terminal.NewMux(), &ports.Manager{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				cstate   = NewInMemoryContentState(dir)
+				ideReady = &ideReadyState{cond: sync.NewCond(&sync.Mutex{})}
+				restarts = newIDERestarter(ideReady)
+				wg       sync.WaitGroup
+				done     = make(chan struct{})
+			)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			wg.Add(1)
+			go startAndWatchIDE(ctx, newLiveConfig(cfg), &wg, cstate, ideReady, newPhaseLog(), &ideExitLog{}, newIDEUsageSampler(), restarts, newIDESuspender(), NewNotificationService(), m)
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+
+			// the hook must not run before the content is ready
+			time.Sleep(100 * time.Millisecond)
+			if _, err := os.Stat(hookOutput); err == nil {
+				t.Fatal("pre-launch hook ran before the content was ready")
+			}
+			cstate.MarkContentReady(csapi.WorkspaceInitFromOther)
+
+			if test.ExpectLaunch {
+				select {
+				case <-ideReady.Wait():
+				case <-time.After(10 * time.Second):
+					t.Fatal("IDE did not become ready")
+				}
+			} else {
+				select {
+				case <-done:
+				case <-time.After(10 * time.Second):
+					t.Fatal("IDE supervisor did not stop after the pre-launch hook failed")
+				}
+				if ideReady.Get() {
+					t.Error("IDE is ready although the pre-launch hook failed")
+				}
+				if _, err := os.Stat(launches); err == nil {
+					t.Error("IDE was launched although the pre-launch hook failed")
+				}
+			}
+
+			out, err := os.ReadFile(hookOutput)
+			if err != nil {
+				t.Fatalf("pre-launch hook did not run: %v", err)
+			}
+			if diff := cmp.Diff(test.ExpectHookOutput, string(out)); diff != "" {
+				t.Errorf("unexpected hook output (-want +got):\n%s", diff)
+			}
+
+			cancel()
+			<-done
+		})
+	}
+}
+
+func TestConnectToInWorkspaceDaemonService(t *testing.T) {
+	tests := []struct {
+		Desc   string
+		Socket func(t *testing.T, fn string)
+		// ExpectErr checks the error, nil expects no error
+		ExpectErr func(err error) bool
+	}{
+		{
+			Desc: "socket appears after a delay",
+			Socket: func(t *testing.T, fn string) {
+				time.Sleep(100 * time.Millisecond)
+				// the socket file exists before the listener accepts connections, hence we
+				// move it into place only once it's listening
+				l, err := net.Listen("unix", fn+".tmp")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				srv := grpc.NewServer()
+				t.Cleanup(srv.Stop)
+				go srv.Serve(l)
+				err = os.Rename(fn+".tmp", fn)
+				if err != nil {
+					t.Error(err)
+				}
+			},
+		},
+		{
+			Desc:      "socket never appears",
+			Socket:    func(t *testing.T, fn string) {},
+			ExpectErr: func(err error) bool { return errors.Is(err, ErrDaemonSocketMissing) },
+		},
+		{
+			Desc: "dial fails",
+			Socket: func(t *testing.T, fn string) {
+				err := os.WriteFile(fn, nil, 0644)
+				if err != nil {
+					t.Error(err)
+				}
+			},
+			ExpectErr: func(err error) bool {
+				var dialErr *DaemonDialError
+				return errors.As(err, &dialErr)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "daemon.sock")
+			go test.Socket(t, fn)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+			_, conn, err := ConnectToInWorkspaceDaemonService(ctx, WithDaemonSocket(fn), WithDaemonPollInterval(10*time.Millisecond))
+			if conn != nil {
+				conn.Close()
+			}
+			if test.ExpectErr == nil {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !test.ExpectErr(err) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+type flakyDaemon struct {
+	daemon.UnimplementedInWorkspaceServiceServer
+
+	mu       sync.Mutex
+	failures []error
+	calls    int
+}
+
+func (d *flakyDaemon) Teardown(ctx context.Context, req *daemon.TeardownRequest) (*daemon.TeardownResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.calls++
+	if len(d.failures) > 0 {
+		err := d.failures[0]
+		d.failures = d.failures[1:]
+		return nil, err
+	}
+	return &daemon.TeardownResponse{}, nil
+}
+
+func TestTeardownDaemon(t *testing.T) {
+	tests := []struct {
+		Desc                string
+		InNamespace         bool
+		InNamespaceTeardown bool
+		NoDaemon            bool
+		ExpectAttempt       bool
+		ExpectedCalls       int
+	}{
+		{Desc: "not in namespace", ExpectAttempt: true, ExpectedCalls: 1},
+		{Desc: "in namespace", InNamespace: true},
+		{Desc: "in namespace with teardown", InNamespace: true, InNamespaceTeardown: true, ExpectAttempt: true, ExpectedCalls: 1},
+		{Desc: "in namespace with teardown but without daemon", InNamespace: true, InNamespaceTeardown: true, NoDaemon: true, ExpectAttempt: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "daemon.sock")
+			fake := &flakyDaemon{}
+			if !test.NoDaemon {
+				l, err := net.Listen("unix", fn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				srv := grpc.NewServer()
+				daemon.RegisterInWorkspaceServiceServer(srv, fake)
+				defer srv.Stop()
+				go srv.Serve(l)
+			}
+
+			start := time.Now()
+			attempted := teardownDaemon(test.InNamespace, test.InNamespaceTeardown, []InWorkspaceDaemonOption{WithDaemonSocket(fn)})
+			if attempted != test.ExpectAttempt {
+				t.Errorf("unexpected teardown attempt: expected %v, got %v", test.ExpectAttempt, attempted)
+			}
+			if test.InNamespace {
+				// a missing daemon must never hold up the teardown of a namespace
+				if dt := time.Since(start); dt > timeBudgetNamespaceDaemonTeardown+time.Second {
+					t.Errorf("teardown in namespace took %v, expected at most %v", dt, timeBudgetNamespaceDaemonTeardown)
+				}
+			}
+
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			if fake.calls != test.ExpectedCalls {
+				t.Errorf("unexpected number of teardown calls: expected %d, got %d", test.ExpectedCalls, fake.calls)
+			}
+		})
+	}
+}
+
+func TestTeardownWithRetry(t *testing.T) {
+	var (
+		unavailable      = status.Error(codes.Unavailable, "busy")
+		deadlineExceeded = status.Error(codes.DeadlineExceeded, "slow")
+		permissionDenied = status.Error(codes.PermissionDenied, "no")
+	)
+	tests := []struct {
+		Desc          string
+		Failures      []error
+		Backoff       time.Duration
+		ExpectedCode  codes.Code
+		ExpectedCalls int
+	}{
+		{Desc: "immediate success", ExpectedCode: codes.OK, ExpectedCalls: 1},
+		{Desc: "transient failures", Failures: []error{unavailable, deadlineExceeded}, ExpectedCode: codes.OK, ExpectedCalls: 3},
+		{Desc: "permanent failure", Failures: []error{unavailable, permissionDenied}, ExpectedCode: codes.PermissionDenied, ExpectedCalls: 2},
+		{
+			Desc:          "attempts exhausted",
+			Failures:      []error{unavailable, unavailable, unavailable, unavailable, unavailable, unavailable},
+			ExpectedCode:  codes.Unavailable,
+			ExpectedCalls: daemonTeardownAttempts,
+		},
+		{
+			Desc:          "time budget exhausted",
+			Failures:      []error{unavailable, unavailable, unavailable, unavailable},
+			Backoff:       2 * timeBudgetDaemonTeardown,
+			ExpectedCode:  codes.Unavailable,
+			ExpectedCalls: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			l, err := net.Listen("unix", filepath.Join(t.TempDir(), "daemon.sock"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fake := &flakyDaemon{failures: test.Failures}
+			srv := grpc.NewServer()
+			daemon.RegisterInWorkspaceServiceServer(srv, fake)
+			defer srv.Stop()
+			go srv.Serve(l)
+
+			conn, err := grpc.Dial("unix://"+l.Addr().String(), grpc.WithInsecure())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			backoff := test.Backoff
+			if backoff == 0 {
+				backoff = time.Millisecond
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeBudgetDaemonTeardown)
+			defer cancel()
+
+			err = teardownWithRetry(ctx, daemon.NewInWorkspaceServiceClient(conn), backoff)
+			if code := status.Code(err); code != test.ExpectedCode {
+				t.Errorf("unexpected error: %v", err)
+			}
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			if fake.calls != test.ExpectedCalls {
+				t.Errorf("expected %d teardown calls, got %d", test.ExpectedCalls, fake.calls)
+			}
+		})
+	}
+}
+
+type fakeShutdownable struct {
+	Err   error
+	Block bool
+
+	called chan struct{}
+}
+
+func (s *fakeShutdownable) Shutdown(ctx context.Context) error {
+	close(s.called)
+	if s.Block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.Err
+}
+
+func TestShutdownServices(t *testing.T) {
+	var (
+		ok       = &fakeShutdownable{called: make(chan struct{})}
+		failing  = &fakeShutdownable{Err: errors.New("cannot flush"), called: make(chan struct{})}
+		blocking = &fakeShutdownable{Block: true, called: make(chan struct{})}
+		services = []RegisterableService{ok, struct{}{}, failing, blocking}
+	)
+
+	timeout := 100 * time.Millisecond
+	start := time.Now()
+	shutdownServices(services, timeout)
+	if dur := time.Since(start); dur > 10*timeout {
+		t.Errorf("shutdown took %v despite a timeout of %v", dur, timeout)
+	}
+
+	for i, s := range []*fakeShutdownable{ok, failing, blocking} {
+		select {
+		case <-s.called:
+		default:
+			t.Errorf("service %d was not shut down", i)
+		}
+	}
+}
+
+type fakeHTTPService struct {
+	Path      string
+	MorePaths []string
+	Body      string
+}
+
+func (s *fakeHTTPService) RegisterHTTP(mux HTTPMux) {
+	for _, p := range append([]string{s.Path}, s.MorePaths...) {
+		mux.HandleFunc(p, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, s.Body)
+		})
+	}
+}
+
+func TestRegisterHTTPServices(t *testing.T) {
+	routes := http.NewServeMux()
+	routes.HandleFunc("/_supervisor/v1/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "supervisor")
+	})
+	registerHTTPServices(routes, []string{"/v1/", "/v1/healthz", "/frontend"}, []RegisterableService{
+		&fakeHTTPService{Path: "/hello", Body: "hello"},
+		struct{}{},
+		&fakeHTTPService{Path: "/hello", Body: "collision"},
+		&fakeHTTPService{Path: "/v1/healthz", Body: "shadowed"},
+		// services which collide are not registered at all, not even their other routes
+		&fakeHTTPService{Path: "/partial", MorePaths: []string{"/hello"}, Body: "partial"},
+		&fakeHTTPService{Path: "/subtree", MorePaths: []string{"/v1/custom"}, Body: "subtree"},
+		&fakeHTTPService{Path: "/twice", MorePaths: []string{"/twice"}, Body: "twice"},
+		&fakeHTTPService{Path: "/world", MorePaths: []string{"/world/"}, Body: "world"},
+	})
+	srv := httptest.NewServer(routes)
+	defer srv.Close()
+
+	tests := []struct {
+		Path       string
+		StatusCode int
+		Body       string
+	}{
+		{Path: "/_supervisor/hello", StatusCode: http.StatusOK, Body: "hello"},
+		{Path: "/_supervisor/v1/healthz", StatusCode: http.StatusOK, Body: "supervisor"},
+		{Path: "/_supervisor/partial", StatusCode: http.StatusNotFound},
+		{Path: "/_supervisor/subtree", StatusCode: http.StatusNotFound},
+		{Path: "/_supervisor/twice", StatusCode: http.StatusNotFound},
+		{Path: "/_supervisor/world", StatusCode: http.StatusOK, Body: "world"},
+		{Path: "/_supervisor/world/foo", StatusCode: http.StatusOK, Body: "world"},
+		{Path: "/hello", StatusCode: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.Path, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + test.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != test.StatusCode {
+				t.Errorf("unexpected status code: expected %d, got %d", test.StatusCode, resp.StatusCode)
+			}
+			if test.Body != "" && string(body) != test.Body {
+				t.Errorf("unexpected body: expected %q, got %q", test.Body, body)
+			}
+		})
+	}
+}
+
+func TestWithoutGitpodService(t *testing.T) {
+	cfg := &Config{WorkspaceConfig: WorkspaceConfig{GitpodHost: "://not-a-url", WorkspaceID: "foobar"}}
+
+	gitpodService := createGitpodService(cfg, NewInMemoryTokenService())
+	if gitpodService != nil {
+		t.Fatalf("expected no Gitpod service, got %v", gitpodService)
+	}
+
+	// wire the services which depend on the Gitpod API the same way Run does
+	exposedPorts := createExposedPortsImpl(cfg, gitpodService)
+	if _, ok := exposedPorts.(*ports.NoopExposedPorts); !ok {
+		t.Errorf("expected NoopExposedPorts, got %T", exposedPorts)
+	}
+
+	tkn, err := NewGitTokenProvider(gitpodService, cfg.WorkspaceConfig, NewNotificationService()).GetToken(context.Background(), &api.GetTokenRequest{Host: "github.com"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if tkn != nil {
+		t.Errorf("expected no token, got %v", tkn)
+	}
+}
+
+// fakeGitpodAPI implements the parts of the Gitpod API used for port exposure, port configs and Git tokens
+type fakeGitpodAPI struct {
+	gitpod.APIInterface
+
+	mu    sync.Mutex
+	ports []*gitpod.WorkspaceInstancePort
+}
+
+func (f *fakeGitpodAPI) InstanceUpdates(ctx context.Context, instanceID string) (<-chan *gitpod.WorkspaceInstance, error) {
+	return make(chan *gitpod.WorkspaceInstance), nil
+}
+
+func (f *fakeGitpodAPI) OpenPort(ctx context.Context, workspaceID string, port *gitpod.WorkspaceInstancePort) (*gitpod.WorkspaceInstancePort, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ports = append(f.ports, port)
+	return port, nil
+}
+
+func (f *fakeGitpodAPI) GetWorkspace(ctx context.Context, id string) (*gitpod.WorkspaceInfo, error) {
+	return &gitpod.WorkspaceInfo{Workspace: &gitpod.Workspace{Config: &gitpod.WorkspaceConfig{
+		Ports: []*gitpod.PortConfig{{Port: 3000, Visibility: "public"}},
+	}}}, nil
+}
+
+func (f *fakeGitpodAPI) GetToken(ctx context.Context, query *gitpod.GetTokenSearchOptions) (*gitpod.Token, error) {
+	return &gitpod.Token{Value: "token", Username: "user"}, nil
+}
+
+func (f *fakeGitpodAPI) OpenedPorts() []*gitpod.WorkspaceInstancePort {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*gitpod.WorkspaceInstancePort(nil), f.ports...)
+}
+
+type fakeServedPorts struct {
+	Changes chan []ports.ServedPort
+}
+
+func (f *fakeServedPorts) Observe(ctx context.Context) (<-chan []ports.ServedPort, <-chan error) {
+	return f.Changes, make(chan error)
+}
+
+type fakePortsConfig struct{}
+
+func (f *fakePortsConfig) Observe(ctx context.Context) (<-chan *ports.Configs, <-chan error) {
+	return make(chan *ports.Configs), make(chan error)
+}
+
+type fakeGitpodConfig struct{}
+
+func (f *fakeGitpodConfig) Observe(ctx context.Context) (<-chan *gitpod.GitpodConfig, <-chan error) {
+	return make(chan *gitpod.GitpodConfig), make(chan error)
+}
+
+func TestReconnectGitpodService(t *testing.T) {
+	var (
+		cfg    = &Config{WorkspaceConfig: WorkspaceConfig{WorkspaceID: "foobar"}}
+		server = &fakeGitpodAPI{}
+		served = make(chan []ports.ServedPort)
+	)
+	portsConfig := ports.NewConfigService(cfg.WorkspaceID, &fakeGitpodConfig{}, nil)
+	portMgmt := ports.NewManager(createExposedPortsImpl(cfg, nil), &fakeServedPorts{Changes: served}, portsConfig)
+	gitTokens := NewGitTokenProvider(nil, cfg.WorkspaceConfig, NewNotificationService())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go portMgmt.Run(ctx, &wg)
+	served <- []ports.ServedPort{{Address: "00000000", Port: 8080}}
+
+	// the server comes up on the third attempt
+	var attempts int
+	connect := func() gitpod.APIInterface {
+		attempts++
+		if attempts < 3 {
+			return nil
+		}
+		return server
+	}
+	connected := make(chan struct{})
+	go func() {
+		defer close(connected)
+		reconnectGitpodService(ctx, connect, time.Millisecond, useGitpodService(cfg, portMgmt, portsConfig, gitTokens))
+	}()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not connect to the Gitpod API")
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 connection attempts, got %d", attempts)
+	}
+
+	// the served port and the port from the workspace config, which is fetched using the new connection,
+	// are exposed
+	var opened []*gitpod.WorkspaceInstancePort
+	for i := 0; i < 100 && len(opened) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		opened = server.OpenedPorts()
+	}
+	sort.Slice(opened, func(i, j int) bool { return opened[i].Port < opened[j].Port })
+	expectation := []*gitpod.WorkspaceInstancePort{
+		{Port: 3000, TargetPort: 3000, Visibility: "public"},
+		{Port: 8080, TargetPort: 8080, Visibility: "private"},
+	}
+	if diff := cmp.Diff(expectation, opened); diff != "" {
+		t.Errorf("unexpected opened ports (-want +got):\n%s", diff)
+	}
+
+	// and Git tokens are resolved using the new connection
+	tkn, err := gitTokens.GetToken(ctx, &api.GetTokenRequest{Host: "github.com", Kind: KindGit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tkn == nil || tkn.Token != "token" {
+		t.Errorf("unexpected token: %v", tkn)
+	}
+
+	// the port manager stops once one of its observers stops
+	close(served)
+	wg.Wait()
+}
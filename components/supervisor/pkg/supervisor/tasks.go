@@ -15,6 +15,8 @@ import (
 	"sync"
 	"time"
 
+	"golang.org/x/xerrors"
+
 	"github.com/gitpod-io/gitpod/common-go/log"
 	csapi "github.com/gitpod-io/gitpod/content-service/api"
 	"github.com/gitpod-io/gitpod/supervisor/api"
@@ -65,13 +67,47 @@ type task struct {
 	command     string
 	successChan chan bool
 	title       string
+
+	// dependencies are the tasks which must be ready before this task starts
+	dependencies []*task
+	// ready is closed once the task has entered its command phase or has finished
+	ready     chan struct{}
+	readyOnce sync.Once
+	// tracksPhases is true if the task records the phase it is in, which we need for timeouts and dependencies
+	tracksPhases bool
+}
+
+// markReady unblocks the tasks which depend on this task
+func (t *task) markReady() {
+	t.readyOnce.Do(func() { close(t.ready) })
 }
 
 type headlessTaskProgressReporter interface {
+	started(task *task)
 	write(data string, task *task, terminal *terminal.Term)
+	exited(task *task, exitCode int)
 	done(success bool)
 }
 
+// taskRunner runs commands in the terminal of a task
+type taskRunner interface {
+	run(task *task, command string) error
+}
+
+// terminalTaskRunner types commands into the terminal of a task
+type terminalTaskRunner struct {
+	terminalService *terminal.MuxTerminalService
+}
+
+func (r *terminalTaskRunner) run(task *task, command string) error {
+	term, ok := r.terminalService.Mux.Get(task.Terminal)
+	if !ok {
+		return xerrors.Errorf("terminal %s does not exist", task.Terminal)
+	}
+	_, err := term.PTY.Write([]byte(command + "\n"))
+	return err
+}
+
 type tasksManager struct {
 	config          *Config
 	storeLocation   string
@@ -83,17 +119,25 @@ type tasksManager struct {
 	terminalService *terminal.MuxTerminalService
 	contentState    ContentState
 	reporter        headlessTaskProgressReporter
+	notifications   *NotificationService
+	runner          taskRunner
+
+	// phasePollInterval is the time between two checks of the phase of tasks which track their phases
+	phasePollInterval time.Duration
 }
 
-func newTasksManager(config *Config, terminalService *terminal.MuxTerminalService, contentState ContentState, reporter headlessTaskProgressReporter) *tasksManager {
+func newTasksManager(config *Config, terminalService *terminal.MuxTerminalService, contentState ContentState, reporter headlessTaskProgressReporter, notifications *NotificationService) *tasksManager {
 	return &tasksManager{
-		config:          config,
-		terminalService: terminalService,
-		contentState:    contentState,
-		reporter:        reporter,
-		subscriptions:   make(map[*tasksSubscription]struct{}),
-		ready:           make(chan struct{}),
-		storeLocation:   "/workspace/.gitpod",
+		config:            config,
+		terminalService:   terminalService,
+		contentState:      contentState,
+		reporter:          reporter,
+		notifications:     notifications,
+		runner:            &terminalTaskRunner{terminalService: terminalService},
+		subscriptions:     make(map[*tasksSubscription]struct{}),
+		ready:             make(chan struct{}),
+		storeLocation:     "/workspace/.gitpod",
+		phasePollInterval: 1 * time.Second,
 	}
 }
 
@@ -159,6 +203,17 @@ func (tm *tasksManager) init(ctx context.Context) {
 	if tasks == nil {
 		tasks = &[]TaskConfig{{}}
 	}
+	dependencies, err := resolveTaskDependencies(*tasks)
+	if err != nil {
+		log.WithError(err).Error()
+		return
+	}
+	dependedOn := make(map[int]bool)
+	for _, deps := range dependencies {
+		for _, dep := range deps {
+			dependedOn[dep] = true
+		}
+	}
 
 	select {
 	case <-ctx.Done():
@@ -191,17 +246,32 @@ func (tm *tasksManager) init(ctx context.Context) {
 				State:        api.TaskState_opening,
 				Presentation: presentation,
 			},
-			config:      config,
-			successChan: make(chan bool, 1),
-			title:       title,
+			config:       config,
+			successChan:  make(chan bool, 1),
+			title:        title,
+			ready:        make(chan struct{}),
+			tracksPhases: config.Timeout != nil || dependedOn[i] || config.Restart.Enabled(),
+		}
+		if task.tracksPhases {
+			err := os.MkdirAll(tm.storeLocation, 0755)
+			if err != nil {
+				log.WithError(err).WithField("task", id).Error("cannot track task phases - ignoring task timeouts and restart policy, dependent tasks start right away")
+				task.tracksPhases = false
+			}
 		}
 		task.command = tm.getCommand(task)
 		if tm.config.isHeadless() && task.command == "exit" {
 			task.State = api.TaskState_closed
 			task.successChan <- true
+			task.markReady()
 		}
 		tm.tasks = append(tm.tasks, task)
 	}
+	for i, deps := range dependencies {
+		for _, dep := range deps {
+			tm.tasks[i].dependencies = append(tm.tasks[i].dependencies, tm.tasks[dep])
+		}
+	}
 }
 
 func (tm *tasksManager) Run(ctx context.Context, wg *sync.WaitGroup) {
@@ -210,64 +280,26 @@ func (tm *tasksManager) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	tm.init(ctx)
 
+	// Tasks without dependencies start right away in the order they are configured. Tasks with dependencies
+	// start as soon as all of their dependencies are ready, independently of each other.
 	for _, t := range tm.tasks {
 		if t.State == api.TaskState_closed {
 			continue
 		}
-		taskLog := log.WithField("command", t.command)
-		taskLog.Info("starting a task terminal...")
-		openRequest := &api.OpenTerminalRequest{}
-		if t.config.Env != nil {
-			openRequest.Env = *t.config.Env
-		}
-		var readTimeout time.Duration
-		if !tm.config.isHeadless() {
-			readTimeout = 5 * time.Second
-		}
-		resp, err := tm.terminalService.OpenWithOptions(ctx, openRequest, terminal.TermOptions{
-			ReadTimeout: readTimeout,
-			Title:       t.title,
-		})
-		if err != nil {
-			taskLog.WithError(err).Error("cannot open new task terminal")
-			t.successChan <- false
-			tm.setTaskState(t, api.TaskState_closed)
+		if len(t.dependencies) == 0 {
+			tm.startTask(ctx, t)
 			continue
 		}
-
-		taskLog = taskLog.WithField("terminal", resp.Terminal.Alias)
-		term, ok := tm.terminalService.Mux.Get(resp.Terminal.Alias)
-		if !ok {
-			taskLog.Error("cannot find a task terminal")
-			t.successChan <- false
-			tm.setTaskState(t, api.TaskState_closed)
-			continue
-		}
-
-		taskLog = taskLog.WithField("pid", term.Command.Process.Pid)
-		taskLog.Info("task terminal has been started")
-		tm.updateState(func() bool {
-			t.Terminal = resp.Terminal.Alias
-			t.State = api.TaskState_running
-			return true
-		})
-
-		go func(t *task, term *terminal.Term) {
-			state, _ := term.Wait()
-			if state != nil {
-				t.successChan <- state.Success()
-			} else {
-				t.successChan <- false
+		go func(t *task) {
+			for _, dep := range t.dependencies {
+				select {
+				case <-ctx.Done():
+					return
+				case <-dep.ready:
+				}
 			}
-			taskLog.Info("task terminal has been closed")
-			tm.setTaskState(t, api.TaskState_closed)
-		}(t, term)
-
-		tm.watch(t, term)
-
-		if t.command != "" {
-			term.PTY.Write([]byte(t.command + "\n"))
-		}
+			tm.startTask(ctx, t)
+		}(t)
 	}
 
 	success := true
@@ -287,13 +319,122 @@ func (tm *tasksManager) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 }
 
+// startTask opens a terminal for a task and runs its command in it
+func (tm *tasksManager) startTask(ctx context.Context, t *task) {
+	taskLog := log.WithField("command", t.command)
+	taskLog.Info("starting a task terminal...")
+	openRequest := &api.OpenTerminalRequest{}
+	if t.config.Env != nil {
+		openRequest.Env = *t.config.Env
+	}
+	var readTimeout time.Duration
+	if !tm.config.isHeadless() {
+		readTimeout = 5 * time.Second
+	}
+	resp, err := tm.terminalService.OpenWithOptions(ctx, openRequest, terminal.TermOptions{
+		ReadTimeout:   readTimeout,
+		Title:         t.title,
+		NoIdleTimeout: true,
+	})
+	if err != nil {
+		taskLog.WithError(err).Error("cannot open new task terminal")
+		t.successChan <- false
+		t.markReady()
+		tm.setTaskState(t, api.TaskState_closed)
+		return
+	}
+
+	taskLog = taskLog.WithField("terminal", resp.Terminal.Alias)
+	term, ok := tm.terminalService.Mux.Get(resp.Terminal.Alias)
+	if !ok {
+		taskLog.Error("cannot find a task terminal")
+		t.successChan <- false
+		t.markReady()
+		tm.setTaskState(t, api.TaskState_closed)
+		return
+	}
+
+	taskLog = taskLog.WithField("pid", term.Command.Process.Pid)
+	taskLog.Info("task terminal has been started")
+	tm.updateState(func() bool {
+		t.Terminal = resp.Terminal.Alias
+		t.State = api.TaskState_running
+		return true
+	})
+
+	if tm.config.isHeadless() {
+		tm.reporter.started(t)
+	}
+	outputDone := tm.watch(t, term)
+
+	exited := make(chan struct{})
+	go func(t *task, term *terminal.Term) {
+		state, _ := term.Wait()
+		close(exited)
+		if tm.config.isHeadless() {
+			exitCode := -1
+			if state != nil {
+				exitCode = state.ExitCode()
+			}
+			// the exit is reported after all output, such that consumers can rely on it being the last event of the task
+			<-outputDone
+			tm.reporter.exited(t, exitCode)
+		}
+		if state != nil {
+			t.successChan <- state.Success()
+		} else {
+			t.successChan <- false
+		}
+		t.markReady()
+		taskLog.Info("task terminal has been closed")
+		tm.setTaskState(t, api.TaskState_closed)
+	}(t, term)
+
+	if t.tracksPhases {
+		// the phase file might be left over from a previous start of the workspace
+		_ = os.Remove(tm.phaseFileName(t))
+		go tm.watchPhases(ctx, t, exited)
+	} else {
+		t.markReady()
+	}
+
+	if t.command != "" {
+		term.PTY.Write([]byte(t.command + "\n"))
+	}
+}
+
+// taskPhase is a phase of a task. The phases of a task run in the order before, init, command.
+type taskPhase string
+
+const (
+	taskPhaseBefore  taskPhase = "before"
+	taskPhaseInit    taskPhase = "init"
+	taskPhaseCommand taskPhase = "command"
+	// taskPhaseDone is entered once all commands of a task have finished, no matter if they succeeded
+	taskPhaseDone taskPhase = "done"
+)
+
+// taskCommand is a command of a task and the phase it runs in
+type taskCommand struct {
+	phase   taskPhase
+	command *string
+}
+
 func (tm *tasksManager) getCommand(task *task) string {
 	commands := tm.getCommands(task)
 	command := composeCommand(composeCommandOptions{
-		commands: commands,
+		commands: tm.withPhaseMarkers(task, commands),
 		format:   "{\n%s\n}",
 		sep:      " && ",
 	})
+	if command == "" {
+		// there is no phase to track
+		task.tracksPhases = false
+	}
+	if task.tracksPhases && !tm.config.isHeadless() {
+		// headless tasks exit with their commands, and the marker would hide their exit code from exit
+		command += "; " + tm.phaseMarker(task, taskPhaseDone)
+	}
 
 	if tm.config.isHeadless() {
 		// it's important that prebuild tasks exit eventually
@@ -304,7 +445,11 @@ func (tm *tasksManager) getCommand(task *task) string {
 		return command + "; exit"
 	}
 
-	histfileCommand := tm.getHistfileCommand(task, commands)
+	var plainCommands []*string
+	for _, c := range commands {
+		plainCommands = append(plainCommands, c.command)
+	}
+	histfileCommand := tm.getHistfileCommand(task, plainCommands)
 	if strings.TrimSpace(command) == "" {
 		return histfileCommand
 	}
@@ -314,6 +459,236 @@ func (tm *tasksManager) getCommand(task *task) string {
 	return histfileCommand + "; " + command
 }
 
+// withPhaseMarkers records the phase of a task which tracks its phases before each phase starts, such that we can
+// tell which phase is running
+func (tm *tasksManager) withPhaseMarkers(task *task, commands []taskCommand) []*string {
+	var (
+		res   []*string
+		phase taskPhase
+	)
+	for _, c := range commands {
+		if c.command == nil || strings.TrimSpace(*c.command) == "" {
+			continue
+		}
+		if task.tracksPhases && c.phase != phase {
+			marker := tm.phaseMarker(task, c.phase)
+			res = append(res, &marker)
+			phase = c.phase
+		}
+		res = append(res, c.command)
+	}
+	return res
+}
+
+// getRestartCommand produces the command which runs the command phase of a task once more
+func (tm *tasksManager) getRestartCommand(task *task) string {
+	var commands []taskCommand
+	for _, c := range tm.getCommands(task) {
+		if c.phase == taskPhaseCommand {
+			commands = append(commands, c)
+		}
+	}
+	command := composeCommand(composeCommandOptions{
+		commands: tm.withPhaseMarkers(task, commands),
+		format:   "{\n%s\n}",
+		sep:      " && ",
+	})
+	return command + "; " + tm.phaseMarker(task, taskPhaseDone)
+}
+
+// phaseMarker produces a command which records that a task entered a phase. The done phase also records the
+// exit code of the commands. The leading space keeps the command out of the bash history.
+func (tm *tasksManager) phaseMarker(task *task, phase taskPhase) string {
+	record := string(phase)
+	if phase == taskPhaseDone {
+		record += " $?"
+	}
+	return " echo " + record + " >> " + tm.phaseFileName(task)
+}
+
+func (tm *tasksManager) phaseFileName(task *task) string {
+	return tm.storeLocation + "/phase-" + task.Id
+}
+
+// phaseRecord records that a task entered a phase
+type phaseRecord struct {
+	phase taskPhase
+	// exitCode is the exit code of the commands of the task if it entered the done phase
+	exitCode int
+}
+
+// readPhases returns the phases a task entered so far in the order it entered them
+func (tm *tasksManager) readPhases(task *task) (res []phaseRecord) {
+	content, err := os.ReadFile(tm.phaseFileName(task))
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		record := phaseRecord{phase: taskPhase(fields[0])}
+		if record.phase == taskPhaseDone && len(fields) > 1 {
+			record.exitCode, _ = strconv.Atoi(fields[1])
+		}
+		res = append(res, record)
+	}
+	return res
+}
+
+// phaseTimeout returns the time a phase may take, or 0 if it may take any time
+func phaseTimeout(timeouts *TaskTimeouts, phase taskPhase) time.Duration {
+	if timeouts == nil {
+		return 0
+	}
+	switch phase {
+	case taskPhaseBefore:
+		return time.Duration(timeouts.Before)
+	case taskPhaseInit:
+		return time.Duration(timeouts.Init)
+	case taskPhaseCommand:
+		return time.Duration(timeouts.Command)
+	default:
+		return 0
+	}
+}
+
+const (
+	defaultRestartBackoff = 1 * time.Second
+	maxRestartBackoff     = 5 * time.Minute
+)
+
+// restartBackoff decides whether to restart the command of a task which exited with exitCode after it was
+// restarted restarts times already, and how long to wait before the restart
+func restartBackoff(cfg *TaskRestart, exitCode int, restarts int) (restart bool, backoff time.Duration) {
+	if !cfg.Enabled() {
+		return false, 0
+	}
+	if cfg.Policy == TaskRestartOnFailure && exitCode == 0 {
+		return false, 0
+	}
+	if cfg.MaxRetries > 0 && restarts >= cfg.MaxRetries {
+		return false, 0
+	}
+
+	backoff = time.Duration(cfg.Backoff)
+	if backoff <= 0 {
+		backoff = defaultRestartBackoff
+	}
+	for i := 0; i < restarts && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+	return true, backoff
+}
+
+// watchPhases marks a task ready once it enters its command phase, restarts its command according to its
+// restart policy, and terminates it if one of its phases exceeds its timeout
+func (tm *tasksManager) watchPhases(ctx context.Context, task *task, exited <-chan struct{}) {
+	ticker := time.NewTicker(tm.phasePollInterval)
+	defer ticker.Stop()
+
+	var (
+		phase    taskPhase
+		since    = time.Now()
+		seen     int
+		restarts int
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+
+		var (
+			records     = tm.readPhases(task)
+			commandExit *phaseRecord
+		)
+		if len(records) > seen {
+			for i, record := range records[seen:] {
+				if record.phase == taskPhaseDone && phase == taskPhaseCommand {
+					commandExit = &records[seen+i]
+				}
+				phase = record.phase
+			}
+			since = time.Now()
+			seen = len(records)
+		}
+		if phase == taskPhaseCommand || phase == taskPhaseDone {
+			task.markReady()
+		}
+
+		if commandExit != nil {
+			restart, backoff := restartBackoff(task.config.Restart, commandExit.exitCode, restarts)
+			if restart {
+				log.WithField("task", task.Id).WithField("exitCode", commandExit.exitCode).WithField("backoff", backoff).Info("restarting task command")
+				select {
+				case <-ctx.Done():
+					return
+				case <-exited:
+					return
+				case <-time.After(backoff):
+				}
+
+				restarts++
+				tm.updateState(func() bool {
+					task.Restarts = int32(restarts)
+					return true
+				})
+				err := tm.runner.run(task, tm.getRestartCommand(task))
+				if err != nil {
+					log.WithError(err).WithField("task", task.Id).Error("cannot restart task command")
+				}
+				continue
+			}
+		}
+
+		timeout := phaseTimeout(task.config.Timeout, phase)
+		if timeout == 0 || time.Since(since) < timeout {
+			continue
+		}
+
+		tm.terminateTask(task, fmt.Sprintf("the %s phase did not finish within %s", phase, timeout))
+		return
+	}
+}
+
+// terminateTask marks a task as failed, closes its terminal and tells the user about it
+func (tm *tasksManager) terminateTask(task *task, failure string) {
+	log.WithField("task", task.Id).WithField("failure", failure).Warn("terminating task")
+	tm.updateState(func() bool {
+		task.Failure = failure
+		return true
+	})
+
+	if tm.notifications != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			_, err := tm.notifications.Notify(ctx, &api.NotifyRequest{
+				Level:   api.NotifyRequest_ERROR,
+				Message: fmt.Sprintf("Task '%s' was terminated because %s.", task.Presentation.Name, failure),
+			})
+			if err != nil {
+				log.WithError(err).Warn("cannot notify user about terminated task")
+			}
+		}()
+	}
+
+	// the task has had its time already, hence we don't give it a grace period
+	err := tm.terminalService.Mux.CloseTerminal(task.Terminal, 0)
+	if err != nil {
+		log.WithError(err).WithField("task", task.Id).Error("cannot terminate task")
+	}
+}
+
 func (tm *tasksManager) getHistfileCommand(task *task, commands []*string) string {
 	histfileCommands := commands
 	if tm.contentSource == csapi.WorkspaceInitFromPrebuild {
@@ -339,34 +714,52 @@ func (tm *tasksManager) getHistfileCommand(task *task, commands []*string) strin
 	return " HISTFILE=" + histfile + " history -r"
 }
 
-func (tm *tasksManager) getCommands(task *task) []*string {
+func (tm *tasksManager) getCommands(task *task) []taskCommand {
 	if tm.config.isHeadless() {
 		// prebuild
-		return []*string{task.config.Before, task.config.Init, task.config.Prebuild}
+		return []taskCommand{
+			{taskPhaseBefore, task.config.Before},
+			{taskPhaseInit, task.config.Init},
+			{taskPhaseInit, task.config.Prebuild},
+		}
 	}
 	if tm.contentSource == csapi.WorkspaceInitFromPrebuild {
 		// prebuilt
 		prebuildLogFileName := tm.prebuildLogFileName(task)
 		legacyPrebuildLogFileName := "/workspace/.prebuild-log-" + task.Id
 		printlogs := "[ -r " + legacyPrebuildLogFileName + " ] && cat " + legacyPrebuildLogFileName + "; [ -r " + prebuildLogFileName + " ] && cat " + prebuildLogFileName + "; true"
-		return []*string{task.config.Before, &printlogs, task.config.Command}
+		return []taskCommand{
+			{taskPhaseBefore, task.config.Before},
+			{taskPhaseBefore, &printlogs},
+			{taskPhaseCommand, task.config.Command},
+		}
 	}
 	if tm.contentSource == csapi.WorkspaceInitFromBackup {
 		// restart
-		return []*string{task.config.Before, task.config.Command}
+		return []taskCommand{
+			{taskPhaseBefore, task.config.Before},
+			{taskPhaseCommand, task.config.Command},
+		}
 	}
 	// init
-	return []*string{task.config.Before, task.config.Init, task.config.Command}
-
+	return []taskCommand{
+		{taskPhaseBefore, task.config.Before},
+		{taskPhaseInit, task.config.Init},
+		{taskPhaseCommand, task.config.Command},
+	}
 }
 
 func (tm *tasksManager) prebuildLogFileName(task *task) string {
 	return tm.storeLocation + "/prebuild-log-" + task.Id
 }
 
-func (tm *tasksManager) watch(task *task, terminal *terminal.Term) {
+// watch forwards the output of headless tasks to the reporter. The returned channel is closed once all output
+// has been forwarded.
+func (tm *tasksManager) watch(task *task, terminal *terminal.Term) <-chan struct{} {
+	done := make(chan struct{})
 	if !tm.config.isHeadless() {
-		return
+		close(done)
+		return done
 	}
 
 	var (
@@ -375,6 +768,7 @@ func (tm *tasksManager) watch(task *task, terminal *terminal.Term) {
 		start       = time.Now()
 	)
 	go func() {
+		defer close(done)
 		defer stdout.Close()
 
 		fileName := tm.prebuildLogFileName(task)
@@ -421,6 +815,7 @@ func (tm *tasksManager) watch(task *task, terminal *terminal.Term) {
 			tm.reporter.write(data, task, terminal)
 		}
 	}()
+	return done
 }
 
 type composeCommandOptions struct {
@@ -439,12 +834,26 @@ func composeCommand(options composeCommandOptions) string {
 	return strings.Join(commands, options.sep)
 }
 
+// loggingHeadlessTaskProgressReporter reports the progress of headless tasks as structured log messages, one JSON
+// object per line. For each task it logs a workspaceTaskStarted message, workspaceTaskOutput messages with chunks of
+// its output, and a workspaceTaskExited message with its exit code, in this order. Once all tasks have exited, it
+// logs either a workspaceTaskDone or a workspaceTaskFailed message.
 type loggingHeadlessTaskProgressReporter struct {
 }
 
+func (r *loggingHeadlessTaskProgressReporter) started(task *task) {
+	log.WithField("component", "workspace").
+		WithField("taskLogMsg", taskLogMessage{Type: "workspaceTaskStarted", Data: task.Presentation.Name, TaskID: task.Id}).Info()
+}
+
 func (r *loggingHeadlessTaskProgressReporter) write(data string, task *task, terminal *terminal.Term) {
 	log.WithField("component", "workspace").WithField("pid", terminal.Command.Process.Pid).
-		WithField("taskLogMsg", taskLogMessage{Type: "workspaceTaskOutput", Data: data}).Info()
+		WithField("taskLogMsg", taskLogMessage{Type: "workspaceTaskOutput", Data: data, TaskID: task.Id}).Info()
+}
+
+func (r *loggingHeadlessTaskProgressReporter) exited(task *task, exitCode int) {
+	log.WithField("component", "workspace").
+		WithField("taskLogMsg", taskLogMessage{Type: "workspaceTaskExited", TaskID: task.Id, ExitCode: &exitCode}).Info()
 }
 
 func (r *loggingHeadlessTaskProgressReporter) done(success bool) {
@@ -461,4 +870,8 @@ func (r *loggingHeadlessTaskProgressReporter) done(success bool) {
 type taskLogMessage struct {
 	Type string `json:"type"`
 	Data string `json:"data"`
+	// TaskID identifies the task a message is about. It is empty for messages about all tasks.
+	TaskID string `json:"taskId,omitempty"`
+	// ExitCode is the exit code of the task in workspaceTaskExited messages, or -1 if it's unknown
+	ExitCode *int `json:"exitCode,omitempty"`
 }
@@ -5,18 +5,26 @@
 package supervisor
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/sirupsen/logrus"
 
 	"github.com/gitpod-io/gitpod/common-go/log"
+	"github.com/gitpod-io/gitpod/common-go/util"
 	"github.com/gitpod-io/gitpod/content-service/api"
+	supervisorapi "github.com/gitpod-io/gitpod/supervisor/api"
 	"github.com/gitpod-io/gitpod/supervisor/pkg/terminal"
 )
 
@@ -125,7 +133,7 @@ func TestTaskManager(t *testing.T) {
 						GitpodTasks:    gitpodTasks,
 						GitpodHeadless: strconv.FormatBool(test.Headless),
 					},
-				}, terminalService, contentState, &reporter)
+				}, terminalService, contentState, &reporter, nil)
 			)
 			taskManager.storeLocation = storeLocation
 			contentState.MarkContentReady(test.Source)
@@ -141,14 +149,345 @@ func TestTaskManager(t *testing.T) {
 
 }
 
+func TestTaskManagerTimeouts(t *testing.T) {
+	log.Log.Logger.SetLevel(logrus.FatalLevel)
+
+	var (
+		sleepCommand = "sleep 10"
+		shortTimeout = util.Duration(200 * time.Millisecond)
+		longTimeout  = util.Duration(time.Minute)
+	)
+	type Expectation struct {
+		Success bool
+		Failure string
+	}
+	tests := []struct {
+		Desc        string
+		Task        TaskConfig
+		Expectation Expectation
+	}{
+		{
+			Desc:        "init finishes in time",
+			Task:        TaskConfig{Before: &skipCommand, Init: &skipCommand, Timeout: &TaskTimeouts{Before: longTimeout, Init: longTimeout}},
+			Expectation: Expectation{Success: true},
+		},
+		{
+			Desc:        "init times out",
+			Task:        TaskConfig{Before: &skipCommand, Init: &sleepCommand, Timeout: &TaskTimeouts{Before: longTimeout, Init: shortTimeout}},
+			Expectation: Expectation{Failure: "the init phase did not finish within 200ms"},
+		},
+		{
+			Desc:        "before times out",
+			Task:        TaskConfig{Before: &sleepCommand, Init: &skipCommand, Timeout: &TaskTimeouts{Before: shortTimeout, Init: longTimeout}},
+			Expectation: Expectation{Failure: "the before phase did not finish within 200ms"},
+		},
+		{
+			Desc:        "timeout of another phase",
+			Task:        TaskConfig{Init: &skipCommand, Prebuild: &skipCommand, Timeout: &TaskTimeouts{Before: shortTimeout, Command: shortTimeout}},
+			Expectation: Expectation{Success: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			gitpodTasks, err := json.Marshal([]TaskConfig{test.Task})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				terminalService = terminal.NewMuxTerminalService(terminal.NewMux())
+				contentState    = NewInMemoryContentState("")
+				reporter        = testHeadlessTaskProgressReporter{}
+				taskManager     = newTasksManager(&Config{
+					WorkspaceConfig: WorkspaceConfig{
+						GitpodTasks:    string(gitpodTasks),
+						GitpodHeadless: "true",
+					},
+				}, terminalService, contentState, &reporter, NewNotificationService())
+			)
+			taskManager.storeLocation = t.TempDir()
+			taskManager.phasePollInterval = 10 * time.Millisecond
+			contentState.MarkContentReady(api.WorkspaceInitFromOther)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go taskManager.Run(ctx, &wg)
+			wg.Wait()
+			if ctx.Err() != nil {
+				t.Fatal("task did not finish")
+			}
+
+			status := taskManager.Status()
+			if len(status) != 1 {
+				t.Fatalf("expected exactly one task, got %d", len(status))
+			}
+			if status[0].State != supervisorapi.TaskState_closed {
+				t.Errorf("expected task to be closed, got %v", status[0].State)
+			}
+			act := Expectation{Success: reporter.Success, Failure: status[0].Failure}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTaskManagerDependencies(t *testing.T) {
+	log.Log.Logger.SetLevel(logrus.FatalLevel)
+
+	var (
+		logFile = filepath.Join(t.TempDir(), "order")
+		named   = func(name string, init string, dependsOn ...string) TaskConfig {
+			init += "; echo " + name + " >> " + logFile
+			return TaskConfig{Name: &name, Init: &init, DependsOn: dependsOn}
+		}
+	)
+	// the tasks are listed in reverse order to make sure they start in the order of their dependencies
+	gitpodTasks, err := json.Marshal([]TaskConfig{
+		named("d", "true", "b", "c"),
+		named("c", "true", "a"),
+		named("b", "sleep 0.2", "a"),
+		named("a", "sleep 0.2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		terminalService = terminal.NewMuxTerminalService(terminal.NewMux())
+		contentState    = NewInMemoryContentState("")
+		reporter        = testHeadlessTaskProgressReporter{}
+		taskManager     = newTasksManager(&Config{
+			WorkspaceConfig: WorkspaceConfig{
+				GitpodTasks:    string(gitpodTasks),
+				GitpodHeadless: "true",
+			},
+		}, terminalService, contentState, &reporter, nil)
+	)
+	taskManager.storeLocation = t.TempDir()
+	taskManager.phasePollInterval = 10 * time.Millisecond
+	contentState.MarkContentReady(api.WorkspaceInitFromOther)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go taskManager.Run(ctx, &wg)
+	wg.Wait()
+	if ctx.Err() != nil {
+		t.Fatal("tasks did not finish")
+	}
+	if !reporter.Success {
+		t.Fatal("tasks did not succeed")
+	}
+
+	content, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	act := strings.Fields(string(content))
+	if diff := cmp.Diff([]string{"a", "c", "b", "d"}, act); diff != "" {
+		t.Errorf("unexpected task order (-want +got):\n%s", diff)
+	}
+}
+
+func TestTaskManagerRestart(t *testing.T) {
+	log.Log.Logger.SetLevel(logrus.FatalLevel)
+
+	restart := func(policy TaskRestartPolicy, maxRetries int) *TaskRestart {
+		return &TaskRestart{Policy: policy, MaxRetries: maxRetries, Backoff: util.Duration(time.Millisecond)}
+	}
+	tests := []struct {
+		Desc    string
+		Restart *TaskRestart
+		// Phases are the phases of the first run of the task
+		Phases string
+		// ExitCodes are the exit codes of the restarted commands. Once they run out, the command keeps running.
+		ExitCodes   []int
+		Expectation int
+	}{
+		{
+			Desc:        "no policy",
+			Phases:      "command\ndone 1\n",
+			Expectation: 0,
+		},
+		{
+			Desc:        "never",
+			Restart:     restart(TaskRestartNever, 0),
+			Phases:      "command\ndone 1\n",
+			Expectation: 0,
+		},
+		{
+			Desc:        "on-failure after failure",
+			Restart:     restart(TaskRestartOnFailure, 0),
+			Phases:      "before\ncommand\ndone 1\n",
+			ExitCodes:   []int{2, 0},
+			Expectation: 2,
+		},
+		{
+			Desc:        "on-failure after success",
+			Restart:     restart(TaskRestartOnFailure, 0),
+			Phases:      "command\ndone 0\n",
+			Expectation: 0,
+		},
+		{
+			Desc:        "always",
+			Restart:     restart(TaskRestartAlways, 0),
+			Phases:      "command\ndone 0\n",
+			ExitCodes:   []int{1, 0},
+			Expectation: 3,
+		},
+		{
+			Desc:        "max retries",
+			Restart:     restart(TaskRestartAlways, 2),
+			Phases:      "command\ndone 1\n",
+			ExitCodes:   []int{1, 1, 1},
+			Expectation: 2,
+		},
+		{
+			Desc:        "init failure",
+			Restart:     restart(TaskRestartAlways, 0),
+			Phases:      "before\ninit\ndone 1\n",
+			Expectation: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			taskManager := newTasksManager(&Config{}, nil, nil, nil, nil)
+			taskManager.storeLocation = t.TempDir()
+			taskManager.phasePollInterval = time.Millisecond
+			runner := &testTaskRunner{
+				PhaseFile: filepath.Join(taskManager.storeLocation, "phase-0"),
+				ExitCodes: test.ExitCodes,
+			}
+			taskManager.runner = runner
+
+			task := &task{
+				TaskStatus: supervisorapi.TaskStatus{Id: "0"},
+				config:     TaskConfig{Restart: test.Restart},
+				ready:      make(chan struct{}),
+			}
+			err := os.WriteFile(runner.PhaseFile, []byte(test.Phases), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			taskManager.watchPhases(ctx, task, make(chan struct{}))
+
+			if runner.Runs != test.Expectation {
+				t.Errorf("unexpected number of runs: expected %d, got %d", test.Expectation, runner.Runs)
+			}
+			if act := int(task.Restarts); act != test.Expectation {
+				t.Errorf("unexpected restarts in status: expected %d, got %d", test.Expectation, act)
+			}
+		})
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	cfg := &TaskRestart{Policy: TaskRestartAlways, Backoff: util.Duration(time.Minute)}
+	for restarts, expectation := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		_, act := restartBackoff(cfg, 1, restarts)
+		if act != expectation {
+			t.Errorf("unexpected backoff after %d restarts: expected %s, got %s", restarts, expectation, act)
+		}
+	}
+}
+
+// testTaskRunner simulates commands which record their phases and exit with the given exit codes
+type testTaskRunner struct {
+	PhaseFile string
+	ExitCodes []int
+	Runs      int
+}
+
+func (r *testTaskRunner) run(task *task, command string) error {
+	phases := "command\n"
+	if r.Runs < len(r.ExitCodes) {
+		phases += fmt.Sprintf("done %d\n", r.ExitCodes[r.Runs])
+	}
+	r.Runs++
+
+	f, err := os.OpenFile(r.PhaseFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(phases)
+	return err
+}
+
+func TestLoggingHeadlessTaskProgressReporter(t *testing.T) {
+	var (
+		logger       = log.Log.Logger
+		oldOut       = logger.Out
+		oldFormatter = logger.Formatter
+		oldLevel     = logger.GetLevel()
+		out          bytes.Buffer
+	)
+	logger.SetOutput(&out)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+	defer func() {
+		logger.SetOutput(oldOut)
+		logger.SetFormatter(oldFormatter)
+		logger.SetLevel(oldLevel)
+	}()
+
+	var (
+		reporter = &loggingHeadlessTaskProgressReporter{}
+		task     = &task{TaskStatus: supervisorapi.TaskStatus{Id: "0", Presentation: &supervisorapi.TaskPresentation{Name: "build"}}}
+		term     = &terminal.Term{Command: &exec.Cmd{Process: &os.Process{Pid: 42}}}
+	)
+	reporter.started(task)
+	reporter.write("building\n", task, term)
+	reporter.exited(task, 1)
+	reporter.done(false)
+
+	type message struct {
+		Component string                 `json:"component"`
+		Message   map[string]interface{} `json:"taskLogMsg"`
+	}
+	var act []message
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var msg message
+		err := json.Unmarshal([]byte(line), &msg)
+		if err != nil {
+			t.Fatalf("cannot parse log line %q: %v", line, err)
+		}
+		act = append(act, msg)
+	}
+
+	expectation := []message{
+		{Component: "workspace", Message: map[string]interface{}{"type": "workspaceTaskStarted", "data": "build", "taskId": "0"}},
+		{Component: "workspace", Message: map[string]interface{}{"type": "workspaceTaskOutput", "data": "building\n", "taskId": "0"}},
+		{Component: "workspace", Message: map[string]interface{}{"type": "workspaceTaskExited", "data": "", "taskId": "0", "exitCode": float64(1)}},
+		{Component: "workspace", Message: map[string]interface{}{"type": "workspaceTaskOutput", "data": "🚛 uploading prebuilt workspace"}},
+		{Component: "workspace", Message: map[string]interface{}{"type": "workspaceTaskFailed", "data": ""}},
+	}
+	if diff := cmp.Diff(expectation, act); diff != "" {
+		t.Errorf("unexpected messages (-want +got):\n%s", diff)
+	}
+}
+
 type testHeadlessTaskProgressReporter struct {
 	Done    bool
 	Success bool
 }
 
+func (r *testHeadlessTaskProgressReporter) started(task *task) {
+}
+
 func (r *testHeadlessTaskProgressReporter) write(data string, task *task, terminal *terminal.Term) {
 }
 
+func (r *testHeadlessTaskProgressReporter) exited(task *task, exitCode int) {
+}
+
 func (r *testHeadlessTaskProgressReporter) done(success bool) {
 	r.Done = true
 	r.Success = success
@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+)
+
+// TokenAuditRecord describes a token request. It never contains the token itself.
+type TokenAuditRecord struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Host   string    `json:"host"`
+	Scopes []string  `json:"scopes,omitempty"`
+	Caller string    `json:"caller,omitempty"`
+
+	// GrantedScopes are the scopes of the token handed out, which can exceed the requested ones
+	GrantedScopes []string `json:"grantedScopes,omitempty"`
+
+	// Granted is true if a token was handed out
+	Granted bool `json:"granted"`
+	// Cached is true if the token came from the cache rather than a provider
+	Cached bool `json:"cached,omitempty"`
+	// Error is the reason the request failed if no token was granted
+	Error string `json:"error,omitempty"`
+}
+
+// TokenAuditSink receives an audit record for every token request
+type TokenAuditSink interface {
+	AuditToken(rec TokenAuditRecord)
+}
+
+// WithTokenAuditSink sends the token audit records to sink instead of the configured one.
+// Token auditing still needs to be enabled in the static config.
+func WithTokenAuditSink(sink TokenAuditSink) RunOption {
+	return func(r *runOptions) {
+		r.TokenAuditSink = sink
+	}
+}
+
+// logTokenAuditSink writes the audit records to supervisor's log
+type logTokenAuditSink struct{}
+
+func (logTokenAuditSink) AuditToken(rec TokenAuditRecord) {
+	log.WithField("kind", rec.Kind).
+		WithField("host", rec.Host).
+		WithField("scopes", rec.Scopes).
+		WithField("caller", rec.Caller).
+		WithField("grantedScopes", rec.GrantedScopes).
+		WithField("granted", rec.Granted).
+		WithField("cached", rec.Cached).
+		WithField("error", rec.Error).
+		Info("token audit")
+}
+
+// writerTokenAuditSink writes the audit records as JSON lines
+type writerTokenAuditSink struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (s *writerTokenAuditSink) AuditToken(rec TokenAuditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.WithError(err).Warn("cannot marshal token audit record")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.out.Write(append(line, '\n'))
+	if err != nil {
+		log.WithError(err).Warn("cannot write token audit record")
+	}
+}
+
+// tokenAuditSink returns the sink for the token audit records as configured, or nil if auditing is disabled.
+// custom takes precedence over the configured sink.
+func (c StaticConfig) tokenAuditSink(custom TokenAuditSink) (TokenAuditSink, error) {
+	if !c.TokenAudit.Enabled {
+		return nil, nil
+	}
+	if custom != nil {
+		return custom, nil
+	}
+	if c.TokenAudit.File == "" {
+		return logTokenAuditSink{}, nil
+	}
+
+	f, err := os.OpenFile(c.TokenAudit.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open token audit file: %w", err)
+	}
+	return &writerTokenAuditSink{out: f}, nil
+}
+
+// tokenCaller identifies the caller of a token request. Requests proxied by the REST gateway are
+// identified by the address the gateway received them from.
+func tokenCaller(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if fwd := md.Get("x-forwarded-for"); len(fwd) > 0 {
+			return strings.Join(fwd, ",") + " (rest)"
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return "unknown"
+}
+
+func sortedScopes(scopes map[string]struct{}) []string {
+	res := make([]string, 0, len(scopes))
+	for scp := range scopes {
+		res = append(res, scp)
+	}
+	sort.Strings(res)
+	return res
+}
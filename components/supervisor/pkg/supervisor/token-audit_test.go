@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/grpc/peer"
+
+	"github.com/gitpod-io/gitpod/supervisor/api"
+)
+
+type recordingTokenAuditSink struct {
+	Records []TokenAuditRecord
+}
+
+func (s *recordingTokenAuditSink) AuditToken(rec TokenAuditRecord) {
+	s.Records = append(s.Records, rec)
+}
+
+func TestTokenAudit(t *testing.T) {
+	const secret = "s3cr3t-t0k3n"
+
+	sink := &recordingTokenAuditSink{}
+	service := NewInMemoryTokenService()
+	service.audit = sink
+	service.provider["git"] = []tokenProvider{tokenProviderFunc(func(ctx context.Context, req *api.GetTokenRequest) (*Token, error) {
+		return &Token{
+			Host:  req.Host,
+			Token: secret,
+			User:  "foo",
+			Scope: mapScopes([]string{"repo", "user:email"}),
+			Reuse: api.TokenReuse_REUSE_WHEN_POSSIBLE,
+		}, nil
+	})}
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}})
+	for _, req := range []*api.GetTokenRequest{
+		{Kind: "git", Host: "github.com", Scope: []string{"repo", " "}},
+		{Kind: "git", Host: "github.com"},
+		{Kind: "unknown", Host: "gitlab.com", Scope: []string{"api"}},
+	} {
+		_, _ = service.GetToken(ctx, req)
+	}
+
+	expectation := []TokenAuditRecord{
+		{Kind: "git", Host: "github.com", Scopes: []string{"repo"}, Caller: "127.0.0.1:4242", GrantedScopes: []string{"repo", "user:email"}, Granted: true},
+		{Kind: "git", Host: "github.com", Caller: "127.0.0.1:4242", GrantedScopes: []string{"repo", "user:email"}, Granted: true, Cached: true},
+		{Kind: "unknown", Host: "gitlab.com", Scopes: []string{"api"}, Caller: "127.0.0.1:4242", Error: "no token available"},
+	}
+	if diff := cmp.Diff(expectation, sink.Records, cmpopts.IgnoreFields(TokenAuditRecord{}, "Time")); diff != "" {
+		t.Errorf("unexpected audit records (-want +got):\n%s", diff)
+	}
+
+	var out bytes.Buffer
+	writer := &writerTokenAuditSink{out: &out}
+	for _, rec := range sink.Records {
+		if rec.Time.IsZero() {
+			t.Errorf("audit record has no time: %v", rec)
+		}
+		writer.AuditToken(rec)
+	}
+	if strings.Contains(out.String(), secret) {
+		t.Errorf("audit log contains the token: %s", out.String())
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(expectation) {
+		t.Fatalf("unexpected number of audit log lines: want %d, got %d", len(expectation), len(lines))
+	}
+	for _, l := range lines {
+		var rec TokenAuditRecord
+		err := json.Unmarshal([]byte(l), &rec)
+		if err != nil {
+			t.Errorf("audit log line is not JSON: %v", err)
+		}
+	}
+}
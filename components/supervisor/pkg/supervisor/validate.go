@@ -0,0 +1,112 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ConfigReport is the result of validating a supervisor config without launching a workspace
+type ConfigReport struct {
+	OK     bool          `json:"ok"`
+	Checks []ConfigCheck `json:"checks"`
+}
+
+// ConfigCheck is a single check of a ConfigReport
+type ConfigCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ValidateConfig checks cfg as far as possible without launching a workspace. The workspace config
+// is drawn from the environment at runtime, hence it is checked only if workspace is true.
+func ValidateConfig(cfg *Config, workspace bool) *ConfigReport {
+	report := &ConfigReport{OK: true}
+	check := func(name string, err error) {
+		c := ConfigCheck{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, c)
+	}
+
+	check("static", cfg.StaticConfig.Validate())
+	check("ide", cfg.IDEConfig.Validate())
+	check("readinessProbe", validateReadinessProbe(cfg))
+	check("frontendLocation", validateFrontendLocation(cfg.StaticConfig))
+	check("entrypoint", validateEntrypoint(cfg.IDEConfig))
+	if workspace {
+		check("workspace", cfg.WorkspaceConfig.Validate())
+	} else {
+		report.Checks = append(report.Checks, ConfigCheck{Name: "workspace", OK: true, Skipped: true})
+	}
+
+	return report
+}
+
+// validateReadinessProbe checks that the readiness probe settings fit the configured probe type.
+// IDEConfig.Validate checks the individual values already.
+func validateReadinessProbe(cfg *Config) error {
+	probe := cfg.ReadinessProbe
+
+	configured := map[ReadinessProbeType]bool{
+		ReadinessHTTPProbe: probe.HTTPProbe.Path != "" || probe.HTTPProbe.SuccessThreshold != 0,
+		ReadinessTCPProbe:  probe.TCPProbe.Port != 0 || probe.TCPProbe.Timeout != 0,
+		ReadinessGRPCProbe: probe.GRPCProbe.Addr != "" || probe.GRPCProbe.Service != "" || probe.GRPCProbe.Timeout != 0,
+	}
+	for _, tpe := range []ReadinessProbeType{ReadinessHTTPProbe, ReadinessTCPProbe, ReadinessGRPCProbe} {
+		if configured[tpe] && probe.Type != tpe {
+			return fmt.Errorf("readinessProbe.%s is configured, but readinessProbe.type is %q", tpe, probe.Type)
+		}
+	}
+
+	switch probe.Type {
+	case ReadinessHTTPProbe:
+		if probe.HTTPProbe.Path != "" && !strings.HasPrefix(probe.HTTPProbe.Path, "/") {
+			return fmt.Errorf("readinessProbe.http.path must start with /")
+		}
+	case ReadinessTCPProbe:
+		if probe.TCPProbe.Port != 0 && probe.TCPProbe.Port == cfg.APIEndpointPort {
+			return fmt.Errorf("readinessProbe.tcp.port is supervisor's API endpoint port, not the IDE's")
+		}
+	case ReadinessGRPCProbe:
+		if probe.GRPCProbe.Addr != "" {
+			if _, _, err := net.SplitHostPort(probe.GRPCProbe.Addr); err != nil {
+				return fmt.Errorf("readinessProbe.grpc.addr is invalid: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateFrontendLocation checks that the frontend location or one of its fallbacks exists
+func validateFrontendLocation(cfg StaticConfig) error {
+	locations := append([]string{cfg.FrontendLocation}, cfg.FrontendFallbackLocations...)
+	if _, ok := resolveFrontendLocation(locations...); !ok {
+		return fmt.Errorf("none of the frontend locations exist: %s", strings.Join(locations, ", "))
+	}
+	return nil
+}
+
+// validateEntrypoint checks that the IDE entrypoint is an executable file
+func validateEntrypoint(cfg IDEConfig) error {
+	stat, err := os.Stat(cfg.Entrypoint)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return fmt.Errorf("entrypoint %s is not a regular file", cfg.Entrypoint)
+	}
+	if stat.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("entrypoint %s is not executable", cfg.Entrypoint)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	var (
+		entrypoint    = filepath.Join(dir, "ide")
+		notExecutable = filepath.Join(dir, "ide.txt")
+		frontend      = filepath.Join(dir, "frontend")
+	)
+	err := os.WriteFile(entrypoint, []byte("#!/bin/sh\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(notExecutable, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(frontend, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Desc      string
+		Change    func(cfg *Config)
+		Workspace bool
+		// Failed lists the names of the failed checks
+		Failed []string
+	}{
+		{Desc: "valid"},
+		{Desc: "valid workspace", Workspace: true, Change: func(cfg *Config) {
+			cfg.IDEPort = 23000
+			cfg.WorkspaceRoot = "/workspace"
+			cfg.GitpodHost = "https://gitpod.io"
+		}},
+		{Desc: "invalid workspace", Workspace: true, Failed: []string{"workspace"}},
+		{Desc: "missing API endpoint port", Change: func(cfg *Config) { cfg.APIEndpointPort = 0 }, Failed: []string{"static"}},
+		{Desc: "missing frontend", Change: func(cfg *Config) { cfg.FrontendLocation = filepath.Join(dir, "missing") }, Failed: []string{"frontendLocation"}},
+		{Desc: "frontend fallback", Change: func(cfg *Config) {
+			cfg.FrontendLocation = filepath.Join(dir, "missing")
+			cfg.FrontendFallbackLocations = []string{frontend}
+		}},
+		{Desc: "frontend is a file", Change: func(cfg *Config) { cfg.FrontendLocation = entrypoint }, Failed: []string{"frontendLocation"}},
+		{Desc: "missing entrypoint", Change: func(cfg *Config) { cfg.Entrypoint = filepath.Join(dir, "missing") }, Failed: []string{"ide", "entrypoint"}},
+		{Desc: "entrypoint not executable", Change: func(cfg *Config) { cfg.Entrypoint = notExecutable }, Failed: []string{"entrypoint"}},
+		{Desc: "HTTP probe settings for TCP probe", Change: func(cfg *Config) {
+			cfg.ReadinessProbe.Type = ReadinessTCPProbe
+			cfg.ReadinessProbe.HTTPProbe.Path = "/status"
+		}, Failed: []string{"readinessProbe"}},
+		{Desc: "TCP probe settings for process probe", Change: func(cfg *Config) { cfg.ReadinessProbe.TCPProbe.Port = 8080 }, Failed: []string{"readinessProbe"}},
+		{Desc: "relative HTTP probe path", Change: func(cfg *Config) {
+			cfg.ReadinessProbe.Type = ReadinessHTTPProbe
+			cfg.ReadinessProbe.HTTPProbe.Path = "status"
+		}, Failed: []string{"readinessProbe"}},
+		{Desc: "TCP probe on the API endpoint", Change: func(cfg *Config) {
+			cfg.ReadinessProbe.Type = ReadinessTCPProbe
+			cfg.ReadinessProbe.TCPProbe.Port = cfg.APIEndpointPort
+		}, Failed: []string{"readinessProbe"}},
+		{Desc: "gRPC probe address without port", Change: func(cfg *Config) {
+			cfg.ReadinessProbe.Type = ReadinessGRPCProbe
+			cfg.ReadinessProbe.GRPCProbe.Addr = "localhost"
+		}, Failed: []string{"readinessProbe"}},
+		{Desc: "unknown probe type", Change: func(cfg *Config) { cfg.ReadinessProbe.Type = "exec" }, Failed: []string{"ide"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Desc, func(t *testing.T) {
+			cfg := &Config{
+				StaticConfig: StaticConfig{
+					IDEConfigLocation: "/ide/supervisor-ide-config.json",
+					FrontendLocation:  frontend,
+					APIEndpointPort:   22999,
+				},
+				IDEConfig: IDEConfig{Entrypoint: entrypoint},
+			}
+			if test.Change != nil {
+				test.Change(cfg)
+			}
+
+			report := ValidateConfig(cfg, test.Workspace)
+
+			var failed []string
+			for _, c := range report.Checks {
+				if !c.OK {
+					failed = append(failed, c.Name)
+				}
+				if c.OK != (c.Error == "") {
+					t.Errorf("check %s has inconsistent result: ok %v, error %q", c.Name, c.OK, c.Error)
+				}
+			}
+			if diff := cmp.Diff(test.Failed, failed); diff != "" {
+				t.Errorf("unexpected failed checks (-want +got):\n%s", diff)
+			}
+			if report.OK != (len(failed) == 0) {
+				t.Errorf("unexpected report result: %v", report.OK)
+			}
+		})
+	}
+}
@@ -11,6 +11,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/creack/pty"
@@ -50,6 +53,10 @@ type MuxTerminalService struct {
 	DefaultWorkdir string
 	DefaultShell   string
 	Env            []string
+
+	// DefaultBacklogSize is the backlog size of terminals which are opened without one. Use 0 for the
+	// default of the terminal mux.
+	DefaultBacklogSize int64
 }
 
 // RegisterGRPC registers a gRPC service
@@ -83,20 +90,19 @@ func (srv *MuxTerminalService) OpenWithOptions(ctx context.Context, req *api.Ope
 	} else {
 		cmd.Dir = req.Workdir
 	}
-	cmd.Env = append(srv.Env, "TERM=xterm-color")
-	for key, value := range req.Env {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%v=%v", key, value))
+	env, err := mergeEnv(append([]string{}, srv.Env...), req.Env)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	cmd.Env = env
 	for k, v := range req.Annotations {
 		options.Annotations[k] = v
 	}
+	if options.BacklogSize == 0 {
+		options.BacklogSize = srv.DefaultBacklogSize
+	}
 	if req.Size != nil {
-		options.Size = &pty.Winsize{
-			Cols: uint16(req.Size.Cols),
-			Rows: uint16(req.Size.Rows),
-			X:    uint16(req.Size.WidthPx),
-			Y:    uint16(req.Size.HeightPx),
-		}
+		options.Size = toWinsize(req.Size)
 	}
 	alias, err := srv.Mux.Start(cmd, options)
 	if err != nil {
@@ -206,6 +212,16 @@ func (srv *MuxTerminalService) Listen(req *api.ListenTerminalRequest, resp api.T
 	if !ok {
 		return status.Error(codes.NotFound, "terminal not found")
 	}
+	var err error
+	if req.Size != nil {
+		err = term.Resize(toWinsize(req.Size))
+	} else {
+		err = term.restoreSize()
+	}
+	if err != nil {
+		log.WithError(err).WithField("alias", req.Alias).Warn("cannot restore terminal size")
+	}
+
 	stdout := term.Stdout.Listen()
 	defer stdout.Close()
 
@@ -307,15 +323,53 @@ func (srv *MuxTerminalService) SetSize(ctx context.Context, req *api.SetTerminal
 		return nil, status.Error(codes.FailedPrecondition, "wrong token or force not set")
 	}
 
-	err := pty.Setsize(term.PTY, &pty.Winsize{
-		Cols: uint16(req.Size.Cols),
-		Rows: uint16(req.Size.Rows),
-		X:    uint16(req.Size.WidthPx),
-		Y:    uint16(req.Size.HeightPx),
-	})
+	err := term.Resize(toWinsize(req.Size))
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	return &api.SetTerminalSizeResponse{}, nil
 }
+
+var envVarNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// mergeEnv adds the variables of a terminal to its base environment, overriding variables of the same name.
+// base is modified.
+func mergeEnv(base []string, vars map[string]string) ([]string, error) {
+	names := make([]string, 0, len(vars))
+	for name, value := range vars {
+		if !envVarNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid environment variable name: %q", name)
+		}
+		if strings.ContainsRune(value, 0) {
+			return nil, fmt.Errorf("environment variable %s contains a NUL byte", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := base[:0]
+	for _, kv := range base {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if _, overridden := vars[name]; overridden || name == "TERM" {
+			continue
+		}
+		res = append(res, kv)
+	}
+	if _, ok := vars["TERM"]; !ok {
+		res = append(res, "TERM=xterm-color")
+	}
+	for _, name := range names {
+		res = append(res, name+"="+vars[name])
+	}
+	return res, nil
+}
+
+func toWinsize(size *api.TerminalSize) *pty.Winsize {
+	return &pty.Winsize{
+		Cols: uint16(size.Cols),
+		Rows: uint16(size.Rows),
+		X:    uint16(size.WidthPx),
+		Y:    uint16(size.HeightPx),
+	}
+}
@@ -35,6 +35,10 @@ type Mux struct {
 	aliases []string
 	terms   map[string]*Term
 	mu      sync.RWMutex
+
+	// IdleTimeout is the time after which terminals without clients and without output are closed.
+	// Use 0 to never close idle terminals.
+	IdleTimeout time.Duration
 }
 
 // Get returns a terminal for the given alias
@@ -45,6 +49,13 @@ func (m *Mux) Get(alias string) (*Term, bool) {
 	return term, ok
 }
 
+// Count returns the number of open terminals
+func (m *Mux) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.terms)
+}
+
 // Start starts a new command in its own pseudo-terminal and returns an alias
 // for that pseudo terminal.
 func (m *Mux) Start(cmd *exec.Cmd, options TermOptions) (alias string, err error) {
@@ -77,10 +88,53 @@ func (m *Mux) Start(cmd *exec.Cmd, options TermOptions) (alias string, err error
 		close(term.waitDone)
 		_ = m.CloseTerminal(alias, 0*time.Second)
 	}()
+	if m.IdleTimeout > 0 && !options.NoIdleTimeout {
+		go m.closeWhenIdle(alias, term, m.IdleTimeout)
+	}
 
 	return alias, nil
 }
 
+// closeWhenIdle closes a terminal once it had neither clients nor output for the timeout.
+// Like a disconnected terminal would, we send SIGHUP first, as interactive shells ignore SIGTERM.
+func (m *Mux) closeWhenIdle(alias string, term *Term, timeout time.Duration) {
+	interval := timeout / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-term.waitDone:
+			return
+		case <-ticker.C:
+		}
+		if term.Stdout.idleFor(time.Now()) < timeout {
+			continue
+		}
+
+		log := log.WithField("alias", alias).WithField("idleTimeout", timeout)
+		log.Info("closing idle terminal")
+		err := term.Command.Process.Signal(unix.SIGHUP)
+		if err != nil {
+			log.WithError(err).Warn("cannot hang up idle terminal")
+		}
+		select {
+		case <-term.waitDone:
+			// the terminal is closed once its process is gone
+			return
+		case <-time.After(closeTerminaldefaultGracePeriod):
+		}
+		err = m.CloseTerminal(alias, closeTerminaldefaultGracePeriod)
+		if err != nil && err != ErrNotFound {
+			log.WithError(err).Warn("cannot close idle terminal")
+		}
+		return
+	}
+}
+
 // Close closes all terminals with closeTerminaldefaultGracePeriod.
 func (m *Mux) Close() error {
 	m.mu.Lock()
@@ -183,7 +237,7 @@ func (term *Term) shutdownProcessImmediately() error {
 	return nil
 }
 
-// terminalBacklogSize is the number of bytes of output we'll store in RAM for each terminal.
+// terminalBacklogSize is the default number of bytes of output we'll store in RAM for each terminal.
 // The higher this number is, the better the UX, but the higher the resource requirements are.
 // For now we assume an average of five terminals per workspace, which makes this consume 1MiB of RAM.
 const terminalBacklogSize = 256 << 10
@@ -194,7 +248,11 @@ func newTerm(pty *os.File, cmd *exec.Cmd, options TermOptions) (*Term, error) {
 		return nil, err
 	}
 
-	recorder, err := NewRingBuffer(terminalBacklogSize)
+	backlogSize := options.BacklogSize
+	if backlogSize == 0 {
+		backlogSize = terminalBacklogSize
+	}
+	recorder, err := NewRingBuffer(backlogSize)
 	if err != nil {
 		return nil, err
 	}
@@ -210,9 +268,12 @@ func newTerm(pty *os.File, cmd *exec.Cmd, options TermOptions) (*Term, error) {
 			timeout:  timeout,
 			listener: make(map[*multiWriterListener]struct{}),
 			recorder: recorder,
+
+			lastActivity: time.Now(),
 		},
 		Annotations: options.Annotations,
 		title:       options.Title,
+		size:        options.Size,
 
 		StarterToken: token.String(),
 
@@ -245,6 +306,13 @@ type TermOptions struct {
 
 	// Title describes the terminal title.
 	Title string
+
+	// BacklogSize is the number of bytes of output retained and replayed to listeners which attach later on.
+	// Use 0 for the default of 256 KiB.
+	BacklogSize int64
+
+	// NoIdleTimeout exempts the terminal from being closed when it's idle, e.g. because it runs a task.
+	NoIdleTimeout bool
 }
 
 // Term is a pseudo-terminal
@@ -261,6 +329,47 @@ type Term struct {
 	waitDone chan struct{}
 
 	fd int
+
+	// size is the last known size of the terminal, or nil if it was never set
+	size   *pty.Winsize
+	sizeMu sync.Mutex
+}
+
+// Resize sets the size of the terminal and tells its foreground process about it.
+// The size is restored when clients attach to the terminal later on.
+func (term *Term) Resize(size *pty.Winsize) error {
+	term.sizeMu.Lock()
+	defer term.sizeMu.Unlock()
+
+	return term.resize(size)
+}
+
+// restoreSize sets the last known size of the terminal again. Even if the size
+// did not change, the foreground process is told to redraw.
+func (term *Term) restoreSize() error {
+	term.sizeMu.Lock()
+	defer term.sizeMu.Unlock()
+
+	if term.size == nil {
+		return nil
+	}
+	return term.resize(term.size)
+}
+
+func (term *Term) resize(size *pty.Winsize) error {
+	err := pty.Setsize(term.PTY, size)
+	if err != nil {
+		return err
+	}
+	term.size = size
+
+	// The kernel only sends SIGWINCH if the size actually changed. We send it regardless,
+	// s.t. TUIs redraw for clients which attached in the meantime.
+	pgrp, err := unix.IoctlGetInt(term.fd, unix.TIOCGPGRP)
+	if err != nil {
+		return err
+	}
+	return unix.Kill(-pgrp, unix.SIGWINCH)
 }
 
 func (term *Term) GetTitle() (string, error) {
@@ -309,9 +418,11 @@ type multiWriter struct {
 	closed   bool
 	mu       sync.RWMutex
 	listener map[*multiWriterListener]struct{}
-	// ring buffer to record last 256kb of pty output
+	// ring buffer to record the last BacklogSize bytes of pty output
 	// new listener is initialized with the latest recodring first
 	recorder *RingBuffer
+	// lastActivity is the time of the last write or the last listener leaving
+	lastActivity time.Time
 }
 
 var (
@@ -411,6 +522,7 @@ func (mw *multiWriter) Listen() io.ReadCloser {
 
 		mw.mu.Lock()
 		delete(mw.listener, res)
+		mw.lastActivity = time.Now()
 		mw.mu.Unlock()
 	}()
 
@@ -424,6 +536,7 @@ func (mw *multiWriter) Write(p []byte) (n int, err error) {
 	defer mw.mu.Unlock()
 
 	mw.recorder.Write(p)
+	mw.lastActivity = time.Now()
 
 	for lstr := range mw.listener {
 		if lstr.closed {
@@ -461,6 +574,17 @@ func (mw *multiWriter) Close() error {
 	return err
 }
 
+// idleFor returns the time since the writer last had listeners or was written to
+func (mw *multiWriter) idleFor(now time.Time) time.Duration {
+	mw.mu.RLock()
+	defer mw.mu.RUnlock()
+
+	if len(mw.listener) > 0 {
+		return 0
+	}
+	return now.Sub(mw.lastActivity)
+}
+
 func (mw *multiWriter) ListenerCount() int {
 	mw.mu.Lock()
 	defer mw.mu.Unlock()
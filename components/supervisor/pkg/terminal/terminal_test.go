@@ -14,9 +14,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/creack/pty"
 	"github.com/google/go-cmp/cmp"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/gitpod-io/gitpod/supervisor/api"
 )
@@ -267,6 +270,220 @@ func TestTerminals(t *testing.T) {
 	}
 }
 
+func TestReplayOnAttach(t *testing.T) {
+	const backlogSize = 24
+
+	mux := NewMux()
+	defer mux.Close()
+
+	terminalService := NewMuxTerminalService(mux)
+	terminalService.DefaultWorkdir = t.TempDir()
+	terminalService.DefaultShell = "/bin/sh"
+	terminalService.Env = append(os.Environ(), "PS1=> ")
+	terminalService.DefaultBacklogSize = backlogSize
+
+	resp, err := terminalService.Open(context.Background(), &api.OpenTerminalRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = mux.CloseTerminal(resp.Terminal.Alias, 0) }()
+	term, ok := mux.Get(resp.Terminal.Alias)
+	if !ok {
+		t.Fatal("no terminal")
+	}
+	_, err = term.PTY.Write([]byte("echo hello-replay\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the output before anyone attaches to the terminal
+	recording := func() string {
+		term.Stdout.mu.RLock()
+		defer term.Stdout.mu.RUnlock()
+		return term.Stdout.recorder.String()
+	}
+	const outputSuffix = "hello-replay\r\n> "
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.HasSuffix(recording(), outputSuffix) {
+		if time.Now().After(deadline) {
+			t.Fatalf("terminal did not produce the expected output, got %q", recording())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener := &testDataTerminalServiceListener{ctx: ctx, data: make(chan string, 10)}
+	go func() {
+		_ = terminalService.Listen(&api.ListenTerminalRequest{Alias: resp.Terminal.Alias}, listener)
+	}()
+
+	var replay string
+	select {
+	case replay = <-listener.data:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no output was replayed")
+	}
+	if !strings.HasSuffix(replay, outputSuffix) {
+		t.Errorf("replay does not end with the latest output: %q", replay)
+	}
+	if len(replay) != backlogSize {
+		t.Errorf("unexpected replay size: expected %d, got %d bytes", backlogSize, len(replay))
+	}
+}
+
+type testDataTerminalServiceListener struct {
+	ctx  context.Context
+	data chan string
+	grpc.ServerStream
+}
+
+func (listener *testDataTerminalServiceListener) Send(resp *api.ListenTerminalResponse) error {
+	if data, ok := resp.Output.(*api.ListenTerminalResponse_Data); ok {
+		listener.data <- string(data.Data)
+	}
+	return nil
+}
+
+func (listener *testDataTerminalServiceListener) Context() context.Context {
+	return listener.ctx
+}
+
+func TestRestoreSizeOnAttach(t *testing.T) {
+	mux := NewMux()
+	defer mux.Close()
+
+	terminalService := NewMuxTerminalService(mux)
+	terminalService.DefaultWorkdir = t.TempDir()
+
+	resp, err := terminalService.Open(context.Background(), &api.OpenTerminalRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = mux.CloseTerminal(resp.Terminal.Alias, 0) }()
+	term, ok := mux.Get(resp.Terminal.Alias)
+	if !ok {
+		t.Fatal("no terminal")
+	}
+
+	_, err = terminalService.SetSize(context.Background(), &api.SetTerminalSizeRequest{
+		Alias:    resp.Terminal.Alias,
+		Priority: &api.SetTerminalSizeRequest_Force{Force: true},
+		Size:     &api.TerminalSize{Cols: 120, Rows: 40},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// simulate the size being lost while no client is attached
+	err = pty.Setsize(term.PTY, &pty.Winsize{Cols: 80, Rows: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener := &testDataTerminalServiceListener{ctx: ctx, data: make(chan string, 10)}
+	go func() {
+		_ = terminalService.Listen(&api.ListenTerminalRequest{Alias: resp.Terminal.Alias}, listener)
+	}()
+
+	var size *pty.Winsize
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		size, err = pty.GetsizeFull(term.PTY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size.Cols == 120 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if diff := cmp.Diff(&pty.Winsize{Cols: 120, Rows: 40}, size); diff != "" {
+		t.Errorf("unexpected terminal size (-want +got):\n%s", diff)
+	}
+}
+
+func TestTerminalEnv(t *testing.T) {
+	mux := NewMux()
+
+	terminalService := NewMuxTerminalService(mux)
+	terminalService.DefaultWorkdir = t.TempDir()
+	// spare capacity would let terminals share the backing array of their environment if we appended to it
+	terminalService.Env = append(make([]string, 0, 10), "BASE=default", "TERM=dumb")
+
+	open := func(env map[string]string) []string {
+		resp, err := terminalService.Open(context.Background(), &api.OpenTerminalRequest{Env: env})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = mux.CloseTerminal(resp.Terminal.Alias, 0) })
+		term, ok := mux.Get(resp.Terminal.Alias)
+		if !ok {
+			t.Fatal("no terminal")
+		}
+		return term.Command.Env
+	}
+	withOverrides := open(map[string]string{"BASE": "override", "TASK": "build"})
+	withoutOverrides := open(nil)
+
+	if diff := cmp.Diff([]string{"TERM=xterm-color", "BASE=override", "TASK=build"}, withOverrides); diff != "" {
+		t.Errorf("unexpected environment with overrides (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"BASE=default", "TERM=xterm-color"}, withoutOverrides); diff != "" {
+		t.Errorf("unexpected environment without overrides (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"BASE=default", "TERM=dumb"}, terminalService.Env); diff != "" {
+		t.Errorf("default environment was modified (-want +got):\n%s", diff)
+	}
+
+	for _, name := range []string{"", "1FOO", "FOO=BAR", "FOO BAR", "FOO-BAR"} {
+		_, err := terminalService.Open(context.Background(), &api.OpenTerminalRequest{Env: map[string]string{name: "value"}})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected malformed variable name %q to be rejected, got %v", name, err)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	mux := NewMux()
+	mux.IdleTimeout = 100 * time.Millisecond
+
+	start := func(options TermOptions) string {
+		alias, err := mux.Start(exec.Command("sleep", "60"), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = mux.CloseTerminal(alias, 0) })
+		return alias
+	}
+	var (
+		idle     = start(TermOptions{})
+		task     = start(TermOptions{NoIdleTimeout: true})
+		attached = start(TermOptions{})
+	)
+	term, _ := mux.Get(attached)
+	stdout := term.Stdout.Listen()
+	defer stdout.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := mux.Get(idle); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle terminal was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := mux.Get(task); !ok {
+		t.Error("terminal without idle timeout was closed")
+	}
+	if _, ok := mux.Get(attached); !ok {
+		t.Error("terminal with a client was closed")
+	}
+}
+
 func TestConcurrent(t *testing.T) {
 	var (
 		terminals     = NewMux()
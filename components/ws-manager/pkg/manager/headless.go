@@ -109,6 +109,10 @@ func (hl *HeadlessListener) handleLogLine(pod *corev1.Pod, line string) (continu
 		hl.OnHeadlessLog(pod, taskMsg.Data)
 		return true
 	}
+	if taskMsg.Type == "workspaceTaskStarted" || taskMsg.Type == "workspaceTaskExited" {
+		// the progress of individual tasks does not change the state of the headless workspace
+		return true
+	}
 
 	log.WithFields(wsk8s.GetOWIFromObject(&pod.ObjectMeta)).WithField("type", taskMsg.Type).Info("headless workspace is done")
 	if taskMsg.Type == "workspaceTaskFailed" || taskMsg.Type == "workspaceTaskDone" {